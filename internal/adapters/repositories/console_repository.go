@@ -58,8 +58,8 @@ func (r *SQLConsoleRepository) GetByID(id int64) (*entities.Console, error) {
 // Update updates a console
 func (r *SQLConsoleRepository) Update(console *entities.Console) error {
 	// Use existing database functions to update the console
-	if console.IsRunning() {
-		// If starting a rental, we need to update the database appropriately
+	if console.IsActive() {
+		// If starting a rental (or flagging it as overtime), we need to update the database appropriately
 		// This would typically involve updating the consoles table directly
 		query := `UPDATE consoles SET status = ?, end_time = ? WHERE id = ?`
 		_, err := r.db.Exec(query, console.Status, console.EndTime, console.ID)
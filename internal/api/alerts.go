@@ -0,0 +1,59 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"switchiot/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// listAlerts returns tamper alerts; ?status=OPEN|ACKED|RESOLVED|all
+// (default: every unresolved alert).
+func (a *API) listAlerts(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 100)
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	list, err := db.ListAlerts(a.DB, c.Query("status"), limit)
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if list == nil {
+		list = []db.Alert{}
+	}
+	return c.JSON(list)
+}
+
+// ackAlert marks an open alert as seen by the current user.
+func (a *API) ackAlert(c *fiber.Ctx) error {
+	return a.updateAlert(c, db.AckAlert)
+}
+
+// resolveAlert closes an alert.
+func (a *API) resolveAlert(c *fiber.Ctx) error {
+	return a.updateAlert(c, db.ResolveAlert)
+}
+
+func (a *API) updateAlert(c *fiber.Ctx, update func(dbx *sql.DB, id int64, user string) error) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, "invalid id")
+	}
+	var user string
+	if sd, ok := c.Locals("user").(sessionData); ok {
+		user = sd.Username
+	}
+	if err := update(a.DB, int64(id), user); err != nil {
+		if errors.Is(err, db.ErrAlertNotFound) {
+			return fiber.NewError(http.StatusNotFound, err.Error())
+		}
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if a.Hub != nil {
+		a.Hub.BroadcastJSON(map[string]any{"type": "alert_update", "id": id})
+	}
+	return c.JSON(fiber.Map{"status": "ok"})
+}
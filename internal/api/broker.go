@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"switchiot/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// listMQTTUsers returns the device credentials of the embedded broker.
+func (a *API) listMQTTUsers(c *fiber.Ctx) error {
+	list, err := db.ListMQTTUsers(a.DB)
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if list == nil {
+		list = []db.MQTTUser{}
+	}
+	return c.JSON(list)
+}
+
+// saveMQTTUser creates a broker credential or changes its password. The
+// username must be the device ID; topics lists extra filters the user may
+// use besides its device's topics.
+func (a *API) saveMQTTUser(c *fiber.Ctx) error {
+	var body struct {
+		Username string   `json:"username"`
+		Password string   `json:"password"`
+		Topics   []string `json:"topics"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	body.Username = strings.TrimSpace(body.Username)
+	if body.Username == "" || body.Password == "" {
+		return fiber.NewError(http.StatusBadRequest, "username/password required")
+	}
+	var topics []string
+	for _, t := range body.Topics {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if strings.Contains(t, ",") {
+			return fiber.NewError(http.StatusBadRequest, "invalid topic filter: "+t)
+		}
+		topics = append(topics, t)
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if err := db.SaveMQTTUser(a.DB, body.Username, string(h), topics); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// deleteMQTTUser removes a broker credential; connected devices keep their
+// session until they reconnect.
+func (a *API) deleteMQTTUser(c *fiber.Ctx) error {
+	if err := db.DeleteMQTTUser(a.DB, c.Params("username")); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(fiber.Map{"status": "deleted"})
+}
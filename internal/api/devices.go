@@ -0,0 +1,192 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"switchiot/internal/db"
+	"switchiot/internal/iot"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// listDevices returns the console-to-device registry.
+func (a *API) listDevices(c *fiber.Ctx) error {
+	list, err := db.ListDevices(a.DB)
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if list == nil {
+		list = []db.Device{}
+	}
+	return c.JSON(list)
+}
+
+// saveDevice creates or replaces the device mapping of a console.
+func (a *API) saveDevice(c *fiber.Ctx) error {
+	var body db.Device
+	if err := c.BodyParser(&body); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	body.DeviceID = strings.TrimSpace(body.DeviceID)
+	body.Transport = strings.ToLower(strings.TrimSpace(body.Transport))
+	if body.Transport == "" {
+		body.Transport = iot.TransportMQTT
+	}
+	if !validTransport(body.Transport) {
+		return fiber.NewError(http.StatusBadRequest, "unknown transport: "+body.Transport)
+	}
+	if err := validFallback(&body); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := validChainOptions(body); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	for _, t := range append([]string{body.Transport}, body.Fallback...) {
+		if t == iot.TransportAlert {
+			continue
+		}
+		if err := validOptions(t, body.Options); err != nil {
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if err := db.SaveDevice(a.DB, body); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := a.reloadDevices(); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// deleteDevice removes a mapping; the console falls back to its legacy ID.
+func (a *API) deleteDevice(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("console_id")
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, "invalid id")
+	}
+	if err := db.DeleteDevice(a.DB, int64(id)); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := a.reloadDevices(); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(fiber.Map{"status": "deleted"})
+}
+
+// listReconcileEvents returns the latest automatic relay corrections.
+func (a *API) listReconcileEvents(c *fiber.Ctx) error {
+	list, err := db.ListReconcileEvents(a.DB, c.QueryInt("limit", 100))
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if list == nil {
+		list = []db.ReconcileEvent{}
+	}
+	return c.JSON(list)
+}
+
+// listDeviceCapabilities returns the protocol handshakes of the devices;
+// devices missing from the list still speak the legacy plain-text protocol.
+func (a *API) listDeviceCapabilities(c *fiber.Ctx) error {
+	list, err := db.ListDeviceCapabilities(a.DB)
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if list == nil {
+		list = []db.DeviceCapabilities{}
+	}
+	return c.JSON(list)
+}
+
+func (a *API) reloadDevices() error {
+	if a.Devices == nil {
+		return nil
+	}
+	return a.Devices.Reload()
+}
+
+// validTransport reports whether a device transport is supported.
+func validTransport(t string) bool {
+	return iot.IsTransport(t)
+}
+
+// validFallback normalizes the fallback chain of a device: known
+// transports other than the primary one, each once, with "alert" only last.
+func validFallback(d *db.Device) error {
+	seen := map[string]bool{d.Transport: true}
+	var chain []string
+	for i, t := range d.Fallback {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch {
+		case t == iot.TransportAlert && i != len(d.Fallback)-1:
+			return errors.New("alert must end the fallback chain")
+		case t != iot.TransportAlert && !validTransport(t):
+			return errors.New("unknown fallback transport: " + t)
+		case seen[t]:
+			return errors.New("duplicate fallback transport: " + t)
+		}
+		seen[t] = true
+		chain = append(chain, t)
+	}
+	d.Fallback = chain
+	return nil
+}
+
+// validChainOptions checks how the options of a device are split across
+// its chain: options keyed by transport may only name transports of the
+// chain, and shared options cannot serve two hardware transports, whose
+// fields (channels, ...) mean different things.
+func validChainOptions(d db.Device) error {
+	chain := iot.Device{Transport: d.Transport, Fallback: d.Fallback}.Chain()
+	if !(iot.Device{Options: d.Options}).SharedOptions() {
+		var keyed map[string]json.RawMessage
+		_ = json.Unmarshal(d.Options, &keyed)
+		for t := range keyed {
+			if !slices.Contains(chain, t) {
+				return fmt.Errorf("options for %s, which is not in the transport chain", t)
+			}
+		}
+		return nil
+	}
+	var hardware []string
+	for _, t := range chain {
+		switch t {
+		case iot.TransportGPIO, iot.TransportModbus, iot.TransportSerial:
+			hardware = append(hardware, t)
+		}
+	}
+	if len(hardware) > 1 && len(d.Options) > 0 {
+		return fmt.Errorf("%s cannot share options; key them by transport, e.g. {\"%s\":{...},\"%s\":{...}}",
+			strings.Join(hardware, " and "), hardware[0], hardware[1])
+	}
+	return nil
+}
+
+// validOptions checks the options of a device for transport t.
+func validOptions(t string, options json.RawMessage) error {
+	dev := iot.Device{Options: options}
+	switch t {
+	case iot.TransportHTTP:
+		_, err := dev.HTTP()
+		return err
+	case iot.TransportWS:
+		_, err := dev.WS()
+		return err
+	case iot.TransportGPIO:
+		_, err := dev.GPIO()
+		return err
+	case iot.TransportModbus:
+		_, err := dev.Modbus()
+		return err
+	case iot.TransportSerial:
+		_, err := dev.SerialRelay()
+		return err
+	}
+	_, _, _, err := dev.Profile()
+	return err
+}
@@ -0,0 +1,22 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"switchiot/internal/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidChainOptions(t *testing.T) {
+	dev := func(transport string, fallback []string, options string) db.Device {
+		return db.Device{Transport: transport, Fallback: fallback, Options: json.RawMessage(options)}
+	}
+	keyed := `{"modbus":{"address":"10.0.0.50:502","coil":1},"serial":{"port":"/dev/ttyUSB0","relay":2}}`
+	assert.NoError(t, validChainOptions(dev("modbus", []string{"serial"}, keyed)))
+	assert.Error(t, validChainOptions(dev("modbus", nil, keyed)), "serial is not in the chain")
+	assert.Error(t, validChainOptions(dev("modbus", []string{"serial"}, `{"address":"10.0.0.50:502","port":"/dev/ttyUSB0","channels":[1]}`)),
+		"channels would mean coils and relays at once")
+	assert.NoError(t, validChainOptions(dev("mqtt", []string{"http", "alert"}, `{"profile":"tasmota","url":"http://10.0.0.32/cm"}`)))
+}
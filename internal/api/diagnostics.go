@@ -0,0 +1,131 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"switchiot/internal/db"
+	"switchiot/internal/domain/entities"
+	"switchiot/internal/iot"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// runDiagnostics pulses the relay of an idle console (ON, hold_ms, OFF),
+// times each command until the device acks it and stores the result with
+// the device's firmware, signal, uptime and last error in the diagnostics
+// history. The pulse goes straight through the router, bypassing the
+// offline queue, so an unreachable board fails the test instead of
+// switching later. A session started during the pulse keeps the relay on:
+// start takes the console lock the pulse holds from its in-use check
+// until the OFF is sent. The ack tracker marks the console under
+// self-test, so the reconciler and tamper detector leave the pulse alone.
+func (a *API) runDiagnostics(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, "invalid id")
+	}
+	consoleID := int64(id)
+	if a.Router == nil || a.Acks == nil {
+		return fiber.NewError(http.StatusServiceUnavailable, "diagnostics not available")
+	}
+	status, err := db.GetConsoleStatus(a.DB, consoleID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fiber.NewError(http.StatusNotFound, "console not found")
+	}
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if entities.PowerRequired(status) {
+		return fiber.NewError(http.StatusConflict, "console is in use, stop the session first")
+	}
+	end, ok := a.Acks.BeginSelfTest(consoleID)
+	if !ok {
+		return fiber.NewError(http.StatusConflict, "diagnostics already running")
+	}
+	defer end()
+
+	hold := time.Duration(min(max(c.QueryInt("hold_ms", 1000), 100), 10000)) * time.Millisecond
+	timeout := time.Duration(min(max(c.QueryInt("timeout_ms", 5000), 500), 30000)) * time.Millisecond
+	dev := a.Devices.Resolve(consoleID)
+	before, _, _ := db.GetDeviceState(a.DB, consoleID)
+	steps := iot.PulseRelay(a.Router, a.Acks, consoleID, iot.PulseOptions{
+		Hold:    hold,
+		Timeout: timeout,
+		KeepOn: func() bool {
+			status, err := db.GetConsoleStatus(a.DB, consoleID)
+			return err == nil && entities.PowerRequired(status)
+		},
+		Lock: a.consoleLock(consoleID),
+	})
+
+	d := db.Diagnostic{
+		ConsoleID:    consoleID,
+		DeviceID:     dev.DeviceID,
+		Transport:    dev.Transport,
+		DeviceStatus: before.Connectivity(a.HeartbeatTimeout),
+		OK:           true,
+	}
+	for _, st := range steps {
+		d.OK = d.OK && st.OK
+		d.AckMS = max(d.AckMS, st.AckMS)
+	}
+	d.Steps, _ = json.Marshal(steps)
+	if del, ok := a.Router.LastDelivery(consoleID); ok {
+		d.Delivered = del.Transport
+	}
+	if caps, ok := a.Devices.Capabilities(dev.DeviceID); ok {
+		d.Firmware = caps.Firmware
+	}
+	if st, ok, _ := db.GetDeviceState(a.DB, consoleID); ok {
+		d.RSSI, d.UptimeSec, d.LastError, d.LastSeen = st.RSSI, st.UptimeSec, st.LastError, st.LastSeen
+	}
+	if err := db.InsertDiagnostic(a.DB, &d); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(d)
+}
+
+// listDiagnostics returns the self-test history of a console, newest first.
+func (a *API) listDiagnostics(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, "invalid id")
+	}
+	list, err := db.ListDiagnostics(a.DB, int64(id), c.QueryInt("limit", 50))
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if list == nil {
+		list = []db.Diagnostic{}
+	}
+	return c.JSON(list)
+}
+
+// diagnosticStats sums up the self-tests of the last ?days (default 30)
+// per console, most failures first, to find flaky boards.
+func (a *API) diagnosticStats(c *fiber.Ctx) error {
+	days := c.QueryInt("days", 30)
+	if days <= 0 {
+		return fiber.NewError(http.StatusBadRequest, "days must be > 0")
+	}
+	list, err := db.ListDiagnosticStats(a.DB, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if list == nil {
+		list = []db.DiagnosticStats{}
+	}
+	return c.JSON(list)
+}
+
+// consoleLock returns the lock that orders session starts against the end
+// of a relay self-test of a console.
+func (a *API) consoleLock(consoleID int64) *sync.Mutex {
+	l, _ := a.consoleLocks.LoadOrStore(consoleID, &sync.Mutex{})
+	return l.(*sync.Mutex)
+}
@@ -3,9 +3,12 @@ package api
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"switchiot/internal/db"
@@ -19,9 +22,30 @@ type API struct {
 	DB     *sql.DB
 	Sender iot.CommandSender
 	Hub    *iot.Hub
-	// dynamic mqtt
-	Mqtt        *iot.MQTTSender
-	mqttRetries int
+	// Devices is the console-to-device registry, reloaded after admin edits.
+	Devices *iot.Registry
+	// Acks tracks acknowledgement of relay commands (nil disables DESYNC reporting).
+	Acks *iot.AckTracker
+	// HeartbeatTimeout marks devices without a recent heartbeat offline.
+	HeartbeatTimeout time.Duration
+	// StandbyWatts separates standby from play in power readings.
+	StandbyWatts float64
+	// ReloadMQTT applies the configuration saved by mqttConfig to the
+	// supervisor and the shared router, returning the number of brokers.
+	ReloadMQTT func() int
+	// Router dispatches commands by device transport (delivery reports).
+	Router *iot.TransportRouter
+	// Broker is the embedded MQTT broker, nil when not enabled.
+	Broker *iot.Broker
+	// Queue holds undelivered commands; its depth is shown in mqtt status.
+	Queue *iot.QueuedSender
+	// Mqtt supervises the (re)connection to the MQTT brokers.
+	Mqtt *iot.MQTTSupervisor
+	// Sequences switches single console outputs by hand (nil sends channel
+	// commands through Sender).
+	Sequences *iot.SequenceSender
+
+	consoleLocks sync.Map // console ID -> *sync.Mutex, see consoleLock
 }
 
 func New(database *sql.DB, sender iot.CommandSender, hub *iot.Hub) *API {
@@ -46,6 +70,7 @@ func (a *API) Register(app *fiber.App) {
 	userGroup.Get("status", a.status)
 	userGroup.Get("transactions/:console_id", a.transactions)
 	userGroup.Get("mqtt/status", a.mqttStatus)
+	userGroup.Get("power/:console_id", a.powerHistory)
 	
 	// reports endpoints
 	userGroup.Get("reports/daily", a.dailyReport)
@@ -59,6 +84,36 @@ func (a *API) Register(app *fiber.App) {
 	adminGroup.Delete("users/:id", a.deleteUser)
 	adminGroup.Post("price", a.updatePrice)
 	adminGroup.Post("mqtt/config", a.mqttConfig)
+	adminGroup.Post("mqtt/test", a.testMQTT)
+	adminGroup.Get("devices", a.listDevices)
+	adminGroup.Post("devices", a.saveDevice)
+	adminGroup.Delete("devices/:console_id", a.deleteDevice)
+	adminGroup.Get("devices/reconcile-events", a.listReconcileEvents)
+	adminGroup.Get("devices/capabilities", a.listDeviceCapabilities)
+	adminGroup.Get("outputs", a.listOutputs)
+	adminGroup.Post("outputs", a.saveOutput)
+	adminGroup.Delete("outputs/:id", a.deleteOutput)
+	adminGroup.Post("outputs/:id/switch", a.switchOutput)
+	adminGroup.Get("ir/codes", a.listIRCodes)
+	adminGroup.Post("ir/codes", a.saveIRCode)
+	adminGroup.Delete("ir/codes/:id", a.deleteIRCode)
+	adminGroup.Post("ir/codes/:id/send", a.sendIRCode)
+	adminGroup.Get("ir/consoles", a.listConsoleIR)
+	adminGroup.Post("ir/consoles", a.saveConsoleIR)
+	adminGroup.Delete("ir/consoles/:console_id", a.deleteConsoleIR)
+	adminGroup.Get("shutdown-profiles", a.listShutdownProfiles)
+	adminGroup.Post("shutdown-profiles", a.saveShutdownProfile)
+	adminGroup.Delete("shutdown-profiles/:type", a.deleteShutdownProfile)
+	adminGroup.Post("consoles/:id/type", a.setConsoleType)
+	adminGroup.Post("consoles/:id/diagnostics", a.runDiagnostics)
+	adminGroup.Get("consoles/:id/diagnostics", a.listDiagnostics)
+	adminGroup.Get("diagnostics", a.diagnosticStats)
+	adminGroup.Get("mqtt/users", a.listMQTTUsers)
+	adminGroup.Post("mqtt/users", a.saveMQTTUser)
+	adminGroup.Delete("mqtt/users/:username", a.deleteMQTTUser)
+	adminGroup.Get("alerts", a.listAlerts)
+	adminGroup.Post("alerts/:id/ack", a.ackAlert)
+	adminGroup.Post("alerts/:id/resolve", a.resolveAlert)
 
 	// Legacy routes without /api prefix for backward compatibility
 	app.Post("/start", a.authRequired("user"), a.start)
@@ -205,15 +260,29 @@ func (a *API) start(c *fiber.Ctx) error {
 		var body struct {
 			ConsoleID   int64 `json:"console_id"`
 			DurationMin int   `json:"duration_minutes"`
+			// Force starts the session even when the device is offline.
+			Force bool `json:"force"`
 		}
 		if err := c.BodyParser(&body); err != nil {
 			return fiber.NewError(http.StatusBadRequest, err.Error())
 		}
+		if !body.Force {
+			if ds, ok, _ := db.GetDeviceState(a.DB, body.ConsoleID); ok && ds.Connectivity(a.HeartbeatTimeout) == db.DeviceOffline {
+				return c.Status(http.StatusConflict).JSON(fiber.Map{
+					"error":     "device offline",
+					"warning":   "relay device is offline, the console may not power on; resend with force=true to start anyway",
+					"last_seen": ds.LastSeen,
+				})
+			}
+		}
+		// a relay self-test must not switch the relay off under the new session
+		lock := a.consoleLock(body.ConsoleID)
+		lock.Lock()
+		defer lock.Unlock()
 		if err := db.StartRental(a.DB, body.ConsoleID, body.DurationMin); err != nil {
 			return fiber.NewError(http.StatusBadRequest, err.Error())
 		}
-		_ = a.Sender.Send(body.ConsoleID, "ON")
-		return c.JSON(fiber.Map{"status": "ok"})
+		return c.JSON(a.sendResult(body.ConsoleID, "ON"))
 	})
 }
 
@@ -241,38 +310,141 @@ func (a *API) stop(c *fiber.Ctx) error {
 		if err := c.BodyParser(&body); err != nil {
 			return fiber.NewError(http.StatusBadRequest, err.Error())
 		}
+		// stopping a console that is already powering down cuts it at once
+		if skipped, err := db.SkipShutdown(a.DB, body.ConsoleID); err != nil {
+			return fiber.NewError(http.StatusInternalServerError, err.Error())
+		} else if skipped {
+			return c.JSON(fiber.Map{"status": "ok", "shutdown": "skipped"})
+		}
 		if err := db.StopRental(a.DB, body.ConsoleID); err != nil {
 			return fiber.NewError(http.StatusBadRequest, err.Error())
 		}
-		_ = a.Sender.Send(body.ConsoleID, "OFF")
-		return c.JSON(fiber.Map{"status": "ok"})
+		started, err := db.BeginShutdown(a.DB, body.ConsoleID)
+		if err != nil {
+			log.Printf("begin shutdown of console %d: %v", body.ConsoleID, err)
+		}
+		if started {
+			a.BroadcastShutdown(body.ConsoleID, db.ShutdownWarn, time.Now())
+			return c.JSON(fiber.Map{"status": "stopping"})
+		}
+		return c.JSON(a.sendResult(body.ConsoleID, "OFF"))
 	})
 }
 
+// sendResult sends a relay command after a session change and reports a
+// delivery failure in the response instead of dropping it; the session
+// change itself stays committed and the ack tracker keeps retrying.
+func (a *API) sendResult(consoleID int64, cmd string) fiber.Map {
+	res := fiber.Map{"status": "ok"}
+	if err := a.Sender.Send(consoleID, cmd); err != nil {
+		log.Printf("send %s to console %d: %v", cmd, consoleID, err)
+		res["device_error"] = err.Error()
+	}
+	return res
+}
+
+// sendErrorStatus maps a failed device command to a response status:
+// commands the device cannot receive are the caller's mistake, anything
+// else is a delivery failure.
+func sendErrorStatus(err error) int {
+	if errors.Is(err, iot.ErrUnsupportedCommand) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadGateway
+}
+
 func (a *API) status(c *fiber.Ctx) error {
-	consoles, err := db.GetConsoles(a.DB)
+	res, err := a.statusItems()
 	if err != nil {
 		return fiber.NewError(http.StatusInternalServerError, err.Error())
 	}
-	now := time.Now()
-	type item struct {
-		db.Console
-		RemainingSec    int             `json:"remaining_sec"`
-		LastTransaction *db.Transaction `json:"last_transaction,omitempty"`
+	return c.JSON(res)
+}
+
+// statusItem is one console entry of the /status response and websocket snapshot.
+type statusItem struct {
+	db.Console
+	RemainingSec    int             `json:"remaining_sec"`
+	OvertimeSec     int             `json:"overtime_sec,omitempty"`
+	LastTransaction *db.Transaction `json:"last_transaction,omitempty"`
+	// Command is the delivery state of the last relay command; Desync is set
+	// when it was never acknowledged by the device.
+	Command *iot.CommandState `json:"command,omitempty"`
+	Desync  bool              `json:"desync"`
+	// Delivery tells which transport carried the last command and which
+	// failed before it.
+	Delivery *iot.Delivery `json:"delivery,omitempty"`
+	// Device is the last state reported by the console's device and
+	// DeviceStatus its connectivity (ONLINE, OFFLINE or UNKNOWN).
+	Device       *db.DeviceState `json:"device,omitempty"`
+	DeviceStatus string          `json:"device_status"`
+	// Watts is the live power draw and Usage whether the console is being
+	// played (PLAYING, STANDBY, OFF); both are omitted without a fresh reading.
+	Watts *float64 `json:"watts,omitempty"`
+	Usage string   `json:"usage,omitempty"`
+	// Shutdown is the safe power-down phase of a STOPPING console.
+	Shutdown *db.Shutdown `json:"shutdown,omitempty"`
+}
+
+// statusItems builds the per-console status shared by /status and the websocket feed.
+func (a *API) statusItems() ([]statusItem, error) {
+	consoles, err := db.GetConsoles(a.DB)
+	if err != nil {
+		return nil, err
+	}
+	states, err := db.GetDeviceStates(a.DB)
+	if err != nil {
+		return nil, err
+	}
+	shutdowns, err := db.ListShutdowns(a.DB)
+	if err != nil {
+		return nil, err
 	}
-	res := make([]item, 0, len(consoles))
+	stopping := make(map[int64]db.Shutdown, len(shutdowns))
+	for _, sd := range shutdowns {
+		stopping[sd.ConsoleID] = sd
+	}
+	now := time.Now()
+	res := make([]statusItem, 0, len(consoles))
 	for _, cs := range consoles {
-		left := 0
+		left, over := 0, 0
 		if cs.Status == "RUNNING" && cs.EndTime.After(now) {
 			left = int(cs.EndTime.Sub(now).Seconds())
 		}
+		if cs.Status == "OVERTIME" && now.After(cs.EndTime) {
+			over = int(now.Sub(cs.EndTime).Seconds())
+		}
 		var lt *db.Transaction
 		if tr, ok, _ := db.LastTransaction(a.DB, cs.ID); ok {
 			lt = &tr
 		}
-		res = append(res, item{Console: cs, RemainingSec: left, LastTransaction: lt})
+		item := statusItem{Console: cs, RemainingSec: left, OvertimeSec: over, LastTransaction: lt}
+		if a.Acks != nil {
+			if st, ok := a.Acks.State(cs.ID); ok {
+				item.Command = &st
+				item.Desync = st.State == iot.CommandDesync
+			}
+		}
+		if a.Router != nil {
+			if d, ok := a.Router.LastDelivery(cs.ID); ok {
+				item.Delivery = &d
+			}
+		}
+		item.DeviceStatus = db.DeviceUnknown
+		if ds, ok := states[cs.ID]; ok {
+			item.Device = &ds
+			item.DeviceStatus = ds.Connectivity(a.HeartbeatTimeout)
+			if item.Usage = ds.Usage(a.StandbyWatts, powerMaxAge); item.Usage != "" {
+				w := ds.Watts
+				item.Watts = &w
+			}
+		}
+		if sd, ok := stopping[cs.ID]; ok {
+			item.Shutdown = &sd
+		}
+		res = append(res, item)
 	}
-	return c.JSON(res)
+	return res, nil
 }
 
 func (a *API) transactions(c *fiber.Ctx) error {
@@ -280,7 +452,7 @@ func (a *API) transactions(c *fiber.Ctx) error {
 	if err != nil {
 		return fiber.NewError(http.StatusBadRequest, "invalid id")
 	}
-	rows, err := a.DB.Query(`SELECT id, console_id, start_time, end_time, duration_minutes, total_price, COALESCE(price_per_hour_snapshot,0) FROM transactions WHERE console_id=? ORDER BY id DESC LIMIT 50`, id)
+	rows, err := a.DB.Query(`SELECT id, console_id, start_time, end_time, duration_minutes, total_price, COALESCE(price_per_hour_snapshot,0), overtime_minutes FROM transactions WHERE console_id=? ORDER BY id DESC LIMIT 50`, id)
 	if err != nil {
 		return fiber.NewError(http.StatusInternalServerError, err.Error())
 	}
@@ -288,7 +460,7 @@ func (a *API) transactions(c *fiber.Ctx) error {
 	var list []db.Transaction
 	for rows.Next() {
 		var t db.Transaction
-		if err := rows.Scan(&t.ID, &t.ConsoleID, &t.StartTime, &t.EndTime, &t.DurationMin, &t.TotalPrice, &t.PricePerHourSnapshot); err != nil {
+		if err := rows.Scan(&t.ID, &t.ConsoleID, &t.StartTime, &t.EndTime, &t.DurationMin, &t.TotalPrice, &t.PricePerHourSnapshot, &t.OvertimeMin); err != nil {
 			return fiber.NewError(http.StatusInternalServerError, err.Error())
 		}
 		list = append(list, t)
@@ -627,101 +799,177 @@ func (a *API) BroadcastStatus() {
 
 // StatusPayload builds the current consoles snapshot as websocket message bytes.
 func (a *API) StatusPayload() []byte {
-	consoles, err := db.GetConsoles(a.DB)
+	res, err := a.statusItems()
 	if err != nil {
 		return []byte("{}")
 	}
-	now := time.Now()
-	type item struct {
-		db.Console
-		RemainingSec    int             `json:"remaining_sec"`
-		LastTransaction *db.Transaction `json:"last_transaction,omitempty"`
-	}
-	res := make([]item, 0, len(consoles))
-	for _, cs := range consoles {
-		left := 0
-		if cs.Status == "RUNNING" && cs.EndTime.After(now) {
-			left = int(cs.EndTime.Sub(now).Seconds())
-		}
-		var lt *db.Transaction
-		if tr, ok, _ := db.LastTransaction(a.DB, cs.ID); ok {
-			lt = &tr
-		}
-		res = append(res, item{Console: cs, RemainingSec: left, LastTransaction: lt})
-	}
 	b, _ := json.Marshal(fiber.Map{"type": "status", "data": res})
 	return b
 }
 
 // mqttStatus returns JSON with connection info.
 func (a *API) mqttStatus(c *fiber.Ctx) error {
-	connected := false
-	prefix := ""
+	res := a.mqttState()
+	if a.Broker != nil {
+		res["embedded"] = fiber.Map{"addr": a.Broker.Addr(), "clients": a.Broker.Clients()}
+	}
+	return c.JSON(res)
+}
+
+// mqttState describes the supervised MQTT connection for /mqtt/status and
+// websocket mqtt events.
+func (a *API) mqttState() fiber.Map {
+	var st iot.MQTTState
+	brokers := 0
 	if a.Mqtt != nil {
-		connected = a.Mqtt.IsConnected()
-		prefix = a.Mqtt.Prefix()
+		st = a.Mqtt.State()
+		brokers = len(a.Mqtt.Endpoints())
+	}
+	res := fiber.Map{
+		"connected": st.State == iot.MQTTConnected,
+		"state":     st.State,
+		"broker":    st.Broker,
+		"brokers":   brokers,
+		"prefix":    st.Prefix,
+		"retries":   st.Attempt,
+		"queue":     a.queueDepth(),
+	}
+	if st.LastError != "" {
+		res["last_error"] = st.LastError
+	}
+	if !st.NextRetry.IsZero() {
+		res["next_retry"] = st.NextRetry
+	}
+	return res
+}
+
+// mqttConfigBody is the payload of mqttConfig and testMQTT. Omitted TLS
+// fields keep the stored value; an empty string clears it.
+type mqttConfigBody struct {
+	Broker     string  `json:"broker"`
+	Prefix     string  `json:"prefix"`
+	Username   string  `json:"username"`
+	Password   string  `json:"password"`
+	CACert     *string `json:"ca_cert"`
+	ClientCert *string `json:"client_cert"`
+	ClientKey  *string `json:"client_key"`
+	ServerName *string `json:"server_name"`
+}
+
+// config merges the body with the stored TLS settings and validates it.
+func (b mqttConfigBody) config(stored db.MQTTConfig) (db.MQTTConfig, error) {
+	cfg := db.MQTTConfig{Broker: strings.TrimSpace(b.Broker), Prefix: b.Prefix, Username: b.Username, Password: b.Password,
+		CACert: stored.CACert, ClientCert: stored.ClientCert, ClientKey: stored.ClientKey, ServerName: stored.ServerName}
+	for _, f := range []struct {
+		v   *string
+		dst *string
+	}{{b.CACert, &cfg.CACert}, {b.ClientCert, &cfg.ClientCert}, {b.ClientKey, &cfg.ClientKey}, {b.ServerName, &cfg.ServerName}} {
+		if f.v != nil {
+			*f.dst = strings.TrimSpace(*f.v)
+		}
+	}
+	for _, url := range strings.Split(cfg.Broker, ",") {
+		if url = strings.TrimSpace(url); url == "" {
+			continue
+		}
+		if _, err := iot.ValidateBrokerURL(url); err != nil {
+			return cfg, err
+		}
 	}
-	return c.JSON(fiber.Map{"connected": connected, "prefix": prefix, "retries": a.mqttRetries})
+	if _, err := mqttTLSOptions(cfg).Config(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func mqttTLSOptions(cfg db.MQTTConfig) iot.TLSOptions {
+	return iot.TLSOptions{CACert: cfg.CACert, ClientCert: cfg.ClientCert, ClientKey: cfg.ClientKey, ServerName: cfg.ServerName}
 }
 
-// mqttConfig accepts broker/prefix/username/password; empty broker means disconnect.
+// mqttConfig accepts broker/prefix/username/password and the TLS settings;
+// empty broker means disconnect. Broker may be a comma separated failover
+// list. The configuration is saved and handed to the connection supervisor;
+// progress is reported through websocket mqtt events instead of blocking
+// the request.
 func (a *API) mqttConfig(c *fiber.Ctx) error {
-	type bodyT struct {
-		Broker   string `json:"broker"`
-		Prefix   string `json:"prefix"`
-		Username string `json:"username"`
-		Password string `json:"password"`
+	var b mqttConfigBody
+	if err := c.BodyParser(&b); err != nil {
+		return fiber.NewError(400, err.Error())
+	}
+	if a.ReloadMQTT == nil {
+		return fiber.NewError(http.StatusServiceUnavailable, "mqtt not available")
 	}
-	var b bodyT
+	stored, _, err := db.LoadMQTTConfig(a.DB)
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	cfg, err := b.config(stored)
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := db.SaveMQTTConfig(a.DB, cfg); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	brokers := a.ReloadMQTT()
+	status := "connecting"
+	if brokers == 0 {
+		status = "disconnected"
+	}
+	return c.Status(http.StatusAccepted).JSON(fiber.Map{"status": status, "brokers": brokers})
+}
+
+// testMQTT connects to every broker of the submitted configuration with a
+// throwaway client, without saving it or touching the live connection.
+// ssl:// and wss:// brokers also report their TLS handshake.
+func (a *API) testMQTT(c *fiber.Ctx) error {
+	var b mqttConfigBody
 	if err := c.BodyParser(&b); err != nil {
 		return fiber.NewError(400, err.Error())
 	}
-	if b.Broker == "" { // disconnect
-		if a.Mqtt != nil {
-			a.Mqtt.Close()
-			a.Mqtt = nil
-		}
-		a.mqttRetries = 0
-		_ = db.SaveMQTTConfig(a.DB, db.MQTTConfig{})
-		a.broadcastMQTT()
-		return c.JSON(fiber.Map{"status": "disconnected"})
-	}
-	cfg := db.MQTTConfig{Broker: b.Broker, Prefix: b.Prefix, Username: b.Username, Password: b.Password}
-	_ = db.SaveMQTTConfig(a.DB, cfg)
-	// attempt connect with up to 3 retries sequentially
-	a.mqttRetries = 0
-	var lastErr error
-	for a.mqttRetries < 3 {
-		opts := iot.MQTTSenderOptions{Prefix: b.Prefix, Username: b.Username, Password: b.Password, QOS: 1, CleanSession: true, StatusCallback: func(id int64, payload string) {}}
-		mqttSender, err := iot.NewMQTTSender(b.Broker, opts)
-		if err == nil {
-			if a.Mqtt != nil {
-				a.Mqtt.Close()
-			}
-			a.Mqtt = mqttSender
-			a.Sender = iot.NewIdempotentSender(mqttSender)
-			a.broadcastMQTT()
-			return c.JSON(fiber.Map{"status": "connected", "retries": a.mqttRetries + 1})
+	stored, _, err := db.LoadMQTTConfig(a.DB)
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	cfg, err := b.config(stored)
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	var results []iot.EndpointTest
+	allOK := true
+	for _, url := range strings.Split(cfg.Broker, ",") {
+		if url = strings.TrimSpace(url); url == "" {
+			continue
 		}
-		lastErr = err
-		a.mqttRetries++
-		time.Sleep(1 * time.Second)
+		ep := iot.MQTTEndpoint{URL: url, Prefix: cfg.Prefix, Username: cfg.Username, Password: cfg.Password, TLS: mqttTLSOptions(cfg)}
+		r := iot.TestEndpoint(ep, 10*time.Second)
+		allOK = allOK && r.OK
+		results = append(results, r)
+	}
+	if len(results) == 0 {
+		return fiber.NewError(http.StatusBadRequest, "no broker to test")
+	}
+	status := http.StatusOK
+	if !allOK {
+		status = http.StatusBadGateway
 	}
-	a.broadcastMQTT()
-	return fiber.NewError(400, "mqtt connect failed after retries: "+lastErr.Error())
+	return c.Status(status).JSON(fiber.Map{"ok": allOK, "results": results})
 }
 
-func (a *API) broadcastMQTT() {
+// BroadcastMQTT pushes the MQTT connection state to dashboards.
+func (a *API) BroadcastMQTT() {
 	if a.Hub == nil {
 		return
 	}
-	connected := false
-	prefix := ""
-	retries := a.mqttRetries
-	if a.Mqtt != nil {
-		connected = a.Mqtt.IsConnected()
-		prefix = a.Mqtt.Prefix()
-	}
-	b, _ := json.Marshal(fiber.Map{"type": "mqtt", "connected": connected, "prefix": prefix, "retries": retries})
+	res := a.mqttState()
+	res["type"] = "mqtt"
+	b, _ := json.Marshal(res)
 	a.Hub.Broadcast(b)
 }
+
+// queueDepth returns the number of commands waiting for redelivery.
+func (a *API) queueDepth() int {
+	if a.Queue == nil {
+		return 0
+	}
+	return a.Queue.Depth()
+}
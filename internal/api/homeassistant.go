@@ -0,0 +1,39 @@
+package api
+
+import (
+	"log"
+
+	"switchiot/internal/domain/entities"
+	"switchiot/internal/iot"
+)
+
+// PublishHomeAssistant mirrors the status snapshot to Home Assistant through
+// the MQTT sender; consoles missing from the snapshot are removed there.
+func (a *API) PublishHomeAssistant() {
+	if a.Mqtt == nil {
+		return
+	}
+	items, err := a.statusItems()
+	if err != nil {
+		log.Printf("home assistant: %v", err)
+		return
+	}
+	consoles := make([]iot.HAConsole, 0, len(items))
+	for _, it := range items {
+		cs := iot.HAConsole{ID: it.ID, Name: it.Name, Status: it.Status, Relay: iot.RelayOff, RemainingMin: (it.RemainingSec + 59) / 60}
+		if entities.PowerRequired(it.Status) {
+			cs.Relay = iot.RelayOn
+			if it.LastTransaction != nil {
+				cs.Revenue = it.LastTransaction.TotalPrice
+			}
+		}
+		// prefer what the device reports over what it should be doing
+		if it.Device != nil && it.Device.Relay != "" {
+			cs.Relay = it.Device.Relay
+		}
+		consoles = append(consoles, cs)
+	}
+	if err := a.Mqtt.PublishHomeAssistant(consoles); err != nil {
+		log.Printf("home assistant: %v", err)
+	}
+}
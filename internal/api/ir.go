@@ -0,0 +1,121 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"switchiot/internal/db"
+	"switchiot/internal/iot"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// listIRCodes returns the IR code library, optionally ?model=.
+func (a *API) listIRCodes(c *fiber.Ctx) error {
+	list, err := db.ListIRCodes(a.DB, c.Query("model"))
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if list == nil {
+		list = []db.IRCode{}
+	}
+	return c.JSON(list)
+}
+
+// saveIRCode stores a learned code; codes are keyed by model and name.
+func (a *API) saveIRCode(c *fiber.Ctx) error {
+	var body db.IRCode
+	if err := c.BodyParser(&body); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	body.Protocol = strings.ToUpper(strings.TrimSpace(body.Protocol))
+	body.Data = strings.TrimSpace(body.Data)
+	if err := irCode(body).Validate(); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	id, err := db.SaveIRCode(a.DB, body)
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(fiber.Map{"status": "ok", "id": id})
+}
+
+// deleteIRCode removes a code from the library.
+func (a *API) deleteIRCode(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, "invalid id")
+	}
+	if err := db.DeleteIRCode(a.DB, int64(id)); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(fiber.Map{"status": "deleted"})
+}
+
+// sendIRCode fires a stored code through the device of a console:
+// {"console_id":1}.
+func (a *API) sendIRCode(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, "invalid id")
+	}
+	var body struct {
+		ConsoleID int64 `json:"console_id"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	code, err := db.GetIRCode(a.DB, int64(id))
+	if err != nil {
+		if errors.Is(err, db.ErrIRCodeNotFound) {
+			return fiber.NewError(http.StatusNotFound, err.Error())
+		}
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if err := a.Sender.Send(body.ConsoleID, iot.IRCommand(irCode(code))); err != nil {
+		return c.Status(sendErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// listConsoleIR returns the TV model and IR sequences of the consoles.
+func (a *API) listConsoleIR(c *fiber.Ctx) error {
+	list, err := db.ListConsoleIR(a.DB)
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if list == nil {
+		list = []db.ConsoleIR{}
+	}
+	return c.JSON(list)
+}
+
+// saveConsoleIR sets the TV model and the IR sequences sent at session
+// start and stop of a console.
+func (a *API) saveConsoleIR(c *fiber.Ctx) error {
+	var body db.ConsoleIR
+	if err := c.BodyParser(&body); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := db.SaveConsoleIR(a.DB, body); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// deleteConsoleIR stops sending IR codes for a console.
+func (a *API) deleteConsoleIR(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("console_id")
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, "invalid id")
+	}
+	if err := db.DeleteConsoleIR(a.DB, int64(id)); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(fiber.Map{"status": "deleted"})
+}
+
+func irCode(c db.IRCode) iot.IRCode {
+	return iot.IRCode{Protocol: c.Protocol, Bits: c.Bits, Data: c.Data}
+}
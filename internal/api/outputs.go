@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"switchiot/internal/db"
+	"switchiot/internal/iot"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// listOutputs returns the named outputs of all consoles or ?console_id=.
+func (a *API) listOutputs(c *fiber.Ctx) error {
+	list, err := db.ListOutputs(a.DB, int64(c.QueryInt("console_id")))
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if list == nil {
+		list = []db.ConsoleOutput{}
+	}
+	return c.JSON(list)
+}
+
+// saveOutput creates or updates an output; outputs are keyed by console
+// and name.
+func (a *API) saveOutput(c *fiber.Ctx) error {
+	var body db.ConsoleOutput
+	if err := c.BodyParser(&body); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	id, err := db.SaveOutput(a.DB, body)
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(fiber.Map{"status": "ok", "id": id})
+}
+
+// deleteOutput removes an output from its console's sequence.
+func (a *API) deleteOutput(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, "invalid id")
+	}
+	if err := db.DeleteOutput(a.DB, int64(id)); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(fiber.Map{"status": "deleted"})
+}
+
+// switchOutput turns one output ON or OFF by hand, outside the session
+// sequence: {"state":"ON"}.
+func (a *API) switchOutput(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, "invalid id")
+	}
+	var body struct {
+		State string `json:"state"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	state := strings.ToUpper(strings.TrimSpace(body.State))
+	if state != iot.RelayOn && state != iot.RelayOff {
+		return fiber.NewError(http.StatusBadRequest, "state must be ON or OFF")
+	}
+	o, ok, err := db.GetOutput(a.DB, int64(id))
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if !ok {
+		return fiber.NewError(http.StatusNotFound, "output not found")
+	}
+	out := iot.Output{Name: o.Name, Channel: o.Channel, StartDelay: time.Duration(o.StartDelaySec) * time.Second, StopDelay: time.Duration(o.StopDelaySec) * time.Second}
+	if a.Sequences != nil {
+		err = a.Sequences.SendOutput(o.ConsoleID, out, state)
+	} else {
+		err = a.Sender.Send(o.ConsoleID, iot.OutputCommand(state, o.Channel))
+	}
+	if err != nil {
+		return c.Status(sendErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	if a.Hub != nil {
+		a.Hub.BroadcastJSON(map[string]any{"type": "output", "console_id": o.ConsoleID, "output": o.Name, "state": state})
+	}
+	return c.JSON(fiber.Map{"status": "ok"})
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"switchiot/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// powerMaxAge is how old the last power reading may be to count as live.
+const powerMaxAge = 2 * time.Minute
+
+// powerHistory returns the power readings of a console for the last
+// ?hours= hours (default 24, max 720).
+func (a *API) powerHistory(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("console_id")
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, "invalid id")
+	}
+	hours := c.QueryInt("hours", 24)
+	if hours <= 0 || hours > 720 {
+		return fiber.NewError(http.StatusBadRequest, "hours must be between 1 and 720")
+	}
+	points, err := db.PowerHistory(a.DB, int64(id), time.Now().Add(-time.Duration(hours)*time.Hour))
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if points == nil {
+		points = []db.PowerPoint{}
+	}
+	return c.JSON(fiber.Map{"console_id": id, "hours": hours, "points": points})
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"switchiot/internal/db"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// listShutdownProfiles returns the safe power-down profiles per console type.
+func (a *API) listShutdownProfiles(c *fiber.Ctx) error {
+	list, err := db.ListShutdownProfiles(a.DB)
+	if err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	if list == nil {
+		list = []db.ShutdownProfile{}
+	}
+	return c.JSON(list)
+}
+
+// saveShutdownProfile creates or replaces the profile of a console type.
+func (a *API) saveShutdownProfile(c *fiber.Ctx) error {
+	var body db.ShutdownProfile
+	if err := c.BodyParser(&body); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := db.SaveShutdownProfile(a.DB, body); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// deleteShutdownProfile removes the profile of a console type.
+func (a *API) deleteShutdownProfile(c *fiber.Ctx) error {
+	if err := db.DeleteShutdownProfile(a.DB, c.Params("type")); err != nil {
+		return fiber.NewError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(fiber.Map{"status": "deleted"})
+}
+
+// setConsoleType assigns the console type: {"console_type":"PS5"}.
+func (a *API) setConsoleType(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fiber.NewError(http.StatusBadRequest, "invalid id")
+	}
+	var body struct {
+		ConsoleType string `json:"console_type"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if err := db.SetConsoleType(a.DB, int64(id), body.ConsoleType); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	go a.BroadcastStatus()
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// BroadcastShutdown pushes a power-down phase change to the dashboards;
+// phase DONE reports a finished power-down.
+func (a *API) BroadcastShutdown(consoleID int64, phase string, due time.Time) {
+	if a.Hub == nil {
+		return
+	}
+	a.Hub.BroadcastJSON(map[string]any{"type": "shutdown", "console_id": consoleID, "phase": phase, "due_at": due})
+}
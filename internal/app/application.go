@@ -2,14 +2,19 @@ package app
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"switchiot/internal/adapters/controllers"
 	"switchiot/internal/adapters/repositories"
 	"switchiot/internal/config"
 	"switchiot/internal/db"
+	"switchiot/internal/domain/entities"
 	"switchiot/internal/domain/usecases"
 	"switchiot/internal/iot"
 	usecaseimpl "switchiot/internal/usecases"
+	"os"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -25,6 +30,32 @@ type Application struct {
 	TransactionService usecases.TransactionService
 	IoTSender          iot.CommandSender
 	Hub                *iot.Hub
+	Devices            *iot.Registry
+	Acks               *iot.AckTracker
+	// Broker is the embedded MQTT broker (nil unless MQTT_EMBEDDED is set).
+	Broker *iot.Broker
+	// MQTT supervises the connection to the MQTT brokers (see MQTTEndpoints).
+	MQTT *iot.MQTTSupervisor
+	// HTTP is the transport for devices with REST firmware.
+	HTTP *iot.HTTPSender
+	// DeviceWS holds the connections of boards on /device/ws.
+	DeviceWS *iot.DeviceHub
+	// GPIO drives relays wired to the host's GPIO header.
+	GPIO *iot.GPIOSender
+	// Modbus drives Modbus TCP/RTU relay boards.
+	Modbus *iot.ModbusSender
+	// Serial drives USB serial relay boards.
+	Serial *iot.SerialRelaySender
+	// Router dispatches commands by device transport; IoTSender wraps it.
+	Router *iot.TransportRouter
+	// Queue persists commands the router failed to deliver and replays them.
+	Queue *iot.QueuedSender
+	// Sequences runs the power sequence (outputs, IR codes) of consoles;
+	// it is the outermost layer of IoTSender.
+	Sequences *iot.SequenceSender
+	// MQTTOptions are the base options (registry, callbacks) shared by every
+	// MQTT sender, including those created at runtime from /mqtt/config.
+	MQTTOptions iot.MQTTSenderOptions
 }
 
 // NewApplication creates a new application instance with all dependencies wired up
@@ -67,8 +98,88 @@ func NewApplication(cfg *config.Config) (*Application, error) {
 	userController := controllers.NewUserController(userService)
 
 	// Initialize IoT components
-	iotSender := initializeIoTSender(database, cfg.MQTT)
+	devices := iot.NewRegistry(deviceSource(database))
+	if err := devices.Reload(); err != nil {
+		return nil, err
+	}
+	if err := loadCapabilities(database, devices); err != nil {
+		return nil, err
+	}
 	hub := iot.NewHub()
+	acks := iot.NewAckTracker(iot.AckOptions{
+		Timeout: cfg.Device.AckTimeout,
+		Retries: cfg.Device.Retries,
+		OnChange: func(id int64, st iot.CommandState) {
+			if st.State == iot.CommandDesync {
+				log.Printf("console %d DESYNC: %s not acknowledged after %d attempts", id, st.Command, st.Attempts)
+			}
+			hub.BroadcastJSON(map[string]any{"type": "command", "console_id": id, "command": st})
+		},
+	})
+	router := iot.NewTransportRouter(devices)
+	queue := iot.NewQueuedSender(router, commandQueue{database})
+	mqttOptions := iot.MQTTSenderOptions{
+		QOS:          1,
+		CleanSession: true,
+		ClientID:     cfg.MQTT.ClientID,
+		Registry:     devices,
+		StatusCallback:       deviceStatusHandler(database, acks, devices, router),
+		AvailabilityCallback: deviceAvailabilityHandler(database, hub, cfg.Device.HeartbeatTimeout),
+		PowerCallback:        devicePowerHandler(database, hub, cfg.Device.StandbyWatts),
+		ConnectCallback:      func() { replayQueue(queue) },
+	}
+	if cfg.MQTT.HADiscovery {
+		mqttOptions.HADiscoveryPrefix = cfg.MQTT.HADiscoveryPrefix
+	}
+	var broker *iot.Broker
+	if cfg.MQTT.Embedded {
+		broker, err = iot.NewBroker(iot.BrokerOptions{Addr: ":" + cfg.MQTT.EmbeddedPort, Authenticate: mqttAuthenticator(database), Authorize: mqttAuthorizer(database, devices, cfg.MQTT.Prefix)})
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("embedded MQTT broker listening on %s", broker.Addr())
+	}
+	endpoints := mqttEndpoints(database, cfg.MQTT, broker)
+	supervisor := iot.NewMQTTSupervisor(mqttOptions, endpoints, iot.SupervisorOptions{MaxBackoff: cfg.MQTT.ReconnectMax})
+	httpSender := iot.NewHTTPSender(iot.HTTPSenderOptions{
+		Registry:             devices,
+		StatusCallback:       mqttOptions.StatusCallback,
+		AvailabilityCallback: mqttOptions.AvailabilityCallback,
+	})
+	httpSender.Start()
+	deviceWS := iot.NewDeviceHub(iot.DeviceHubOptions{
+		Registry:             devices,
+		StatusCallback:       mqttOptions.StatusCallback,
+		AvailabilityCallback: mqttOptions.AvailabilityCallback,
+	})
+	router.Set(iot.TransportMQTT, mqttRoute(supervisor, acks, len(endpoints), cfg.Device.Mock))
+	router.OnDelivery(deliveryHandler(hub))
+	router.SetAlert(undeliveredHandler(database, hub))
+	router.Set(iot.TransportHTTP, acks.Wrap(httpSender))
+	gpioSender := iot.NewGPIOSender(iot.GPIOSenderOptions{
+		Registry:       devices,
+		Desired:        desiredOutputs(database),
+		StatusCallback: mqttOptions.StatusCallback,
+	})
+	gpioSender.Start()
+	router.Set(iot.TransportWS, acks.Wrap(deviceWS))
+	router.Set(iot.TransportGPIO, acks.Wrap(gpioSender))
+	modbusSender := iot.NewModbusSender(iot.ModbusSenderOptions{
+		Registry:       devices,
+		StatusCallback: mqttOptions.StatusCallback,
+	})
+	router.Set(iot.TransportModbus, acks.Wrap(modbusSender))
+	serialSender := iot.NewSerialRelaySender(iot.SerialRelaySenderOptions{
+		Registry:             devices,
+		StatusCallback:       mqttOptions.StatusCallback,
+		AvailabilityCallback: mqttOptions.AvailabilityCallback,
+	})
+	serialSender.Start()
+	router.Set(iot.TransportSerial, acks.Wrap(serialSender))
+	// wrap with idempotent filter to avoid duplicate ON/OFF publishes
+	sequences := iot.NewSequenceSender(iot.NewIdempotentSender(queue), sequenceSource(database))
+	sequences.SetAlert(undeliveredHandler(database, hub))
+	iotSender := sequences
 
 	return &Application{
 		Config:             cfg,
@@ -80,11 +191,42 @@ func NewApplication(cfg *config.Config) (*Application, error) {
 		TransactionService: transactionService,
 		IoTSender:          iotSender,
 		Hub:                hub,
+		Devices:            devices,
+		Acks:               acks,
+		MQTTOptions:        mqttOptions,
+		Broker:             broker,
+		MQTT:               supervisor,
+		HTTP:               httpSender,
+		DeviceWS:           deviceWS,
+		GPIO:               gpioSender,
+		Modbus:             modbusSender,
+		Serial:             serialSender,
+		Router:             router,
+		Queue:              queue,
+		Sequences:          sequences,
 	}, nil
 }
 
 // Close closes the application and releases resources
 func (app *Application) Close() error {
+	if app.HTTP != nil {
+		app.HTTP.Close()
+	}
+	if app.GPIO != nil {
+		_ = app.GPIO.Close()
+	}
+	if app.Modbus != nil {
+		_ = app.Modbus.Close()
+	}
+	if app.Serial != nil {
+		_ = app.Serial.Close()
+	}
+	if app.MQTT != nil {
+		app.MQTT.Close()
+	}
+	if app.Broker != nil {
+		_ = app.Broker.Close()
+	}
 	if app.Database != nil {
 		return app.Database.Close()
 	}
@@ -107,45 +249,406 @@ func seedDefaultAdmin(database *sql.DB, adminConfig config.AdminConfig) error {
 	return nil
 }
 
-// initializeIoTSender creates and configures the IoT sender
-func initializeIoTSender(database *sql.DB, mqttConfig config.MQTTConfig) iot.CommandSender {
-	var sender iot.CommandSender
-
-	// Priority: DB stored config > env (legacy) > mock
-	if cfg, ok, _ := db.LoadMQTTConfig(database); ok && cfg.Broker != "" {
-		for attempt := 1; attempt <= 3; attempt++ {
-			ms, err := iot.NewMQTTSender(cfg.Broker, iot.MQTTSenderOptions{
-				Prefix:         cfg.Prefix,
-				Username:       cfg.Username,
-				Password:       cfg.Password,
-				QOS:            1,
-				CleanSession:   true,
-				StatusCallback: func(id int64, payload string) {},
-			})
-			if err == nil {
-				sender = ms
-				break
+// mqttAuthenticator checks embedded broker logins against the mqtt_users table
+func mqttAuthenticator(database *sql.DB) func(username, password string) bool {
+	return func(username, password string) bool {
+		hash, ok, err := db.GetMQTTUserHash(database, username)
+		if err != nil || !ok {
+			return false
+		}
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+}
+
+// mqttAuthorizer limits embedded broker users to the topics of their device
+// plus the extra filters stored with their credential
+func mqttAuthorizer(database *sql.DB, devices *iot.Registry, prefix string) func(username, topic string, write bool) bool {
+	return func(username, topic string, _ bool) bool {
+		if devices.DeviceTopicAllowed(username, prefix, topic) {
+			return true
+		}
+		topics, err := db.GetMQTTUserTopics(database, username)
+		if err != nil {
+			log.Printf("mqtt acl %s: %v", username, err)
+			return false
+		}
+		for _, allowed := range topics {
+			if iot.TopicCovered(topic, allowed) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// deviceStatusHandler persists device status messages as reported state and
+// feeds them to the ack tracker. A protocol hello records the device's
+// capabilities and is answered with HELLO through sender.
+func deviceStatusHandler(database *sql.DB, acks *iot.AckTracker, devices *iot.Registry, sender iot.CommandSender) func(id int64, payload string) {
+	return func(id int64, payload string) {
+		if env, ok := iot.ParseStatusEnvelope(payload); ok && env.Type == iot.StatusTypeHello {
+			registerHello(database, devices, id, env)
+			go func() {
+				if err := sender.Send(id, iot.CommandHello); err != nil {
+					log.Printf("hello reply to device %d: %v", id, err)
+				}
+			}()
+		}
+		st := iot.ParseStatus(payload)
+		if err := db.SaveDeviceReport(database, id, st.Relay, payload); err != nil {
+			log.Printf("save status of device %d: %v", id, err)
+		}
+		if env, ok := iot.ParseStatusEnvelope(payload); ok && env.OK != nil && !*env.OK {
+			// a rejected command is not an ack; let the tracker retry it
+			log.Printf("device %d rejected command %s: %s", id, env.ID, env.Error)
+			if err := db.SaveDeviceError(database, id, env.Error); err != nil {
+				log.Printf("save error of device %d: %v", id, err)
+			}
+			return
+		}
+		acks.Observe(id, payload)
+	}
+}
+
+// registerHello negotiates the protocol of a device from its hello and
+// persists the outcome.
+func registerHello(database *sql.DB, devices *iot.Registry, consoleID int64, env iot.StatusEnvelope) {
+	deviceID := devices.Resolve(consoleID).DeviceID
+	caps := iot.NegotiateHello(env)
+	devices.SetCapabilities(deviceID, caps)
+	log.Printf("device %s hello: firmware=%q protocol=%d commands=%v", deviceID, caps.Firmware, caps.Protocol, caps.Commands)
+	err := db.SaveDeviceCapabilities(database, db.DeviceCapabilities{
+		DeviceID: deviceID, Protocol: caps.Protocol, Commands: caps.Commands, Firmware: caps.Firmware,
+	})
+	if err != nil {
+		log.Printf("save capabilities of device %s: %v", deviceID, err)
+	}
+}
+
+// loadCapabilities restores the handshakes negotiated before a restart.
+func loadCapabilities(database *sql.DB, devices *iot.Registry) error {
+	list, err := db.ListDeviceCapabilities(database)
+	if err != nil {
+		return err
+	}
+	for _, c := range list {
+		devices.SetCapabilities(c.DeviceID, iot.Capabilities{Protocol: c.Protocol, Firmware: c.Firmware, Commands: c.Commands, SeenAt: c.UpdatedAt})
+	}
+	return nil
+}
+
+// deviceAvailabilityHandler records heartbeats (with the telemetry of
+// versioned ones) and Last Will messages and pushes a websocket event when a
+// device goes online or offline
+func deviceAvailabilityHandler(database *sql.DB, hub *iot.Hub, timeout time.Duration) func(id int64, online bool, payload string) {
+	return func(id int64, online bool, payload string) {
+		prev, _, _ := db.GetDeviceState(database, id)
+		if err := db.SaveDeviceHeartbeat(database, id, online); err != nil {
+			log.Printf("save heartbeat of device %d: %v", id, err)
+			return
+		}
+		if env, ok := iot.ParseStatusEnvelope(payload); ok && env.Type == iot.StatusTypeHeartbeat {
+			if err := db.SaveDeviceTelemetry(database, id, env.RSSI, env.Uptime); err != nil {
+				log.Printf("save telemetry of device %d: %v", id, err)
+			}
+			if env.Error != "" {
+				if err := db.SaveDeviceError(database, id, env.Error); err != nil {
+					log.Printf("save error of device %d: %v", id, err)
+				}
 			}
-			log.Printf("MQTT stored connect failed (%d/3): %v", attempt, err)
+		}
+		cur, _, _ := db.GetDeviceState(database, id)
+		if before, after := prev.Connectivity(timeout), cur.Connectivity(timeout); before != after {
+			log.Printf("device of console %d is %s (%s)", id, after, payload)
+			hub.BroadcastJSON(map[string]any{"type": "device", "console_id": id, "device_status": after, "last_seen": cur.LastSeen})
 		}
 	}
+}
 
-	if sender == nil && mqttConfig.Broker != "" {
-		ms, err := iot.NewFromEnv(func(id int64, payload string) {
-			log.Printf("status update from device %d: %s", id, payload)
+// deliveryHandler pushes the delivery report of every command to
+// dashboards and logs commands that needed a fallback transport
+func deliveryHandler(hub *iot.Hub) func(id int64, d iot.Delivery) {
+	return func(id int64, d iot.Delivery) {
+		if d.Fallback() {
+			log.Printf("console %d: %s delivered via fallback %s (%s failed: %s)", id, d.Command, d.Transport, d.Attempts[0].Transport, d.Attempts[0].Error)
+		}
+		hub.BroadcastJSON(map[string]any{"type": "delivery", "console_id": id, "delivery": d})
+	}
+}
+
+// undeliveredHandler raises an alert for a command no transport of the
+// console's chain could deliver, or a delayed main relay step that failed
+func undeliveredHandler(database *sql.DB, hub *iot.Hub) func(id int64, cmd string, cause error) {
+	return func(id int64, cmd string, cause error) {
+		msg := fmt.Sprintf("console %d: %s not delivered (%v)", id, cmd, cause)
+		alert, created, err := db.RaiseAlert(database, id, db.AlertCommandUndelivered, msg)
+		if err != nil {
+			log.Printf("raise alert: %v", err)
+			return
+		}
+		if created {
+			log.Printf("ALERT %s %s", alert.Kind, alert.Message)
+			hub.BroadcastJSON(map[string]any{"type": "alert", "alert": alert})
+		}
+	}
+}
+
+// devicePowerHandler stores power meter readings and pushes the live
+// wattage to dashboards
+func devicePowerHandler(database *sql.DB, hub *iot.Hub, standbyWatts float64) func(id int64, r iot.PowerReading) {
+	return func(id int64, r iot.PowerReading) {
+		if err := db.SavePowerReading(database, id, r.Watts, r.Voltage, r.Current, r.EnergyKWh); err != nil {
+			log.Printf("save power reading of device %d: %v", id, err)
+			return
+		}
+		usage := db.DeviceState{Watts: r.Watts, PowerAt: time.Now()}.Usage(standbyWatts, 0)
+		hub.BroadcastJSON(map[string]any{"type": "power", "console_id": id, "power": r, "usage": usage})
+	}
+}
+
+// ReplayQueue retries the commands that could not be delivered earlier
+func (app *Application) ReplayQueue() {
+	replayQueue(app.Queue)
+}
+
+// replayQueue delivers the queued commands and logs the outcome
+func replayQueue(queue *iot.QueuedSender) {
+	n, err := queue.Replay()
+	if err != nil {
+		log.Printf("replay command queue: %v", err)
+	}
+	if n > 0 {
+		log.Printf("replayed %d queued commands (%d left)", n, queue.Depth())
+	}
+}
+
+// commandQueue adapts the command_queue table to iot.CommandQueue
+type commandQueue struct{ db *sql.DB }
+
+func (q commandQueue) Enqueue(consoleID int64, cmd string, cause error) error {
+	return db.EnqueueCommand(q.db, consoleID, cmd, cause.Error())
+}
+
+func (q commandQueue) Pending() ([]iot.QueuedCommand, error) {
+	list, err := db.ListQueuedCommands(q.db)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]iot.QueuedCommand, 0, len(list))
+	for _, c := range list {
+		res = append(res, iot.QueuedCommand{ID: c.ID, ConsoleID: c.ConsoleID, Command: c.Command, QueuedAt: c.CreatedAt})
+	}
+	return res, nil
+}
+
+func (q commandQueue) Done(id int64) error { return db.DeleteQueuedCommand(q.db, id) }
+
+func (q commandQueue) Failed(id int64, cause error) error {
+	return db.FailQueuedCommand(q.db, id, cause.Error())
+}
+
+func (q commandQueue) Clear(consoleID int64) error { return db.ClearQueuedCommands(q.db, consoleID) }
+
+func (q commandQueue) Len() (int, error) { return db.CountQueuedCommands(q.db) }
+
+// sequenceSource builds the power sequence of a console from its outputs
+// (console_outputs) and the IR codes sent to its TV (console_ir).
+func sequenceSource(database *sql.DB) iot.SequenceSource {
+	return func(consoleID int64, cmd string) ([]iot.SequenceStep, error) {
+		list, err := db.ListOutputs(database, consoleID)
+		if err != nil {
+			return nil, err
+		}
+		ir, err := irSteps(database, consoleID, cmd)
+		if err != nil {
+			log.Printf("ir sequence of console %d: %v", consoleID, err)
+		}
+		if len(list) == 0 && len(ir) == 0 {
+			return nil, nil
+		}
+		outputs := make([]iot.Output, 0, len(list))
+		for _, o := range list {
+			outputs = append(outputs, iot.Output{
+				Name:       o.Name,
+				Channel:    o.Channel,
+				StartDelay: time.Duration(o.StartDelaySec) * time.Second,
+				StopDelay:  time.Duration(o.StopDelaySec) * time.Second,
+			})
+		}
+		return iot.PowerSequence(outputs, cmd, ir...), nil
+	}
+}
+
+// irSteps resolves the IR sequence of a console for session start (ON) or
+// stop (OFF); unknown codes are skipped.
+func irSteps(database *sql.DB, consoleID int64, cmd string) ([]iot.SequenceStep, error) {
+	cfg, ok, err := db.GetConsoleIR(database, consoleID)
+	if err != nil || !ok {
+		return nil, err
+	}
+	seq := cfg.OnStart
+	if cmd == iot.RelayOff {
+		seq = cfg.OnStop
+	}
+	steps := make([]iot.SequenceStep, 0, len(seq))
+	for _, st := range seq {
+		code, err := db.FindIRCode(database, cfg.Model, st.Code)
+		if err != nil {
+			log.Printf("ir sequence of console %d: %s/%s: %v", consoleID, cfg.Model, st.Code, err)
+			continue
+		}
+		steps = append(steps, iot.SequenceStep{
+			Output:  "ir:" + st.Code,
+			Delay:   time.Duration(st.DelayMS) * time.Millisecond,
+			Command: iot.IRCommand(iot.IRCode{Protocol: code.Protocol, Bits: code.Bits, Data: code.Data}),
 		})
-		if err == nil {
-			sender = ms
-		} else {
-			log.Printf("MQTT env connect failed: %v", err)
-			sender = iot.NewMockSender()
+	}
+	return steps, nil
+}
+
+// DesiredRelay returns the relay state a console status calls for; the
+// relay stays on until a safe power-down (STOPPING) completes.
+func DesiredRelay(status string) string {
+	if entities.PowerRequired(status) {
+		return iot.RelayOn
+	}
+	return iot.RelayOff
+}
+
+// desiredOutputs returns the state a console's relay (channel -1) and
+// output channels should be in, so GPIO lines come back right after a
+// restart: named outputs follow the console's power like its power
+// sequence does, channels without an output stay off.
+func desiredOutputs(database *sql.DB) func(consoleID int64, channel int) string {
+	return func(consoleID int64, channel int) string {
+		status, err := db.GetConsoleStatus(database, consoleID)
+		if err != nil {
+			return iot.RelayOff
+		}
+		desired := DesiredRelay(status)
+		if channel < 0 || desired == iot.RelayOff {
+			return desired
+		}
+		list, err := db.ListOutputs(database, consoleID)
+		if err != nil {
+			return iot.RelayOff
 		}
+		for _, o := range list {
+			if o.Channel == channel && o.Name != iot.MainOutput {
+				return desired
+			}
+		}
+		return iot.RelayOff
 	}
+}
 
-	if sender == nil {
-		sender = iot.NewMockSender()
+// deviceSource adapts the devices table to the iot device registry
+func deviceSource(database *sql.DB) iot.DeviceSource {
+	return func() ([]iot.Device, error) {
+		list, err := db.ListDevices(database)
+		if err != nil {
+			return nil, err
+		}
+		devices := make([]iot.Device, 0, len(list))
+		for _, d := range list {
+			devices = append(devices, iot.Device{
+				ConsoleID:    d.ConsoleID,
+				DeviceID:     d.DeviceID,
+				Transport:    d.Transport,
+				CommandTopic: d.CommandTopic,
+				StatusTopic:  d.StatusTopic,
+				Payload:      d.Payload,
+				Options:      d.Options,
+				Fallback:     d.Fallback,
+			})
+		}
+		return devices, nil
 	}
+}
 
-	// wrap with idempotent filter to avoid duplicate ON/OFF publishes
-	return iot.NewIdempotentSender(sender)
-}
\ No newline at end of file
+// MQTTEndpoints returns the broker failover list: the config saved through
+// /mqtt/config, then the embedded broker, then MQTT_BROKER
+func (app *Application) MQTTEndpoints() []iot.MQTTEndpoint {
+	return mqttEndpoints(app.Database, app.Config.MQTT, app.Broker)
+}
+
+// ReloadMQTT applies the saved MQTT configuration at runtime: the supervisor
+// reconnects to the new broker list and the router's MQTT route is swapped.
+// Every component sends through IoTSender and so through the router, which
+// makes the API, auto-stop, warnings and reconciliation all use the new
+// route at once. It returns the number of brokers.
+func (app *Application) ReloadMQTT() int {
+	endpoints := app.MQTTEndpoints()
+	app.MQTT.SetEndpoints(endpoints)
+	app.Router.Set(iot.TransportMQTT, mqttRoute(app.MQTT, app.Acks, len(endpoints), app.Config.Device.Mock))
+	return len(endpoints)
+}
+
+// mqttRoute is the router's MQTT route for a broker list of the given size.
+// Without any broker MQTT consoles take their fallback chain; only IOT_MOCK
+// lets them reach the mock.
+func mqttRoute(supervisor *iot.MQTTSupervisor, acks *iot.AckTracker, brokers int, mock bool) iot.CommandSender {
+	if brokers > 0 {
+		return acks.Wrap(supervisor)
+	}
+	if mock {
+		log.Printf("IOT_MOCK: no MQTT broker, commands to MQTT consoles only reach the mock")
+		return iot.NewMockSender()
+	}
+	return nil
+}
+
+// mqttEndpoints builds the failover list; broker URLs may be comma separated
+func mqttEndpoints(database *sql.DB, mqttConfig config.MQTTConfig, broker *iot.Broker) []iot.MQTTEndpoint {
+	var list []iot.MQTTEndpoint
+	if cfg, ok, _ := db.LoadMQTTConfig(database); ok {
+		tlsOpts := iot.TLSOptions{CACert: cfg.CACert, ClientCert: cfg.ClientCert, ClientKey: cfg.ClientKey, ServerName: cfg.ServerName}
+		for _, url := range splitBrokers(cfg.Broker) {
+			list = append(list, iot.MQTTEndpoint{URL: url, Prefix: cfg.Prefix, Username: cfg.Username, Password: cfg.Password, TLS: tlsOpts})
+		}
+	}
+	if broker != nil {
+		user, pass := broker.Credentials()
+		list = append(list, iot.MQTTEndpoint{URL: broker.URL(), Prefix: mqttConfig.Prefix, Username: user, Password: pass})
+	}
+	if brokers := splitBrokers(mqttConfig.Broker); len(brokers) > 0 {
+		tlsOpts, err := envTLSOptions(mqttConfig)
+		if err != nil {
+			log.Printf("MQTT TLS files: %v", err)
+		}
+		for _, url := range brokers {
+			list = append(list, iot.MQTTEndpoint{URL: url, Prefix: mqttConfig.Prefix, Username: mqttConfig.Username, Password: mqttConfig.Password, TLS: tlsOpts})
+		}
+	}
+	return list
+}
+
+// envTLSOptions loads the PEM files named by MQTT_CA_FILE, MQTT_CERT_FILE and
+// MQTT_KEY_FILE
+func envTLSOptions(mqttConfig config.MQTTConfig) (iot.TLSOptions, error) {
+	opts := iot.TLSOptions{ServerName: mqttConfig.ServerName}
+	for _, f := range []struct {
+		path string
+		dst  *string
+	}{{mqttConfig.CAFile, &opts.CACert}, {mqttConfig.CertFile, &opts.ClientCert}, {mqttConfig.KeyFile, &opts.ClientKey}} {
+		if f.path == "" {
+			continue
+		}
+		b, err := os.ReadFile(f.path)
+		if err != nil {
+			return opts, err
+		}
+		*f.dst = string(b)
+	}
+	return opts, nil
+}
+
+func splitBrokers(s string) []string {
+	var res []string
+	for _, url := range strings.Split(s, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			res = append(res, url)
+		}
+	}
+	return res
+}
@@ -2,7 +2,10 @@ package config
 
 import (
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Config holds application configuration
@@ -11,6 +14,9 @@ type Config struct {
 	Database DatabaseConfig
 	MQTT     MQTTConfig
 	App      AppConfig
+	Session  SessionConfig
+	Device   DeviceConfig
+	Alerts   AlertConfig
 }
 
 // ServerConfig holds server-related configuration
@@ -26,11 +32,30 @@ type DatabaseConfig struct {
 
 // MQTTConfig holds MQTT-related configuration
 type MQTTConfig struct {
+	// Broker is a comma separated failover list, tried in order.
 	Broker   string
 	Prefix   string
 	Username string
 	Password string
 	ClientID string
+	// Embedded starts an in-process MQTT broker on EmbeddedPort that the
+	// server connects to automatically; devices authenticate with the
+	// credentials stored in the mqtt_users table.
+	Embedded     bool
+	EmbeddedPort string
+	// ReconnectMax caps the exponential backoff between reconnect rounds.
+	ReconnectMax time.Duration
+	// CAFile, CertFile and KeyFile are PEM files for ssl:// and wss://
+	// brokers; ServerName overrides the host name verified in the
+	// broker certificate.
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	// HADiscovery publishes Home Assistant MQTT discovery configs for every
+	// console under HADiscoveryPrefix.
+	HADiscovery       bool
+	HADiscoveryPrefix string
 }
 
 // AppConfig holds application-specific configuration
@@ -40,6 +65,43 @@ type AppConfig struct {
 	DefaultAdmin  AdminConfig
 }
 
+// SessionConfig holds rental session timing configuration
+type SessionConfig struct {
+	// WarningThresholds are the remaining-time marks (largest first) at which
+	// a pre-expiry warning is sent to the device, e.g. 5m and 1m.
+	WarningThresholds []time.Duration
+	// GracePeriod keeps power on after expiry while the console is flagged
+	// OVERTIME and the extra minutes are billed. Zero disables it.
+	GracePeriod time.Duration
+}
+
+// DeviceConfig holds relay device communication configuration
+type DeviceConfig struct {
+	AckTimeout time.Duration // wait for a command ack before resending
+	Retries    int           // resends before the console is marked DESYNC
+	// HeartbeatTimeout marks a device offline when no heartbeat arrived in time
+	HeartbeatTimeout time.Duration
+	// StandbyWatts is the power draw below which a powered console counts as
+	// idling in standby rather than being played
+	StandbyWatts float64
+	// PowerRetention is how long raw power readings are kept before they are
+	// downsampled into hourly aggregates
+	PowerRetention time.Duration
+	// Mock routes MQTT consoles to the in-memory mock when no broker is
+	// configured (demo / development only); otherwise their commands fail
+	// and take the device's fallback chain
+	Mock bool
+}
+
+// AlertConfig holds tamper / bypass detection configuration
+type AlertConfig struct {
+	// Debounce is how long a mismatch between device and console must last
+	// before an alert is raised
+	Debounce time.Duration
+	// PowerWatts is the draw on an idle console that counts as bypass
+	PowerWatts float64
+}
+
 // AdminConfig holds default admin configuration
 type AdminConfig struct {
 	Username string
@@ -62,6 +124,17 @@ func LoadConfig() *Config {
 			Username: os.Getenv("MQTT_USERNAME"),
 			Password: os.Getenv("MQTT_PASSWORD"),
 			ClientID: os.Getenv("MQTT_CLIENT_ID"),
+
+			Embedded:     getEnvBool("MQTT_EMBEDDED", false),
+			EmbeddedPort: strings.TrimPrefix(getEnvOrDefault("MQTT_EMBEDDED_PORT", "1883"), ":"),
+			ReconnectMax: getEnvDuration("MQTT_RECONNECT_MAX", time.Minute),
+			CAFile:       os.Getenv("MQTT_CA_FILE"),
+			CertFile:     os.Getenv("MQTT_CERT_FILE"),
+			KeyFile:      os.Getenv("MQTT_KEY_FILE"),
+			ServerName:   os.Getenv("MQTT_SERVER_NAME"),
+
+			HADiscovery:       getEnvBool("HA_DISCOVERY", false),
+			HADiscoveryPrefix: getEnvOrDefault("HA_DISCOVERY_PREFIX", "homeassistant"),
 		},
 		App: AppConfig{
 			ConsoleCount: 5,
@@ -71,6 +144,23 @@ func LoadConfig() *Config {
 				Password: "admin123",
 			},
 		},
+		Session: SessionConfig{
+			WarningThresholds: parseDurations(getEnvOrDefault("SESSION_WARNINGS", "5m,1m")),
+			GracePeriod:       getEnvDuration("SESSION_GRACE", 0),
+		},
+		Device: DeviceConfig{
+			AckTimeout: getEnvDuration("COMMAND_ACK_TIMEOUT", 5*time.Second),
+			Retries:    getEnvInt("COMMAND_RETRIES", 3),
+
+			HeartbeatTimeout: getEnvDuration("DEVICE_HEARTBEAT_TIMEOUT", 90*time.Second),
+			StandbyWatts:     getEnvFloat("POWER_STANDBY_WATTS", 30),
+			PowerRetention:   getEnvDuration("POWER_RAW_RETENTION", 24*time.Hour),
+			Mock:             getEnvBool("IOT_MOCK", false),
+		},
+		Alerts: AlertConfig{
+			Debounce:   getEnvDuration("TAMPER_DEBOUNCE", time.Minute),
+			PowerWatts: getEnvFloat("TAMPER_WATTS", 10),
+		},
 	}
 }
 
@@ -82,6 +172,66 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvDuration parses a duration environment variable (e.g. "90s", "5m"),
+// falling back to the default when unset or invalid
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+// getEnvInt parses an integer environment variable, falling back to the
+// default when unset or invalid
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
+// getEnvBool parses a boolean environment variable (1/true/yes/on),
+// falling back to the default when unset or invalid
+func getEnvBool(key string, defaultValue bool) bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(key))) {
+	case "1", "true", "yes", "on":
+		return true
+	case "0", "false", "no", "off":
+		return false
+	}
+	return defaultValue
+}
+
+// getEnvFloat parses a decimal environment variable, falling back to the
+// default when unset or invalid
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return defaultValue
+}
+
+// parseDurations parses a comma separated duration list, dropping invalid or
+// non-positive entries, and returns it sorted largest first
+func parseDurations(value string) []time.Duration {
+	var res []time.Duration
+	for _, part := range strings.Split(value, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil || d <= 0 {
+			continue
+		}
+		res = append(res, d)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] > res[j] })
+	return res
+}
+
 // NormalizePort removes leading colon from port if present
 func (c *Config) NormalizePort() {
 	c.Server.Port = strings.TrimPrefix(c.Server.Port, ":")
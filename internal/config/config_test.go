@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -32,6 +33,89 @@ func TestLoadConfig_Defaults(t *testing.T) {
 	assert.Equal(t, 40000, config.App.DefaultPrice)
 	assert.Equal(t, "admin", config.App.DefaultAdmin.Username)
 	assert.Equal(t, "admin123", config.App.DefaultAdmin.Password)
+
+	// Test session config defaults
+	assert.Equal(t, []time.Duration{5 * time.Minute, time.Minute}, config.Session.WarningThresholds)
+	assert.Equal(t, time.Duration(0), config.Session.GracePeriod)
+
+	// Test device config defaults
+	assert.Equal(t, 5*time.Second, config.Device.AckTimeout)
+	assert.Equal(t, 3, config.Device.Retries)
+	assert.Equal(t, 90*time.Second, config.Device.HeartbeatTimeout)
+	assert.Equal(t, 30.0, config.Device.StandbyWatts)
+	assert.Equal(t, 24*time.Hour, config.Device.PowerRetention)
+	assert.False(t, config.Device.Mock)
+	assert.Equal(t, time.Minute, config.Alerts.Debounce)
+	assert.False(t, config.MQTT.Embedded)
+	assert.Equal(t, "1883", config.MQTT.EmbeddedPort)
+	assert.Equal(t, time.Minute, config.MQTT.ReconnectMax)
+	assert.False(t, config.MQTT.HADiscovery)
+	assert.Equal(t, "homeassistant", config.MQTT.HADiscoveryPrefix)
+	assert.Equal(t, 10.0, config.Alerts.PowerWatts)
+}
+
+func TestLoadConfig_SessionEnvironmentVariables(t *testing.T) {
+	os.Setenv("SESSION_WARNINGS", "1m, 10m,bogus,-2m")
+	os.Setenv("SESSION_GRACE", "15m")
+	defer os.Clearenv()
+
+	config := LoadConfig()
+
+	assert.Equal(t, []time.Duration{10 * time.Minute, time.Minute}, config.Session.WarningThresholds)
+	assert.Equal(t, 15*time.Minute, config.Session.GracePeriod)
+}
+
+func TestGetEnvInt(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("TEST_INT", "7")
+	assert.Equal(t, 7, getEnvInt("TEST_INT", 1))
+	os.Setenv("TEST_INT", "seven")
+	assert.Equal(t, 1, getEnvInt("TEST_INT", 1))
+	os.Unsetenv("TEST_INT")
+	assert.Equal(t, 1, getEnvInt("TEST_INT", 1))
+}
+
+func TestGetEnvBool(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("TEST_BOOL", "yes")
+	assert.True(t, getEnvBool("TEST_BOOL", false))
+	os.Setenv("TEST_BOOL", "0")
+	assert.False(t, getEnvBool("TEST_BOOL", true))
+	os.Setenv("TEST_BOOL", "maybe")
+	assert.True(t, getEnvBool("TEST_BOOL", true))
+	os.Unsetenv("TEST_BOOL")
+}
+
+func TestGetEnvFloat(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("TEST_FLOAT", "12.5")
+	assert.Equal(t, 12.5, getEnvFloat("TEST_FLOAT", 1))
+	os.Setenv("TEST_FLOAT", "many")
+	assert.Equal(t, 1.0, getEnvFloat("TEST_FLOAT", 1))
+	os.Unsetenv("TEST_FLOAT")
+}
+
+func TestGetEnvDuration(t *testing.T) {
+	os.Clearenv()
+
+	t.Run("valid duration", func(t *testing.T) {
+		os.Setenv("TEST_DURATION", "90s")
+		defer os.Unsetenv("TEST_DURATION")
+		assert.Equal(t, 90*time.Second, getEnvDuration("TEST_DURATION", time.Minute))
+	})
+
+	t.Run("invalid duration", func(t *testing.T) {
+		os.Setenv("TEST_DURATION", "soon")
+		defer os.Unsetenv("TEST_DURATION")
+		assert.Equal(t, time.Minute, getEnvDuration("TEST_DURATION", time.Minute))
+	})
+
+	t.Run("unset", func(t *testing.T) {
+		assert.Equal(t, time.Minute, getEnvDuration("TEST_DURATION", time.Minute))
+	})
 }
 
 func TestLoadConfig_WithEnvironmentVariables(t *testing.T) {
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Alert kinds raised when the device contradicts the console state.
+const (
+	AlertPowerWhileIdle  = "POWER_WHILE_IDLE"
+	AlertRelayOnIdle     = "RELAY_ON_WHILE_IDLE"
+	AlertRelayOffRunning = "RELAY_OFF_WHILE_RUNNING"
+)
+
+// AlertCommandUndelivered is raised when no transport of a device's
+// fallback chain could deliver a command.
+const AlertCommandUndelivered = "COMMAND_UNDELIVERED"
+
+// Alert lifecycle states.
+const (
+	AlertOpen     = "OPEN"
+	AlertAcked    = "ACKED"
+	AlertResolved = "RESOLVED"
+)
+
+// ErrAlertNotFound is returned when acting on an unknown or resolved alert.
+var ErrAlertNotFound = errors.New("alert not found")
+
+// Alert is a tamper / bypass event that staff must look at.
+type Alert struct {
+	ID         int64     `json:"id"`
+	ConsoleID  int64     `json:"console_id"`
+	Kind       string    `json:"kind"`
+	Message    string    `json:"message"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	AckedBy    string    `json:"acked_by,omitempty"`
+	AckedAt    time.Time `json:"acked_at"`
+	ResolvedBy string    `json:"resolved_by,omitempty"`
+	ResolvedAt time.Time `json:"resolved_at"`
+}
+
+// initAlerts creates the alerts table.
+func initAlerts(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS alerts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		console_id INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		message TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'OPEN',
+		created_at DATETIME NOT NULL,
+		acked_by TEXT NOT NULL DEFAULT '',
+		acked_at DATETIME,
+		resolved_by TEXT NOT NULL DEFAULT '',
+		resolved_at DATETIME,
+		FOREIGN KEY(console_id) REFERENCES consoles(id)
+	);`)
+	return err
+}
+
+// RaiseAlert stores a new alert unless an unresolved alert of the same kind
+// already exists for the console. created reports whether one was stored.
+func RaiseAlert(dbx *sql.DB, consoleID int64, kind, message string) (Alert, bool, error) {
+	var cnt int
+	if err := dbx.QueryRow(`SELECT COUNT(1) FROM alerts WHERE console_id=? AND kind=? AND status<>?`, consoleID, kind, AlertResolved).Scan(&cnt); err != nil {
+		return Alert{}, false, err
+	}
+	if cnt > 0 {
+		return Alert{}, false, nil
+	}
+	a := Alert{ConsoleID: consoleID, Kind: kind, Message: message, Status: AlertOpen, CreatedAt: time.Now()}
+	res, err := dbx.Exec(`INSERT INTO alerts(console_id, kind, message, status, created_at) VALUES(?,?,?,?,?)`,
+		a.ConsoleID, a.Kind, a.Message, a.Status, a.CreatedAt)
+	if err != nil {
+		return Alert{}, false, err
+	}
+	a.ID, _ = res.LastInsertId()
+	return a, true, nil
+}
+
+// AckAlert marks an open alert as seen by user.
+func AckAlert(dbx *sql.DB, id int64, user string) error {
+	res, err := dbx.Exec(`UPDATE alerts SET status=?, acked_by=?, acked_at=? WHERE id=? AND status=?`, AlertAcked, user, time.Now(), id, AlertOpen)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAlertNotFound
+	}
+	return nil
+}
+
+// ResolveAlert closes an open or acknowledged alert.
+func ResolveAlert(dbx *sql.DB, id int64, user string) error {
+	res, err := dbx.Exec(`UPDATE alerts SET status=?, resolved_by=?, resolved_at=? WHERE id=? AND status<>?`, AlertResolved, user, time.Now(), id, AlertResolved)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAlertNotFound
+	}
+	return nil
+}
+
+// ListAlerts returns the most recent alerts; an empty status lists every
+// unresolved alert, "all" lists alerts in any state.
+func ListAlerts(dbx *sql.DB, status string, limit int) ([]Alert, error) {
+	q := `SELECT id, console_id, kind, message, status, created_at, acked_by, acked_at, resolved_by, resolved_at FROM alerts`
+	var args []any
+	switch status {
+	case "all":
+	case "":
+		q += ` WHERE status<>?`
+		args = append(args, AlertResolved)
+	default:
+		q += ` WHERE status=?`
+		args = append(args, status)
+	}
+	q += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+	rows, err := dbx.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Alert
+	for rows.Next() {
+		var a Alert
+		var acked, resolved sql.NullTime
+		if err := rows.Scan(&a.ID, &a.ConsoleID, &a.Kind, &a.Message, &a.Status, &a.CreatedAt, &a.AckedBy, &acked, &a.ResolvedBy, &resolved); err != nil {
+			return nil, err
+		}
+		if acked.Valid {
+			a.AckedAt = acked.Time
+		}
+		if resolved.Valid {
+			a.ResolvedAt = resolved.Time
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRaiseAlert_Deduplicates(t *testing.T) {
+	dbx := openTestDB(t)
+
+	first, created, err := RaiseAlert(dbx, 1, AlertRelayOnIdle, "PS1: relay reported ON")
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, AlertOpen, first.Status)
+
+	// same console and kind while unresolved: not stored again, even once acked
+	_, created, err = RaiseAlert(dbx, 1, AlertRelayOnIdle, "PS1: relay reported ON")
+	require.NoError(t, err)
+	assert.False(t, created)
+	require.NoError(t, AckAlert(dbx, first.ID, "admin"))
+	_, created, err = RaiseAlert(dbx, 1, AlertRelayOnIdle, "PS1: relay reported ON")
+	require.NoError(t, err)
+	assert.False(t, created)
+
+	// other kinds and consoles are separate alerts
+	_, created, err = RaiseAlert(dbx, 1, AlertPowerWhileIdle, "PS1: draws 80 W")
+	require.NoError(t, err)
+	assert.True(t, created)
+	_, created, err = RaiseAlert(dbx, 2, AlertRelayOnIdle, "PS2: relay reported ON")
+	require.NoError(t, err)
+	assert.True(t, created)
+
+	// after resolving, the condition alerts again
+	require.NoError(t, ResolveAlert(dbx, first.ID, "admin"))
+	_, created, err = RaiseAlert(dbx, 1, AlertRelayOnIdle, "PS1: relay reported ON")
+	require.NoError(t, err)
+	assert.True(t, created)
+
+	open, err := ListAlerts(dbx, "", 100)
+	require.NoError(t, err)
+	assert.Len(t, open, 3)
+}
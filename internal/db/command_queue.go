@@ -0,0 +1,99 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// QueuedCommand is a device command that could not be delivered and waits
+// for the transport to come back.
+type QueuedCommand struct {
+	ID        int64     `json:"id"`
+	ConsoleID int64     `json:"console_id"`
+	Command   string    `json:"command"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// initCommandQueue creates the outbound command queue table.
+func initCommandQueue(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS command_queue (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		console_id INTEGER NOT NULL,
+		command TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);`)
+	return err
+}
+
+// EnqueueCommand queues a command, collapsing what it makes stale: a relay
+// command (ON/OFF) replaces everything queued for the console, any other
+// command (warnings) replaces the earlier non-relay commands. Output channel
+// commands (ON:1) only replace the queued commands of their channel and are
+// left alone by the console's own commands.
+func EnqueueCommand(dbx *sql.DB, consoleID int64, command, lastError string) error {
+	return withTx(dbx, func(tx *sql.Tx) error {
+		q := `DELETE FROM command_queue WHERE console_id=? AND command NOT IN ('ON','OFF') AND command NOT LIKE '%:%'`
+		args := []any{consoleID}
+		if command == "ON" || command == "OFF" {
+			q = `DELETE FROM command_queue WHERE console_id=? AND command NOT LIKE '%:%'`
+		} else if i := strings.LastIndexByte(command, ':'); i >= 0 {
+			q = `DELETE FROM command_queue WHERE console_id=? AND command LIKE ?`
+			args = append(args, "%"+command[i:])
+		}
+		if _, err := tx.Exec(q, args...); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO command_queue(console_id, command, attempts, last_error, created_at) VALUES(?,?,1,?,?)`,
+			consoleID, command, lastError, time.Now())
+		return err
+	})
+}
+
+// ListQueuedCommands returns the queue in delivery order.
+func ListQueuedCommands(dbx *sql.DB) ([]QueuedCommand, error) {
+	rows, err := dbx.Query(`SELECT id, console_id, command, attempts, last_error, created_at FROM command_queue ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []QueuedCommand
+	for rows.Next() {
+		var c QueuedCommand
+		if err := rows.Scan(&c.ID, &c.ConsoleID, &c.Command, &c.Attempts, &c.LastError, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+// DeleteQueuedCommand removes a delivered command.
+func DeleteQueuedCommand(dbx *sql.DB, id int64) error {
+	_, err := dbx.Exec(`DELETE FROM command_queue WHERE id=?`, id)
+	return err
+}
+
+// FailQueuedCommand records another failed delivery attempt.
+func FailQueuedCommand(dbx *sql.DB, id int64, lastError string) error {
+	_, err := dbx.Exec(`UPDATE command_queue SET attempts=attempts+1, last_error=? WHERE id=?`, lastError, id)
+	return err
+}
+
+// ClearQueuedCommands drops the queued commands of a console, e.g. once a
+// newer relay command got through directly. Output channel commands stay.
+func ClearQueuedCommands(dbx *sql.DB, consoleID int64) error {
+	_, err := dbx.Exec(`DELETE FROM command_queue WHERE console_id=? AND command NOT LIKE '%:%'`, consoleID)
+	return err
+}
+
+// CountQueuedCommands returns the queue depth.
+func CountQueuedCommands(dbx *sql.DB) (int, error) {
+	var n int
+	err := dbx.QueryRow(`SELECT COUNT(*) FROM command_queue`).Scan(&n)
+	return n, err
+}
@@ -0,0 +1,20 @@
+package db
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+// openTestDB returns an initialised in-memory database with four consoles.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dbx, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	dbx.SetMaxOpenConns(1) // every connection would get its own memory database
+	t.Cleanup(func() { dbx.Close() })
+	require.NoError(t, Init(dbx, 4, 10000))
+	return dbx
+}
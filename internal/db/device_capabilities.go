@@ -0,0 +1,67 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// DeviceCapabilities is the outcome of a device's protocol handshake.
+//
+// Fields:
+//
+//	Protocol: negotiated JSON protocol version, 0 for legacy plain text
+//	Commands: commands the device announced, empty means all
+//	Firmware: firmware version from the hello
+type DeviceCapabilities struct {
+	DeviceID  string    `json:"device_id"`
+	Protocol  int       `json:"protocol"`
+	Commands  []string  `json:"commands"`
+	Firmware  string    `json:"firmware"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// initDeviceCapabilities creates the handshake table.
+func initDeviceCapabilities(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS device_capabilities (
+		device_id TEXT PRIMARY KEY,
+		protocol INTEGER NOT NULL DEFAULT 0,
+		commands TEXT NOT NULL DEFAULT '[]',
+		firmware TEXT NOT NULL DEFAULT '',
+		updated_at DATETIME NOT NULL
+	);`)
+	return err
+}
+
+// SaveDeviceCapabilities stores (or replaces) the handshake of a device.
+func SaveDeviceCapabilities(dbx *sql.DB, c DeviceCapabilities) error {
+	cmds, err := json.Marshal(c.Commands)
+	if err != nil {
+		return err
+	}
+	_, err = dbx.Exec(`INSERT INTO device_capabilities(device_id, protocol, commands, firmware, updated_at) VALUES(?,?,?,?,?)
+		ON CONFLICT(device_id) DO UPDATE SET protocol=excluded.protocol, commands=excluded.commands,
+		firmware=excluded.firmware, updated_at=excluded.updated_at`,
+		c.DeviceID, c.Protocol, string(cmds), c.Firmware, time.Now())
+	return err
+}
+
+// ListDeviceCapabilities returns every stored handshake.
+func ListDeviceCapabilities(dbx *sql.DB) ([]DeviceCapabilities, error) {
+	rows, err := dbx.Query(`SELECT device_id, protocol, commands, firmware, updated_at FROM device_capabilities ORDER BY device_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []DeviceCapabilities
+	for rows.Next() {
+		var c DeviceCapabilities
+		var cmds string
+		if err := rows.Scan(&c.DeviceID, &c.Protocol, &cmds, &c.Firmware, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal([]byte(cmds), &c.Commands)
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// DeviceState is the last state reported by the device of a console.
+//
+// Fields:
+//
+//	Relay: ON, OFF or empty if the device never reported its relay
+//	LastSeen: time of the last message from the device
+//	Raw: last raw payload, kept for troubleshooting
+//	Online: false once the device's Last Will (or an explicit offline) arrived
+//	LastHeartbeat: last heartbeat/availability message; zero for devices
+//	that do not publish heartbeats, whose connectivity is then unknown
+//	Watts, Voltage, EnergyKWh: last power meter reading, taken at PowerAt
+//	(zero for devices without a power meter)
+//	RSSI, UptimeSec: Wi-Fi signal (dBm, nil if never reported) and uptime
+//	from the last versioned heartbeat, received at TelemetryAt
+//	LastError: last error the device reported (heartbeat or rejected
+//	command), at LastErrorAt
+type DeviceState struct {
+	ConsoleID     int64     `json:"console_id"`
+	Relay         string    `json:"relay"`
+	LastSeen      time.Time `json:"last_seen"`
+	Raw           string    `json:"raw"`
+	Online        bool      `json:"online"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	Watts         float64   `json:"watts"`
+	Voltage       float64   `json:"voltage"`
+	EnergyKWh     float64   `json:"energy_kwh"`
+	PowerAt       time.Time `json:"power_at"`
+	RSSI          *int      `json:"rssi"`
+	UptimeSec     int64     `json:"uptime_sec"`
+	TelemetryAt   time.Time `json:"telemetry_at"`
+	LastError     string    `json:"last_error"`
+	LastErrorAt   time.Time `json:"last_error_at"`
+}
+
+// Device connectivity states.
+const (
+	DeviceOnline  = "ONLINE"
+	DeviceOffline = "OFFLINE"
+	DeviceUnknown = "UNKNOWN"
+)
+
+// Connectivity derives ONLINE/OFFLINE/UNKNOWN from the stored flags: a
+// device is offline after its Last Will or when no heartbeat arrived within
+// timeout; devices that never sent a heartbeat are UNKNOWN.
+func (s DeviceState) Connectivity(timeout time.Duration) string {
+	if s.LastHeartbeat.IsZero() {
+		return DeviceUnknown
+	}
+	if !s.Online || (timeout > 0 && time.Since(s.LastHeartbeat) > timeout) {
+		return DeviceOffline
+	}
+	return DeviceOnline
+}
+
+// Usage tells actual play from a console idling in standby using the last
+// power reading. It is empty when the device has no reading newer than maxAge.
+func (s DeviceState) Usage(standbyWatts float64, maxAge time.Duration) string {
+	if s.PowerAt.IsZero() || (maxAge > 0 && time.Since(s.PowerAt) > maxAge) {
+		return ""
+	}
+	switch {
+	case s.Watts < offWatts:
+		return UsageOff
+	case s.Watts < standbyWatts:
+		return UsageStandby
+	}
+	return UsagePlaying
+}
+
+// ReconcileEvent records an automatic correction of a relay whose reported
+// state did not match the console's desired state.
+type ReconcileEvent struct {
+	ID        int64     `json:"id"`
+	ConsoleID int64     `json:"console_id"`
+	Desired   string    `json:"desired"`
+	Reported  string    `json:"reported"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// initDeviceState creates the device state and reconciliation tables.
+func initDeviceState(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS device_state (
+		console_id INTEGER PRIMARY KEY,
+		relay TEXT NOT NULL DEFAULT '',
+		last_seen DATETIME NOT NULL,
+		raw TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(console_id) REFERENCES consoles(id)
+	);`); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "device_state", "online", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "device_state", "last_heartbeat", "DATETIME"); err != nil {
+		return err
+	}
+	for col, ddl := range map[string]string{
+		"rssi":          "INTEGER",
+		"uptime_sec":    "INTEGER NOT NULL DEFAULT 0",
+		"telemetry_at":  "DATETIME",
+		"last_error":    "TEXT NOT NULL DEFAULT ''",
+		"last_error_at": "DATETIME",
+	} {
+		if err := ensureColumn(db, "device_state", col, ddl); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS reconcile_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		console_id INTEGER NOT NULL,
+		desired TEXT NOT NULL,
+		reported TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(console_id) REFERENCES consoles(id)
+	);`)
+	return err
+}
+
+// SaveDeviceReport stores a status message of a device. An empty relay
+// keeps the previously reported relay state. Any message proves the device
+// is connected, so it also clears an earlier offline flag.
+func SaveDeviceReport(dbx *sql.DB, consoleID int64, relay, raw string) error {
+	_, err := dbx.Exec(`INSERT INTO device_state(console_id, relay, last_seen, raw, online) VALUES(?,?,?,?,1)
+		ON CONFLICT(console_id) DO UPDATE SET relay=CASE WHEN excluded.relay='' THEN device_state.relay ELSE excluded.relay END,
+		last_seen=excluded.last_seen, raw=excluded.raw, online=1`, consoleID, relay, time.Now(), raw)
+	return err
+}
+
+// SaveDeviceHeartbeat stores a heartbeat or availability (Last Will) message.
+func SaveDeviceHeartbeat(dbx *sql.DB, consoleID int64, online bool) error {
+	now := time.Now()
+	_, err := dbx.Exec(`INSERT INTO device_state(console_id, last_seen, online, last_heartbeat) VALUES(?,?,?,?)
+		ON CONFLICT(console_id) DO UPDATE SET last_seen=excluded.last_seen, online=excluded.online, last_heartbeat=excluded.last_heartbeat`,
+		consoleID, now, online, now)
+	return err
+}
+
+// SaveDeviceTelemetry stores the signal strength (nil keeps the previous
+// value) and uptime from a versioned heartbeat.
+func SaveDeviceTelemetry(dbx *sql.DB, consoleID int64, rssi *int, uptimeSec int64) error {
+	now := time.Now()
+	_, err := dbx.Exec(`INSERT INTO device_state(console_id, last_seen, rssi, uptime_sec, telemetry_at) VALUES(?,?,?,?,?)
+		ON CONFLICT(console_id) DO UPDATE SET rssi=COALESCE(excluded.rssi, device_state.rssi),
+		uptime_sec=excluded.uptime_sec, telemetry_at=excluded.telemetry_at`,
+		consoleID, now, rssi, uptimeSec, now)
+	return err
+}
+
+// SaveDeviceError stores the last error a device reported.
+func SaveDeviceError(dbx *sql.DB, consoleID int64, msg string) error {
+	now := time.Now()
+	_, err := dbx.Exec(`INSERT INTO device_state(console_id, last_seen, last_error, last_error_at) VALUES(?,?,?,?)
+		ON CONFLICT(console_id) DO UPDATE SET last_error=excluded.last_error, last_error_at=excluded.last_error_at`,
+		consoleID, now, msg, now)
+	return err
+}
+
+const deviceStateColumns = `console_id, relay, last_seen, raw, online, last_heartbeat, watts, voltage, energy_kwh, power_at,
+	rssi, uptime_sec, telemetry_at, last_error, last_error_at`
+
+func scanDeviceState(row interface{ Scan(...any) error }) (DeviceState, error) {
+	var s DeviceState
+	var hb, pw, tm, le sql.NullTime
+	var rssi sql.NullInt64
+	if err := row.Scan(&s.ConsoleID, &s.Relay, &s.LastSeen, &s.Raw, &s.Online, &hb, &s.Watts, &s.Voltage, &s.EnergyKWh, &pw,
+		&rssi, &s.UptimeSec, &tm, &s.LastError, &le); err != nil {
+		return DeviceState{}, err
+	}
+	if hb.Valid {
+		s.LastHeartbeat = hb.Time
+	}
+	if pw.Valid {
+		s.PowerAt = pw.Time
+	}
+	if rssi.Valid {
+		v := int(rssi.Int64)
+		s.RSSI = &v
+	}
+	if tm.Valid {
+		s.TelemetryAt = tm.Time
+	}
+	if le.Valid {
+		s.LastErrorAt = le.Time
+	}
+	return s, nil
+}
+
+// GetDeviceState returns the reported state of one device.
+func GetDeviceState(dbx *sql.DB, consoleID int64) (DeviceState, bool, error) {
+	s, err := scanDeviceState(dbx.QueryRow(`SELECT `+deviceStateColumns+` FROM device_state WHERE console_id=?`, consoleID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return DeviceState{}, false, nil
+		}
+		return DeviceState{}, false, err
+	}
+	return s, true, nil
+}
+
+// GetDeviceStates returns the reported state of every device keyed by console.
+func GetDeviceStates(dbx *sql.DB) (map[int64]DeviceState, error) {
+	rows, err := dbx.Query(`SELECT ` + deviceStateColumns + ` FROM device_state`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[int64]DeviceState)
+	for rows.Next() {
+		s, err := scanDeviceState(rows)
+		if err != nil {
+			return nil, err
+		}
+		res[s.ConsoleID] = s
+	}
+	return res, rows.Err()
+}
+
+// InsertReconcileEvent records a reconciliation attempt.
+func InsertReconcileEvent(dbx *sql.DB, ev ReconcileEvent) error {
+	_, err := dbx.Exec(`INSERT INTO reconcile_events(console_id, desired, reported, error, created_at) VALUES(?,?,?,?,?)`,
+		ev.ConsoleID, ev.Desired, ev.Reported, ev.Error, time.Now())
+	return err
+}
+
+// ListReconcileEvents returns the most recent reconciliation events.
+func ListReconcileEvents(dbx *sql.DB, limit int) ([]ReconcileEvent, error) {
+	rows, err := dbx.Query(`SELECT id, console_id, desired, reported, error, created_at FROM reconcile_events ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []ReconcileEvent
+	for rows.Next() {
+		var ev ReconcileEvent
+		if err := rows.Scan(&ev.ID, &ev.ConsoleID, &ev.Desired, &ev.Reported, &ev.Error, &ev.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, ev)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Device maps a console to the hardware that switches it.
+//
+// Fields:
+//
+//	ConsoleID: console this device powers (one device per console)
+//	DeviceID: identifier used by the firmware (topic segment, hostname, ...)
+//	Transport: how the device is reached (mqtt, http, ...)
+//	Fallback: transports tried in order when Transport fails; "alert" raises an alert
+//	CommandTopic / StatusTopic / Payload: templates, empty means default
+//	Options: transport specific settings as a JSON object
+type Device struct {
+	ConsoleID    int64           `json:"console_id"`
+	DeviceID     string          `json:"device_id"`
+	Transport    string          `json:"transport"`
+	CommandTopic string          `json:"command_topic"`
+	StatusTopic  string          `json:"status_topic"`
+	Payload      string          `json:"payload"`
+	Options      json.RawMessage `json:"options,omitempty"`
+	Fallback     []string        `json:"fallback,omitempty"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+}
+
+// initDevices creates the device registry table.
+func initDevices(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS devices (
+		console_id INTEGER PRIMARY KEY,
+		device_id TEXT NOT NULL UNIQUE,
+		transport TEXT NOT NULL DEFAULT 'mqtt',
+		command_topic TEXT NOT NULL DEFAULT '',
+		status_topic TEXT NOT NULL DEFAULT '',
+		payload TEXT NOT NULL DEFAULT '',
+		updated_at DATETIME NOT NULL,
+		FOREIGN KEY(console_id) REFERENCES consoles(id)
+	);`)
+	if err != nil {
+		return err
+	}
+	if err := ensureColumn(db, "devices", "options", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	return ensureColumn(db, "devices", "fallback", "TEXT NOT NULL DEFAULT ''")
+}
+
+// ListDevices returns all registered devices ordered by console.
+func ListDevices(dbx *sql.DB) ([]Device, error) {
+	rows, err := dbx.Query(`SELECT console_id, device_id, transport, command_topic, status_topic, payload, options, fallback, updated_at FROM devices ORDER BY console_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Device
+	for rows.Next() {
+		var d Device
+		var options, fallback string
+		if err := rows.Scan(&d.ConsoleID, &d.DeviceID, &d.Transport, &d.CommandTopic, &d.StatusTopic, &d.Payload, &options, &fallback, &d.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if options != "" {
+			d.Options = json.RawMessage(options)
+		}
+		if fallback != "" {
+			d.Fallback = strings.Split(fallback, ",")
+		}
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+// SaveDevice inserts or replaces the device mapping of a console.
+func SaveDevice(dbx *sql.DB, d Device) error {
+	if d.DeviceID == "" {
+		return errors.New("device_id required")
+	}
+	var exists int
+	if err := dbx.QueryRow(`SELECT COUNT(1) FROM consoles WHERE id=?`, d.ConsoleID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errors.New("console not found")
+	}
+	if d.Transport == "" {
+		d.Transport = "mqtt"
+	}
+	_, err := dbx.Exec(`INSERT INTO devices(console_id, device_id, transport, command_topic, status_topic, payload, options, fallback, updated_at) VALUES(?,?,?,?,?,?,?,?,?)
+		ON CONFLICT(console_id) DO UPDATE SET device_id=excluded.device_id, transport=excluded.transport, command_topic=excluded.command_topic,
+		status_topic=excluded.status_topic, payload=excluded.payload, options=excluded.options, fallback=excluded.fallback, updated_at=excluded.updated_at`,
+		d.ConsoleID, d.DeviceID, d.Transport, d.CommandTopic, d.StatusTopic, d.Payload, string(d.Options), strings.Join(d.Fallback, ","), time.Now())
+	return err
+}
+
+// DeleteDevice removes the device mapping of a console (it falls back to the legacy ID mapping).
+func DeleteDevice(dbx *sql.DB, consoleID int64) error {
+	_, err := dbx.Exec(`DELETE FROM devices WHERE console_id=?`, consoleID)
+	return err
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Diagnostic is one run of the relay self-test of a console, with the
+// device telemetry at that time.
+//
+// Fields:
+//
+//	Transport: transport of the device, Delivered the one that carried the
+//	last command (differs when a fallback was used)
+//	DeviceStatus: ONLINE, OFFLINE or UNKNOWN when the test started
+//	OK: every step of the pulse was delivered and acked
+//	AckMS: slowest acked step
+//	Steps: the pulse commands with their outcome, as JSON
+//	Firmware, RSSI, UptimeSec, LastError: last values the device reported
+type Diagnostic struct {
+	ID           int64           `json:"id"`
+	ConsoleID    int64           `json:"console_id"`
+	DeviceID     string          `json:"device_id"`
+	Transport    string          `json:"transport"`
+	Delivered    string          `json:"delivered,omitempty"`
+	DeviceStatus string          `json:"device_status"`
+	OK           bool            `json:"ok"`
+	AckMS        int64           `json:"ack_ms"`
+	Steps        json.RawMessage `json:"steps"`
+	Firmware     string          `json:"firmware"`
+	RSSI         *int            `json:"rssi"`
+	UptimeSec    int64           `json:"uptime_sec"`
+	LastError    string          `json:"last_error"`
+	LastSeen     time.Time       `json:"last_seen"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
+
+// DiagnosticStats sums up the self-tests of one console, so boards that
+// fail intermittently stand out.
+type DiagnosticStats struct {
+	ConsoleID   int64   `json:"console_id"`
+	Runs        int     `json:"runs"`
+	Failures    int     `json:"failures"`
+	FailureRate float64 `json:"failure_rate"`
+	AvgAckMS    float64 `json:"avg_ack_ms"`
+	MaxAckMS    int64   `json:"max_ack_ms"`
+}
+
+// initDiagnostics creates the self-test history table.
+func initDiagnostics(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS diagnostics (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		console_id INTEGER NOT NULL,
+		device_id TEXT NOT NULL,
+		transport TEXT NOT NULL,
+		delivered TEXT NOT NULL DEFAULT '',
+		device_status TEXT NOT NULL,
+		ok INTEGER NOT NULL,
+		ack_ms INTEGER NOT NULL DEFAULT 0,
+		steps TEXT NOT NULL DEFAULT '[]',
+		firmware TEXT NOT NULL DEFAULT '',
+		rssi INTEGER,
+		uptime_sec INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		last_seen DATETIME,
+		created_at DATETIME NOT NULL,
+		FOREIGN KEY(console_id) REFERENCES consoles(id)
+	);`); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_diagnostics_console ON diagnostics(console_id, id)`)
+	return err
+}
+
+// InsertDiagnostic stores a self-test run and sets its ID and time.
+func InsertDiagnostic(dbx *sql.DB, d *Diagnostic) error {
+	if len(d.Steps) == 0 {
+		d.Steps = json.RawMessage("[]")
+	}
+	var lastSeen sql.NullTime
+	if !d.LastSeen.IsZero() {
+		lastSeen = sql.NullTime{Time: d.LastSeen, Valid: true}
+	}
+	d.CreatedAt = time.Now()
+	res, err := dbx.Exec(`INSERT INTO diagnostics(console_id, device_id, transport, delivered, device_status, ok, ack_ms, steps,
+		firmware, rssi, uptime_sec, last_error, last_seen, created_at) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		d.ConsoleID, d.DeviceID, d.Transport, d.Delivered, d.DeviceStatus, d.OK, d.AckMS, string(d.Steps),
+		d.Firmware, d.RSSI, d.UptimeSec, d.LastError, lastSeen, d.CreatedAt)
+	if err != nil {
+		return err
+	}
+	d.ID, err = res.LastInsertId()
+	return err
+}
+
+// ListDiagnostics returns the most recent self-tests of a console.
+func ListDiagnostics(dbx *sql.DB, consoleID int64, limit int) ([]Diagnostic, error) {
+	rows, err := dbx.Query(`SELECT id, console_id, device_id, transport, delivered, device_status, ok, ack_ms, steps,
+		firmware, rssi, uptime_sec, last_error, last_seen, created_at FROM diagnostics WHERE console_id=? ORDER BY id DESC LIMIT ?`,
+		consoleID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Diagnostic
+	for rows.Next() {
+		var d Diagnostic
+		var steps string
+		var rssi sql.NullInt64
+		var lastSeen sql.NullTime
+		if err := rows.Scan(&d.ID, &d.ConsoleID, &d.DeviceID, &d.Transport, &d.Delivered, &d.DeviceStatus, &d.OK, &d.AckMS, &steps,
+			&d.Firmware, &rssi, &d.UptimeSec, &d.LastError, &lastSeen, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		d.Steps = json.RawMessage(steps)
+		if rssi.Valid {
+			v := int(rssi.Int64)
+			d.RSSI = &v
+		}
+		if lastSeen.Valid {
+			d.LastSeen = lastSeen.Time
+		}
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+// ListDiagnosticStats sums up the self-tests since a time per console,
+// most failures first.
+func ListDiagnosticStats(dbx *sql.DB, since time.Time) ([]DiagnosticStats, error) {
+	rows, err := dbx.Query(`SELECT console_id, COUNT(1), SUM(CASE WHEN ok THEN 0 ELSE 1 END),
+		COALESCE(AVG(CASE WHEN ok THEN ack_ms END), 0), MAX(ack_ms)
+		FROM diagnostics WHERE created_at >= ? GROUP BY console_id ORDER BY 3 DESC, console_id`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []DiagnosticStats
+	for rows.Next() {
+		var st DiagnosticStats
+		if err := rows.Scan(&st.ConsoleID, &st.Runs, &st.Failures, &st.AvgAckMS, &st.MaxAckMS); err != nil {
+			return nil, err
+		}
+		st.FailureRate = float64(st.Failures) / float64(st.Runs)
+		list = append(list, st)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,206 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// IRCode is a learned infrared code in the library of a TV model.
+//
+// Fields:
+//
+//	Model: TV (or appliance) model the code belongs to, e.g. "LG-43UK6300"
+//	Name: function of the code within the model, e.g. power, hdmi2, vol_up
+//	Protocol / Bits / Data: encoding sent to the board's IR blaster
+type IRCode struct {
+	ID       int64  `json:"id"`
+	Model    string `json:"model"`
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Bits     int    `json:"bits"`
+	Data     string `json:"data"`
+}
+
+// IRStep sends the named code of the console's TV model DelayMS after the
+// session started or stopped.
+type IRStep struct {
+	Code    string `json:"code"`
+	DelayMS int    `json:"delay_ms"`
+}
+
+// ConsoleIR links a console to the TV model in its booth and lists the IR
+// sequences sent at session start and stop.
+type ConsoleIR struct {
+	ConsoleID int64    `json:"console_id"`
+	Model     string   `json:"model"`
+	OnStart   []IRStep `json:"on_start"`
+	OnStop    []IRStep `json:"on_stop"`
+}
+
+// ErrIRCodeNotFound is returned for unknown IR codes.
+var ErrIRCodeNotFound = errors.New("ir code not found")
+
+// initIR creates the IR code library and the per-console IR settings.
+func initIR(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS ir_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		model TEXT NOT NULL,
+		name TEXT NOT NULL,
+		protocol TEXT NOT NULL,
+		bits INTEGER NOT NULL DEFAULT 0,
+		data TEXT NOT NULL,
+		UNIQUE(model, name)
+	);`); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS console_ir (
+		console_id INTEGER PRIMARY KEY,
+		model TEXT NOT NULL,
+		on_start TEXT NOT NULL DEFAULT '[]',
+		on_stop TEXT NOT NULL DEFAULT '[]',
+		FOREIGN KEY(console_id) REFERENCES consoles(id)
+	);`)
+	return err
+}
+
+const irCodeColumns = `id, model, name, protocol, bits, data`
+
+func scanIRCode(row interface{ Scan(...any) error }) (IRCode, error) {
+	var c IRCode
+	err := row.Scan(&c.ID, &c.Model, &c.Name, &c.Protocol, &c.Bits, &c.Data)
+	return c, err
+}
+
+// ListIRCodes returns the library, optionally limited to one model.
+func ListIRCodes(dbx *sql.DB, model string) ([]IRCode, error) {
+	rows, err := dbx.Query(`SELECT `+irCodeColumns+` FROM ir_codes WHERE ?='' OR model=? ORDER BY model, name`, model, model)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []IRCode
+	for rows.Next() {
+		c, err := scanIRCode(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+// GetIRCode returns a code by ID.
+func GetIRCode(dbx *sql.DB, id int64) (IRCode, error) {
+	c, err := scanIRCode(dbx.QueryRow(`SELECT `+irCodeColumns+` FROM ir_codes WHERE id=?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return IRCode{}, ErrIRCodeNotFound
+	}
+	return c, err
+}
+
+// FindIRCode returns the code of a model by name.
+func FindIRCode(dbx *sql.DB, model, name string) (IRCode, error) {
+	c, err := scanIRCode(dbx.QueryRow(`SELECT `+irCodeColumns+` FROM ir_codes WHERE model=? AND name=?`, model, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return IRCode{}, ErrIRCodeNotFound
+	}
+	return c, err
+}
+
+// SaveIRCode creates or replaces (by model and name) a code.
+func SaveIRCode(dbx *sql.DB, c IRCode) (int64, error) {
+	c.Model, c.Name = strings.TrimSpace(c.Model), strings.TrimSpace(c.Name)
+	if c.Model == "" || c.Name == "" {
+		return 0, errors.New("model and name required")
+	}
+	var id int64
+	err := dbx.QueryRow(`INSERT INTO ir_codes(model, name, protocol, bits, data) VALUES(?,?,?,?,?)
+		ON CONFLICT(model, name) DO UPDATE SET protocol=excluded.protocol, bits=excluded.bits, data=excluded.data RETURNING id`,
+		c.Model, c.Name, c.Protocol, c.Bits, c.Data).Scan(&id)
+	return id, err
+}
+
+// DeleteIRCode removes a code from the library.
+func DeleteIRCode(dbx *sql.DB, id int64) error {
+	_, err := dbx.Exec(`DELETE FROM ir_codes WHERE id=?`, id)
+	return err
+}
+
+// GetConsoleIR returns the IR settings of a console.
+func GetConsoleIR(dbx *sql.DB, consoleID int64) (ConsoleIR, bool, error) {
+	list, err := listConsoleIR(dbx, `WHERE console_id=?`, consoleID)
+	if err != nil || len(list) == 0 {
+		return ConsoleIR{}, false, err
+	}
+	return list[0], true, nil
+}
+
+// ListConsoleIR returns the IR settings of every console that has them.
+func ListConsoleIR(dbx *sql.DB) ([]ConsoleIR, error) {
+	return listConsoleIR(dbx, ``)
+}
+
+func listConsoleIR(dbx *sql.DB, where string, args ...any) ([]ConsoleIR, error) {
+	rows, err := dbx.Query(`SELECT console_id, model, on_start, on_stop FROM console_ir `+where+` ORDER BY console_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []ConsoleIR
+	for rows.Next() {
+		var c ConsoleIR
+		var start, stop string
+		if err := rows.Scan(&c.ConsoleID, &c.Model, &start, &stop); err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal([]byte(start), &c.OnStart)
+		_ = json.Unmarshal([]byte(stop), &c.OnStop)
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+// SaveConsoleIR stores the IR settings of a console; every step must name
+// a code of the model.
+func SaveConsoleIR(dbx *sql.DB, c ConsoleIR) error {
+	c.Model = strings.TrimSpace(c.Model)
+	if c.Model == "" {
+		return errors.New("model required")
+	}
+	var exists int
+	if err := dbx.QueryRow(`SELECT COUNT(1) FROM consoles WHERE id=?`, c.ConsoleID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errors.New("console not found")
+	}
+	for _, st := range append(append([]IRStep{}, c.OnStart...), c.OnStop...) {
+		if st.DelayMS < 0 {
+			return errors.New("delay_ms must not be negative")
+		}
+		if _, err := FindIRCode(dbx, c.Model, st.Code); err != nil {
+			return errors.New("unknown ir code " + c.Model + "/" + st.Code)
+		}
+	}
+	start, _ := json.Marshal(nonNilSteps(c.OnStart))
+	stop, _ := json.Marshal(nonNilSteps(c.OnStop))
+	_, err := dbx.Exec(`INSERT INTO console_ir(console_id, model, on_start, on_stop) VALUES(?,?,?,?)
+		ON CONFLICT(console_id) DO UPDATE SET model=excluded.model, on_start=excluded.on_start, on_stop=excluded.on_stop`,
+		c.ConsoleID, c.Model, string(start), string(stop))
+	return err
+}
+
+func nonNilSteps(s []IRStep) []IRStep {
+	if s == nil {
+		return []IRStep{}
+	}
+	return s
+}
+
+// DeleteConsoleIR removes the IR settings of a console.
+func DeleteConsoleIR(dbx *sql.DB, consoleID int64) error {
+	_, err := dbx.Exec(`DELETE FROM console_ir WHERE console_id=?`, consoleID)
+	return err
+}
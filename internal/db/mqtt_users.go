@@ -0,0 +1,95 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// MQTTUser is a device credential accepted by the embedded MQTT broker. The
+// username is the device ID; the user may use the topics of that device plus
+// the Topics filters (e.g. "#" for Home Assistant).
+type MQTTUser struct {
+	Username  string    `json:"username"`
+	Topics    []string  `json:"topics,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// initMQTTUsers creates the embedded broker credential table.
+func initMQTTUsers(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS mqtt_users (
+		username TEXT PRIMARY KEY,
+		password_hash TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+	return ensureColumn(db, "mqtt_users", "topics", "TEXT NOT NULL DEFAULT ''")
+}
+
+// SaveMQTTUser creates a broker credential or replaces its password hash
+// and extra topic filters.
+func SaveMQTTUser(dbx *sql.DB, username, passwordHash string, topics []string) error {
+	if username == "" {
+		return errors.New("username required")
+	}
+	_, err := dbx.Exec(`INSERT INTO mqtt_users(username, password_hash, topics, created_at) VALUES(?,?,?,?)
+		ON CONFLICT(username) DO UPDATE SET password_hash=excluded.password_hash, topics=excluded.topics`,
+		username, passwordHash, strings.Join(topics, ","), time.Now())
+	return err
+}
+
+// DeleteMQTTUser removes a broker credential.
+func DeleteMQTTUser(dbx *sql.DB, username string) error {
+	_, err := dbx.Exec(`DELETE FROM mqtt_users WHERE username=?`, username)
+	return err
+}
+
+// ListMQTTUsers returns the broker credentials without their hashes.
+func ListMQTTUsers(dbx *sql.DB) ([]MQTTUser, error) {
+	rows, err := dbx.Query(`SELECT username, topics, created_at FROM mqtt_users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []MQTTUser
+	for rows.Next() {
+		var u MQTTUser
+		var topics string
+		if err := rows.Scan(&u.Username, &topics, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		if topics != "" {
+			u.Topics = strings.Split(topics, ",")
+		}
+		list = append(list, u)
+	}
+	return list, rows.Err()
+}
+
+// GetMQTTUserHash returns the password hash of a broker credential.
+func GetMQTTUserHash(dbx *sql.DB, username string) (string, bool, error) {
+	var hash string
+	if err := dbx.QueryRow(`SELECT password_hash FROM mqtt_users WHERE username=?`, username).Scan(&hash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return hash, true, nil
+}
+
+// GetMQTTUserTopics returns the extra topic filters of a broker credential.
+func GetMQTTUserTopics(dbx *sql.DB, username string) ([]string, error) {
+	var topics string
+	err := dbx.QueryRow(`SELECT topics FROM mqtt_users WHERE username=?`, username).Scan(&topics)
+	if err != nil || topics == "" {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+		return nil, err
+	}
+	return strings.Split(topics, ","), nil
+}
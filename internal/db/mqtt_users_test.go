@@ -0,0 +1,29 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMQTTUserTopics(t *testing.T) {
+	dbx := openTestDB(t)
+	require.NoError(t, SaveMQTTUser(dbx, "board-4", "hash", nil))
+	require.NoError(t, SaveMQTTUser(dbx, "homeassistant", "hash", []string{"homeassistant/#", "ps/+/state"}))
+
+	topics, err := GetMQTTUserTopics(dbx, "board-4")
+	require.NoError(t, err)
+	assert.Empty(t, topics)
+	topics, err = GetMQTTUserTopics(dbx, "homeassistant")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"homeassistant/#", "ps/+/state"}, topics)
+	topics, err = GetMQTTUserTopics(dbx, "unknown")
+	require.NoError(t, err)
+	assert.Empty(t, topics)
+
+	list, err := ListMQTTUsers(dbx)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, []string{"homeassistant/#", "ps/+/state"}, list[1].Topics)
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// ConsoleOutput is a named relay output of a console (TV, AC, lights, ...).
+//
+// Fields:
+//
+//	Name: unique per console; "console" stands for the console relay itself
+//	Channel: relay channel on the console's device (0-based)
+//	StartDelaySec / StopDelaySec: offset of the output in the power sequence
+//	run when a session starts / stops
+type ConsoleOutput struct {
+	ID            int64  `json:"id"`
+	ConsoleID     int64  `json:"console_id"`
+	Name          string `json:"name"`
+	Channel       int    `json:"channel"`
+	StartDelaySec int    `json:"start_delay_sec"`
+	StopDelaySec  int    `json:"stop_delay_sec"`
+}
+
+// initOutputs creates the console output table.
+func initOutputs(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS console_outputs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		console_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		channel INTEGER NOT NULL DEFAULT 0,
+		start_delay_sec INTEGER NOT NULL DEFAULT 0,
+		stop_delay_sec INTEGER NOT NULL DEFAULT 0,
+		UNIQUE(console_id, name),
+		FOREIGN KEY(console_id) REFERENCES consoles(id)
+	);`)
+	return err
+}
+
+// ListOutputs returns the outputs of a console, or of every console when
+// consoleID is 0.
+func ListOutputs(dbx *sql.DB, consoleID int64) ([]ConsoleOutput, error) {
+	rows, err := dbx.Query(`SELECT id, console_id, name, channel, start_delay_sec, stop_delay_sec FROM console_outputs
+		WHERE ?=0 OR console_id=? ORDER BY console_id, id`, consoleID, consoleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []ConsoleOutput
+	for rows.Next() {
+		var o ConsoleOutput
+		if err := rows.Scan(&o.ID, &o.ConsoleID, &o.Name, &o.Channel, &o.StartDelaySec, &o.StopDelaySec); err != nil {
+			return nil, err
+		}
+		list = append(list, o)
+	}
+	return list, rows.Err()
+}
+
+// GetOutput returns one output by ID.
+func GetOutput(dbx *sql.DB, id int64) (ConsoleOutput, bool, error) {
+	var o ConsoleOutput
+	err := dbx.QueryRow(`SELECT id, console_id, name, channel, start_delay_sec, stop_delay_sec FROM console_outputs WHERE id=?`, id).
+		Scan(&o.ID, &o.ConsoleID, &o.Name, &o.Channel, &o.StartDelaySec, &o.StopDelaySec)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ConsoleOutput{}, false, nil
+	}
+	return o, err == nil, err
+}
+
+// SaveOutput creates or updates (by console and name) an output.
+func SaveOutput(dbx *sql.DB, o ConsoleOutput) (int64, error) {
+	o.Name = strings.TrimSpace(o.Name)
+	if o.Name == "" {
+		return 0, errors.New("name required")
+	}
+	if o.Channel < 0 || o.StartDelaySec < 0 || o.StopDelaySec < 0 {
+		return 0, errors.New("channel and delays must not be negative")
+	}
+	var exists int
+	if err := dbx.QueryRow(`SELECT COUNT(1) FROM consoles WHERE id=?`, o.ConsoleID).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if exists == 0 {
+		return 0, errors.New("console not found")
+	}
+	var id int64
+	err := dbx.QueryRow(`INSERT INTO console_outputs(console_id, name, channel, start_delay_sec, stop_delay_sec) VALUES(?,?,?,?,?)
+		ON CONFLICT(console_id, name) DO UPDATE SET channel=excluded.channel, start_delay_sec=excluded.start_delay_sec,
+		stop_delay_sec=excluded.stop_delay_sec RETURNING id`,
+		o.ConsoleID, o.Name, o.Channel, o.StartDelaySec, o.StopDelaySec).Scan(&id)
+	return id, err
+}
+
+// DeleteOutput removes an output.
+func DeleteOutput(dbx *sql.DB, id int64) error {
+	_, err := dbx.Exec(`DELETE FROM console_outputs WHERE id=?`, id)
+	return err
+}
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Console usage derived from power readings while the relay is on.
+const (
+	UsagePlaying = "PLAYING"
+	UsageStandby = "STANDBY"
+	UsageOff     = "OFF"
+)
+
+// offWatts is the draw below which a console is considered fully off.
+const offWatts = 1.0
+
+// PowerPoint is one point of a power history. Raw points are single
+// readings; downsampled points aggregate an hour of readings.
+type PowerPoint struct {
+	Time      time.Time `json:"time"`
+	Watts     float64   `json:"watts"` // average over the point
+	MaxWatts  float64   `json:"max_watts"`
+	Voltage   float64   `json:"voltage"`
+	EnergyKWh float64   `json:"energy_kwh"` // meter total at the end of the point
+	Samples   int       `json:"samples"`
+	Hourly    bool      `json:"hourly"`
+}
+
+// initPower creates the raw and hourly power reading tables.
+func initPower(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS power_readings (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		console_id INTEGER NOT NULL,
+		ts DATETIME NOT NULL,
+		watts REAL NOT NULL,
+		voltage REAL NOT NULL DEFAULT 0,
+		current REAL NOT NULL DEFAULT 0,
+		energy_kwh REAL NOT NULL DEFAULT 0,
+		FOREIGN KEY(console_id) REFERENCES consoles(id)
+	);`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_power_readings_console_ts ON power_readings(console_id, ts)`); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS power_hourly (
+		console_id INTEGER NOT NULL,
+		hour DATETIME NOT NULL,
+		avg_watts REAL NOT NULL,
+		max_watts REAL NOT NULL,
+		voltage REAL NOT NULL DEFAULT 0,
+		energy_kwh REAL NOT NULL DEFAULT 0,
+		samples INTEGER NOT NULL,
+		PRIMARY KEY(console_id, hour),
+		FOREIGN KEY(console_id) REFERENCES consoles(id)
+	);`); err != nil {
+		return err
+	}
+	for col, ddl := range map[string]string{
+		"watts":      "REAL NOT NULL DEFAULT 0",
+		"voltage":    "REAL NOT NULL DEFAULT 0",
+		"energy_kwh": "REAL NOT NULL DEFAULT 0",
+		"power_at":   "DATETIME",
+	} {
+		if err := ensureColumn(db, "device_state", col, ddl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SavePowerReading stores a raw reading and updates the live values of the
+// device state.
+func SavePowerReading(dbx *sql.DB, consoleID int64, watts, voltage, current, energyKWh float64) error {
+	tx, err := dbx.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	if _, err := tx.Exec(`INSERT INTO power_readings(console_id, ts, watts, voltage, current, energy_kwh) VALUES(?,?,?,?,?,?)`,
+		consoleID, now, watts, voltage, current, energyKWh); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO device_state(console_id, last_seen, online, watts, voltage, energy_kwh, power_at) VALUES(?,?,1,?,?,?,?)
+		ON CONFLICT(console_id) DO UPDATE SET last_seen=excluded.last_seen, online=1, watts=excluded.watts,
+		voltage=excluded.voltage, energy_kwh=excluded.energy_kwh, power_at=excluded.power_at`,
+		consoleID, now, watts, voltage, energyKWh, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DownsamplePower folds raw readings older than before into hourly
+// aggregates and deletes them, keeping the readings table small.
+func DownsamplePower(dbx *sql.DB, before time.Time) (int, error) {
+	tx, err := dbx.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	type key struct {
+		console int64
+		hour    time.Time
+	}
+	type agg struct {
+		sum, max, voltage, energy float64
+		n                         int
+	}
+	rows, err := tx.Query(`SELECT console_id, ts, watts, voltage, energy_kwh FROM power_readings WHERE ts < ? ORDER BY ts`, before)
+	if err != nil {
+		return 0, err
+	}
+	buckets := make(map[key]*agg)
+	var order []key
+	count := 0
+	for rows.Next() {
+		var id int64
+		var ts time.Time
+		var w, v, e float64
+		if err := rows.Scan(&id, &ts, &w, &v, &e); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		k := key{id, ts.Truncate(time.Hour)}
+		b, ok := buckets[k]
+		if !ok {
+			b = &agg{}
+			buckets[k] = b
+			order = append(order, k)
+		}
+		b.sum += w
+		b.n++
+		if w > b.max {
+			b.max = w
+		}
+		if v > 0 {
+			b.voltage = v
+		}
+		if e > 0 {
+			b.energy = e
+		}
+		count++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, k := range order {
+		b := buckets[k]
+		// merge with an hour aggregated by an earlier pass (weighted average)
+		if _, err := tx.Exec(`INSERT INTO power_hourly(console_id, hour, avg_watts, max_watts, voltage, energy_kwh, samples) VALUES(?,?,?,?,?,?,?)
+			ON CONFLICT(console_id, hour) DO UPDATE SET
+			avg_watts=(power_hourly.avg_watts*power_hourly.samples + excluded.avg_watts*excluded.samples)/(power_hourly.samples+excluded.samples),
+			max_watts=MAX(power_hourly.max_watts, excluded.max_watts),
+			voltage=CASE WHEN excluded.voltage>0 THEN excluded.voltage ELSE power_hourly.voltage END,
+			energy_kwh=CASE WHEN excluded.energy_kwh>0 THEN excluded.energy_kwh ELSE power_hourly.energy_kwh END,
+			samples=power_hourly.samples+excluded.samples`,
+			k.console, k.hour, b.sum/float64(b.n), b.max, b.voltage, b.energy, b.n); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM power_readings WHERE ts < ?`, before); err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+// PowerHistory returns the power history of a console since the given time:
+// hourly aggregates for downsampled periods followed by raw readings.
+func PowerHistory(dbx *sql.DB, consoleID int64, since time.Time) ([]PowerPoint, error) {
+	var points []PowerPoint
+	rows, err := dbx.Query(`SELECT hour, avg_watts, max_watts, voltage, energy_kwh, samples FROM power_hourly
+		WHERE console_id=? AND hour >= ? ORDER BY hour`, consoleID, since.Truncate(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		p := PowerPoint{Hourly: true}
+		if err := rows.Scan(&p.Time, &p.Watts, &p.MaxWatts, &p.Voltage, &p.EnergyKWh, &p.Samples); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows, err = dbx.Query(`SELECT ts, watts, voltage, energy_kwh FROM power_readings
+		WHERE console_id=? AND ts >= ? ORDER BY ts`, consoleID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		p := PowerPoint{Samples: 1}
+		if err := rows.Scan(&p.Time, &p.Watts, &p.Voltage, &p.EnergyKWh); err != nil {
+			return nil, err
+		}
+		p.MaxWatts = p.Watts
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
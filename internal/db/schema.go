@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"time"
 )
 
@@ -14,9 +15,11 @@ import (
 //
 //	ID: primary key
 //	Name: human readable name (PS1, PS2, etc.)
-//	Status: IDLE or RUNNING
+//	Status: IDLE, RUNNING, OVERTIME (paid time over, grace period running)
+//	or STOPPING (session over, safe power-down in progress)
 //	EndTime: when the current rental ends (valid if RUNNING)
 //	PricePerHour: pricing in local currency per hour
+//	ConsoleType: selects the shutdown profile (e.g. PS5), may be empty
 //
 // The zero value of EndTime is treated as no active session.
 type Console struct {
@@ -25,6 +28,7 @@ type Console struct {
 	Status       string    `json:"status"`
 	EndTime      time.Time `json:"end_time"`
 	PricePerHour int       `json:"price_per_hour"`
+	ConsoleType  string    `json:"console_type"`
 }
 
 // Transaction records a rental usage window for a console.
@@ -38,6 +42,8 @@ type Transaction struct {
 	TotalPrice  int       `json:"total_price"`
 	// PricePerHourSnapshot is the hourly price used for this (current) transaction calculation.
 	PricePerHourSnapshot int `json:"price_per_hour"`
+	// OvertimeMin is the part of DurationMin billed as grace-period overtime.
+	OvertimeMin int `json:"overtime_minutes"`
 }
 
 // Init creates tables if they do not exist and seeds initial consoles.
@@ -117,7 +123,42 @@ func Init(db *sql.DB, consoleCount int, pricePerHour int) error {
 	if colCount == 0 {
 		_, _ = db.Exec(`ALTER TABLE transactions ADD COLUMN price_per_hour_snapshot INTEGER`)
 	}
-	return nil
+	colCount = 0
+	_ = db.QueryRow(`SELECT COUNT(1) FROM pragma_table_info('transactions') WHERE name='overtime_minutes'`).Scan(&colCount)
+	if colCount == 0 {
+		_, _ = db.Exec(`ALTER TABLE transactions ADD COLUMN overtime_minutes INTEGER NOT NULL DEFAULT 0`)
+	}
+	if err := initDevices(db); err != nil {
+		return err
+	}
+	if err := initOutputs(db); err != nil {
+		return err
+	}
+	if err := initShutdown(db); err != nil {
+		return err
+	}
+	if err := initIR(db); err != nil {
+		return err
+	}
+	if err := initDeviceState(db); err != nil {
+		return err
+	}
+	if err := initPower(db); err != nil {
+		return err
+	}
+	if err := initAlerts(db); err != nil {
+		return err
+	}
+	if err := initMQTTUsers(db); err != nil {
+		return err
+	}
+	if err := initCommandQueue(db); err != nil {
+		return err
+	}
+	if err := initDeviceCapabilities(db); err != nil {
+		return err
+	}
+	return initDiagnostics(db)
 }
 
 // ----- Users & Auth -----
@@ -188,7 +229,7 @@ func CountUsers(dbx *sql.DB) (int, error) {
 
 // GetConsoles returns all consoles.
 func GetConsoles(db *sql.DB) ([]Console, error) {
-	rows, err := db.Query(`SELECT id,name,status,end_time,price_per_hour FROM consoles ORDER BY id`)
+	rows, err := db.Query(`SELECT id,name,status,end_time,price_per_hour,console_type FROM consoles ORDER BY id`)
 	if err != nil {
 		return nil, err
 	}
@@ -197,7 +238,7 @@ func GetConsoles(db *sql.DB) ([]Console, error) {
 	for rows.Next() {
 		var c Console
 		var end sql.NullTime
-		if err := rows.Scan(&c.ID, &c.Name, &c.Status, &end, &c.PricePerHour); err != nil {
+		if err := rows.Scan(&c.ID, &c.Name, &c.Status, &end, &c.PricePerHour, &c.ConsoleType); err != nil {
 			return nil, err
 		}
 		if end.Valid {
@@ -208,6 +249,13 @@ func GetConsoles(db *sql.DB) ([]Console, error) {
 	return res, rows.Err()
 }
 
+// GetConsoleStatus returns the status of a console.
+func GetConsoleStatus(db *sql.DB, consoleID int64) (string, error) {
+	var status string
+	err := db.QueryRow(`SELECT status FROM consoles WHERE id = ?`, consoleID).Scan(&status)
+	return status, err
+}
+
 // StartRental sets a console to RUNNING and inserts a transaction skeleton.
 func StartRental(db *sql.DB, consoleID int64, durationMin int) error {
 	if durationMin <= 0 {
@@ -218,9 +266,12 @@ func StartRental(db *sql.DB, consoleID int64, durationMin int) error {
 		if err := tx.QueryRow(`SELECT status FROM consoles WHERE id=?`, consoleID).Scan(&status); err != nil {
 			return err
 		}
-		if status == "RUNNING" {
+		if status == "RUNNING" || status == "OVERTIME" {
 			return errors.New("console already running")
 		}
+		if status == StatusStopping {
+			return errors.New("console is shutting down")
+		}
 		end := time.Now().Add(time.Duration(durationMin) * time.Minute)
 		if _, err := tx.Exec(`UPDATE consoles SET status='RUNNING', end_time=? WHERE id=?`, end, consoleID); err != nil {
 			return err
@@ -249,11 +300,15 @@ func ExtendRental(db *sql.DB, consoleID int64, addMinutes int) error {
 		if err := tx.QueryRow(`SELECT status,end_time FROM consoles WHERE id=?`, consoleID).Scan(&status, &end); err != nil {
 			return err
 		}
-		if status != "RUNNING" {
+		if status != "RUNNING" && status != "OVERTIME" {
 			return errors.New("console not running")
 		}
 		newEnd := end.Add(time.Duration(addMinutes) * time.Minute)
-		if _, err := tx.Exec(`UPDATE consoles SET end_time=? WHERE id=?`, newEnd, consoleID); err != nil {
+		// extending an overtime session covers the overtime already used
+		if status == "OVERTIME" && newEnd.After(time.Now()) {
+			status = "RUNNING"
+		}
+		if _, err := tx.Exec(`UPDATE consoles SET status=?, end_time=? WHERE id=?`, status, newEnd, consoleID); err != nil {
 			return err
 		}
 		// Update last transaction for this console
@@ -277,16 +332,23 @@ func ExtendRental(db *sql.DB, consoleID int64, addMinutes int) error {
 	})
 }
 
-// StopRental stops an active rental.
+// StopRental stops an active rental. Stopping an OVERTIME console bills the
+// overtime minutes (rounded up) onto its latest transaction.
 func StopRental(db *sql.DB, consoleID int64) error {
 	return withTx(db, func(tx *sql.Tx) error {
 		var status string
-		if err := tx.QueryRow(`SELECT status FROM consoles WHERE id=?`, consoleID).Scan(&status); err != nil {
+		var end sql.NullTime
+		if err := tx.QueryRow(`SELECT status,end_time FROM consoles WHERE id=?`, consoleID).Scan(&status, &end); err != nil {
 			return err
 		}
-		if status != "RUNNING" {
+		if status != "RUNNING" && status != "OVERTIME" {
 			return errors.New("console not running")
 		}
+		if status == "OVERTIME" && end.Valid {
+			if err := billOvertime(tx, consoleID, time.Since(end.Time)); err != nil {
+				return err
+			}
+		}
 		if _, err := tx.Exec(`UPDATE consoles SET status='IDLE', end_time=NULL WHERE id=?`, consoleID); err != nil {
 			return err
 		}
@@ -294,11 +356,32 @@ func StopRental(db *sql.DB, consoleID int64) error {
 	})
 }
 
+// billOvertime adds the overtime (rounded up to whole minutes) to the latest
+// transaction of a console, priced at the transaction's snapshot rate.
+func billOvertime(tx *sql.Tx, consoleID int64, over time.Duration) error {
+	minutes := int(math.Ceil(over.Minutes()))
+	if minutes <= 0 {
+		return nil
+	}
+	row := tx.QueryRow(`SELECT id, duration_minutes, COALESCE(price_per_hour_snapshot,0) FROM transactions WHERE console_id=? ORDER BY id DESC LIMIT 1`, consoleID)
+	var tid int64
+	var duration, pricePerHour int
+	if err := row.Scan(&tid, &duration, &pricePerHour); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	newDuration := duration + minutes
+	_, err := tx.Exec(`UPDATE transactions SET end_time=?, duration_minutes=?, total_price=?, overtime_minutes=overtime_minutes+? WHERE id=?`, time.Now(), newDuration, calcPrice(pricePerHour, newDuration), minutes, tid)
+	return err
+}
+
 // LastTransaction returns the most recent transaction for a console.
 func LastTransaction(db *sql.DB, consoleID int64) (Transaction, bool, error) {
-	row := db.QueryRow(`SELECT id, console_id, start_time, end_time, duration_minutes, total_price, COALESCE(price_per_hour_snapshot,0) FROM transactions WHERE console_id=? ORDER BY id DESC LIMIT 1`, consoleID)
+	row := db.QueryRow(`SELECT id, console_id, start_time, end_time, duration_minutes, total_price, COALESCE(price_per_hour_snapshot,0), overtime_minutes FROM transactions WHERE console_id=? ORDER BY id DESC LIMIT 1`, consoleID)
 	var t Transaction
-	err := row.Scan(&t.ID, &t.ConsoleID, &t.StartTime, &t.EndTime, &t.DurationMin, &t.TotalPrice, &t.PricePerHourSnapshot)
+	err := row.Scan(&t.ID, &t.ConsoleID, &t.StartTime, &t.EndTime, &t.DurationMin, &t.TotalPrice, &t.PricePerHourSnapshot, &t.OvertimeMin)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Transaction{}, false, nil
@@ -330,6 +413,20 @@ func DueSoon(db *sql.DB, threshold time.Duration) ([]Console, error) {
 	return res, rows.Err()
 }
 
+// ensureColumn adds a column to an existing table when missing (SQLite has
+// no ADD COLUMN IF NOT EXISTS).
+func ensureColumn(db *sql.DB, table, column, ddl string) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(1) FROM pragma_table_info(?) WHERE name=?`, table, column).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, ddl))
+	return err
+}
+
 func calcPrice(pricePerHour int, durationMin int) int {
 	// price is proportional to minutes (ceil to next minute already done by integer minutes)
 	return int(float64(pricePerHour) * (float64(durationMin) / 60.0))
@@ -403,12 +500,17 @@ func GetSetting(dbx *sql.DB, key string) (string, bool, error) {
 	return v, true, nil
 }
 
-// MQTTConfig persisted config.
+// MQTTConfig persisted config. The TLS fields hold PEM text and apply to
+// ssl:// and wss:// brokers; ServerName overrides the verified host name.
 type MQTTConfig struct {
-	Broker   string `json:"broker"`
-	Prefix   string `json:"prefix"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Broker     string `json:"broker"`
+	Prefix     string `json:"prefix"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	CACert     string `json:"ca_cert,omitempty"`
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
 }
 
 const mqttConfigKey = "mqtt_config"
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ShutdownProfile describes how consoles of one type are powered down
+// safely after a session ends instead of having their mains cut at once.
+//
+// Fields:
+//
+//	ConsoleType: matches consoles.console_type (e.g. PS5)
+//	WarnSec: warning phase; the device gets a WARN command this long before
+//	the soft shutdown (0 skips the phase)
+//	SoftCommand: device command that puts the console to standby, e.g. a
+//	CEC_STANDBY the board sends over HDMI-CEC (empty skips the phase)
+//	DelaySec: time the console gets to shut down before the relay is cut
+type ShutdownProfile struct {
+	ConsoleType string `json:"console_type"`
+	WarnSec     int    `json:"warn_sec"`
+	SoftCommand string `json:"soft_command"`
+	DelaySec    int    `json:"delay_sec"`
+}
+
+// Shutdown phases; a shutdown runs WARN -> SOFT -> OFF, each phase
+// starting at DueAt.
+const (
+	ShutdownWarn = "WARN"
+	ShutdownSoft = "SOFT"
+	ShutdownOff  = "OFF"
+)
+
+// Shutdown is a power-down in progress; its console is STOPPING. The
+// profile is copied so edits do not affect running shutdowns.
+type Shutdown struct {
+	ConsoleID   int64     `json:"console_id"`
+	Phase       string    `json:"phase"`
+	DueAt       time.Time `json:"due_at"`
+	StartedAt   time.Time `json:"started_at"`
+	WarnSec     int       `json:"warn_sec"`
+	SoftCommand string    `json:"soft_command"`
+	DelaySec    int       `json:"delay_sec"`
+}
+
+// StatusStopping is the console status during a safe power-down.
+const StatusStopping = "STOPPING"
+
+// initShutdown creates the console type column and the shutdown tables.
+func initShutdown(db *sql.DB) error {
+	if err := ensureColumn(db, "consoles", "console_type", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS shutdown_profiles (
+		console_type TEXT PRIMARY KEY,
+		warn_sec INTEGER NOT NULL DEFAULT 0,
+		soft_command TEXT NOT NULL DEFAULT '',
+		delay_sec INTEGER NOT NULL DEFAULT 0
+	);`); err != nil {
+		return err
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS shutdowns (
+		console_id INTEGER PRIMARY KEY,
+		phase TEXT NOT NULL,
+		due_at DATETIME NOT NULL,
+		started_at DATETIME NOT NULL,
+		warn_sec INTEGER NOT NULL DEFAULT 0,
+		soft_command TEXT NOT NULL DEFAULT '',
+		delay_sec INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(console_id) REFERENCES consoles(id)
+	);`)
+	return err
+}
+
+// SetConsoleType assigns the type that selects a console's shutdown profile.
+func SetConsoleType(dbx *sql.DB, consoleID int64, consoleType string) error {
+	res, err := dbx.Exec(`UPDATE consoles SET console_type=? WHERE id=?`, strings.TrimSpace(consoleType), consoleID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("console not found")
+	}
+	return nil
+}
+
+// ListShutdownProfiles returns the profiles ordered by console type.
+func ListShutdownProfiles(dbx *sql.DB) ([]ShutdownProfile, error) {
+	rows, err := dbx.Query(`SELECT console_type, warn_sec, soft_command, delay_sec FROM shutdown_profiles ORDER BY console_type`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []ShutdownProfile
+	for rows.Next() {
+		var p ShutdownProfile
+		if err := rows.Scan(&p.ConsoleType, &p.WarnSec, &p.SoftCommand, &p.DelaySec); err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+// SaveShutdownProfile creates or replaces the profile of a console type.
+func SaveShutdownProfile(dbx *sql.DB, p ShutdownProfile) error {
+	p.ConsoleType = strings.TrimSpace(p.ConsoleType)
+	if p.ConsoleType == "" {
+		return errors.New("console_type required")
+	}
+	if p.WarnSec < 0 || p.DelaySec < 0 {
+		return errors.New("warn_sec and delay_sec must not be negative")
+	}
+	_, err := dbx.Exec(`INSERT INTO shutdown_profiles(console_type, warn_sec, soft_command, delay_sec) VALUES(?,?,?,?)
+		ON CONFLICT(console_type) DO UPDATE SET warn_sec=excluded.warn_sec, soft_command=excluded.soft_command, delay_sec=excluded.delay_sec`,
+		p.ConsoleType, p.WarnSec, strings.TrimSpace(p.SoftCommand), p.DelaySec)
+	return err
+}
+
+// DeleteShutdownProfile removes a profile; its consoles are cut off at once
+// again.
+func DeleteShutdownProfile(dbx *sql.DB, consoleType string) error {
+	_, err := dbx.Exec(`DELETE FROM shutdown_profiles WHERE console_type=?`, consoleType)
+	return err
+}
+
+// BeginShutdown moves a console whose session just stopped into STOPPING
+// when its type has a shutdown profile. It reports false (and changes
+// nothing) for consoles without a profile, which should be switched off
+// directly.
+func BeginShutdown(dbx *sql.DB, consoleID int64) (bool, error) {
+	started := false
+	err := withTx(dbx, func(tx *sql.Tx) error {
+		var p ShutdownProfile
+		err := tx.QueryRow(`SELECT p.console_type, p.warn_sec, p.soft_command, p.delay_sec FROM consoles c
+			JOIN shutdown_profiles p ON p.console_type=c.console_type WHERE c.id=? AND c.status='IDLE'`, consoleID).
+			Scan(&p.ConsoleType, &p.WarnSec, &p.SoftCommand, &p.DelaySec)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		phase := ShutdownWarn
+		if p.WarnSec == 0 {
+			phase = ShutdownSoft
+		}
+		now := time.Now()
+		if _, err := tx.Exec(`UPDATE consoles SET status=? WHERE id=?`, StatusStopping, consoleID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO shutdowns(console_id, phase, due_at, started_at, warn_sec, soft_command, delay_sec) VALUES(?,?,?,?,?,?,?)`,
+			consoleID, phase, now, now, p.WarnSec, p.SoftCommand, p.DelaySec); err != nil {
+			return err
+		}
+		started = true
+		return nil
+	})
+	return started, err
+}
+
+// ListShutdowns returns the power-downs in progress.
+func ListShutdowns(dbx *sql.DB) ([]Shutdown, error) {
+	rows, err := dbx.Query(`SELECT console_id, phase, due_at, started_at, warn_sec, soft_command, delay_sec FROM shutdowns ORDER BY due_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Shutdown
+	for rows.Next() {
+		var s Shutdown
+		if err := rows.Scan(&s.ConsoleID, &s.Phase, &s.DueAt, &s.StartedAt, &s.WarnSec, &s.SoftCommand, &s.DelaySec); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// AdvanceShutdown moves a shutdown to its next phase.
+func AdvanceShutdown(dbx *sql.DB, consoleID int64, phase string, dueAt time.Time) error {
+	_, err := dbx.Exec(`UPDATE shutdowns SET phase=?, due_at=? WHERE console_id=?`, phase, dueAt, consoleID)
+	return err
+}
+
+// SkipShutdown makes a running shutdown cut the relay right away.
+func SkipShutdown(dbx *sql.DB, consoleID int64) (bool, error) {
+	res, err := dbx.Exec(`UPDATE shutdowns SET phase=?, due_at=? WHERE console_id=?`, ShutdownOff, time.Now(), consoleID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// FinishShutdown ends a power-down: the console becomes IDLE.
+func FinishShutdown(dbx *sql.DB, consoleID int64) error {
+	return withTx(dbx, func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM shutdowns WHERE console_id=?`, consoleID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE consoles SET status='IDLE' WHERE id=? AND status=?`, consoleID, StatusStopping)
+		return err
+	})
+}
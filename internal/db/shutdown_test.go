@@ -0,0 +1,82 @@
+package db
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// consoleStatus reads the status column of a console.
+func consoleStatus(t *testing.T, dbx *sql.DB, id int64) string {
+	t.Helper()
+	var status string
+	require.NoError(t, dbx.QueryRow(`SELECT status FROM consoles WHERE id=?`, id).Scan(&status))
+	return status
+}
+
+func TestShutdown_Lifecycle(t *testing.T) {
+	dbx := openTestDB(t)
+	require.NoError(t, SaveShutdownProfile(dbx, ShutdownProfile{ConsoleType: "PS5", WarnSec: 60, SoftCommand: "CEC_STANDBY", DelaySec: 30}))
+	require.NoError(t, SetConsoleType(dbx, 1, "PS5"))
+
+	started, err := BeginShutdown(dbx, 1)
+	require.NoError(t, err)
+	assert.True(t, started)
+	assert.Equal(t, StatusStopping, consoleStatus(t, dbx, 1))
+	list, err := ListShutdowns(dbx)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, ShutdownWarn, list[0].Phase)
+	assert.Equal(t, "CEC_STANDBY", list[0].SoftCommand)
+	assert.WithinDuration(t, time.Now(), list[0].DueAt, time.Second)
+
+	// a console already powering down is not started again
+	started, err = BeginShutdown(dbx, 1)
+	require.NoError(t, err)
+	assert.False(t, started)
+
+	due := time.Now().Add(time.Minute)
+	require.NoError(t, AdvanceShutdown(dbx, 1, ShutdownSoft, due))
+	list, err = ListShutdowns(dbx)
+	require.NoError(t, err)
+	assert.Equal(t, ShutdownSoft, list[0].Phase)
+	assert.WithinDuration(t, due, list[0].DueAt, time.Millisecond)
+
+	require.NoError(t, FinishShutdown(dbx, 1))
+	assert.Equal(t, "IDLE", consoleStatus(t, dbx, 1))
+	list, err = ListShutdowns(dbx)
+	require.NoError(t, err)
+	assert.Empty(t, list)
+}
+
+func TestBeginShutdown_Skipped(t *testing.T) {
+	dbx := openTestDB(t)
+	require.NoError(t, SaveShutdownProfile(dbx, ShutdownProfile{ConsoleType: "PS4", DelaySec: 10}))
+
+	// no profile for the console type: the relay is cut directly
+	started, err := BeginShutdown(dbx, 1)
+	require.NoError(t, err)
+	assert.False(t, started)
+	assert.Equal(t, "IDLE", consoleStatus(t, dbx, 1))
+
+	// still running: nothing to power down yet
+	require.NoError(t, SetConsoleType(dbx, 2, "PS4"))
+	_, err = dbx.Exec(`UPDATE consoles SET status='RUNNING' WHERE id=2`)
+	require.NoError(t, err)
+	started, err = BeginShutdown(dbx, 2)
+	require.NoError(t, err)
+	assert.False(t, started)
+
+	// without a warning the shutdown starts at the soft phase
+	require.NoError(t, SetConsoleType(dbx, 3, "PS4"))
+	started, err = BeginShutdown(dbx, 3)
+	require.NoError(t, err)
+	assert.True(t, started)
+	list, err := ListShutdowns(dbx)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, ShutdownSoft, list[0].Phase)
+}
@@ -15,8 +15,10 @@ type Console struct {
 
 // ConsoleStatus constants
 const (
-	StatusIdle    = "IDLE"
-	StatusRunning = "RUNNING"
+	StatusIdle     = "IDLE"
+	StatusRunning  = "RUNNING"
+	StatusOvertime = "OVERTIME"
+	StatusStopping = "STOPPING"
 )
 
 // IsRunning returns true if the console is currently running
@@ -24,6 +26,30 @@ func (c *Console) IsRunning() bool {
 	return c.Status == StatusRunning
 }
 
+// IsOvertime returns true if the paid time is over but power is kept on
+// during the grace period
+func (c *Console) IsOvertime() bool {
+	return c.Status == StatusOvertime
+}
+
+// IsStopping returns true while the console is being powered down safely
+// after its session ended
+func (c *Console) IsStopping() bool {
+	return c.Status == StatusStopping
+}
+
+// IsActive returns true if the console has a session in progress, either
+// within its paid time or in overtime
+func (c *Console) IsActive() bool {
+	return c.IsRunning() || c.IsOvertime()
+}
+
+// PowerRequired reports whether a console in the given status needs its
+// relay on: a session runs, is in overtime or is being powered down safely
+func PowerRequired(status string) bool {
+	return status == StatusRunning || status == StatusOvertime || status == StatusStopping
+}
+
 // IsExpired returns true if the console rental has expired
 func (c *Console) IsExpired() bool {
 	return c.IsRunning() && !c.EndTime.IsZero() && time.Now().After(c.EndTime)
@@ -47,10 +73,40 @@ func (c *Console) StartRental(durationMinutes int) {
 	c.EndTime = time.Now().Add(time.Duration(durationMinutes) * time.Minute)
 }
 
-// ExtendRental extends the current rental by the specified minutes
-func (c *Console) ExtendRental(additionalMinutes int) {
+// OvertimeDuration returns how long the console has been used past its paid time
+func (c *Console) OvertimeDuration() time.Duration {
+	if !c.IsOvertime() || c.EndTime.IsZero() {
+		return 0
+	}
+	over := time.Since(c.EndTime)
+	if over < 0 {
+		return 0
+	}
+	return over
+}
+
+// GraceExpired returns true if an overtime console has exceeded the grace period
+func (c *Console) GraceExpired(grace time.Duration) bool {
+	return c.IsOvertime() && !c.EndTime.IsZero() && time.Now().After(c.EndTime.Add(grace))
+}
+
+// MarkOvertime flags an expired session as overtime, keeping its end time
+// so the overtime minutes can be billed when it stops
+func (c *Console) MarkOvertime() {
 	if c.IsRunning() {
+		c.Status = StatusOvertime
+	}
+}
+
+// ExtendRental extends the current rental by the specified minutes.
+// Extending an overtime session returns it to RUNNING once the new end
+// time is in the future.
+func (c *Console) ExtendRental(additionalMinutes int) {
+	if c.IsActive() {
 		c.EndTime = c.EndTime.Add(time.Duration(additionalMinutes) * time.Minute)
+		if c.IsOvertime() && c.EndTime.After(time.Now()) {
+			c.Status = StatusRunning
+		}
 	}
 }
 
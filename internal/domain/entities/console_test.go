@@ -183,6 +183,38 @@ func TestConsole_ExtendRental_NotRunning(t *testing.T) {
 	assert.Equal(t, originalEndTime, console.EndTime)
 }
 
+func TestConsole_ExtendRental_Overtime(t *testing.T) {
+	console := &Console{
+		Status:  StatusOvertime,
+		EndTime: time.Now().Add(-5 * time.Minute),
+	}
+
+	console.ExtendRental(30)
+
+	assert.Equal(t, StatusRunning, console.Status)
+	assert.True(t, console.EndTime.After(time.Now()))
+}
+
+func TestConsole_Overtime(t *testing.T) {
+	console := &Console{
+		Status:  StatusRunning,
+		EndTime: time.Now().Add(-3 * time.Minute),
+	}
+
+	assert.True(t, console.IsExpired())
+	assert.Equal(t, time.Duration(0), console.OvertimeDuration())
+
+	console.MarkOvertime()
+
+	assert.Equal(t, StatusOvertime, console.Status)
+	assert.True(t, console.IsActive())
+	assert.False(t, console.IsRunning())
+	assert.False(t, console.IsExpired())
+	assert.InDelta(t, (3 * time.Minute).Seconds(), console.OvertimeDuration().Seconds(), 1)
+	assert.False(t, console.GraceExpired(10*time.Minute))
+	assert.True(t, console.GraceExpired(time.Minute))
+}
+
 func TestConsole_StopRental(t *testing.T) {
 	console := &Console{
 		Status:  StatusRunning,
@@ -198,4 +230,12 @@ func TestConsole_StopRental(t *testing.T) {
 func TestConsole_StatusConstants(t *testing.T) {
 	assert.Equal(t, "IDLE", StatusIdle)
 	assert.Equal(t, "RUNNING", StatusRunning)
-}
\ No newline at end of file
+	assert.Equal(t, "OVERTIME", StatusOvertime)
+}
+func TestPowerRequired(t *testing.T) {
+	for status, want := range map[string]bool{
+		StatusIdle: false, StatusRunning: true, StatusOvertime: true, StatusStopping: true, "": false,
+	} {
+		assert.Equal(t, want, PowerRequired(status), status)
+	}
+}
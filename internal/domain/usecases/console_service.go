@@ -27,4 +27,9 @@ type ConsoleService interface {
 	
 	// CheckExpiredRentals checks and stops expired rental sessions
 	CheckExpiredRentals() ([]entities.Console, error)
+
+	// ProcessExpiredRentals moves expired sessions into OVERTIME while the
+	// grace period lasts and stops those whose grace period has run out.
+	// With a zero grace period it behaves like CheckExpiredRentals.
+	ProcessExpiredRentals(grace time.Duration) (overtime []entities.Console, stopped []entities.Console, err error)
 }
\ No newline at end of file
@@ -0,0 +1,273 @@
+package iot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery states of the last relay command sent to a console.
+const (
+	CommandPending = "PENDING"
+	CommandAcked   = "ACKED"
+	CommandDesync  = "DESYNC"
+)
+
+// CommandState describes the last ON/OFF command of a console and whether
+// the device confirmed it.
+type CommandState struct {
+	ID        string    `json:"id"`
+	Command   string    `json:"command"`
+	State     string    `json:"state"`
+	Attempts  int       `json:"attempts"`
+	IssuedAt  time.Time `json:"issued_at"`
+	AckedAt   time.Time `json:"acked_at,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// CorrelatedSender is implemented by transports that can carry a
+// correlation ID to the device, so the device can echo it in its ack.
+type CorrelatedSender interface {
+	SendWithID(consoleID int64, cmd, id string) error
+}
+
+// AckOptions configures acknowledgement tracking.
+type AckOptions struct {
+	Timeout  time.Duration // wait for an ack before retrying (default 5s)
+	Retries  int           // resends after the first attempt (default 3)
+	Backoff  time.Duration // delay before the first resend, doubled each time (default 1s)
+	OnChange func(consoleID int64, st CommandState)
+}
+
+// AckTracker correlates relay commands with the acks devices publish on
+// their status channel. Senders wrapped with Wrap resend unconfirmed
+// commands with exponential backoff and mark the console DESYNC when the
+// retries run out. Acks match either by correlation ID in the payload or,
+// for legacy firmware, by a reported relay state equal to the command.
+type AckTracker struct {
+	opt     AckOptions
+	mu      sync.Mutex
+	states  map[int64]*pendingCommand
+	testing map[int64]bool // consoles with a relay self-test running
+}
+
+type pendingCommand struct {
+	state      CommandState
+	done       chan struct{} // closed when acked, desynced or superseded
+	superseded bool          // a newer command replaced this one
+}
+
+// NewAckTracker creates a tracker with defaults applied.
+func NewAckTracker(opt AckOptions) *AckTracker {
+	if opt.Timeout <= 0 {
+		opt.Timeout = 5 * time.Second
+	}
+	if opt.Retries < 0 {
+		opt.Retries = 0
+	}
+	if opt.Backoff <= 0 {
+		opt.Backoff = time.Second
+	}
+	return &AckTracker{opt: opt, states: make(map[int64]*pendingCommand), testing: make(map[int64]bool)}
+}
+
+// BeginSelfTest marks a relay self-test (see PulseRelay) of a console as
+// running until end is called; ok is false while another one runs. The
+// relay of a console under test is switched on purpose, so reconciliation
+// and tamper checks skip it (see SelfTesting).
+func (t *AckTracker) BeginSelfTest(consoleID int64) (end func(), ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.testing[consoleID] {
+		return nil, false
+	}
+	t.testing[consoleID] = true
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.testing, consoleID)
+	}, true
+}
+
+// SelfTesting reports whether a relay self-test of the console is running.
+func (t *AckTracker) SelfTesting(consoleID int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.testing[consoleID]
+}
+
+// Wrap returns a CommandSender that tracks ON/OFF commands sent via inner.
+func (t *AckTracker) Wrap(inner CommandSender) CommandSender {
+	return &ackSender{inner: inner, tracker: t}
+}
+
+type ackSender struct {
+	inner   CommandSender
+	tracker *AckTracker
+}
+
+// Send delivers the first attempt synchronously and returns its error;
+// confirmation and retries happen in the background.
+func (s *ackSender) Send(consoleID int64, cmd string) error {
+	if !isRelayCommand(cmd) {
+		return s.inner.Send(consoleID, cmd)
+	}
+	return s.tracker.send(s.inner, consoleID, cmd)
+}
+
+// State returns the last relay command state of a console.
+func (t *AckTracker) State(consoleID int64) (CommandState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.states[consoleID]
+	if !ok {
+		return CommandState{}, false
+	}
+	return p.state, true
+}
+
+// Wait blocks until the last relay command of a console is acked, given up
+// (DESYNC) or superseded, or timeout passes, and returns its state. ok is
+// false when no command was sent to the console.
+func (t *AckTracker) Wait(consoleID int64, timeout time.Duration) (CommandState, bool) {
+	t.mu.Lock()
+	p, ok := t.states[consoleID]
+	t.mu.Unlock()
+	if !ok {
+		return CommandState{}, false
+	}
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return p.state, true
+}
+
+// Observe feeds a status message of a console; a matching message acks the
+// pending (or desynced) command.
+func (t *AckTracker) Observe(consoleID int64, payload string) {
+	t.mu.Lock()
+	p, ok := t.states[consoleID]
+	if !ok || p.state.State == CommandAcked {
+		t.mu.Unlock()
+		return
+	}
+	if !strings.Contains(payload, p.state.ID) && ParseStatus(payload).Relay != p.state.Command {
+		t.mu.Unlock()
+		return
+	}
+	if p.state.State == CommandPending {
+		close(p.done)
+	}
+	p.state.State = CommandAcked
+	p.state.AckedAt = time.Now()
+	p.state.LastError = ""
+	st := p.state
+	t.mu.Unlock()
+	t.notify(consoleID, st)
+}
+
+func (t *AckTracker) send(inner CommandSender, consoleID int64, cmd string) error {
+	p := &pendingCommand{
+		state: CommandState{ID: newCorrelationID(), Command: cmd, State: CommandPending, IssuedAt: time.Now()},
+		done:  make(chan struct{}),
+	}
+	t.mu.Lock()
+	if prev, ok := t.states[consoleID]; ok {
+		if prev.state.State == CommandPending {
+			close(prev.done)
+		}
+		prev.superseded = true
+	}
+	t.states[consoleID] = p
+	t.mu.Unlock()
+
+	st, live, err := t.deliver(inner, consoleID, p)
+	if live {
+		t.notify(consoleID, st)
+	}
+	go t.await(inner, consoleID, p)
+	return err
+}
+
+// deliver sends one attempt and records its outcome. It returns a snapshot
+// of the state and live=false, without sending, once p was superseded.
+func (t *AckTracker) deliver(inner CommandSender, consoleID int64, p *pendingCommand) (st CommandState, live bool, err error) {
+	t.mu.Lock()
+	if p.superseded {
+		t.mu.Unlock()
+		return CommandState{}, false, nil
+	}
+	t.mu.Unlock()
+	if cs, ok := inner.(CorrelatedSender); ok {
+		err = cs.SendWithID(consoleID, p.state.Command, p.state.ID)
+	} else {
+		err = inner.Send(consoleID, p.state.Command)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p.state.Attempts++
+	p.state.LastError = ""
+	if err != nil {
+		p.state.LastError = err.Error()
+	}
+	return p.state, !p.superseded, err
+}
+
+// await waits for the ack, resending with exponential backoff, and marks
+// the console DESYNC once the retries are exhausted.
+func (t *AckTracker) await(inner CommandSender, consoleID int64, p *pendingCommand) {
+	delay := t.opt.Backoff
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-p.done:
+			return
+		case <-time.After(t.opt.Timeout):
+		}
+		if attempt >= t.opt.Retries {
+			t.mu.Lock()
+			if p.superseded || p.state.State != CommandPending {
+				t.mu.Unlock()
+				return
+			}
+			p.state.State = CommandDesync
+			close(p.done)
+			st := p.state
+			t.mu.Unlock()
+			t.notify(consoleID, st)
+			return
+		}
+		select {
+		case <-p.done:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if _, live, _ := t.deliver(inner, consoleID, p); !live {
+			return
+		}
+	}
+}
+
+func (t *AckTracker) notify(consoleID int64, st CommandState) {
+	if t.opt.OnChange != nil {
+		t.opt.OnChange(consoleID, st)
+	}
+}
+
+// isRelayCommand reports whether cmd switches the relay and so expects an ack.
+func isRelayCommand(cmd string) bool {
+	return cmd == "ON" || cmd == "OFF"
+}
+
+func newCorrelationID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return hex.EncodeToString([]byte(time.Now().Format("150405.000")))
+	}
+	return hex.EncodeToString(b)
+}
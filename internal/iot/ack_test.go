@@ -0,0 +1,191 @@
+package iot
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingSender counts deliveries and remembers correlation IDs.
+type recordingSender struct {
+	mu    sync.Mutex
+	sends int
+	ids   []string
+}
+
+func (r *recordingSender) Send(consoleID int64, cmd string) error {
+	return r.SendWithID(consoleID, cmd, "")
+}
+
+func (r *recordingSender) SendWithID(consoleID int64, cmd, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sends++
+	r.ids = append(r.ids, id)
+	return nil
+}
+
+func (r *recordingSender) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sends
+}
+
+func (r *recordingSender) sentWithID(id string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, got := range r.ids {
+		if got == id {
+			n++
+		}
+	}
+	return n
+}
+
+func TestAckTracker_AckByRelayState(t *testing.T) {
+	tracker := NewAckTracker(AckOptions{Timeout: 50 * time.Millisecond, Retries: 2, Backoff: time.Millisecond})
+	inner := &recordingSender{}
+	sender := tracker.Wrap(inner)
+
+	assert.NoError(t, sender.Send(1, "ON"))
+	st, ok := tracker.State(1)
+	assert.True(t, ok)
+	assert.Equal(t, CommandPending, st.State)
+
+	tracker.Observe(1, "relay_off") // wrong state, ignored
+	st, _ = tracker.State(1)
+	assert.Equal(t, CommandPending, st.State)
+
+	tracker.Observe(1, "relay_on")
+	st, _ = tracker.State(1)
+	assert.Equal(t, CommandAcked, st.State)
+	assert.False(t, st.AckedAt.IsZero())
+
+	time.Sleep(120 * time.Millisecond)
+	assert.Equal(t, 1, inner.count())
+}
+
+func TestAckTracker_AckByCorrelationID(t *testing.T) {
+	tracker := NewAckTracker(AckOptions{Timeout: time.Second})
+	inner := &recordingSender{}
+
+	assert.NoError(t, tracker.Wrap(inner).Send(1, "OFF"))
+	st, _ := tracker.State(1)
+	assert.Equal(t, st.ID, inner.ids[0])
+
+	tracker.Observe(1, `{"ack":"`+st.ID+`"}`)
+	st, _ = tracker.State(1)
+	assert.Equal(t, CommandAcked, st.State)
+}
+
+func TestAckTracker_RetryThenDesync(t *testing.T) {
+	changes := make(chan CommandState, 10)
+	tracker := NewAckTracker(AckOptions{
+		Timeout:  10 * time.Millisecond,
+		Retries:  2,
+		Backoff:  time.Millisecond,
+		OnChange: func(_ int64, st CommandState) { changes <- st },
+	})
+	inner := &recordingSender{}
+
+	assert.NoError(t, tracker.Wrap(inner).Send(1, "ON"))
+
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case st := <-changes:
+			if st.State != CommandDesync {
+				continue
+			}
+			assert.Equal(t, 3, st.Attempts)
+			assert.Equal(t, 3, inner.count())
+
+			// a late matching report clears the desync
+			tracker.Observe(1, "ON")
+			st, _ = tracker.State(1)
+			assert.Equal(t, CommandAcked, st.State)
+			return
+		case <-deadline:
+			t.Fatal("console never marked DESYNC")
+		}
+	}
+}
+
+func TestAckTracker_SupersededCommandGoesQuiet(t *testing.T) {
+	var mu sync.Mutex
+	var changes []CommandState
+	tracker := NewAckTracker(AckOptions{
+		Timeout: 10 * time.Millisecond,
+		Retries: 2,
+		Backoff: time.Millisecond,
+		OnChange: func(_ int64, st CommandState) {
+			mu.Lock()
+			changes = append(changes, st)
+			mu.Unlock()
+		},
+	})
+	inner := &recordingSender{}
+	sender := tracker.Wrap(inner)
+
+	assert.NoError(t, sender.Send(1, "ON"))
+	first, _ := tracker.State(1)
+	time.Sleep(15 * time.Millisecond) // first command is now retrying
+	assert.NoError(t, sender.Send(1, "OFF"))
+	sentBefore := inner.sentWithID(first.ID)
+
+	st, _ := tracker.Wait(1, 2*time.Second)
+	assert.Equal(t, "OFF", st.Command)
+	assert.Equal(t, CommandDesync, st.State)
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Equal(t, sentBefore, inner.sentWithID(first.ID), "superseded command was resent")
+	mu.Lock()
+	defer mu.Unlock()
+	for _, c := range changes {
+		if c.ID == first.ID {
+			assert.Equal(t, CommandPending, c.State)
+		}
+	}
+}
+
+func TestAckTracker_NonRelayCommandsUntracked(t *testing.T) {
+	tracker := NewAckTracker(AckOptions{})
+	inner := &recordingSender{}
+
+	assert.NoError(t, tracker.Wrap(inner).Send(1, "WARN5"))
+	_, ok := tracker.State(1)
+	assert.False(t, ok)
+	assert.Equal(t, 1, inner.count())
+}
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		payload string
+		relay   string
+	}{
+		{"ON", RelayOn},
+		{"relay_off", RelayOff},
+		{" 1 ", RelayOn},
+		{`{"relay":"on"}`, RelayOn},
+		{`{"state":false}`, RelayOff},
+		{`{"power":1}`, RelayOn},
+		{"hello", ""},
+		{`{"rssi":-60}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.payload, func(t *testing.T) {
+			assert.Equal(t, tt.relay, ParseStatus(tt.payload).Relay)
+		})
+	}
+}
+
+func TestParseAvailability(t *testing.T) {
+	assert.True(t, ParseAvailability("online"))
+	assert.True(t, ParseAvailability("1"))
+	assert.False(t, ParseAvailability("offline"))
+	assert.False(t, ParseAvailability(" Offline\n"))
+	assert.False(t, ParseAvailability("0"))
+}
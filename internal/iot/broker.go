@@ -0,0 +1,205 @@
+package iot
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// BrokerOptions configures the embedded MQTT broker.
+type BrokerOptions struct {
+	// Addr is the TCP listen address, e.g. ":1883"; ":0" picks a free port.
+	Addr string
+	// Authenticate checks device credentials; nil allows every client.
+	Authenticate func(username, password string) bool
+	// Authorize decides which topics (and subscription filters) an
+	// authenticated client may use. nil limits every client to the topics
+	// of its own device in Devices (see Registry.DeviceTopicAllowed). The
+	// server's internal client may always use every topic. Ignored when
+	// Authenticate is nil.
+	Authorize func(username, topic string, write bool) bool
+	// Devices and Prefix resolve device topics for the default Authorize;
+	// a nil registry knows only legacy devices named by their console ID.
+	Devices *Registry
+	Prefix  string
+	// TLS makes the listener accept ssl:// clients only.
+	TLS *tls.Config
+}
+
+// Broker is an in-process MQTT broker so a single binary can serve the
+// dashboard and the relay devices. It also works as a local stand-in broker
+// in tests. The server's own MQTT client authenticates with generated
+// internal credentials (see Credentials), independent of Authenticate.
+type Broker struct {
+	server   *mochi.Server
+	listener *listeners.TCP
+	username string
+	password string
+	close    sync.Once
+	closeErr error
+	scheme   string
+}
+
+// NewBroker starts a broker listening on opt.Addr.
+func NewBroker(opt BrokerOptions) (*Broker, error) {
+	if opt.Addr == "" {
+		opt.Addr = ":1883"
+	}
+	b := &Broker{username: "heheswitch-internal", password: randomSecret(), scheme: "tcp"}
+	if opt.TLS != nil {
+		b.scheme = "ssl"
+	}
+	level := new(slog.LevelVar)
+	level.Set(slog.LevelWarn)
+	b.server = mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})),
+	})
+	if opt.Authorize == nil {
+		devices, prefix := opt.Devices, opt.Prefix
+		opt.Authorize = func(username, topic string, _ bool) bool {
+			return devices.DeviceTopicAllowed(username, prefix, topic)
+		}
+	}
+	if err := b.server.AddHook(&brokerAuthHook{broker: b, authenticate: opt.Authenticate, authorize: opt.Authorize}, nil); err != nil {
+		return nil, err
+	}
+	b.listener = listeners.NewTCP(listeners.Config{Type: listeners.TypeTCP, ID: "tcp", Address: opt.Addr, TLSConfig: opt.TLS})
+	if err := b.server.AddListener(b.listener); err != nil {
+		return nil, fmt.Errorf("embedded broker listen %s: %w", opt.Addr, err)
+	}
+	if err := b.server.Serve(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Addr returns the address the broker listens on.
+func (b *Broker) Addr() string {
+	return b.listener.Address()
+}
+
+// URL returns a tcp:// (ssl:// with TLS) URL for clients on this host.
+func (b *Broker) URL() string {
+	host, port, err := net.SplitHostPort(b.Addr())
+	if err != nil {
+		return b.scheme + "://" + b.Addr()
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return b.scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// Credentials returns the internal username and password used by the
+// server's own MQTT client.
+func (b *Broker) Credentials() (username, password string) {
+	return b.username, b.password
+}
+
+// Clients returns the number of connected clients.
+func (b *Broker) Clients() int {
+	return b.server.Clients.Len()
+}
+
+// Publish injects a message as if it was published by a client.
+func (b *Broker) Publish(topic string, payload []byte, retain bool, qos byte) error {
+	return b.server.Publish(topic, payload, retain, qos)
+}
+
+// Close stops the broker and disconnects its clients; later calls are no-ops.
+func (b *Broker) Close() error {
+	b.close.Do(func() { b.closeErr = b.server.Close() })
+	return b.closeErr
+}
+
+// brokerAuthHook authenticates clients against the internal credentials and
+// the Authenticate callback and restricts device clients to their topics,
+// so a device credential cannot switch other consoles.
+type brokerAuthHook struct {
+	mochi.HookBase
+	broker       *Broker
+	authenticate func(username, password string) bool
+	authorize    func(username, topic string, write bool) bool
+}
+
+func (h *brokerAuthHook) ID() string { return "heheswitch-auth" }
+
+func (h *brokerAuthHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{mochi.OnConnectAuthenticate, mochi.OnACLCheck}, []byte{b})
+}
+
+func (h *brokerAuthHook) OnConnectAuthenticate(cl *mochi.Client, pk packets.Packet) bool {
+	user, pass := string(pk.Connect.Username), string(pk.Connect.Password)
+	if user == h.broker.username && pass == h.broker.password {
+		return true
+	}
+	if h.authenticate == nil {
+		return true
+	}
+	return h.authenticate(user, pass)
+}
+
+func (h *brokerAuthHook) OnACLCheck(cl *mochi.Client, topic string, write bool) bool {
+	user := string(cl.Properties.Username)
+	if h.authenticate == nil || user == h.broker.username {
+		return true
+	}
+	return h.authorize(user, topic, write)
+}
+
+// DeviceTopicAllowed reports whether the device logged in as username may
+// use a topic or subscription filter. The username must be the ID of an
+// MQTT device in the registry (or a legacy numeric console ID), and the
+// topic must lie within that device's TopicFilters, so filters like
+// ps/+/cmd or # are refused and so are usernames like "ps" or "cmd".
+func (r *Registry) DeviceTopicAllowed(username, prefix, topic string) bool {
+	consoleID, ok := r.ConsoleFor(username)
+	if !ok {
+		return false
+	}
+	dev := r.Resolve(consoleID)
+	if dev.DeviceID != username || !dev.Uses(TransportMQTT) {
+		return false
+	}
+	for _, allowed := range dev.TopicFilters(prefix) {
+		if TopicCovered(topic, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// TopicCovered reports whether every topic matched by filter is also
+// matched by the filter allowed (MQTT + and # wildcards).
+func TopicCovered(filter, allowed string) bool {
+	f, a := strings.Split(filter, "/"), strings.Split(allowed, "/")
+	for i, level := range a {
+		if level == "#" {
+			return true
+		}
+		if i >= len(f) || f[i] == "#" || (level != "+" && f[i] != level) {
+			return false
+		}
+	}
+	return len(f) == len(a)
+}
+
+func randomSecret() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return newCorrelationID() + newCorrelationID()
+	}
+	return hex.EncodeToString(b)
+}
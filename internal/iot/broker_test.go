@@ -0,0 +1,193 @@
+package iot
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestBroker starts an embedded broker on a free port that accepts the
+// device credential dev/secret.
+func newTestBroker(t *testing.T) *Broker {
+	t.Helper()
+	b, err := NewBroker(BrokerOptions{
+		Addr:         "127.0.0.1:0",
+		Authenticate: func(u, p string) bool { return u == "dev" && p == "secret" },
+		// dev plays a tool like Home Assistant that may use every topic
+		Authorize: func(u, topic string, write bool) bool { return u == "dev" },
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = b.Close() })
+	return b
+}
+
+func connectDevice(t *testing.T, b *Broker, user, pass string) (mqtt.Client, error) {
+	t.Helper()
+	opts := mqtt.NewClientOptions().AddBroker(b.URL()).SetClientID("device-" + user).SetUsername(user).SetPassword(pass)
+	c := mqtt.NewClient(opts)
+	tok := c.Connect()
+	if !tok.WaitTimeout(5 * time.Second) {
+		t.Fatal("device connect timeout")
+	}
+	if tok.Error() == nil {
+		t.Cleanup(func() { c.Disconnect(0) })
+	}
+	return c, tok.Error()
+}
+
+func TestBroker_SenderRoundTrip(t *testing.T) {
+	b := newTestBroker(t)
+
+	status := make(chan string, 1)
+	user, pass := b.Credentials()
+	sender, err := NewMQTTSender(b.URL(), MQTTSenderOptions{
+		Prefix: "ps", QOS: 1, Username: user, Password: pass, CleanSession: true,
+		StatusCallback: func(id int64, payload string) {
+			if id == 1 {
+				status <- payload
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer sender.Close()
+
+	device, err := connectDevice(t, b, "dev", "secret")
+	require.NoError(t, err)
+	cmds := make(chan string, 1)
+	tok := device.Subscribe("ps/1/cmd", 1, func(_ mqtt.Client, m mqtt.Message) { cmds <- string(m.Payload()) })
+	tok.Wait()
+	require.NoError(t, tok.Error())
+
+	require.NoError(t, sender.Send(1, "ON"))
+	select {
+	case got := <-cmds:
+		assert.Equal(t, "ON", got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("device did not receive command")
+	}
+
+	device.Publish("ps/1/status", 1, false, "relay_on").Wait()
+	select {
+	case got := <-status:
+		assert.Equal(t, "relay_on", got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not receive status")
+	}
+	assert.GreaterOrEqual(t, b.Clients(), 2)
+}
+
+func TestBroker_RejectsBadCredentials(t *testing.T) {
+	b := newTestBroker(t)
+	_, err := connectDevice(t, b, "dev", "wrong")
+	assert.Error(t, err)
+}
+
+func TestBroker_DeviceACL(t *testing.T) {
+	b, err := NewBroker(BrokerOptions{
+		Addr:         "127.0.0.1:0",
+		Authenticate: func(u, p string) bool { return p == "secret" },
+		Prefix:       "ps",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = b.Close() })
+
+	own, err := connectDevice(t, b, "1", "secret")
+	require.NoError(t, err)
+	cmds := make(chan string, 2)
+	tok := own.Subscribe("ps/1/cmd", 1, func(_ mqtt.Client, m mqtt.Message) { cmds <- string(m.Payload()) })
+	tok.Wait()
+	require.NoError(t, tok.Error())
+
+	// another device may neither switch console 1 nor listen to everything
+	other, err := connectDevice(t, b, "2", "secret")
+	require.NoError(t, err)
+	tok = other.Subscribe("ps/+/cmd", 1, func(mqtt.Client, mqtt.Message) {})
+	tok.Wait()
+	if st, ok := tok.(*mqtt.SubscribeToken); assert.True(t, ok) {
+		assert.Equal(t, byte(0x80), st.Result()["ps/+/cmd"], "subscription refused")
+	}
+	// the broker drops the publish (and disconnects the client)
+	other.Publish("ps/1/cmd", 1, false, "ON").WaitTimeout(time.Second)
+
+	// the server's internal client may use every topic
+	user, pass := b.Credentials()
+	server, err := connectDevice(t, b, user, pass)
+	require.NoError(t, err)
+	server.Publish("ps/1/cmd", 1, false, "OFF").Wait()
+
+	select {
+	case got := <-cmds:
+		assert.Equal(t, "OFF", got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("command of the internal client not delivered")
+	}
+	select {
+	case got := <-cmds:
+		t.Fatalf("foreign command delivered: %s", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRegistry_DeviceTopicAllowed(t *testing.T) {
+	reg := NewRegistry(nil)
+	plug := profileDevice(`{"profile":"tasmota"}`)
+	plug.ConsoleID = 2
+	reg.Replace([]Device{
+		{ConsoleID: 1, DeviceID: "board-4", Transport: TransportMQTT},
+		plug,
+		{ConsoleID: 3, DeviceID: "custom", Transport: TransportMQTT, CommandTopic: "relays/{device}/{cmd_lower}"},
+		{ConsoleID: 4, DeviceID: "web", Transport: TransportHTTP},
+	})
+	for _, c := range []struct {
+		user, topic string
+		want        bool
+	}{
+		{"board-4", "ps/board-4/cmd", true},
+		{"board-4", "ps/board-4/status", true},
+		{"board-4", "ps/board-4/heartbeat", true},
+		{"board-4", "ps/board-4/availability", true},
+		{"board-4", "ps/board-4/power", true},
+		{"board-4", "ps/board-4/#", false},
+		{"board-4", "ps/board-40/cmd", false},
+		{"board-4", "ps/+/cmd", false},
+		{"board-4", "#", false},
+		{"board-4", "cmnd/board-4/POWER", false},
+		{"plug1", "cmnd/plug1/POWER", true},
+		{"plug1", "cmnd/plug1/#", true},
+		{"plug1", "tele/plug1/LWT", true},
+		{"plug1", "ps/plug1/cmd", false},
+		{"custom", "relays/custom/on", true},
+		{"custom", "relays/custom/+", true},
+		{"web", "ps/web/cmd", false},    // not an MQTT device
+		{"7", "ps/7/cmd", true},         // legacy console ID
+		{"1", "ps/1/cmd", false},        // console 1 belongs to board-4
+		{"ps", "ps/board-4/cmd", false}, // a level of the topic, not a device
+		{"cmd", "ps/board-4/cmd", false},
+		{"status", "ps/plug1/status", false},
+		{"", "ps//cmd", false},
+	} {
+		assert.Equal(t, c.want, reg.DeviceTopicAllowed(c.user, "ps", c.topic), "%s on %s", c.user, c.topic)
+	}
+}
+
+func TestTopicCovered(t *testing.T) {
+	for _, c := range []struct {
+		filter, allowed string
+		want            bool
+	}{
+		{"homeassistant/switch/x/config", "homeassistant/#", true},
+		{"homeassistant/#", "homeassistant/#", true},
+		{"homeassistant", "homeassistant/#", true}, // # includes the parent level
+		{"#", "homeassistant/#", false},
+		{"ps/1/cmd", "ps/+/cmd", true},
+		{"ps/+/cmd", "ps/+/cmd", true},
+		{"ps/+/cmd", "ps/1/cmd", false},
+		{"ps/1/cmd/x", "ps/+/cmd", false},
+		{"anything/at/all", "#", true},
+	} {
+		assert.Equal(t, c.want, TopicCovered(c.filter, c.allowed), "%s in %s", c.filter, c.allowed)
+	}
+}
@@ -0,0 +1,189 @@
+package iot
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDeviceNotConnected is returned when a command targets a websocket
+// device without an open connection.
+var ErrDeviceNotConnected = errors.New("device not connected")
+
+// WSOptions configures a websocket device, stored in Device.Options.
+type WSOptions struct {
+	Token string `json:"token"` // shared secret the board presents when connecting
+}
+
+// WS decodes and validates the websocket options of a device.
+func (d Device) WS() (WSOptions, error) {
+	var o WSOptions
+	if raw := d.OptionsFor(TransportWS); len(raw) > 0 {
+		if err := json.Unmarshal(raw, &o); err != nil {
+			return o, fmt.Errorf("invalid ws options: %w", err)
+		}
+	}
+	if o.Token == "" {
+		return o, errors.New("ws options: token required")
+	}
+	return o, nil
+}
+
+// DeviceConn is the part of a websocket connection the DeviceHub uses.
+type DeviceConn interface {
+	ReadMessage() (int, []byte, error)
+	WriteMessage(messageType int, data []byte) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// textMessage is the websocket text frame type.
+const textMessage = 1
+
+// DeviceHubOptions configures the device websocket channel.
+type DeviceHubOptions struct {
+	Registry *Registry
+	// WriteTimeout bounds a command write (default 5s).
+	WriteTimeout time.Duration
+	// StatusCallback receives every message a board pushes except pings.
+	StatusCallback func(id int64, payload string)
+	// AvailabilityCallback is told about connects, disconnects and every
+	// message (as a heartbeat).
+	AvailabilityCallback func(id int64, online bool, payload string)
+}
+
+// DeviceHub keeps the persistent websocket connections of relay boards and
+// implements CommandSender over them. Unlike the dashboard Hub, each
+// connection belongs to one console. Commands to a console whose board is
+// not connected fail immediately with ErrDeviceNotConnected.
+type DeviceHub struct {
+	opt   DeviceHubOptions
+	mu    sync.Mutex
+	conns map[int64]*deviceConn
+}
+
+type deviceConn struct {
+	conn DeviceConn
+	mu   sync.Mutex // serializes writes
+}
+
+// NewDeviceHub creates an empty device hub.
+func NewDeviceHub(opt DeviceHubOptions) *DeviceHub {
+	if opt.WriteTimeout <= 0 {
+		opt.WriteTimeout = 5 * time.Second
+	}
+	return &DeviceHub{opt: opt, conns: make(map[int64]*deviceConn)}
+}
+
+// Authenticate checks the token a board presents and returns its console.
+func (h *DeviceHub) Authenticate(deviceID, token string) (int64, error) {
+	dev, ok := h.opt.Registry.LookupDevice(deviceID)
+	if !ok || !dev.Uses(TransportWS) {
+		return 0, fmt.Errorf("unknown websocket device %q", deviceID)
+	}
+	o, err := dev.WS()
+	if err != nil {
+		return 0, err
+	}
+	if subtle.ConstantTimeCompare([]byte(o.Token), []byte(token)) != 1 {
+		return 0, errors.New("invalid device token")
+	}
+	return dev.ConsoleID, nil
+}
+
+// Serve registers conn as the connection of a console and reads its
+// messages until it closes. A new connection replaces an older one.
+func (h *DeviceHub) Serve(consoleID int64, conn DeviceConn) {
+	dc := &deviceConn{conn: conn}
+	h.mu.Lock()
+	if old, ok := h.conns[consoleID]; ok {
+		_ = old.conn.Close()
+	}
+	h.conns[consoleID] = dc
+	h.mu.Unlock()
+	h.available(consoleID, true, "connected")
+
+	for {
+		mt, msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if mt != textMessage {
+			continue
+		}
+		payload := strings.TrimSpace(string(msg))
+		h.available(consoleID, true, "message")
+		if strings.EqualFold(payload, "ping") {
+			_ = dc.write([]byte("pong"), h.opt.WriteTimeout)
+			continue
+		}
+		if h.opt.StatusCallback != nil {
+			h.opt.StatusCallback(consoleID, payload)
+		}
+	}
+
+	h.mu.Lock()
+	current := h.conns[consoleID] == dc
+	if current {
+		delete(h.conns, consoleID)
+	}
+	h.mu.Unlock()
+	_ = conn.Close()
+	if current {
+		h.available(consoleID, false, "disconnected")
+	}
+}
+
+// Send delivers a command to the console's board.
+func (h *DeviceHub) Send(consoleID int64, cmd string) error {
+	return h.SendWithID(consoleID, cmd, "")
+}
+
+// SendWithID delivers a command rendered with the device payload template,
+// or as a JSON envelope once the board negotiated the structured protocol.
+func (h *DeviceHub) SendWithID(consoleID int64, cmd, id string) error {
+	h.mu.Lock()
+	dc, ok := h.conns[consoleID]
+	h.mu.Unlock()
+	if !ok {
+		return ErrDeviceNotConnected
+	}
+	dev := h.opt.Registry.Resolve(consoleID)
+	payload, ok := h.opt.Registry.Encode(dev, "", cmd, id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnsupportedCommand, cmd)
+	}
+	return dc.write([]byte(payload), h.opt.WriteTimeout)
+}
+
+// Connected reports whether the board of a console is connected.
+func (h *DeviceHub) Connected(consoleID int64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.conns[consoleID]
+	return ok
+}
+
+// Size returns the number of connected boards.
+func (h *DeviceHub) Size() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.conns)
+}
+
+func (h *DeviceHub) available(consoleID int64, online bool, payload string) {
+	if h.opt.AvailabilityCallback != nil {
+		h.opt.AvailabilityCallback(consoleID, online, payload)
+	}
+}
+
+func (c *deviceConn) write(msg []byte, timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	return c.conn.WriteMessage(textMessage, msg)
+}
@@ -0,0 +1,117 @@
+package iot
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConn is an in-memory DeviceConn; frames pushed to in are read by the
+// hub, frames the hub writes are collected in out.
+type fakeConn struct {
+	in     chan string
+	mu     sync.Mutex
+	out    []string
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{in: make(chan string, 8), closed: make(chan struct{})}
+}
+
+func (c *fakeConn) ReadMessage() (int, []byte, error) {
+	select {
+	case m := <-c.in:
+		return textMessage, []byte(m), nil
+	case <-c.closed:
+		return 0, nil, errors.New("closed")
+	}
+}
+
+func (c *fakeConn) WriteMessage(_ int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.out = append(c.out, string(data))
+	return nil
+}
+
+func (c *fakeConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConn) written() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.out...)
+}
+
+func wsRegistry() *Registry {
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{{ConsoleID: 4, DeviceID: "board-4", Transport: TransportWS, Options: json.RawMessage(`{"token":"s3cret"}`)}})
+	return reg
+}
+
+func TestDeviceHub_Authenticate(t *testing.T) {
+	h := NewDeviceHub(DeviceHubOptions{Registry: wsRegistry()})
+
+	id, err := h.Authenticate("board-4", "s3cret")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), id)
+	_, err = h.Authenticate("board-4", "wrong")
+	assert.Error(t, err)
+	_, err = h.Authenticate("board-9", "s3cret")
+	assert.Error(t, err)
+}
+
+func TestDeviceHub_SendFailsFastWhenDisconnected(t *testing.T) {
+	h := NewDeviceHub(DeviceHubOptions{Registry: wsRegistry()})
+	assert.ErrorIs(t, h.Send(4, "ON"), ErrDeviceNotConnected)
+}
+
+func TestDeviceHub_CommandsAndStatus(t *testing.T) {
+	status := make(chan string, 4)
+	var mu sync.Mutex
+	var avail []bool
+	h := NewDeviceHub(DeviceHubOptions{
+		Registry:       wsRegistry(),
+		StatusCallback: func(id int64, p string) { status <- p },
+		AvailabilityCallback: func(id int64, online bool, p string) {
+			mu.Lock()
+			avail = append(avail, online)
+			mu.Unlock()
+		},
+	})
+	conn := newFakeConn()
+	done := make(chan struct{})
+	go func() { h.Serve(4, conn); close(done) }()
+	require.Eventually(t, func() bool { return h.Connected(4) }, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, h.Send(4, "ON"))
+	conn.in <- "ping"
+	conn.in <- "relay_on"
+	select {
+	case got := <-status:
+		assert.Equal(t, "relay_on", got)
+	case <-time.After(time.Second):
+		t.Fatal("status not received")
+	}
+	assert.Equal(t, []string{"ON", "pong"}, conn.written())
+
+	_ = conn.Close()
+	<-done
+	assert.False(t, h.Connected(4))
+	assert.ErrorIs(t, h.Send(4, "OFF"), ErrDeviceNotConnected)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, avail[0])
+	assert.False(t, avail[len(avail)-1])
+}
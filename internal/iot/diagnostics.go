@@ -0,0 +1,91 @@
+package iot
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RelayStep is one command of a relay self-test.
+type RelayStep struct {
+	Command  string `json:"command"`
+	OK       bool   `json:"ok"`     // delivered and acked by the device
+	AckMS    int64  `json:"ack_ms"` // send to ack, including resends
+	Attempts int    `json:"attempts,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// PulseOptions configures PulseRelay.
+type PulseOptions struct {
+	Hold    time.Duration // time the relay stays on (default 1s)
+	Timeout time.Duration // wait for each ack (default 5s)
+	// KeepOn is asked before switching the relay off again; returning true
+	// skips the OFF, e.g. because a rental started during the pulse.
+	KeepOn func() bool
+	// Lock, if set, is held from KeepOn until the OFF is sent, so whoever
+	// switches the relay on under the same lock cannot slip in between.
+	Lock sync.Locker
+}
+
+// PulseRelay switches the relay of a console ON, holds it and switches it
+// OFF again, timing each command from send to device ack. sender must
+// deliver through senders wrapped by acks (e.g. the transport router) and
+// bypass idempotent filtering; commands acks never saw are reported as
+// unacked. The OFF is sent even when the ON failed, so a relay that did
+// switch without confirming is not left on.
+func PulseRelay(sender CommandSender, acks *AckTracker, consoleID int64, opt PulseOptions) []RelayStep {
+	if opt.Hold <= 0 {
+		opt.Hold = time.Second
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = 5 * time.Second
+	}
+	on := relayStep(sender, acks, consoleID, RelayOn, opt.Timeout, nil)
+	if on.OK {
+		time.Sleep(opt.Hold)
+	}
+	unlock := func() {}
+	if opt.Lock != nil {
+		opt.Lock.Lock()
+		unlock = opt.Lock.Unlock
+	}
+	if opt.KeepOn != nil && opt.KeepOn() {
+		unlock()
+		return []RelayStep{on, {Command: RelayOff, Error: "skipped, console in use"}}
+	}
+	return []RelayStep{on, relayStep(sender, acks, consoleID, RelayOff, opt.Timeout, unlock)}
+}
+
+// relayStep sends cmd and waits for its ack; sent, if set, is called once
+// the command went out, before the wait.
+func relayStep(sender CommandSender, acks *AckTracker, consoleID int64, cmd string, timeout time.Duration, sent func()) RelayStep {
+	step := RelayStep{Command: cmd}
+	start := time.Now()
+	err := sender.Send(consoleID, cmd)
+	if sent != nil {
+		sent()
+	}
+	if err != nil {
+		step.Error = err.Error()
+		return step
+	}
+	st, ok := acks.Wait(consoleID, timeout)
+	if !ok || st.Command != cmd || st.IssuedAt.Before(start) {
+		step.Error = "command not tracked, transport does not report acks"
+		return step
+	}
+	step.Attempts = st.Attempts
+	switch st.State {
+	case CommandAcked:
+		step.OK = true
+		step.AckMS = st.AckedAt.Sub(st.IssuedAt).Milliseconds()
+	case CommandDesync:
+		step.Error = "device did not confirm"
+	default:
+		step.Error = fmt.Sprintf("no ack within %s", timeout)
+	}
+	if !step.OK && st.LastError != "" {
+		step.Error += ": " + st.LastError
+	}
+	return step
+}
@@ -0,0 +1,108 @@
+package iot
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoDevice acks every relay command after a delay, like a board
+// reporting its relay state; ignore makes it silent for one command.
+type echoDevice struct {
+	tracker *AckTracker
+	delay   time.Duration
+	ignore  string
+	sent    []string
+}
+
+func (d *echoDevice) Send(consoleID int64, cmd string) error {
+	d.sent = append(d.sent, cmd)
+	if cmd != d.ignore {
+		time.AfterFunc(d.delay, func() { d.tracker.Observe(consoleID, cmd) })
+	}
+	return nil
+}
+
+func TestPulseRelay(t *testing.T) {
+	tracker := NewAckTracker(AckOptions{Timeout: time.Second})
+	dev := &echoDevice{tracker: tracker, delay: 20 * time.Millisecond}
+
+	steps := PulseRelay(tracker.Wrap(dev), tracker, 1, PulseOptions{Hold: 10 * time.Millisecond})
+	require.Len(t, steps, 2)
+	for i, cmd := range []string{RelayOn, RelayOff} {
+		assert.Equal(t, cmd, steps[i].Command)
+		assert.True(t, steps[i].OK, steps[i].Error)
+		assert.GreaterOrEqual(t, steps[i].AckMS, int64(20))
+		assert.Equal(t, 1, steps[i].Attempts)
+	}
+	assert.Equal(t, []string{RelayOn, RelayOff}, dev.sent)
+}
+
+func TestPulseRelay_NoAck(t *testing.T) {
+	tracker := NewAckTracker(AckOptions{Timeout: time.Second})
+	dev := &echoDevice{tracker: tracker, ignore: RelayOn}
+
+	steps := PulseRelay(tracker.Wrap(dev), tracker, 1, PulseOptions{Timeout: 30 * time.Millisecond})
+	assert.False(t, steps[0].OK)
+	assert.Contains(t, steps[0].Error, "no ack within")
+	// the relay is switched off even though ON was never confirmed
+	assert.True(t, steps[1].OK, steps[1].Error)
+	assert.Equal(t, []string{RelayOn, RelayOff}, dev.sent)
+}
+
+func TestPulseRelay_SendErrorAndUntracked(t *testing.T) {
+	tracker := NewAckTracker(AckOptions{Timeout: time.Second})
+	steps := PulseRelay(tracker.Wrap(&flakySender{all: true}), tracker, 1, PulseOptions{})
+	assert.Equal(t, "mqtt not connected", steps[0].Error)
+
+	// a sender that bypasses the tracker cannot be timed
+	steps = PulseRelay(&flakySender{}, tracker, 2, PulseOptions{})
+	assert.False(t, steps[0].OK)
+	assert.Contains(t, steps[0].Error, "not tracked")
+}
+
+func TestPulseRelay_KeepOn(t *testing.T) {
+	tracker := NewAckTracker(AckOptions{Timeout: time.Second})
+	dev := &echoDevice{tracker: tracker}
+
+	steps := PulseRelay(tracker.Wrap(dev), tracker, 1, PulseOptions{Hold: time.Millisecond, KeepOn: func() bool { return true }})
+	assert.True(t, steps[0].OK)
+	assert.False(t, steps[1].OK)
+	assert.Equal(t, []string{RelayOn}, dev.sent)
+}
+
+// lockProbe records whether its lock was held when each command was sent.
+type lockProbe struct {
+	echoDevice
+	lock   *sync.Mutex
+	locked []bool
+}
+
+func (p *lockProbe) Send(consoleID int64, cmd string) error {
+	free := p.lock.TryLock()
+	if free {
+		p.lock.Unlock()
+	}
+	p.locked = append(p.locked, !free)
+	return p.echoDevice.Send(consoleID, cmd)
+}
+
+func TestPulseRelay_LockHeldUntilOffSent(t *testing.T) {
+	tracker := NewAckTracker(AckOptions{Timeout: time.Second})
+	var mu sync.Mutex
+	dev := &lockProbe{echoDevice: echoDevice{tracker: tracker, delay: 20 * time.Millisecond}, lock: &mu}
+	var heldInKeepOn bool
+	keepOn := func() bool {
+		heldInKeepOn = !mu.TryLock()
+		return false
+	}
+
+	steps := PulseRelay(tracker.Wrap(dev), tracker, 1, PulseOptions{Hold: time.Millisecond, KeepOn: keepOn, Lock: &mu})
+	assert.True(t, steps[1].OK, steps[1].Error)
+	assert.True(t, heldInKeepOn)
+	assert.Equal(t, []bool{false, true}, dev.locked, "only the OFF is sent under the lock")
+	assert.True(t, mu.TryLock(), "released after the OFF")
+}
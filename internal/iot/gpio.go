@@ -0,0 +1,326 @@
+package iot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// GPIOOptions configures a relay on a GPIO line, stored in Device.Options.
+// Channels maps output channels (see Output) to further lines of the same
+// chip, e.g. [17, 27] puts channel 0 on line 17 and channel 1 on line 27.
+type GPIOOptions struct {
+	Chip      string `json:"chip"`       // default /dev/gpiochip0
+	Line      int    `json:"line"`       // line offset of the console relay
+	ActiveLow bool   `json:"active_low"` // relay modules that switch on a low level
+	Channels  []int  `json:"channels,omitempty"`
+}
+
+// GPIO decodes and validates the GPIO options of a device.
+func (d Device) GPIO() (GPIOOptions, error) {
+	var o GPIOOptions
+	if raw := d.OptionsFor(TransportGPIO); len(raw) > 0 {
+		if err := json.Unmarshal(raw, &o); err != nil {
+			return o, fmt.Errorf("invalid gpio options: %w", err)
+		}
+	}
+	if o.Chip == "" {
+		o.Chip = "/dev/gpiochip0"
+	}
+	for _, l := range append([]int{o.Line}, o.Channels...) {
+		if l < 0 {
+			return o, fmt.Errorf("gpio options: invalid line %d", l)
+		}
+	}
+	return o, nil
+}
+
+// line returns the line of a channel (-1 is the console relay).
+func (o GPIOOptions) line(channel int) (int, error) {
+	if channel < 0 {
+		return o.Line, nil
+	}
+	if channel >= len(o.Channels) {
+		return 0, fmt.Errorf("gpio: no line for channel %d", channel)
+	}
+	return o.Channels[channel], nil
+}
+
+// GPIOChip is a GPIO controller, normally the Linux character device
+// /dev/gpiochipN (see OpenGPIOChip); tests use FakeGPIOChip.
+type GPIOChip interface {
+	// RequestOutput claims a line as output driven to value (logical,
+	// before active-low inversion).
+	RequestOutput(offset int, activeLow bool, value bool) (GPIOLine, error)
+	Close() error
+}
+
+// GPIOLine is a claimed output line. Values are logical: true switches the
+// relay on, whatever the line's polarity.
+type GPIOLine interface {
+	Set(value bool) error
+	Get() (bool, error)
+	Close() error
+}
+
+// GPIOSenderOptions configures the GPIO transport.
+type GPIOSenderOptions struct {
+	Registry *Registry
+	// Open opens a chip by path; default OpenGPIOChip.
+	Open func(path string) (GPIOChip, error)
+	// Desired returns the state (ON/OFF) an output of a console should be
+	// in, channel -1 being the console relay; lines are claimed with it so
+	// a restart restores the relays without glitching them. Nil claims
+	// lines OFF.
+	Desired func(consoleID int64, channel int) string
+	// StatusCallback receives the state read back after each switch.
+	StatusCallback func(id int64, payload string)
+}
+
+// GPIOSender implements CommandSender for devices with the gpio transport.
+// Lines are claimed by Start and re-synced when the registry changes;
+// after every write the line is read back and reported as the relay state.
+type GPIOSender struct {
+	opt     GPIOSenderOptions
+	mu      sync.Mutex
+	chips   map[string]GPIOChip
+	lines   map[gpioLineKey]*gpioLine
+	unwatch func()
+}
+
+type gpioLineKey struct {
+	chip   string
+	offset int
+}
+
+type gpioLine struct {
+	GPIOLine
+	activeLow bool
+}
+
+// NewGPIOSender creates a GPIO transport; call Start to claim the lines.
+func NewGPIOSender(opt GPIOSenderOptions) *GPIOSender {
+	if opt.Open == nil {
+		opt.Open = OpenGPIOChip
+	}
+	return &GPIOSender{opt: opt, chips: make(map[string]GPIOChip), lines: make(map[gpioLineKey]*gpioLine)}
+}
+
+// Start claims the lines of every gpio device, driving them to the desired
+// state, and keeps them in sync with the registry until Close.
+func (s *GPIOSender) Start() {
+	s.sync()
+	if s.opt.Registry != nil {
+		s.unwatch = s.opt.Registry.OnChange(s.sync)
+	}
+}
+
+// sync claims the lines of new devices and releases the ones no longer used.
+func (s *GPIOSender) sync() {
+	want := make(map[gpioLineKey]bool)
+	for _, dev := range s.opt.Registry.All() {
+		if !dev.Uses(TransportGPIO) {
+			continue
+		}
+		o, err := dev.GPIO()
+		if err != nil {
+			log.Printf("gpio device %s: %v", dev.DeviceID, err)
+			continue
+		}
+		for i, offset := range append([]int{o.Line}, o.Channels...) {
+			key := gpioLineKey{o.Chip, offset}
+			want[key] = true
+			on := s.opt.Desired != nil && s.opt.Desired(dev.ConsoleID, i-1) == RelayOn
+			if _, err := s.claim(key, o.ActiveLow, on); err != nil {
+				log.Printf("gpio device %s: %v", dev.DeviceID, err)
+			}
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, l := range s.lines {
+		if !want[key] {
+			_ = l.Close()
+			delete(s.lines, key)
+		}
+	}
+}
+
+// claim returns the line, requesting it from its chip (driven to value)
+// the first time.
+func (s *GPIOSender) claim(key gpioLineKey, activeLow, value bool) (*gpioLine, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.lines[key]; ok && l.activeLow == activeLow {
+		return l, nil
+	} else if ok {
+		_ = l.Close() // polarity changed
+		delete(s.lines, key)
+	}
+	chip, ok := s.chips[key.chip]
+	if !ok {
+		var err error
+		if chip, err = s.opt.Open(key.chip); err != nil {
+			return nil, err
+		}
+		s.chips[key.chip] = chip
+	}
+	gl, err := chip.RequestOutput(key.offset, activeLow, value)
+	if err != nil {
+		return nil, fmt.Errorf("%s line %d: %w", key.chip, key.offset, err)
+	}
+	l := &gpioLine{GPIOLine: gl, activeLow: activeLow}
+	s.lines[key] = l
+	return l, nil
+}
+
+// Send switches the console's relay (ON/OFF) or one of its output
+// channels (ON:1). Other commands (warnings, IR codes) have no meaning for
+// a bare relay and are ignored.
+func (s *GPIOSender) Send(consoleID int64, cmd string) error {
+	action, channel := SplitOutput(cmd)
+	if !isRelayCommand(action) {
+		return nil
+	}
+	dev, ok := s.opt.Registry.Lookup(consoleID)
+	if !ok || !dev.Uses(TransportGPIO) {
+		return fmt.Errorf("console %d has no gpio device", consoleID)
+	}
+	o, err := dev.GPIO()
+	if err != nil {
+		return err
+	}
+	offset, err := o.line(channel)
+	if err != nil {
+		return err
+	}
+	on := action == RelayOn
+	l, err := s.claim(gpioLineKey{o.Chip, offset}, o.ActiveLow, on)
+	if err != nil {
+		return err
+	}
+	if err := l.Set(on); err != nil {
+		return fmt.Errorf("gpio %s line %d: %w", o.Chip, offset, err)
+	}
+	got, err := l.Get()
+	if err != nil {
+		return fmt.Errorf("gpio %s line %d: %w", o.Chip, offset, err)
+	}
+	if got != on {
+		return fmt.Errorf("gpio %s line %d: read back %s", o.Chip, offset, relayName(got))
+	}
+	if channel < 0 && s.opt.StatusCallback != nil {
+		s.opt.StatusCallback(consoleID, relayName(got))
+	}
+	return nil
+}
+
+// Close releases every line and chip.
+func (s *GPIOSender) Close() error {
+	if s.unwatch != nil {
+		s.unwatch()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for key, l := range s.lines {
+		errs = append(errs, l.Close())
+		delete(s.lines, key)
+	}
+	for path, c := range s.chips {
+		errs = append(errs, c.Close())
+		delete(s.chips, path)
+	}
+	return errors.Join(errs...)
+}
+
+func relayName(on bool) string {
+	if on {
+		return RelayOn
+	}
+	return RelayOff
+}
+
+// FakeGPIOChip is an in-memory GPIOChip for tests and demos. Levels holds
+// the physical level of each line, so active-low inversion is observable.
+type FakeGPIOChip struct {
+	mu     sync.Mutex
+	lines  int
+	levels map[int]bool
+	owned  map[int]bool
+	closed bool
+}
+
+// NewFakeGPIOChip creates a chip with n lines.
+func NewFakeGPIOChip(n int) *FakeGPIOChip {
+	return &FakeGPIOChip{lines: n, levels: make(map[int]bool), owned: make(map[int]bool)}
+}
+
+// Level returns the physical level of a line.
+func (c *FakeGPIOChip) Level(offset int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.levels[offset]
+}
+
+// Claimed reports whether a line is requested.
+func (c *FakeGPIOChip) Claimed(offset int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.owned[offset]
+}
+
+func (c *FakeGPIOChip) RequestOutput(offset int, activeLow bool, value bool) (GPIOLine, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errors.New("chip closed")
+	}
+	if offset < 0 || offset >= c.lines {
+		return nil, fmt.Errorf("invalid line %d", offset)
+	}
+	if c.owned[offset] {
+		return nil, errors.New("line busy")
+	}
+	c.owned[offset] = true
+	c.levels[offset] = value != activeLow
+	return &fakeGPIOLine{chip: c, offset: offset, activeLow: activeLow}, nil
+}
+
+func (c *FakeGPIOChip) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+type fakeGPIOLine struct {
+	chip      *FakeGPIOChip
+	offset    int
+	activeLow bool
+}
+
+func (l *fakeGPIOLine) Set(value bool) error {
+	l.chip.mu.Lock()
+	defer l.chip.mu.Unlock()
+	if !l.chip.owned[l.offset] {
+		return errors.New("line released")
+	}
+	l.chip.levels[l.offset] = value != l.activeLow
+	return nil
+}
+
+func (l *fakeGPIOLine) Get() (bool, error) {
+	l.chip.mu.Lock()
+	defer l.chip.mu.Unlock()
+	return l.chip.levels[l.offset] != l.activeLow, nil
+}
+
+func (l *fakeGPIOLine) Close() error {
+	l.chip.mu.Lock()
+	defer l.chip.mu.Unlock()
+	delete(l.chip.owned, l.offset)
+	return nil
+}
@@ -0,0 +1,124 @@
+//go:build linux
+
+package iot
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// GPIO character device uAPI v2 (linux/gpio.h).
+const (
+	gpioV2GetLineIoctl       = 0xC250B407
+	gpioV2LineGetValuesIoctl = 0xC010B40E
+	gpioV2LineSetValuesIoctl = 0xC010B40F
+
+	gpioV2LineFlagActiveLow = 1 << 1
+	gpioV2LineFlagOutput    = 1 << 3
+
+	gpioV2LineAttrIDOutputValues = 2
+
+	gpioConsumer = "switchiot"
+)
+
+type gpioV2LineAttribute struct {
+	ID      uint32
+	Padding uint32
+	Value   uint64 // flags, values bitmap or debounce period
+}
+
+type gpioV2LineConfigAttribute struct {
+	Attr gpioV2LineAttribute
+	Mask uint64
+}
+
+type gpioV2LineConfig struct {
+	Flags    uint64
+	NumAttrs uint32
+	Padding  [5]uint32
+	Attrs    [10]gpioV2LineConfigAttribute
+}
+
+type gpioV2LineRequest struct {
+	Offsets         [64]uint32
+	Consumer        [32]byte
+	Config          gpioV2LineConfig
+	NumLines        uint32
+	EventBufferSize uint32
+	Padding         [5]uint32
+	Fd              int32
+}
+
+type gpioV2LineValues struct {
+	Bits uint64
+	Mask uint64
+}
+
+// OpenGPIOChip opens a GPIO character device such as /dev/gpiochip0.
+func OpenGPIOChip(path string) (GPIOChip, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &cdevChip{f: f}, nil
+}
+
+type cdevChip struct {
+	f *os.File
+}
+
+func (c *cdevChip) RequestOutput(offset int, activeLow bool, value bool) (GPIOLine, error) {
+	var req gpioV2LineRequest
+	req.Offsets[0] = uint32(offset)
+	req.NumLines = 1
+	copy(req.Consumer[:], gpioConsumer)
+	req.Config.Flags = gpioV2LineFlagOutput
+	if activeLow {
+		req.Config.Flags |= gpioV2LineFlagActiveLow
+	}
+	if value {
+		req.Config.NumAttrs = 1
+		req.Config.Attrs[0] = gpioV2LineConfigAttribute{
+			Attr: gpioV2LineAttribute{ID: gpioV2LineAttrIDOutputValues, Value: 1},
+			Mask: 1,
+		}
+	}
+	if err := ioctl(c.f.Fd(), gpioV2GetLineIoctl, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("request line: %w", err)
+	}
+	return &cdevLine{f: os.NewFile(uintptr(req.Fd), fmt.Sprintf("%s:%d", c.f.Name(), offset))}, nil
+}
+
+func (c *cdevChip) Close() error { return c.f.Close() }
+
+// cdevLine is a single-line request; bit 0 is the line.
+type cdevLine struct {
+	f *os.File
+}
+
+func (l *cdevLine) Set(value bool) error {
+	v := gpioV2LineValues{Mask: 1}
+	if value {
+		v.Bits = 1
+	}
+	return ioctl(l.f.Fd(), gpioV2LineSetValuesIoctl, unsafe.Pointer(&v))
+}
+
+func (l *cdevLine) Get() (bool, error) {
+	v := gpioV2LineValues{Mask: 1}
+	if err := ioctl(l.f.Fd(), gpioV2LineGetValuesIoctl, unsafe.Pointer(&v)); err != nil {
+		return false, err
+	}
+	return v.Bits&1 == 1, nil
+}
+
+func (l *cdevLine) Close() error { return l.f.Close() }
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package iot
+
+import "errors"
+
+// OpenGPIOChip is only available on Linux (GPIO character device).
+func OpenGPIOChip(path string) (GPIOChip, error) {
+	return nil, errors.New("gpio: not supported on this platform")
+}
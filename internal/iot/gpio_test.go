@@ -0,0 +1,95 @@
+package iot
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gpioDevice registers console 1 as a gpio device on a fake chip.
+func gpioDevice(t *testing.T, opts GPIOOptions) (*Registry, *FakeGPIOChip, func(string) (GPIOChip, error)) {
+	t.Helper()
+	raw, err := json.Marshal(opts)
+	require.NoError(t, err)
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{{ConsoleID: 1, DeviceID: "rpi-1", Transport: TransportGPIO, Options: raw}})
+	chip := NewFakeGPIOChip(32)
+	return reg, chip, func(string) (GPIOChip, error) { return chip, nil }
+}
+
+func TestGPIOSender_Send(t *testing.T) {
+	reg, chip, open := gpioDevice(t, GPIOOptions{Line: 17})
+	var status []string
+	s := NewGPIOSender(GPIOSenderOptions{Registry: reg, Open: open, StatusCallback: func(id int64, p string) { status = append(status, p) }})
+	s.Start()
+	defer s.Close()
+	require.True(t, chip.Claimed(17))
+	assert.False(t, chip.Level(17))
+
+	require.NoError(t, s.Send(1, "ON"))
+	assert.True(t, chip.Level(17))
+	require.NoError(t, s.Send(1, "OFF"))
+	assert.False(t, chip.Level(17))
+	assert.Equal(t, []string{"ON", "OFF"}, status)
+
+	// warnings and IR codes mean nothing to a bare relay
+	require.NoError(t, s.Send(1, "WARN5"))
+	assert.Error(t, s.Send(2, "ON"))
+}
+
+func TestGPIOSender_ActiveLow(t *testing.T) {
+	reg, chip, open := gpioDevice(t, GPIOOptions{Line: 4, ActiveLow: true})
+	s := NewGPIOSender(GPIOSenderOptions{Registry: reg, Open: open})
+	s.Start()
+	defer s.Close()
+	assert.True(t, chip.Level(4), "off is a high level")
+
+	require.NoError(t, s.Send(1, "ON"))
+	assert.False(t, chip.Level(4))
+}
+
+func TestGPIOSender_RestoresDesiredState(t *testing.T) {
+	// the console runs and has a named output on channel 1 only
+	desired := func(_ int64, channel int) string {
+		if channel == 0 {
+			return RelayOff
+		}
+		return RelayOn
+	}
+	reg, chip, open := gpioDevice(t, GPIOOptions{Line: 5, ActiveLow: true, Channels: []int{6, 7}})
+	s := NewGPIOSender(GPIOSenderOptions{Registry: reg, Open: open, Desired: desired})
+	s.Start()
+	defer s.Close()
+	assert.False(t, chip.Level(5), "running console comes back on")
+	assert.True(t, chip.Level(6), "unused channel stays off")
+	assert.False(t, chip.Level(7), "channel of a named output comes back on")
+
+	require.NoError(t, s.Send(1, "ON:0"))
+	assert.False(t, chip.Level(6))
+	assert.Error(t, s.Send(1, "ON:2"))
+}
+
+func TestGPIOSender_RegistryChange(t *testing.T) {
+	reg, chip, open := gpioDevice(t, GPIOOptions{Line: 17})
+	s := NewGPIOSender(GPIOSenderOptions{Registry: reg, Open: open})
+	s.Start()
+	require.True(t, chip.Claimed(17))
+
+	raw, _ := json.Marshal(GPIOOptions{Line: 18})
+	reg.Replace([]Device{{ConsoleID: 1, DeviceID: "rpi-1", Transport: TransportGPIO, Options: raw}})
+	assert.False(t, chip.Claimed(17))
+	assert.True(t, chip.Claimed(18))
+
+	require.NoError(t, s.Close())
+	assert.False(t, chip.Claimed(18))
+}
+
+func TestDeviceGPIO(t *testing.T) {
+	o, err := Device{}.GPIO()
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/gpiochip0", o.Chip)
+	_, err = Device{Options: json.RawMessage(`{"line":-1}`)}.GPIO()
+	assert.Error(t, err)
+}
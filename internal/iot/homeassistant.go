@@ -0,0 +1,196 @@
+package iot
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// HAConsole is the state of one console as exposed to Home Assistant.
+type HAConsole struct {
+	ID           int64
+	Name         string
+	Status       string // IDLE, RUNNING, OVERTIME, STOPPING
+	Relay        string // ON or OFF
+	RemainingMin int    // paid minutes left in the session
+	Revenue      int    // price of the current session, 0 when idle
+}
+
+// haEntity describes one discovery entity published per console.
+type haEntity struct {
+	component string
+	suffix    string
+	config    map[string]any
+}
+
+// The relay is read-only: a binary_sensor, since switching it from Home
+// Assistant would bypass billing.
+var haEntities = []haEntity{
+	{"binary_sensor", "relay", map[string]any{"name": "Relay", "value_template": "{{ value_json.relay }}", "payload_on": RelayOn, "payload_off": RelayOff, "device_class": "power", "icon": "mdi:power-socket-eu"}},
+	{"sensor", "status", map[string]any{"name": "Status", "value_template": "{{ value_json.status }}", "icon": "mdi:gamepad-variant"}},
+	{"sensor", "remaining", map[string]any{"name": "Remaining", "value_template": "{{ value_json.remaining_min }}", "unit_of_measurement": "min", "device_class": "duration", "state_class": "measurement"}},
+	{"sensor", "revenue", map[string]any{"name": "Session revenue", "value_template": "{{ value_json.revenue }}", "icon": "mdi:cash"}},
+}
+
+// haRetired lists entities earlier versions published; their retained
+// configs are cleared when a console is announced or removed. The relay
+// used to be a switch without command_topic, which Home Assistant rejects.
+var haRetired = []haEntity{{component: "switch", suffix: "relay"}}
+
+// haPublished is what was last published for a console.
+type haPublished struct {
+	config string // console name the configs were published with
+	state  string
+}
+
+var haUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// haNode is the discovery node ID grouping this server's entities.
+func (m *MQTTSender) haNode() string {
+	return "heheswitch_" + haUnsafe.ReplaceAllString(m.prefix, "_")
+}
+
+func (m *MQTTSender) haConfigTopic(e haEntity, id int64) string {
+	return fmt.Sprintf("%s/%s/%s/console_%d_%s/config", m.haPrefix, e.component, m.haNode(), id, e.suffix)
+}
+
+func (m *MQTTSender) haStateTopic(id int64) string {
+	return fmt.Sprintf("%s/ha/%d/state", m.prefix, id)
+}
+
+// subscribeHomeAssistant learns the consoles announced before a restart from
+// the retained discovery configs, so consoles retired meanwhile get removed.
+// The handler only records IDs under haLearnMu: it must not wait for haMu,
+// which is held while publishing and thus while our own configs echo back.
+func (m *MQTTSender) subscribeHomeAssistant(c mqtt.Client) {
+	m.haMu.Lock()
+	m.ha = make(map[int64]haPublished)
+	m.haMu.Unlock()
+	filter := fmt.Sprintf("%s/+/%s/+/config", m.haPrefix, m.haNode())
+	token := c.Subscribe(filter, m.qos, func(_ mqtt.Client, msg mqtt.Message) {
+		if len(msg.Payload()) == 0 {
+			return // removal
+		}
+		parts := strings.Split(msg.Topic(), "/")
+		idStr, _, _ := strings.Cut(strings.TrimPrefix(parts[len(parts)-2], "console_"), "_")
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return
+		}
+		m.haLearnMu.Lock()
+		if m.haLearned == nil {
+			m.haLearned = make(map[int64]bool)
+		}
+		m.haLearned[id] = true
+		m.haLearnMu.Unlock()
+	})
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("mqtt subscribe %s error: %v", filter, token.Error())
+	}
+}
+
+// PublishHomeAssistant announces every console to Home Assistant and updates
+// their state topics. Configs and states are retained and only republished
+// when they change; consoles announced earlier but missing from consoles are
+// removed. It is a no-op unless HADiscoveryPrefix is set.
+func (m *MQTTSender) PublishHomeAssistant(consoles []HAConsole) error {
+	if m.haPrefix == "" || !m.IsConnected() {
+		return nil
+	}
+	m.haMu.Lock()
+	defer m.haMu.Unlock()
+	if m.ha == nil {
+		m.ha = make(map[int64]haPublished)
+	}
+	m.haLearnMu.Lock()
+	for id := range m.haLearned {
+		if _, ok := m.ha[id]; !ok {
+			m.ha[id] = haPublished{}
+		}
+	}
+	m.haLearned = nil
+	m.haLearnMu.Unlock()
+	seen := make(map[int64]bool, len(consoles))
+	for _, cs := range consoles {
+		seen[cs.ID] = true
+		prev := m.ha[cs.ID]
+		if prev.config != cs.Name || prev.state == "" {
+			if err := m.haAnnounce(cs); err != nil {
+				return err
+			}
+			prev.config = cs.Name
+		}
+		b, _ := json.Marshal(map[string]any{"relay": cs.Relay, "status": cs.Status, "remaining_min": cs.RemainingMin, "revenue": cs.Revenue})
+		if state := string(b); state != prev.state {
+			if err := m.haPublish(m.haStateTopic(cs.ID), state); err != nil {
+				return err
+			}
+			prev.state = state
+		}
+		m.ha[cs.ID] = prev
+	}
+	for id := range m.ha {
+		if seen[id] {
+			continue
+		}
+		if err := m.haClear(id, haEntities, haRetired); err != nil {
+			return err
+		}
+		if err := m.haPublish(m.haStateTopic(id), ""); err != nil {
+			return err
+		}
+		delete(m.ha, id)
+	}
+	return nil
+}
+
+// haAnnounce publishes the discovery configs of one console.
+func (m *MQTTSender) haAnnounce(cs HAConsole) error {
+	node := m.haNode()
+	device := map[string]any{
+		"identifiers":  []string{fmt.Sprintf("%s_console_%d", node, cs.ID)},
+		"name":         cs.Name,
+		"manufacturer": "heheswitch",
+		"model":        "Rental console",
+	}
+	for _, e := range haEntities {
+		cfg := map[string]any{
+			"unique_id":   fmt.Sprintf("%s_console_%d_%s", node, cs.ID, e.suffix),
+			"object_id":   fmt.Sprintf("%s_%s", haUnsafe.ReplaceAllString(strings.ToLower(cs.Name), "_"), e.suffix),
+			"state_topic": m.haStateTopic(cs.ID),
+			"device":      device,
+		}
+		for k, v := range e.config {
+			cfg[k] = v
+		}
+		b, _ := json.Marshal(cfg)
+		if err := m.haPublish(m.haConfigTopic(e, cs.ID), string(b)); err != nil {
+			return err
+		}
+	}
+	return m.haClear(cs.ID, haRetired)
+}
+
+// haClear removes the retained discovery configs of a console's entities.
+func (m *MQTTSender) haClear(id int64, lists ...[]haEntity) error {
+	for _, list := range lists {
+		for _, e := range list {
+			if err := m.haPublish(m.haConfigTopic(e, id), ""); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MQTTSender) haPublish(topic, payload string) error {
+	token := m.client.Publish(topic, m.qos, true, payload)
+	token.Wait()
+	return token.Error()
+}
@@ -0,0 +1,119 @@
+package iot
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// haRecorder collects the last payload of every discovery and state topic.
+type haRecorder struct {
+	mu   sync.Mutex
+	msgs map[string]string
+}
+
+func (r *haRecorder) get(topic string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.msgs[topic]
+	return p, ok
+}
+
+func watchHomeAssistant(t *testing.T, b *Broker) *haRecorder {
+	t.Helper()
+	rec := &haRecorder{msgs: make(map[string]string)}
+	c, err := connectDevice(t, b, "dev", "secret")
+	require.NoError(t, err)
+	for _, filter := range []string{"homeassistant/#", "ps/ha/#"} {
+		tok := c.Subscribe(filter, 1, func(_ mqtt.Client, m mqtt.Message) {
+			rec.mu.Lock()
+			rec.msgs[m.Topic()] = string(m.Payload())
+			rec.mu.Unlock()
+		})
+		tok.Wait()
+		require.NoError(t, tok.Error())
+	}
+	return rec
+}
+
+func newHASender(t *testing.T, b *Broker) *MQTTSender {
+	t.Helper()
+	user, pass := b.Credentials()
+	s, err := NewMQTTSender(b.URL(), MQTTSenderOptions{
+		Prefix: "ps", QOS: 1, Username: user, Password: pass, CleanSession: true,
+		ClientID: "server-" + t.Name() + time.Now().Format("150405.000000"), HADiscoveryPrefix: "homeassistant",
+	})
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestMQTTSender_HomeAssistantDiscovery(t *testing.T) {
+	b := newTestBroker(t)
+	rec := watchHomeAssistant(t, b)
+	// a relay switch config left retained by an earlier version
+	legacyTopic := "homeassistant/switch/heheswitch_ps/console_1_relay/config"
+	require.NoError(t, b.Publish(legacyTopic, []byte(`{"name":"Relay"}`), true, 1))
+	sender := newHASender(t, b)
+
+	consoles := []HAConsole{
+		{ID: 1, Name: "PS1", Status: "RUNNING", Relay: RelayOn, RemainingMin: 42, Revenue: 40000},
+		{ID: 2, Name: "PS2", Status: "IDLE", Relay: RelayOff},
+	}
+	require.NoError(t, sender.PublishHomeAssistant(consoles))
+
+	relayTopic := "homeassistant/binary_sensor/heheswitch_ps/console_1_relay/config"
+	require.Eventually(t, func() bool { _, ok := rec.get(relayTopic); return ok }, 5*time.Second, 20*time.Millisecond)
+	raw, _ := rec.get(relayTopic)
+	var cfg map[string]any
+	require.NoError(t, json.Unmarshal([]byte(raw), &cfg))
+	assert.Equal(t, "ps/ha/1/state", cfg["state_topic"])
+	assert.Equal(t, "heheswitch_ps_console_1_relay", cfg["unique_id"])
+	assert.Equal(t, RelayOn, cfg["payload_on"])
+	assert.Equal(t, RelayOff, cfg["payload_off"])
+	assert.NotContains(t, cfg, "command_topic")
+	require.Eventually(t, func() bool { p, _ := rec.get(legacyTopic); return p == "" }, 5*time.Second, 20*time.Millisecond)
+
+	require.Eventually(t, func() bool { _, ok := rec.get("ps/ha/1/state"); return ok }, 5*time.Second, 20*time.Millisecond)
+	state, _ := rec.get("ps/ha/1/state")
+	assert.JSONEq(t, `{"relay":"ON","status":"RUNNING","remaining_min":42,"revenue":40000}`, state)
+	for _, suffix := range []string{"status", "remaining", "revenue"} {
+		_, ok := rec.get("homeassistant/sensor/heheswitch_ps/console_2_" + suffix + "/config")
+		assert.True(t, ok, suffix)
+	}
+
+	// retiring PS2 clears its retained configs
+	require.NoError(t, sender.PublishHomeAssistant(consoles[:1]))
+	require.Eventually(t, func() bool {
+		p, _ := rec.get("homeassistant/binary_sensor/heheswitch_ps/console_2_relay/config")
+		return p == ""
+	}, 5*time.Second, 20*time.Millisecond)
+	p, _ := rec.get(relayTopic)
+	assert.NotEmpty(t, p)
+}
+
+func TestMQTTSender_HomeAssistantRemovesAfterRestart(t *testing.T) {
+	b := newTestBroker(t)
+	first := newHASender(t, b)
+	require.NoError(t, first.PublishHomeAssistant([]HAConsole{{ID: 1, Name: "PS1"}, {ID: 7, Name: "PS7"}}))
+	first.Close()
+
+	rec := watchHomeAssistant(t, b)
+	second := newHASender(t, b)
+	// retained configs of the previous run are learned asynchronously
+	require.Eventually(t, func() bool {
+		second.haLearnMu.Lock()
+		defer second.haLearnMu.Unlock()
+		return second.haLearned[7]
+	}, 5*time.Second, 20*time.Millisecond)
+	require.NoError(t, second.PublishHomeAssistant([]HAConsole{{ID: 1, Name: "PS1"}}))
+	require.Eventually(t, func() bool {
+		p, ok := rec.get("homeassistant/sensor/heheswitch_ps/console_7_status/config")
+		return ok && p == ""
+	}, 5*time.Second, 20*time.Millisecond)
+}
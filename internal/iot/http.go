@@ -0,0 +1,225 @@
+package iot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPOptions configures a device reached over plain HTTP, stored in
+// Device.Options. URL and StatusURL are templates with the same
+// placeholders as MQTT topics; the request body (POST/PUT) is rendered from
+// Device.Payload.
+type HTTPOptions struct {
+	URL       string `json:"url"`        // command URL, e.g. http://10.0.0.21/relay?state={cmd_lower}
+	Method    string `json:"method"`     // default GET
+	Auth      string `json:"auth"`       // Authorization header value, e.g. "Basic ..."
+	TimeoutMS int    `json:"timeout_ms"` // default 5000
+	Expect    string `json:"expect"`     // regexp the response body must match; empty accepts any 2xx
+	StatusURL string `json:"status_url"` // polled with GET for the relay state; empty disables polling
+	PollSec   int    `json:"poll_sec"`   // polling interval, default 10
+}
+
+// HTTP decodes and validates the HTTP options of a device.
+func (d Device) HTTP() (HTTPOptions, error) {
+	var o HTTPOptions
+	if raw := d.OptionsFor(TransportHTTP); len(raw) > 0 {
+		if err := json.Unmarshal(raw, &o); err != nil {
+			return o, fmt.Errorf("invalid http options: %w", err)
+		}
+	}
+	if o.URL == "" {
+		return o, errors.New("http options: url required")
+	}
+	o.Method = strings.ToUpper(o.Method)
+	if o.Method == "" {
+		o.Method = http.MethodGet
+	}
+	if o.TimeoutMS <= 0 {
+		o.TimeoutMS = 5000
+	}
+	if o.PollSec <= 0 {
+		o.PollSec = 10
+	}
+	if o.Expect != "" {
+		if _, err := regexp.Compile(o.Expect); err != nil {
+			return o, fmt.Errorf("http options: invalid expect: %w", err)
+		}
+	}
+	return o, nil
+}
+
+// HTTPSenderOptions configures the HTTP transport.
+type HTTPSenderOptions struct {
+	Registry *Registry
+	Client   *http.Client // default: a client without timeout (per-device timeouts apply)
+	// StatusCallback receives command responses and polled status bodies.
+	StatusCallback func(id int64, payload string)
+	// AvailabilityCallback receives the outcome of each status poll.
+	AvailabilityCallback func(id int64, online bool, payload string)
+}
+
+// HTTPSender implements CommandSender for devices with the http transport,
+// e.g. ESP8266 boards with REST firmware. Non-empty command responses are
+// forwarded as status messages so they can ack the command. Devices with a
+// status URL are polled by Start.
+type HTTPSender struct {
+	opt      HTTPSenderOptions
+	client   *http.Client
+	mu       sync.Mutex
+	lastPoll map[int64]time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewHTTPSender creates an HTTP transport; call Start to enable polling.
+func NewHTTPSender(opt HTTPSenderOptions) *HTTPSender {
+	client := opt.Client
+	if client == nil {
+		client = &http.Client{}
+	}
+	return &HTTPSender{opt: opt, client: client, lastPoll: make(map[int64]time.Time), stop: make(chan struct{})}
+}
+
+// Send performs the command request of the console's device.
+func (s *HTTPSender) Send(consoleID int64, cmd string) error {
+	return s.SendWithID(consoleID, cmd, "")
+}
+
+// SendWithID performs the command request with a correlation ID available
+// to the URL and body templates as {id}.
+func (s *HTTPSender) SendWithID(consoleID int64, cmd, id string) error {
+	dev, ok := s.opt.Registry.Lookup(consoleID)
+	if !ok || !dev.Uses(TransportHTTP) {
+		return fmt.Errorf("console %d has no http device", consoleID)
+	}
+	o, err := dev.HTTP()
+	if err != nil {
+		return err
+	}
+	var body string
+	if o.Method != http.MethodGet && o.Method != http.MethodDelete {
+		if body, ok = s.opt.Registry.Encode(dev, "", cmd, id); !ok {
+			return fmt.Errorf("%w: %s", ErrUnsupportedCommand, cmd)
+		}
+	}
+	resp, err := s.do(o, o.Method, dev.expand(o.URL, "", cmd, id), body)
+	if err != nil {
+		return fmt.Errorf("http %s: %w", dev.DeviceID, err)
+	}
+	if resp != "" && s.opt.StatusCallback != nil {
+		s.opt.StatusCallback(consoleID, resp)
+	}
+	return nil
+}
+
+// do performs one request and checks status code and expected response.
+func (s *HTTPSender) do(o HTTPOptions, method, url, body string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.TimeoutMS)*time.Millisecond)
+	defer cancel()
+	var rd io.Reader
+	if body != "" {
+		rd = strings.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, rd)
+	if err != nil {
+		return "", err
+	}
+	if o.Auth != "" {
+		req.Header.Set("Authorization", o.Auth)
+	}
+	if body != "" {
+		ct := "text/plain"
+		if strings.HasPrefix(strings.TrimSpace(body), "{") {
+			ct = "application/json"
+		}
+		req.Header.Set("Content-Type", ct)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if o.Expect != "" && !regexp.MustCompile(o.Expect).Match(b) {
+		return "", fmt.Errorf("unexpected response %q", truncate(string(b), 64))
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// Poll queries the status URL of every due http device once.
+func (s *HTTPSender) Poll() {
+	now := time.Now()
+	for _, dev := range s.opt.Registry.All() {
+		if dev.Transport != TransportHTTP {
+			continue
+		}
+		o, err := dev.HTTP()
+		if err != nil || o.StatusURL == "" {
+			continue
+		}
+		s.mu.Lock()
+		due := now.Sub(s.lastPoll[dev.ConsoleID]) >= time.Duration(o.PollSec)*time.Second
+		if due {
+			s.lastPoll[dev.ConsoleID] = now
+		}
+		s.mu.Unlock()
+		if !due {
+			continue
+		}
+		body, err := s.do(o, http.MethodGet, dev.expand(o.StatusURL, "", "", ""), "")
+		if err != nil {
+			if s.opt.AvailabilityCallback != nil {
+				s.opt.AvailabilityCallback(dev.ConsoleID, false, err.Error())
+			}
+			continue
+		}
+		if s.opt.AvailabilityCallback != nil {
+			s.opt.AvailabilityCallback(dev.ConsoleID, true, "poll")
+		}
+		if body != "" && s.opt.StatusCallback != nil {
+			s.opt.StatusCallback(dev.ConsoleID, body)
+		}
+	}
+}
+
+// Start polls device status in the background until Close.
+func (s *HTTPSender) Start() {
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+				s.Poll()
+			}
+		}
+	}()
+}
+
+// Close stops polling.
+func (s *HTTPSender) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,121 @@
+package iot
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// httpDevice registers console 1 as an http device with the given options.
+func httpDevice(t *testing.T, opts HTTPOptions, payload string) *Registry {
+	t.Helper()
+	raw, err := json.Marshal(opts)
+	require.NoError(t, err)
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{{ConsoleID: 1, DeviceID: "esp-1", Transport: TransportHTTP, Payload: payload, Options: raw}})
+	return reg
+}
+
+func TestHTTPSender_Send(t *testing.T) {
+	var got *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		_, _ = io.WriteString(w, `{"relay":"on"}`)
+	}))
+	defer srv.Close()
+
+	var status string
+	reg := httpDevice(t, HTTPOptions{URL: srv.URL + "/relay?state={cmd_lower}", Auth: "Bearer t0k", Expect: `"relay"`}, "")
+	s := NewHTTPSender(HTTPSenderOptions{Registry: reg, StatusCallback: func(id int64, p string) { status = p }})
+
+	require.NoError(t, s.Send(1, "ON"))
+	assert.Equal(t, http.MethodGet, got.Method)
+	assert.Equal(t, "on", got.URL.Query().Get("state"))
+	assert.Equal(t, "Bearer t0k", got.Header.Get("Authorization"))
+	assert.Equal(t, `{"relay":"on"}`, status)
+}
+
+func TestHTTPSender_PostBodyAndExpect(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		_, _ = io.WriteString(w, "FAIL")
+	}))
+	defer srv.Close()
+
+	reg := httpDevice(t, HTTPOptions{URL: srv.URL, Method: "post", Expect: "^OK"}, `{"cmd":"{cmd}","id":"{id}"}`)
+	s := NewHTTPSender(HTTPSenderOptions{Registry: reg})
+
+	err := s.SendWithID(1, "OFF", "abc")
+	assert.ErrorContains(t, err, "unexpected response")
+	assert.Equal(t, `{"cmd":"OFF","id":"abc"}`, body)
+}
+
+func TestHTTPSender_StatusCodeAndUnknownConsole(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	s := NewHTTPSender(HTTPSenderOptions{Registry: httpDevice(t, HTTPOptions{URL: srv.URL}, "")})
+	assert.ErrorContains(t, s.Send(1, "ON"), "401")
+	assert.Error(t, s.Send(2, "ON"))
+}
+
+func TestHTTPSender_Poll(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "relay_off")
+	}))
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var status []string
+	var online []bool
+	reg := httpDevice(t, HTTPOptions{URL: srv.URL, StatusURL: srv.URL + "/status/{device}"}, "")
+	s := NewHTTPSender(HTTPSenderOptions{
+		Registry:             reg,
+		StatusCallback:       func(id int64, p string) { mu.Lock(); status = append(status, p); mu.Unlock() },
+		AvailabilityCallback: func(id int64, ok bool, p string) { mu.Lock(); online = append(online, ok); mu.Unlock() },
+	})
+	s.Poll()
+	s.Poll() // not due yet
+
+	assert.Equal(t, []string{"relay_off"}, status)
+	assert.Equal(t, []bool{true}, online)
+}
+
+func TestDeviceHTTPOptions(t *testing.T) {
+	_, err := Device{}.HTTP()
+	assert.Error(t, err)
+	_, err = Device{Options: json.RawMessage(`{"url":"http://x","expect":"("}`)}.HTTP()
+	assert.Error(t, err)
+	o, err := Device{Options: json.RawMessage(`{"url":"http://x"}`)}.HTTP()
+	require.NoError(t, err)
+	assert.Equal(t, http.MethodGet, o.Method)
+	assert.Equal(t, 5000, o.TimeoutMS)
+}
+
+func TestTransportRouter(t *testing.T) {
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{{ConsoleID: 2, DeviceID: "esp-2", Transport: TransportHTTP}})
+	mqttSide, httpSide := NewMockSender(), NewMockSender()
+	r := NewTransportRouter(reg)
+	r.Set(TransportMQTT, mqttSide)
+	r.Set(TransportHTTP, httpSide)
+
+	require.NoError(t, r.Send(1, "ON"))
+	require.NoError(t, r.Send(2, "OFF"))
+	assert.Equal(t, "ON", mqttSide.Last(1))
+	assert.Equal(t, "OFF", httpSide.Last(2))
+	assert.Empty(t, mqttSide.Last(2))
+
+	r.Set(TransportHTTP, nil)
+	assert.Error(t, r.Send(2, "ON"))
+}
@@ -4,30 +4,62 @@ import "sync"
 
 // IdempotentSender wraps a CommandSender and suppresses duplicate consecutive
 // commands (e.g. sending OFF twice). Useful to avoid double publish when
-// auto-expire and manual stop happen nearly simultaneously.
+// auto-expire and manual stop happen nearly simultaneously. Channel
+// commands of a console's outputs are tracked per channel.
 type IdempotentSender struct {
 	inner CommandSender
 	mu    sync.Mutex
-	last  map[int64]string
+	last  map[outputKey]string
+}
+
+// outputKey identifies an output; channel -1 is the console relay itself.
+type outputKey struct {
+	console int64
+	channel int
 }
 
 func NewIdempotentSender(inner CommandSender) *IdempotentSender {
-	return &IdempotentSender{inner: inner, last: make(map[int64]string)}
+	return &IdempotentSender{inner: inner, last: make(map[outputKey]string)}
 }
 
 func (s *IdempotentSender) Send(consoleID int64, cmd string) error {
+	if isIRCommand(cmd) {
+		return s.inner.Send(consoleID, cmd) // IR codes are actions, not states
+	}
+	_, ch := SplitOutput(cmd)
+	key := outputKey{consoleID, ch}
 	s.mu.Lock()
-	prev := s.last[consoleID]
+	prev := s.last[key]
 	if prev == cmd { // suppress duplicate
 		s.mu.Unlock()
 		return nil
 	}
 	s.mu.Unlock()
-	if err := s.inner.Send(consoleID, cmd); err != nil {
-		return err
+	err := s.inner.Send(consoleID, cmd)
+	s.mu.Lock()
+	if err != nil {
+		// the output's state is unknown now and a queued retry may still
+		// switch it, so the next command must not be suppressed
+		delete(s.last, key)
+	} else {
+		s.last[key] = cmd
 	}
+	s.mu.Unlock()
+	return err
+}
+
+// Forget clears the remembered command of a console so the next Send is
+// delivered even if it repeats the previous one.
+func (s *IdempotentSender) Forget(consoleID int64) {
 	s.mu.Lock()
-	s.last[consoleID] = cmd
+	delete(s.last, outputKey{consoleID, -1})
 	s.mu.Unlock()
-	return nil
+}
+
+// Resend delivers cmd even when sender would suppress it as a duplicate.
+func Resend(sender CommandSender, consoleID int64, cmd string) error {
+	if f, ok := sender.(interface{ Forget(int64) }); ok {
+		f.Forget(consoleID)
+	}
+	return sender.Send(consoleID, cmd)
 }
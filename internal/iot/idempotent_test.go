@@ -0,0 +1,32 @@
+package iot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotentSender_SuppressesDuplicates(t *testing.T) {
+	inner := &recordingSender{}
+	s := NewIdempotentSender(inner)
+
+	assert.NoError(t, s.Send(1, "ON"))
+	assert.NoError(t, s.Send(1, "ON"))
+	assert.Equal(t, 1, inner.count())
+
+	assert.NoError(t, s.Send(1, "OFF"))
+	assert.Equal(t, 2, inner.count())
+}
+
+func TestResend_BypassesIdempotentFilter(t *testing.T) {
+	inner := &recordingSender{}
+	s := NewIdempotentSender(inner)
+
+	assert.NoError(t, s.Send(1, "OFF"))
+	assert.NoError(t, Resend(s, 1, "OFF"))
+	assert.Equal(t, 2, inner.count())
+
+	// plain senders are sent to directly
+	assert.NoError(t, Resend(inner, 1, "OFF"))
+	assert.Equal(t, 3, inner.count())
+}
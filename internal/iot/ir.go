@@ -0,0 +1,64 @@
+package iot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IRCode is a learned infrared code of a TV (or other appliance) model.
+// Protocol names the encoding understood by the board's IR library (NEC,
+// SAMSUNG, SONY, RAW, ...), Bits its length and Data the code itself: a hex
+// value, or comma separated microsecond timings for RAW.
+type IRCode struct {
+	Protocol string
+	Bits     int
+	Data     string
+}
+
+// irPrefix starts IR commands: IR:<protocol>:<bits>:<data>.
+const irPrefix = "IR:"
+
+// IRCommand renders code as a device command, e.g. IR:NEC:32:0x20DF10EF.
+// Transports pass it through payload templates unchanged; the JSON protocol
+// sends it as command IR with protocol, bits and data args.
+func IRCommand(code IRCode) string {
+	return irPrefix + strings.ToUpper(code.Protocol) + ":" + strconv.Itoa(code.Bits) + ":" + code.Data
+}
+
+// ParseIRCommand is the reverse of IRCommand.
+func ParseIRCommand(cmd string) (IRCode, bool) {
+	if !strings.HasPrefix(cmd, irPrefix) {
+		return IRCode{}, false
+	}
+	parts := strings.SplitN(cmd[len(irPrefix):], ":", 3)
+	if len(parts) != 3 {
+		return IRCode{}, false
+	}
+	bits, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return IRCode{}, false
+	}
+	return IRCode{Protocol: parts[0], Bits: bits, Data: parts[2]}, true
+}
+
+// Validate checks that a code can be rendered as a command.
+func (c IRCode) Validate() error {
+	if c.Protocol == "" || strings.ContainsAny(c.Protocol, ": ") {
+		return fmt.Errorf("invalid ir protocol %q", c.Protocol)
+	}
+	if c.Bits < 0 {
+		return fmt.Errorf("invalid ir bits %d", c.Bits)
+	}
+	if strings.TrimSpace(c.Data) == "" {
+		return fmt.Errorf("ir data required")
+	}
+	return nil
+}
+
+// isIRCommand reports whether cmd sends an IR code. IR codes are often
+// toggles (power) and only make sense right away, so they are not queued
+// for later delivery.
+func isIRCommand(cmd string) bool {
+	return strings.HasPrefix(cmd, irPrefix)
+}
@@ -0,0 +1,69 @@
+package iot
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIRCommand_RoundTrip(t *testing.T) {
+	cmd := IRCommand(IRCode{Protocol: "nec", Bits: 32, Data: "0x20DF10EF"})
+	assert.Equal(t, "IR:NEC:32:0x20DF10EF", cmd)
+	code, ok := ParseIRCommand(cmd)
+	require.True(t, ok)
+	assert.Equal(t, IRCode{Protocol: "NEC", Bits: 32, Data: "0x20DF10EF"}, code)
+
+	raw, ok := ParseIRCommand("IR:RAW:0:9000,4500,560")
+	require.True(t, ok)
+	assert.Equal(t, "9000,4500,560", raw.Data)
+
+	_, ok = ParseIRCommand("ON:1")
+	assert.False(t, ok)
+	_, ch := SplitOutput(cmd)
+	assert.Equal(t, -1, ch, "IR commands are not channel commands")
+
+	assert.Error(t, IRCode{Protocol: "NEC", Bits: 32}.Validate())
+	assert.Error(t, IRCode{Protocol: "N:C", Data: "1"}.Validate())
+}
+
+func TestIRCommand_Transports(t *testing.T) {
+	cmd := IRCommand(IRCode{Protocol: "NEC", Bits: 32, Data: "0x20DF10EF"})
+
+	topic, payload, ok := tasmotaProfile{}.Command(profileDevice(`{"profile":"tasmota"}`), 0, cmd)
+	require.True(t, ok)
+	assert.Equal(t, "cmnd/plug1/IRsend", topic)
+	assert.JSONEq(t, `{"Protocol":"NEC","Bits":32,"Data":"0x20DF10EF"}`, payload)
+	_, payload, _ = tasmotaProfile{}.Command(profileDevice(`{"profile":"tasmota"}`), 0, "IR:RAW:0:9000,4500")
+	assert.Equal(t, "0,9000,4500", payload)
+	_, _, ok = shellyGen1Profile{}.Command(profileDevice(`{"profile":"shelly_gen1"}`), 0, cmd)
+	assert.False(t, ok)
+
+	var env CommandEnvelope
+	require.NoError(t, json.Unmarshal([]byte(mustEncode(t, cmd)), &env))
+	assert.Equal(t, "IR", env.Command)
+	assert.Equal(t, map[string]any{"protocol": "NEC", "bits": float64(32), "data": "0x20DF10EF"}, env.Args)
+}
+
+func mustEncode(t *testing.T, cmd string) string {
+	reg := NewRegistry(nil)
+	reg.SetCapabilities("1", Capabilities{Protocol: 1})
+	p, ok := reg.Encode(reg.Resolve(1), "ps", cmd, "")
+	require.True(t, ok)
+	return p
+}
+
+func TestIRCommand_NotQueuedNorDeduplicated(t *testing.T) {
+	inner := &flakySender{all: true}
+	q := &memQueue{}
+	s := NewQueuedSender(inner, q)
+	assert.Error(t, s.Send(1, "IR:NEC:32:0x1"))
+	assert.Equal(t, 0, s.Depth())
+
+	rec := &recordingSender{}
+	idem := NewIdempotentSender(rec)
+	assert.NoError(t, idem.Send(1, "IR:NEC:32:0x1"))
+	assert.NoError(t, idem.Send(1, "IR:NEC:32:0x1"))
+	assert.Equal(t, 2, rec.count(), "a repeated power toggle must be sent again")
+}
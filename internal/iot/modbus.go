@@ -0,0 +1,481 @@
+package iot
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Modbus framings.
+const (
+	ModbusTCP = "tcp"
+	ModbusRTU = "rtu" // RTU over a serial line (RS-485 adapter)
+)
+
+// ModbusOptions configures a console on a Modbus relay board, stored in
+// Device.Options. Consoles sharing a board use the same address and unit
+// with different coils.
+type ModbusOptions struct {
+	Mode      string `json:"mode"`    // tcp (default) or rtu
+	Address   string `json:"address"` // host[:502] for tcp, serial device for rtu
+	Baud      int    `json:"baud"`    // rtu, default 9600
+	Parity    string `json:"parity"`  // rtu: N (default), E or O; 8 data bits, 1 stop bit
+	Unit      int    `json:"unit"`    // slave ID, default 1
+	Coil      int    `json:"coil"`    // coil of the console relay (0-based address)
+	Channels  []int  `json:"channels,omitempty"`
+	TimeoutMS int    `json:"timeout_ms"` // default 1000
+}
+
+// Modbus decodes and validates the Modbus options of a device.
+func (d Device) Modbus() (ModbusOptions, error) {
+	var o ModbusOptions
+	if raw := d.OptionsFor(TransportModbus); len(raw) > 0 {
+		if err := json.Unmarshal(raw, &o); err != nil {
+			return o, fmt.Errorf("invalid modbus options: %w", err)
+		}
+	}
+	if o.Mode == "" {
+		o.Mode = ModbusTCP
+	}
+	if o.Mode != ModbusTCP && o.Mode != ModbusRTU {
+		return o, fmt.Errorf("modbus options: unknown mode %q", o.Mode)
+	}
+	if o.Address == "" {
+		return o, errors.New("modbus options: address required")
+	}
+	if o.Mode == ModbusTCP {
+		if _, _, err := net.SplitHostPort(o.Address); err != nil {
+			o.Address = net.JoinHostPort(o.Address, "502")
+		}
+	}
+	if o.Baud == 0 {
+		o.Baud = 9600
+	}
+	switch o.Parity {
+	case "":
+		o.Parity = "N"
+	case "N", "E", "O":
+	default:
+		return o, fmt.Errorf("modbus options: invalid parity %q", o.Parity)
+	}
+	if o.Unit == 0 {
+		o.Unit = 1
+	}
+	if o.Unit < 1 || o.Unit > 247 {
+		return o, fmt.Errorf("modbus options: invalid unit %d", o.Unit)
+	}
+	for _, c := range append([]int{o.Coil}, o.Channels...) {
+		if c < 0 || c > 0xFFFF {
+			return o, fmt.Errorf("modbus options: invalid coil %d", c)
+		}
+	}
+	if o.TimeoutMS <= 0 {
+		o.TimeoutMS = 1000
+	}
+	return o, nil
+}
+
+// coil returns the coil of a channel (-1 is the console relay).
+func (o ModbusOptions) coil(channel int) (int, error) {
+	if channel < 0 {
+		return o.Coil, nil
+	}
+	if channel >= len(o.Channels) {
+		return 0, fmt.Errorf("modbus: no coil for channel %d", channel)
+	}
+	return o.Channels[channel], nil
+}
+
+// ModbusSenderOptions configures the Modbus transport.
+type ModbusSenderOptions struct {
+	Registry *Registry
+	// BatchWindow is how long a write waits for writes to other coils of
+	// the same unit so they go out in one request (default 20ms).
+	BatchWindow time.Duration
+	// Dial opens the connection to a board; default TCP or serial by mode.
+	Dial func(o ModbusOptions) (io.ReadWriteCloser, error)
+	// StatusCallback receives the relay state read back after each switch.
+	StatusCallback func(id int64, payload string)
+}
+
+// ModbusSender implements CommandSender for devices with the modbus
+// transport. Writes to the same unit within BatchWindow are merged (write
+// multiple coils for adjacent coils) and confirmed with a single read
+// coils request. Connections are opened on demand and reopened after an
+// error.
+type ModbusSender struct {
+	opt     ModbusSenderOptions
+	mu      sync.Mutex
+	clients map[string]*modbusClient
+	batches map[modbusUnit]*modbusBatch
+}
+
+type modbusUnit struct {
+	client string
+	unit   byte
+}
+
+// modbusBatch collects the coil writes of one unit.
+type modbusBatch struct {
+	writes map[int]bool
+	done   chan struct{}
+	err    error
+	got    map[int]bool // read back
+}
+
+// NewModbusSender creates a Modbus transport.
+func NewModbusSender(opt ModbusSenderOptions) *ModbusSender {
+	if opt.BatchWindow <= 0 {
+		opt.BatchWindow = 20 * time.Millisecond
+	}
+	if opt.Dial == nil {
+		opt.Dial = dialModbus
+	}
+	return &ModbusSender{opt: opt, clients: make(map[string]*modbusClient), batches: make(map[modbusUnit]*modbusBatch)}
+}
+
+func dialModbus(o ModbusOptions) (io.ReadWriteCloser, error) {
+	if o.Mode == ModbusRTU {
+		return openSerial(o.Address, o.Baud, o.Parity)
+	}
+	return net.DialTimeout("tcp", o.Address, time.Duration(o.TimeoutMS)*time.Millisecond)
+}
+
+// Send switches the console's coil (ON/OFF) or one of its output channels
+// (ON:1), waiting for the batch it joins to be written and read back.
+// Other commands are ignored.
+func (s *ModbusSender) Send(consoleID int64, cmd string) error {
+	action, channel := SplitOutput(cmd)
+	if !isRelayCommand(action) {
+		return nil
+	}
+	dev, ok := s.opt.Registry.Lookup(consoleID)
+	if !ok || !dev.Uses(TransportModbus) {
+		return fmt.Errorf("console %d has no modbus device", consoleID)
+	}
+	o, err := dev.Modbus()
+	if err != nil {
+		return err
+	}
+	coil, err := o.coil(channel)
+	if err != nil {
+		return err
+	}
+	on := action == RelayOn
+	b := s.join(o, coil, on)
+	<-b.done
+	if b.err != nil {
+		return fmt.Errorf("modbus %s unit %d: %w", o.Address, o.Unit, b.err)
+	}
+	if got := b.got[coil]; got != on {
+		return fmt.Errorf("modbus %s unit %d coil %d: read back %s", o.Address, o.Unit, coil, relayName(got))
+	}
+	if channel < 0 && s.opt.StatusCallback != nil {
+		s.opt.StatusCallback(consoleID, relayName(on))
+	}
+	return nil
+}
+
+// join adds a coil write to the pending batch of its unit, starting a new
+// batch when none is pending.
+func (s *ModbusSender) join(o ModbusOptions, coil int, on bool) *modbusBatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.client(o)
+	key := modbusUnit{c.key, byte(o.Unit)}
+	b, ok := s.batches[key]
+	if !ok {
+		b = &modbusBatch{writes: make(map[int]bool), done: make(chan struct{})}
+		s.batches[key] = b
+		time.AfterFunc(s.opt.BatchWindow, func() {
+			s.mu.Lock()
+			delete(s.batches, key)
+			s.mu.Unlock()
+			b.got, b.err = c.apply(key.unit, b.writes)
+			close(b.done)
+		})
+	}
+	b.writes[coil] = on
+	return b
+}
+
+// client returns the connection to a board, keyed by mode and address.
+// Called with s.mu held.
+func (s *ModbusSender) client(o ModbusOptions) *modbusClient {
+	key := o.Mode + "://" + o.Address
+	c, ok := s.clients[key]
+	if !ok {
+		c = &modbusClient{key: key, rtu: o.Mode == ModbusRTU, timeout: time.Duration(o.TimeoutMS) * time.Millisecond}
+		c.dial = func() (io.ReadWriteCloser, error) { return s.opt.Dial(o) }
+		s.clients[key] = c
+	}
+	return c
+}
+
+// Close closes every board connection.
+func (s *ModbusSender) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for key, c := range s.clients {
+		errs = append(errs, c.close())
+		delete(s.clients, key)
+	}
+	return errors.Join(errs...)
+}
+
+// Modbus function codes.
+const (
+	modbusReadCoils          = 0x01
+	modbusWriteSingleCoil    = 0x05
+	modbusWriteMultipleCoils = 0x0F
+)
+
+// ModbusException is an exception response from a Modbus device.
+type ModbusException struct {
+	Function byte
+	Code     byte
+}
+
+func (e *ModbusException) Error() string {
+	return fmt.Sprintf("modbus exception %d (function 0x%02x)", e.Code, e.Function)
+}
+
+// modbusClient runs requests one at a time over a TCP or RTU connection.
+type modbusClient struct {
+	key     string
+	rtu     bool
+	timeout time.Duration
+	dial    func() (io.ReadWriteCloser, error)
+
+	mu   sync.Mutex
+	conn io.ReadWriteCloser
+	tid  uint16
+}
+
+// apply writes coils, merging adjacent ones into one request, then reads
+// the written range back.
+func (c *modbusClient) apply(unit byte, writes map[int]bool) (map[int]bool, error) {
+	coils := make([]int, 0, len(writes))
+	for coil := range writes {
+		coils = append(coils, coil)
+	}
+	sort.Ints(coils)
+	for i := 0; i < len(coils); {
+		j := i + 1
+		for j < len(coils) && coils[j] == coils[j-1]+1 && j-i < 0x7B0 {
+			j++
+		}
+		var err error
+		if j-i == 1 {
+			err = c.writeCoil(unit, coils[i], writes[coils[i]])
+		} else {
+			values := make([]bool, 0, j-i)
+			for _, coil := range coils[i:j] {
+				values = append(values, writes[coil])
+			}
+			err = c.writeCoils(unit, coils[i], values)
+		}
+		if err != nil {
+			return nil, err
+		}
+		i = j
+	}
+	got := make(map[int]bool, len(coils))
+	for i := 0; i < len(coils); {
+		// read back in spans of at most 2000 coils
+		j := i + 1
+		for j < len(coils) && coils[j]-coils[i] < 2000 {
+			j++
+		}
+		first, n := coils[i], coils[j-1]-coils[i]+1
+		values, err := c.readCoils(unit, first, n)
+		if err != nil {
+			return nil, err
+		}
+		for _, coil := range coils[i:j] {
+			got[coil] = values[coil-first]
+		}
+		i = j
+	}
+	return got, nil
+}
+
+func (c *modbusClient) readCoils(unit byte, addr, n int) ([]bool, error) {
+	pdu := make([]byte, 5)
+	pdu[0] = modbusReadCoils
+	binary.BigEndian.PutUint16(pdu[1:], uint16(addr))
+	binary.BigEndian.PutUint16(pdu[3:], uint16(n))
+	resp, err := c.call(unit, pdu)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 2 || int(resp[1]) != (n+7)/8 || len(resp) != 2+int(resp[1]) {
+		return nil, errors.New("modbus: malformed read coils response")
+	}
+	values := make([]bool, n)
+	for i := range values {
+		values[i] = resp[2+i/8]&(1<<(i%8)) != 0
+	}
+	return values, nil
+}
+
+func (c *modbusClient) writeCoil(unit byte, addr int, on bool) error {
+	pdu := make([]byte, 5)
+	pdu[0] = modbusWriteSingleCoil
+	binary.BigEndian.PutUint16(pdu[1:], uint16(addr))
+	if on {
+		pdu[3] = 0xFF
+	}
+	_, err := c.call(unit, pdu)
+	return err
+}
+
+func (c *modbusClient) writeCoils(unit byte, addr int, values []bool) error {
+	pdu := make([]byte, 6+(len(values)+7)/8)
+	pdu[0] = modbusWriteMultipleCoils
+	binary.BigEndian.PutUint16(pdu[1:], uint16(addr))
+	binary.BigEndian.PutUint16(pdu[3:], uint16(len(values)))
+	pdu[5] = byte((len(values) + 7) / 8)
+	for i, v := range values {
+		if v {
+			pdu[6+i/8] |= 1 << (i % 8)
+		}
+	}
+	_, err := c.call(unit, pdu)
+	return err
+}
+
+// call sends a request PDU and returns the response PDU. The connection is
+// dropped on any I/O error so the next call redials.
+func (c *modbusClient) call(unit byte, pdu []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, err := c.dial()
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+	if d, ok := c.conn.(interface{ SetDeadline(time.Time) error }); ok {
+		_ = d.SetDeadline(time.Now().Add(c.timeout))
+	}
+	var resp []byte
+	var err error
+	if c.rtu {
+		resp, err = c.callRTU(unit, pdu)
+	} else {
+		resp, err = c.callTCP(unit, pdu)
+	}
+	if err != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+		return nil, err
+	}
+	if resp[0] == pdu[0]|0x80 {
+		return nil, &ModbusException{Function: pdu[0], Code: resp[1]}
+	}
+	if resp[0] != pdu[0] {
+		return nil, fmt.Errorf("modbus: unexpected function 0x%02x in response", resp[0])
+	}
+	return resp, nil
+}
+
+// callTCP exchanges an MBAP framed request.
+func (c *modbusClient) callTCP(unit byte, pdu []byte) ([]byte, error) {
+	c.tid++
+	req := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(req[0:], c.tid)
+	binary.BigEndian.PutUint16(req[4:], uint16(len(pdu)+1))
+	req[6] = unit
+	if _, err := c.conn.Write(append(req, pdu...)); err != nil {
+		return nil, err
+	}
+	for {
+		head := make([]byte, 7)
+		if _, err := io.ReadFull(c.conn, head); err != nil {
+			return nil, err
+		}
+		n := int(binary.BigEndian.Uint16(head[4:]))
+		if n < 3 || n > 254 {
+			return nil, errors.New("modbus: invalid response length")
+		}
+		resp := make([]byte, n-1)
+		if _, err := io.ReadFull(c.conn, resp); err != nil {
+			return nil, err
+		}
+		// skip late responses to earlier, timed out requests
+		if binary.BigEndian.Uint16(head[0:]) == c.tid {
+			return resp, nil
+		}
+	}
+}
+
+// callRTU exchanges a CRC framed request on a serial line.
+func (c *modbusClient) callRTU(unit byte, pdu []byte) ([]byte, error) {
+	req := append([]byte{unit}, pdu...)
+	req = binary.LittleEndian.AppendUint16(req, modbusCRC(req))
+	if _, err := c.conn.Write(req); err != nil {
+		return nil, err
+	}
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(c.conn, head); err != nil {
+		return nil, err
+	}
+	var rest int // bytes after head, excluding the CRC
+	switch {
+	case head[1]&0x80 != 0:
+		rest = 0 // exception code already read
+	case head[1] == modbusReadCoils:
+		rest = int(head[2])
+	default:
+		rest = 3 // echo of address and value/quantity
+	}
+	frame := make([]byte, 3+rest+2)
+	copy(frame, head)
+	if _, err := io.ReadFull(c.conn, frame[3:]); err != nil {
+		return nil, err
+	}
+	body := frame[:len(frame)-2]
+	if binary.LittleEndian.Uint16(frame[len(frame)-2:]) != modbusCRC(body) {
+		return nil, errors.New("modbus: crc mismatch")
+	}
+	if body[0] != unit {
+		return nil, fmt.Errorf("modbus: response from unit %d", body[0])
+	}
+	return body[1:], nil
+}
+
+// modbusCRC is the CRC-16/MODBUS of b.
+func modbusCRC(b []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, v := range b {
+		crc ^= uint16(v)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+func (c *modbusClient) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
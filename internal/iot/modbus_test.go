@@ -0,0 +1,268 @@
+package iot
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// modbusServer is a Modbus slave stand-in holding the coils of one unit.
+type modbusServer struct {
+	mu        sync.Mutex
+	unit      byte
+	coils     [64]bool
+	stuck     map[int]bool // coils that ignore writes
+	functions []byte
+}
+
+func newModbusServer(unit byte) *modbusServer {
+	return &modbusServer{unit: unit, stuck: make(map[int]bool)}
+}
+
+func (m *modbusServer) coil(i int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.coils[i]
+}
+
+func (m *modbusServer) calls() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]byte(nil), m.functions...)
+}
+
+// handle executes a request PDU and returns the response PDU.
+func (m *modbusServer) handle(pdu []byte) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.functions = append(m.functions, pdu[0])
+	addr := int(binary.BigEndian.Uint16(pdu[1:]))
+	n := int(binary.BigEndian.Uint16(pdu[3:]))
+	set := func(i int, v bool) {
+		if !m.stuck[i] {
+			m.coils[i] = v
+		}
+	}
+	switch pdu[0] {
+	case modbusReadCoils:
+		if addr+n > len(m.coils) {
+			return []byte{pdu[0] | 0x80, 2}
+		}
+		resp := make([]byte, 2+(n+7)/8)
+		resp[0], resp[1] = pdu[0], byte((n+7)/8)
+		for i := 0; i < n; i++ {
+			if m.coils[addr+i] {
+				resp[2+i/8] |= 1 << (i % 8)
+			}
+		}
+		return resp
+	case modbusWriteSingleCoil:
+		if addr >= len(m.coils) {
+			return []byte{pdu[0] | 0x80, 2}
+		}
+		set(addr, pdu[3] == 0xFF)
+		return pdu[:5]
+	case modbusWriteMultipleCoils:
+		for i := 0; i < n; i++ {
+			set(addr+i, pdu[6+i/8]&(1<<(i%8)) != 0)
+		}
+		return pdu[:5]
+	}
+	return []byte{pdu[0] | 0x80, 1}
+}
+
+// serveTCP answers MBAP framed requests on a local listener.
+func (m *modbusServer) serveTCP(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					head := make([]byte, 7)
+					if _, err := io.ReadFull(conn, head); err != nil {
+						return
+					}
+					pdu := make([]byte, binary.BigEndian.Uint16(head[4:])-1)
+					if _, err := io.ReadFull(conn, pdu); err != nil {
+						return
+					}
+					resp := m.handle(pdu)
+					binary.BigEndian.PutUint16(head[4:], uint16(len(resp)+1))
+					if _, err := conn.Write(append(head, resp...)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// serveRTU answers CRC framed requests on one end of a pipe.
+func (m *modbusServer) serveRTU(conn net.Conn) {
+	defer conn.Close()
+	for {
+		head := make([]byte, 7)
+		if _, err := io.ReadFull(conn, head); err != nil {
+			return
+		}
+		frame := head
+		if head[1] == modbusWriteMultipleCoils {
+			rest := make([]byte, int(head[6])+2)
+			if _, err := io.ReadFull(conn, rest); err != nil {
+				return
+			}
+			frame = append(frame, rest...)
+		} else {
+			rest := make([]byte, 1)
+			if _, err := io.ReadFull(conn, rest); err != nil {
+				return
+			}
+			frame = append(frame, rest...)
+		}
+		body := frame[:len(frame)-2]
+		if binary.LittleEndian.Uint16(frame[len(frame)-2:]) != modbusCRC(body) || body[0] != m.unit {
+			continue
+		}
+		resp := append([]byte{m.unit}, m.handle(body[1:])...)
+		if _, err := conn.Write(binary.LittleEndian.AppendUint16(resp, modbusCRC(resp))); err != nil {
+			return
+		}
+	}
+}
+
+func modbusDevices(t *testing.T, opts ...ModbusOptions) *Registry {
+	t.Helper()
+	var devs []Device
+	for i, o := range opts {
+		raw, err := json.Marshal(o)
+		require.NoError(t, err)
+		devs = append(devs, Device{ConsoleID: int64(i + 1), DeviceID: "board", Transport: TransportModbus, Options: raw})
+	}
+	reg := NewRegistry(nil)
+	reg.Replace(devs)
+	return reg
+}
+
+func TestModbusSender_TCP(t *testing.T) {
+	srv := newModbusServer(1)
+	addr := srv.serveTCP(t)
+	reg := modbusDevices(t, ModbusOptions{Address: addr, Coil: 3, Channels: []int{10}})
+	var status []string
+	s := NewModbusSender(ModbusSenderOptions{Registry: reg, BatchWindow: time.Millisecond, StatusCallback: func(id int64, p string) { status = append(status, p) }})
+	defer s.Close()
+
+	require.NoError(t, s.Send(1, "ON"))
+	assert.True(t, srv.coil(3))
+	require.NoError(t, s.Send(1, "ON:0"))
+	assert.True(t, srv.coil(10))
+	require.NoError(t, s.Send(1, "OFF"))
+	assert.False(t, srv.coil(3))
+	assert.Equal(t, []string{"ON", "OFF"}, status)
+	assert.Equal(t, []byte{modbusWriteSingleCoil, modbusReadCoils}, srv.calls()[:2])
+
+	require.NoError(t, s.Send(1, "WARN5"))
+	assert.Error(t, s.Send(1, "ON:1"))
+}
+
+func TestModbusSender_ReadBackMismatch(t *testing.T) {
+	srv := newModbusServer(1)
+	srv.stuck[2] = true
+	reg := modbusDevices(t, ModbusOptions{Address: srv.serveTCP(t), Coil: 2})
+	s := NewModbusSender(ModbusSenderOptions{Registry: reg, BatchWindow: time.Millisecond})
+	defer s.Close()
+
+	err := s.Send(1, "ON")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "read back OFF")
+}
+
+func TestModbusSender_Exception(t *testing.T) {
+	srv := newModbusServer(1)
+	reg := modbusDevices(t, ModbusOptions{Address: srv.serveTCP(t), Coil: 100})
+	s := NewModbusSender(ModbusSenderOptions{Registry: reg, BatchWindow: time.Millisecond})
+	defer s.Close()
+
+	var exc *ModbusException
+	require.ErrorAs(t, s.Send(1, "ON"), &exc)
+	assert.Equal(t, byte(2), exc.Code)
+}
+
+func TestModbusSender_Batch(t *testing.T) {
+	srv := newModbusServer(1)
+	addr := srv.serveTCP(t)
+	reg := modbusDevices(t,
+		ModbusOptions{Address: addr, Coil: 0},
+		ModbusOptions{Address: addr, Coil: 1},
+		ModbusOptions{Address: addr, Coil: 2},
+		ModbusOptions{Address: addr, Coil: 7},
+	)
+	s := NewModbusSender(ModbusSenderOptions{Registry: reg, BatchWindow: 50 * time.Millisecond})
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for id := int64(1); id <= 4; id++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.Send(id, "ON"))
+		}()
+	}
+	wg.Wait()
+	for _, c := range []int{0, 1, 2, 7} {
+		assert.True(t, srv.coil(c), "coil %d", c)
+	}
+	// coils 0-2 in one request, coil 7 alone, one read back
+	assert.ElementsMatch(t, []byte{modbusWriteMultipleCoils, modbusWriteSingleCoil, modbusReadCoils}, srv.calls())
+}
+
+func TestModbusSender_RTU(t *testing.T) {
+	srv := newModbusServer(5)
+	reg := modbusDevices(t, ModbusOptions{Mode: ModbusRTU, Address: "/dev/ttyUSB0", Unit: 5, Coil: 4})
+	dials := 0
+	s := NewModbusSender(ModbusSenderOptions{Registry: reg, BatchWindow: time.Millisecond, Dial: func(o ModbusOptions) (io.ReadWriteCloser, error) {
+		assert.Equal(t, 9600, o.Baud)
+		dials++
+		client, server := net.Pipe()
+		go srv.serveRTU(server)
+		return client, nil
+	}})
+	defer s.Close()
+
+	require.NoError(t, s.Send(1, "ON"))
+	assert.True(t, srv.coil(4))
+	require.NoError(t, s.Send(1, "OFF"))
+	assert.False(t, srv.coil(4))
+	assert.Equal(t, 1, dials, "connection reused")
+}
+
+func TestModbusCRC(t *testing.T) {
+	// read 8 coils from address 0 of unit 1
+	assert.Equal(t, uint16(0xCC3D), modbusCRC([]byte{0x01, 0x01, 0x00, 0x00, 0x00, 0x08}))
+}
+
+func TestDeviceModbus(t *testing.T) {
+	o, err := Device{Options: json.RawMessage(`{"address":"10.0.0.9"}`)}.Modbus()
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.9:502", o.Address)
+	assert.Equal(t, 1, o.Unit)
+	_, err = Device{Options: json.RawMessage(`{"address":"10.0.0.9","unit":300}`)}.Modbus()
+	assert.Error(t, err)
+	_, err = Device{Options: json.RawMessage(`{"mode":"ascii","address":"x"}`)}.Modbus()
+	assert.Error(t, err)
+}
@@ -1,10 +1,10 @@
 package iot
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,16 +13,30 @@ import (
 )
 
 // MQTTSender implements CommandSender using an MQTT broker.
-// It publishes ON/OFF commands to a topic pattern like: <prefix>/<id>/cmd
-// and (optionally) listens for status messages on: <prefix>/<id>/status
-// Status messages are forwarded to the provided callback.
+// It publishes ON/OFF commands to a topic pattern like: <prefix>/<device>/cmd
+// and (optionally) listens for status messages on: <prefix>/<device>/status
+// Topics and payloads are resolved per console through the device Registry;
+// status messages are mapped back to console IDs and forwarded to the callback.
 type MQTTSender struct {
 	client   mqtt.Client
 	prefix   string
 	qos      byte
 	retain   bool
 	statusCb func(id int64, payload string)
+	availCb  func(id int64, online bool, payload string)
+	powerCb  func(id int64, r PowerReading)
+	registry *Registry
 	mu       sync.Mutex
+	subMu    sync.Mutex
+	subs     map[string]bool // custom status topics subscribed
+	haPrefix string
+	haMu     sync.Mutex
+	ha       map[int64]haPublished // consoles announced to Home Assistant
+	// haLearned collects consoles found in retained discovery configs
+	haLearnMu sync.Mutex
+	haLearned map[int64]bool
+	// unwatch unregisters the registry listener
+	unwatch func()
 }
 
 // MQTTSenderOptions configures the MQTT sender.
@@ -35,7 +49,25 @@ type MQTTSenderOptions struct {
 	Password       string
 	CleanSession   bool
 	StatusCallback func(id int64, payload string)
+	// AvailabilityCallback receives heartbeats (online=true) and availability
+	// messages, including device Last Will "offline" payloads.
+	AvailabilityCallback func(id int64, online bool, payload string)
+	// PowerCallback receives power meter readings from <prefix>/<device>/power.
+	PowerCallback  func(id int64, r PowerReading)
 	ConnectTimeout time.Duration
+	// Registry resolves consoles to devices; nil keeps the legacy ID mapping.
+	Registry *Registry
+	// TLS is used for ssl:// and wss:// brokers (nil uses system defaults).
+	TLS *tls.Config
+	// ConnectCallback runs (in its own goroutine) after every (re)connect
+	// once the subscriptions are in place, e.g. to replay queued commands.
+	ConnectCallback func()
+	// ConnectionLostCallback is called when an established connection
+	// drops. The sender does not reconnect by itself; MQTTSupervisor does.
+	ConnectionLostCallback func(err error)
+	// HADiscoveryPrefix enables Home Assistant discovery (see
+	// PublishHomeAssistant) under this prefix, usually "homeassistant".
+	HADiscoveryPrefix string
 }
 
 // NewMQTTSender creates and connects a new MQTTSender.
@@ -50,14 +82,21 @@ func NewMQTTSender(broker string, opt MQTTSenderOptions) (*MQTTSender, error) {
 	if opt.ConnectTimeout == 0 {
 		opt.ConnectTimeout = 10 * time.Second
 	}
-	mopts := mqtt.NewClientOptions().AddBroker(broker).SetClientID(opt.ClientID).SetCleanSession(opt.CleanSession)
+	mopts := mqtt.NewClientOptions().AddBroker(broker).SetClientID(opt.ClientID).SetCleanSession(opt.CleanSession).
+		SetAutoReconnect(false)
+	if opt.ConnectionLostCallback != nil {
+		mopts.SetConnectionLostHandler(func(_ mqtt.Client, err error) { opt.ConnectionLostCallback(err) })
+	}
 	if opt.Username != "" {
 		mopts.SetUsername(opt.Username)
 	}
 	if opt.Password != "" {
 		mopts.SetPassword(opt.Password)
 	}
-	sender := &MQTTSender{prefix: opt.Prefix, qos: opt.QOS, retain: opt.Retain, statusCb: opt.StatusCallback}
+	if opt.TLS != nil {
+		mopts.SetTLSConfig(opt.TLS)
+	}
+	sender := &MQTTSender{prefix: opt.Prefix, qos: opt.QOS, retain: opt.Retain, statusCb: opt.StatusCallback, availCb: opt.AvailabilityCallback, powerCb: opt.PowerCallback, registry: opt.Registry, haPrefix: opt.HADiscoveryPrefix}
 	mopts.SetOnConnectHandler(func(c mqtt.Client) {
 		// subscribe to status
 		topic := fmt.Sprintf("%s/+/status", sender.prefix)
@@ -66,31 +105,161 @@ func NewMQTTSender(broker string, opt MQTTSenderOptions) (*MQTTSender, error) {
 		if token.Error() != nil {
 			log.Printf("mqtt subscribe error: %v", token.Error())
 		}
+		// heartbeats and availability (device Last Will)
+		for _, suffix := range []string{"heartbeat", "availability"} {
+			token = c.Subscribe(fmt.Sprintf("%s/+/%s", sender.prefix, suffix), sender.qos, sender.handleAvailability)
+			token.Wait()
+			if token.Error() != nil {
+				log.Printf("mqtt subscribe %s error: %v", suffix, token.Error())
+			}
+		}
+		// power meter readings
+		token = c.Subscribe(fmt.Sprintf("%s/+/power", sender.prefix), sender.qos, sender.handlePower)
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf("mqtt subscribe power error: %v", token.Error())
+		}
+		sender.subMu.Lock()
+		sender.subs = make(map[string]bool)
+		sender.subMu.Unlock()
+		sender.subscribeDevices()
+		if sender.haPrefix != "" {
+			sender.subscribeHomeAssistant(c)
+		}
+		if opt.ConnectCallback != nil {
+			go opt.ConnectCallback()
+		}
 	})
 	sender.client = mqtt.NewClient(mopts)
 	token := sender.client.Connect()
 	if !token.WaitTimeout(opt.ConnectTimeout) {
+		sender.client.Disconnect(0)
 		return nil, fmt.Errorf("mqtt connect timeout")
 	}
 	if token.Error() != nil {
 		return nil, token.Error()
 	}
+	if opt.Registry != nil {
+		sender.unwatch = opt.Registry.OnChange(sender.subscribeDevices)
+	}
 	return sender, nil
 }
 
 // Send publishes a command (e.g., ON / OFF) to the device topic.
 func (m *MQTTSender) Send(consoleID int64, cmd string) error {
+	return m.SendWithID(consoleID, cmd, "")
+}
+
+// SendWithID publishes a command carrying a correlation ID; the ID reaches
+// the device only if its payload template contains {id} or the device
+// negotiated the JSON protocol (see Registry.Encode). Devices with a
+// vendor profile get the vendor's topic and payload instead. Commands the
+// device cannot receive fail with ErrUnsupportedCommand.
+func (m *MQTTSender) SendWithID(consoleID int64, cmd, id string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if m.client == nil || !m.client.IsConnectionOpen() {
 		return fmt.Errorf("mqtt not connected")
 	}
-	topic := fmt.Sprintf("%s/%d/cmd", m.prefix, consoleID)
-	token := m.client.Publish(topic, m.qos, m.retain, cmd)
+	dev := m.registry.Resolve(consoleID)
+	topic := dev.CommandTopicFor(m.prefix)
+	payload, ok := m.registry.Encode(dev, m.prefix, cmd, id)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnsupportedCommand, cmd)
+	}
+	if p, o, ok, err := dev.Profile(); err != nil {
+		return err
+	} else if ok {
+		channel := o.Channel
+		if action, ch := SplitOutput(cmd); ch >= 0 {
+			cmd, channel = action, ch
+		}
+		if topic, payload, ok = p.Command(dev, channel, cmd); !ok {
+			return fmt.Errorf("%w: %s", ErrUnsupportedCommand, cmd)
+		}
+	}
+	token := m.client.Publish(topic, m.qos, m.retain, payload)
 	token.Wait()
 	return token.Error()
 }
 
+// subscribeDevices subscribes to status topics of registered devices that
+// are not covered by the <prefix>/+/status wildcard, and to the vendor
+// topics of devices with a profile.
+func (m *MQTTSender) subscribeDevices() {
+	if m.registry == nil || !m.IsConnected() {
+		return
+	}
+	wildcard := fmt.Sprintf("%s/+/status", m.prefix)
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	for _, d := range m.registry.All() {
+		if !d.Uses(TransportMQTT) {
+			continue
+		}
+		if p, o, ok, err := d.Profile(); err != nil {
+			log.Printf("device %s: %v", d.DeviceID, err)
+			continue
+		} else if ok {
+			m.subscribeProfile(d.DeviceID, p.Topics(d, o.Channel))
+			continue
+		}
+		topic := d.StatusTopicFor(m.prefix)
+		if m.subs[topic] || topicMatches(wildcard, topic) {
+			continue
+		}
+		token := m.client.Subscribe(topic, m.qos, m.handleStatus)
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf("mqtt subscribe %s error: %v", topic, token.Error())
+			continue
+		}
+		m.subs[topic] = true
+	}
+}
+
+// subscribeProfile subscribes to the vendor topics of one device. Callers
+// hold subMu.
+func (m *MQTTSender) subscribeProfile(deviceID string, topics []string) {
+	handler := func(_ mqtt.Client, msg mqtt.Message) { m.handleProfile(deviceID, msg) }
+	for _, topic := range topics {
+		if m.subs[topic] {
+			continue
+		}
+		token := m.client.Subscribe(topic, m.qos, handler)
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf("mqtt subscribe %s error: %v", topic, token.Error())
+			continue
+		}
+		m.subs[topic] = true
+	}
+}
+
+// handleProfile translates a vendor message into the status, power and
+// availability callbacks. The device is looked up again so edits to its
+// mapping apply without resubscribing.
+func (m *MQTTSender) handleProfile(deviceID string, msg mqtt.Message) {
+	d, ok := m.registry.LookupDevice(deviceID)
+	if !ok {
+		return
+	}
+	p, o, ok, err := d.Profile()
+	if err != nil || !ok {
+		return
+	}
+	pm := p.Parse(d, o.Channel, msg.Topic(), msg.Payload())
+	if pm.Relay != "" && m.statusCb != nil {
+		m.statusCb(d.ConsoleID, pm.Relay)
+	}
+	if pm.Power != nil && m.powerCb != nil {
+		m.powerCb(d.ConsoleID, *pm.Power)
+	}
+	if pm.Online != nil && m.availCb != nil {
+		m.availCb(d.ConsoleID, *pm.Online, string(msg.Payload()))
+	}
+}
+
 // IsConnected returns current connection state.
 func (m *MQTTSender) IsConnected() bool { return m.client != nil && m.client.IsConnectionOpen() }
 
@@ -101,38 +270,103 @@ func (m *MQTTSender) Prefix() string { return m.prefix }
 func (m *MQTTSender) Close() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if m.unwatch != nil {
+		m.unwatch()
+		m.unwatch = nil
+	}
 	if m.client != nil && m.client.IsConnectionOpen() {
 		m.client.Disconnect(250)
 	}
 }
 
 func (m *MQTTSender) handleStatus(_ mqtt.Client, msg mqtt.Message) {
-	// topic pattern: prefix/<id>/status
+	id, ok := m.consoleForStatus(msg.Topic())
+	if !ok {
+		return
+	}
+	if m.statusCb != nil {
+		m.statusCb(id, string(msg.Payload()))
+	}
+}
+
+// consoleForStatus resolves a status topic to a console: registered custom
+// topics first, then the <prefix>/<device>/status convention.
+func (m *MQTTSender) consoleForStatus(topic string) (int64, bool) {
+	if m.registry != nil {
+		for _, d := range m.registry.All() {
+			if d.Uses(TransportMQTT) && d.StatusTopicFor(m.prefix) == topic {
+				return d.ConsoleID, true
+			}
+		}
+	}
+	return m.consoleForTopic(topic, "status")
+}
+
+// consoleForTopic resolves a <prefix>/<device>/<suffix> topic to a console.
+func (m *MQTTSender) consoleForTopic(topic, suffix string) (int64, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 3 || parts[len(parts)-1] != suffix {
+		return 0, false
+	}
+	return m.registry.ConsoleFor(parts[len(parts)-2])
+}
+
+func (m *MQTTSender) handleAvailability(_ mqtt.Client, msg mqtt.Message) {
 	parts := strings.Split(msg.Topic(), "/")
-	if len(parts) < 3 {
+	suffix := parts[len(parts)-1]
+	id, ok := m.consoleForTopic(msg.Topic(), suffix)
+	if !ok || m.availCb == nil {
 		return
 	}
-	idStr := parts[len(parts)-2]
-	id, err := strconv.ParseInt(idStr, 10, 64)
-	if err != nil {
+	payload := string(msg.Payload())
+	online := true
+	if suffix == "availability" {
+		online = ParseAvailability(payload)
+	}
+	m.availCb(id, online, payload)
+}
+
+func (m *MQTTSender) handlePower(_ mqtt.Client, msg mqtt.Message) {
+	id, ok := m.consoleForTopic(msg.Topic(), "power")
+	if !ok || m.powerCb == nil {
 		return
 	}
-	if m.statusCb != nil {
-		m.statusCb(id, string(msg.Payload()))
+	r, ok := ParsePower(string(msg.Payload()))
+	if !ok {
+		return
+	}
+	m.powerCb(id, r)
+}
+
+// topicMatches reports whether topic matches an MQTT filter with + and # wildcards.
+func topicMatches(filter, topic string) bool {
+	fp := strings.Split(filter, "/")
+	tp := strings.Split(topic, "/")
+	for i, f := range fp {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tp) || (f != "+" && f != tp[i]) {
+			return false
+		}
 	}
+	return len(fp) == len(tp)
 }
 
-// NewFromEnv builds an MQTTSender from environment variables.
+// NewFromEnv builds an MQTTSender from environment variables on top of the
+// base options (callbacks, registry).
 // Required: MQTT_BROKER (e.g. tcp://localhost:1883)
 // Optional: MQTT_PREFIX (default ps), MQTT_USERNAME, MQTT_PASSWORD, MQTT_CLIENT_ID
-func NewFromEnv(statusCb func(id int64, payload string)) (*MQTTSender, error) {
+func NewFromEnv(base MQTTSenderOptions) (*MQTTSender, error) {
 	broker := os.Getenv("MQTT_BROKER")
 	if broker == "" {
 		return nil, fmt.Errorf("MQTT_BROKER not set")
 	}
-	prefix := os.Getenv("MQTT_PREFIX")
-	cid := os.Getenv("MQTT_CLIENT_ID")
-	user := os.Getenv("MQTT_USERNAME")
-	pass := os.Getenv("MQTT_PASSWORD")
-	return NewMQTTSender(broker, MQTTSenderOptions{Prefix: prefix, ClientID: cid, Username: user, Password: pass, QOS: 1, CleanSession: true, StatusCallback: statusCb})
+	base.Prefix = os.Getenv("MQTT_PREFIX")
+	base.ClientID = os.Getenv("MQTT_CLIENT_ID")
+	base.Username = os.Getenv("MQTT_USERNAME")
+	base.Password = os.Getenv("MQTT_PASSWORD")
+	base.QOS = 1
+	base.CleanSession = true
+	return NewMQTTSender(broker, base)
 }
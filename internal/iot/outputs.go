@@ -0,0 +1,227 @@
+package iot
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MainOutput names the output that stands for the console's own relay: its
+// steps send the plain ON/OFF command (acknowledged and reconciled like
+// consoles without outputs) instead of a channel command.
+const MainOutput = "console"
+
+// Output is a named relay output of a console (TV, AC, lights, ...) on a
+// channel of the console's device. StartDelay and StopDelay place it in the
+// power sequence run when a session starts or stops.
+type Output struct {
+	Name       string
+	Channel    int // 0-based relay of the device
+	StartDelay time.Duration
+	StopDelay  time.Duration
+}
+
+// SequenceSource returns the power sequence of a console for a relay
+// command (ON at session start, OFF at stop); none means the console is
+// switched by its relay alone.
+type SequenceSource func(consoleID int64, cmd string) ([]SequenceStep, error)
+
+// OutputCommand addresses cmd to one relay channel of the console's device,
+// e.g. ON:1. Transports expose the parts as {action} and {channel}.
+func OutputCommand(cmd string, channel int) string {
+	return cmd + ":" + strconv.Itoa(channel)
+}
+
+// SplitOutput splits a channel command into action and channel; commands
+// without a channel return channel -1.
+func SplitOutput(cmd string) (string, int) {
+	i := strings.LastIndexByte(cmd, ':')
+	if i < 0 || !isRelayCommand(cmd[:i]) {
+		return cmd, -1
+	}
+	ch, err := strconv.Atoi(cmd[i+1:])
+	if err != nil || ch < 0 {
+		return cmd, -1
+	}
+	return cmd[:i], ch
+}
+
+// SequenceStep is one command of a power sequence.
+type SequenceStep struct {
+	Output  string
+	Delay   time.Duration
+	Command string
+}
+
+// PowerSequence orders the outputs for a session start (ON) or stop (OFF)
+// and any extra steps (e.g. IR codes) by their delay. The console relay is
+// switched at delay 0 unless one of the outputs is the MainOutput.
+func PowerSequence(outputs []Output, cmd string, extra ...SequenceStep) []SequenceStep {
+	steps := make([]SequenceStep, 0, len(outputs)+len(extra)+1)
+	main := false
+	for _, o := range outputs {
+		delay := o.StartDelay
+		if cmd == RelayOff {
+			delay = o.StopDelay
+		}
+		step := SequenceStep{Output: o.Name, Delay: delay, Command: OutputCommand(cmd, o.Channel)}
+		if o.Name == MainOutput {
+			main = true
+			step.Command = cmd
+		}
+		steps = append(steps, step)
+	}
+	if !main {
+		steps = append(steps, SequenceStep{Output: MainOutput, Command: cmd})
+	}
+	steps = append(steps, extra...)
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Delay < steps[j].Delay })
+	return steps
+}
+
+// SequenceSender runs the power sequence of consoles with outputs or IR
+// steps when their relay is switched ON or OFF; all other commands, and
+// consoles without a sequence, pass straight through to inner. Steps due immediately
+// are sent synchronously and a main relay failure is returned; delayed steps
+// run in the background and are cancelled when the console switches again.
+// A delayed main relay step that fails is reported through SetAlert.
+type SequenceSender struct {
+	inner   CommandSender
+	source  SequenceSource
+	mu      sync.Mutex
+	running map[int64]*sequenceRun
+	alert   func(consoleID int64, cmd string, cause error)
+}
+
+type sequenceRun struct {
+	cancel chan struct{}
+}
+
+// NewSequenceSender wraps inner with the sequences of src.
+func NewSequenceSender(inner CommandSender, src SequenceSource) *SequenceSender {
+	return &SequenceSender{inner: inner, source: src, running: make(map[int64]*sequenceRun)}
+}
+
+// Send switches a console, running its power sequence if it has outputs.
+func (s *SequenceSender) Send(consoleID int64, cmd string) error {
+	if !isRelayCommand(cmd) || s.source == nil {
+		return s.inner.Send(consoleID, cmd)
+	}
+	steps, err := s.source(consoleID, cmd)
+	if err != nil {
+		log.Printf("power sequence of console %d: %v", consoleID, err)
+	}
+	if len(steps) == 0 {
+		s.cancel(consoleID)
+		return s.inner.Send(consoleID, cmd)
+	}
+	run := &sequenceRun{cancel: make(chan struct{})}
+	s.mu.Lock()
+	if prev, ok := s.running[consoleID]; ok {
+		close(prev.cancel)
+	}
+	s.running[consoleID] = run
+	s.mu.Unlock()
+
+	var mainErr error
+	i := 0
+	for ; i < len(steps) && steps[i].Delay <= 0; i++ {
+		if err := s.step(consoleID, steps[i]); err != nil && steps[i].Command == cmd {
+			mainErr = err
+		}
+	}
+	if i == len(steps) {
+		s.finish(consoleID, run)
+		return mainErr
+	}
+	go s.runDelayed(consoleID, run, steps[i:])
+	return mainErr
+}
+
+// SetAlert sets the function called when a delayed main relay step fails,
+// since no caller is left to return the error to.
+func (s *SequenceSender) SetAlert(fn func(consoleID int64, cmd string, cause error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.alert = fn
+}
+
+// SendOutput switches a single output by hand.
+func (s *SequenceSender) SendOutput(consoleID int64, o Output, cmd string) error {
+	if o.Name == MainOutput {
+		return s.inner.Send(consoleID, cmd)
+	}
+	return s.inner.Send(consoleID, OutputCommand(cmd, o.Channel))
+}
+
+// ResendRelay switches only the console relay, bypassing the duplicate
+// filter and the power sequence. Used to correct a relay that drifted,
+// where replaying the sequence would toggle the IR-controlled TV again.
+func (s *SequenceSender) ResendRelay(consoleID int64, cmd string) error {
+	s.Forget(consoleID)
+	return s.SendOutput(consoleID, Output{Name: MainOutput}, cmd)
+}
+
+// Forget lets a repeated command of the console through the inner sender.
+func (s *SequenceSender) Forget(consoleID int64) {
+	if f, ok := s.inner.(interface{ Forget(int64) }); ok {
+		f.Forget(consoleID)
+	}
+}
+
+// Running reports whether a power sequence of the console is in progress.
+func (s *SequenceSender) Running(consoleID int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.running[consoleID]
+	return ok
+}
+
+func (s *SequenceSender) runDelayed(consoleID int64, run *sequenceRun, steps []SequenceStep) {
+	defer s.finish(consoleID, run)
+	start := time.Now()
+	for _, st := range steps {
+		select {
+		case <-run.cancel:
+			return
+		case <-time.After(time.Until(start.Add(st.Delay))):
+		}
+		if err := s.step(consoleID, st); err != nil && st.Output == MainOutput {
+			s.mu.Lock()
+			alert := s.alert
+			s.mu.Unlock()
+			if alert != nil {
+				alert(consoleID, st.Command, err)
+			}
+		}
+	}
+}
+
+func (s *SequenceSender) step(consoleID int64, st SequenceStep) error {
+	err := s.inner.Send(consoleID, st.Command)
+	if err != nil {
+		log.Printf("sequence console %d: %s %s: %v", consoleID, st.Output, st.Command, err)
+	}
+	return err
+}
+
+// cancel stops the running sequence of a console, if any.
+func (s *SequenceSender) cancel(consoleID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.running[consoleID]; ok {
+		close(prev.cancel)
+		delete(s.running, consoleID)
+	}
+}
+
+func (s *SequenceSender) finish(consoleID int64, run *sequenceRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[consoleID] == run {
+		delete(s.running, consoleID)
+	}
+}
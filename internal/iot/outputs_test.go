@@ -0,0 +1,140 @@
+package iot
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (f *flakySender) commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.sent...)
+}
+
+func TestSplitOutput(t *testing.T) {
+	cmd, ch := SplitOutput(OutputCommand("ON", 2))
+	assert.Equal(t, "ON", cmd)
+	assert.Equal(t, 2, ch)
+
+	cmd, ch = SplitOutput("WARN5")
+	assert.Equal(t, "WARN5", cmd)
+	assert.Equal(t, -1, ch)
+}
+
+func TestPowerSequence(t *testing.T) {
+	outputs := []Output{
+		{Name: "tv", Channel: 1, StopDelay: 30 * time.Second},
+		{Name: MainOutput, Channel: 0, StartDelay: 2 * time.Second},
+	}
+	start := PowerSequence(outputs, RelayOn)
+	require.Len(t, start, 2)
+	assert.Equal(t, SequenceStep{Output: "tv", Command: "ON:1"}, start[0])
+	assert.Equal(t, SequenceStep{Output: MainOutput, Delay: 2 * time.Second, Command: "ON"}, start[1])
+
+	stop := PowerSequence(outputs, RelayOff)
+	assert.Equal(t, "OFF", stop[0].Command)
+	assert.Equal(t, "OFF:1", stop[1].Command)
+
+	// without a console output the relay is switched right away
+	steps := PowerSequence([]Output{{Name: "ac", Channel: 2, StartDelay: time.Second}}, RelayOn)
+	assert.Equal(t, []string{"ON", "ON:2"}, []string{steps[0].Command, steps[1].Command})
+
+	// extra steps (IR codes) are merged by delay
+	steps = PowerSequence(nil, RelayOn, SequenceStep{Output: "ir:hdmi2", Delay: time.Second, Command: "IR:NEC:32:0x2"},
+		SequenceStep{Output: "ir:power", Command: "IR:NEC:32:0x1"})
+	assert.Equal(t, []string{"ON", "IR:NEC:32:0x1", "IR:NEC:32:0x2"}, []string{steps[0].Command, steps[1].Command, steps[2].Command})
+}
+
+func TestSequenceSender_ResendRelaySkipsSequence(t *testing.T) {
+	inner := &flakySender{}
+	idem := NewIdempotentSender(inner)
+	s := NewSequenceSender(idem, func(int64, string) ([]SequenceStep, error) {
+		return PowerSequence(nil, RelayOn, SequenceStep{Output: "ir:power", Command: "IR:NEC:32:0x1"}), nil
+	})
+
+	require.NoError(t, s.Send(1, RelayOn))
+	assert.Equal(t, []string{"ON", "IR:NEC:32:0x1"}, inner.commands())
+
+	// the relay is re-sent despite the duplicate filter, the IR toggle is not
+	require.NoError(t, s.ResendRelay(1, RelayOn))
+	assert.Equal(t, []string{"ON", "IR:NEC:32:0x1", "ON"}, inner.commands())
+}
+
+func TestSequenceSender_RunsAndCancels(t *testing.T) {
+	inner := &flakySender{}
+	outputs := map[int64][]Output{1: {
+		{Name: "tv", Channel: 1, StopDelay: 50 * time.Millisecond},
+		{Name: MainOutput, StartDelay: 50 * time.Millisecond},
+	}}
+	s := NewSequenceSender(inner, func(id int64, cmd string) ([]SequenceStep, error) {
+		if len(outputs[id]) == 0 {
+			return nil, nil
+		}
+		return PowerSequence(outputs[id], cmd), nil
+	})
+
+	require.NoError(t, s.Send(1, RelayOn))
+	assert.Equal(t, []string{"ON:1"}, inner.commands())
+	require.Eventually(t, func() bool { return len(inner.commands()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "ON", inner.commands()[1])
+
+	// stopping cancels the pending TV step of a previous stop
+	require.NoError(t, s.Send(1, RelayOff))
+	assert.True(t, s.Running(1))
+	require.NoError(t, s.Send(1, RelayOn))
+	require.Eventually(t, func() bool { return !s.Running(1) }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"ON:1", "ON", "OFF", "ON:1", "ON"}, inner.commands())
+
+	// consoles without outputs and other commands pass through
+	require.NoError(t, s.Send(2, RelayOn))
+	require.NoError(t, s.Send(1, "WARN5"))
+	assert.Equal(t, []string{"ON", "WARN5"}, inner.commands()[5:])
+}
+
+func TestSequenceSender_AlertsDelayedMainFailure(t *testing.T) {
+	inner := &flakySender{down: map[int64]bool{}}
+	s := NewSequenceSender(inner, func(int64, string) ([]SequenceStep, error) {
+		return PowerSequence([]Output{
+			{Name: "tv", Channel: 1},
+			{Name: MainOutput, StopDelay: 20 * time.Millisecond},
+		}, RelayOff), nil
+	})
+	alerts := make(chan string, 1)
+	s.SetAlert(func(consoleID int64, cmd string, cause error) {
+		assert.Error(t, cause)
+		alerts <- fmt.Sprintf("%d %s", consoleID, cmd)
+	})
+
+	require.NoError(t, s.Send(1, RelayOff))
+	inner.mu.Lock()
+	inner.down[1] = true // device drops off before the relay step is due
+	inner.mu.Unlock()
+	select {
+	case got := <-alerts:
+		assert.Equal(t, "1 OFF", got)
+	case <-time.After(time.Second):
+		t.Fatal("delayed main relay failure not reported")
+	}
+	assert.Equal(t, []string{"OFF:1"}, inner.commands())
+}
+
+func TestIdempotentSender_TracksOutputsSeparately(t *testing.T) {
+	inner := &recordingSender{}
+	s := NewIdempotentSender(inner)
+
+	assert.NoError(t, s.Send(1, "ON"))
+	assert.NoError(t, s.Send(1, "ON:1"))
+	assert.NoError(t, s.Send(1, "ON"))
+	assert.NoError(t, s.Send(1, "ON:1"))
+	assert.Equal(t, 2, inner.count())
+}
+
+func TestDevice_ExpandsChannel(t *testing.T) {
+	d := Device{DeviceID: "booth", Payload: `{"relay":{channel},"state":"{action}"}`}
+	assert.Equal(t, `{"relay":2,"state":"OFF"}`, d.PayloadFor("ps", "OFF:2", ""))
+	assert.Equal(t, "ON:2", Device{}.PayloadFor("ps", "ON:2", ""))
+}
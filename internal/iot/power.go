@@ -0,0 +1,70 @@
+package iot
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// PowerReading is one sample from a device's power meter (PZEM, INA219, ...).
+// Fields a device does not measure are left zero.
+type PowerReading struct {
+	Watts     float64 `json:"watts"`
+	Voltage   float64 `json:"voltage"`
+	Current   float64 `json:"current"`
+	EnergyKWh float64 `json:"energy_kwh"`
+}
+
+// ParsePower understands a bare number (watts) and JSON objects with
+// power/watts, voltage, current and energy/total/kwh fields, matched case
+// insensitively. Tasmota style payloads nesting them in an "ENERGY" object
+// are accepted too. ok is false when the payload carries no power value.
+func ParsePower(payload string) (PowerReading, bool) {
+	p := strings.TrimSpace(payload)
+	if !strings.HasPrefix(p, "{") {
+		w, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return PowerReading{}, false
+		}
+		return PowerReading{Watts: w}, true
+	}
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(p), &obj); err != nil {
+		return PowerReading{}, false
+	}
+	fields := make(map[string]any, len(obj))
+	for k, v := range obj {
+		if nested, ok := v.(map[string]any); ok && strings.EqualFold(k, "energy") {
+			for nk, nv := range nested {
+				fields[strings.ToLower(nk)] = nv
+			}
+			continue
+		}
+		fields[strings.ToLower(k)] = v
+	}
+	var r PowerReading
+	w, ok := firstNumber(fields, "power", "watts", "w")
+	if !ok {
+		return PowerReading{}, false
+	}
+	r.Watts = w
+	r.Voltage, _ = firstNumber(fields, "voltage", "v")
+	r.Current, _ = firstNumber(fields, "current", "a")
+	r.EnergyKWh, _ = firstNumber(fields, "energy", "total", "kwh")
+	return r, true
+}
+
+// firstNumber returns the first numeric value among keys.
+func firstNumber(fields map[string]any, keys ...string) (float64, bool) {
+	for _, k := range keys {
+		switch v := fields[k].(type) {
+		case float64:
+			return v, true
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return f, true
+			}
+		}
+	}
+	return 0, false
+}
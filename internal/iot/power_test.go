@@ -0,0 +1,29 @@
+package iot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePower(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    PowerReading
+		ok      bool
+	}{
+		{"85.5", PowerReading{Watts: 85.5}, true},
+		{`{"power":120,"voltage":221.4,"current":0.6,"energy":3.2}`, PowerReading{Watts: 120, Voltage: 221.4, Current: 0.6, EnergyKWh: 3.2}, true},
+		{`{"watts":"12","kwh":1.5}`, PowerReading{Watts: 12, EnergyKWh: 1.5}, true},
+		{`{"ENERGY":{"Power":7,"Voltage":230,"Total":10.1}}`, PowerReading{Watts: 7, Voltage: 230, EnergyKWh: 10.1}, true},
+		{`{"voltage":230}`, PowerReading{}, false},
+		{"on", PowerReading{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.payload, func(t *testing.T) {
+			got, ok := ParsePower(tt.payload)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package iot
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ProfileOptions selects a vendor adapter for an MQTT device, stored in
+// Device.Options, e.g. {"profile":"tasmota","channel":0}.
+type ProfileOptions struct {
+	Profile string `json:"profile"` // empty for our own firmware
+	Channel int    `json:"channel"` // relay output, 0-based
+}
+
+// Profile translates our commands into a vendor's MQTT topics and payloads
+// and parses the vendor's status, telemetry and availability messages.
+// The device ID is the vendor's topic / device name.
+type Profile interface {
+	// Command returns topic and payload for cmd; ok is false for commands
+	// the vendor firmware has no equivalent for (e.g. WARN5).
+	Command(d Device, channel int, cmd string) (topic, payload string, ok bool)
+	// Topics lists the topics to subscribe to for a device.
+	Topics(d Device, channel int) []string
+	// Namespaces lists the topic filters the device itself publishes and
+	// subscribes under, which the embedded broker grants its credential.
+	Namespaces(d Device) []string
+	// Parse decodes a message received on one of those topics.
+	Parse(d Device, channel int, topic string, payload []byte) ProfileMessage
+}
+
+// ProfileMessage is the normalized content of a vendor message; fields the
+// message does not carry are left empty / nil.
+type ProfileMessage struct {
+	Relay  string
+	Power  *PowerReading
+	Online *bool
+}
+
+// Built-in vendor profiles.
+const (
+	ProfileTasmota    = "tasmota"
+	ProfileShellyGen1 = "shelly_gen1"
+	ProfileShellyGen2 = "shelly_gen2"
+)
+
+var profiles = map[string]Profile{
+	ProfileTasmota:    tasmotaProfile{},
+	ProfileShellyGen1: shellyGen1Profile{},
+	ProfileShellyGen2: &shellyGen2Profile{},
+}
+
+// LookupProfile returns a built-in profile by name.
+func LookupProfile(name string) (Profile, bool) {
+	p, ok := profiles[name]
+	return p, ok
+}
+
+// ProfileNames lists the built-in profiles.
+func ProfileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for n := range profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Profile decodes the profile options of a device; ok is false for devices
+// using our own topic convention.
+func (d Device) Profile() (Profile, ProfileOptions, bool, error) {
+	var o ProfileOptions
+	if raw := d.OptionsFor(TransportMQTT); len(raw) > 0 {
+		if err := json.Unmarshal(raw, &o); err != nil {
+			return nil, o, false, fmt.Errorf("invalid profile options: %w", err)
+		}
+	}
+	if o.Profile == "" {
+		return nil, o, false, nil
+	}
+	p, ok := LookupProfile(o.Profile)
+	if !ok {
+		return nil, o, false, fmt.Errorf("unknown profile %q (supported: %s)", o.Profile, strings.Join(ProfileNames(), ", "))
+	}
+	if o.Channel < 0 {
+		return nil, o, false, fmt.Errorf("invalid channel %d", o.Channel)
+	}
+	return p, o, true, nil
+}
+
+func boolPtr(v bool) *bool { return &v }
+
+// ---- Tasmota ----
+
+// tasmotaProfile speaks the default Tasmota topics:
+// cmnd/<topic>/POWER<n>, stat/<topic>/{POWER<n>,RESULT},
+// tele/<topic>/{STATE,SENSOR,LWT}. IR codes go to cmnd/<topic>/IRsend.
+type tasmotaProfile struct{}
+
+// powerKey is POWER for the first relay and POWER<n> (1-based) otherwise.
+func (tasmotaProfile) powerKey(channel int) string {
+	if channel == 0 {
+		return "POWER"
+	}
+	return "POWER" + strconv.Itoa(channel+1)
+}
+
+func (p tasmotaProfile) Command(d Device, channel int, cmd string) (string, string, bool) {
+	if code, ok := ParseIRCommand(cmd); ok {
+		return "cmnd/" + d.DeviceID + "/IRsend", tasmotaIRSend(code), true
+	}
+	if !isRelayCommand(cmd) {
+		return "", "", false
+	}
+	return "cmnd/" + d.DeviceID + "/" + p.powerKey(channel), cmd, true
+}
+
+func (p tasmotaProfile) Topics(d Device, channel int) []string {
+	return []string{
+		"stat/" + d.DeviceID + "/" + p.powerKey(channel),
+		"stat/" + d.DeviceID + "/RESULT",
+		"tele/" + d.DeviceID + "/STATE",
+		"tele/" + d.DeviceID + "/SENSOR",
+		"tele/" + d.DeviceID + "/LWT",
+	}
+}
+
+func (tasmotaProfile) Namespaces(d Device) []string {
+	return []string{"cmnd/" + d.DeviceID + "/#", "stat/" + d.DeviceID + "/#", "tele/" + d.DeviceID + "/#"}
+}
+
+func (p tasmotaProfile) Parse(d Device, channel int, topic string, payload []byte) ProfileMessage {
+	var msg ProfileMessage
+	switch topic[strings.LastIndex(topic, "/")+1:] {
+	case p.powerKey(channel):
+		msg.Relay = relayValue(string(payload))
+	case "RESULT", "STATE":
+		var obj map[string]any
+		if json.Unmarshal(payload, &obj) == nil {
+			v, ok := obj[p.powerKey(channel)]
+			if !ok && channel == 0 {
+				v = obj["POWER1"]
+			}
+			msg.Relay = relayValue(v)
+		}
+	case "SENSOR":
+		if r, ok := ParsePower(string(payload)); ok {
+			msg.Power = &r
+		}
+	case "LWT":
+		msg.Online = boolPtr(ParseAvailability(string(payload)))
+	}
+	return msg
+}
+
+// tasmotaIRSend renders an IRsend payload; RAW codes use the raw timing
+// form, others the JSON form.
+func tasmotaIRSend(code IRCode) string {
+	if strings.EqualFold(code.Protocol, "RAW") {
+		return "0," + code.Data
+	}
+	b, _ := json.Marshal(map[string]any{"Protocol": code.Protocol, "Bits": code.Bits, "Data": code.Data})
+	return string(b)
+}
+
+// ---- Shelly Gen1 ----
+
+// shellyGen1Profile speaks the Shelly Gen1 MQTT API:
+// shellies/<id>/relay/<n>/command, shellies/<id>/relay/<n>[/power],
+// shellies/<id>/online.
+type shellyGen1Profile struct{}
+
+func (shellyGen1Profile) relayTopic(d Device, channel int) string {
+	return "shellies/" + d.DeviceID + "/relay/" + strconv.Itoa(channel)
+}
+
+func (p shellyGen1Profile) Command(d Device, channel int, cmd string) (string, string, bool) {
+	if !isRelayCommand(cmd) {
+		return "", "", false
+	}
+	return p.relayTopic(d, channel) + "/command", strings.ToLower(cmd), true
+}
+
+func (p shellyGen1Profile) Topics(d Device, channel int) []string {
+	relay := p.relayTopic(d, channel)
+	return []string{relay, relay + "/power", "shellies/" + d.DeviceID + "/online"}
+}
+
+func (shellyGen1Profile) Namespaces(d Device) []string {
+	return []string{"shellies/" + d.DeviceID + "/#"}
+}
+
+func (p shellyGen1Profile) Parse(d Device, channel int, topic string, payload []byte) ProfileMessage {
+	var msg ProfileMessage
+	relay := p.relayTopic(d, channel)
+	switch topic {
+	case relay:
+		if s := strings.TrimSpace(string(payload)); s == "overpower" {
+			msg.Relay = RelayOff
+		} else {
+			msg.Relay = relayValue(s)
+		}
+	case relay + "/power":
+		if w, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64); err == nil {
+			msg.Power = &PowerReading{Watts: w}
+		}
+	default:
+		msg.Online = boolPtr(ParseAvailability(string(payload)))
+	}
+	return msg
+}
+
+// ---- Shelly Gen2 ----
+
+// shellyGen2Profile speaks the Shelly Gen2 RPC over MQTT API: Switch.Set
+// requests on <id>/rpc; status from <id>/status/switch:<n> and NotifyStatus
+// events on <id>/events/rpc; availability on <id>/online.
+type shellyGen2Profile struct {
+	seq atomic.Int64 // RPC request ids
+}
+
+func (p *shellyGen2Profile) Command(d Device, channel int, cmd string) (string, string, bool) {
+	if !isRelayCommand(cmd) {
+		return "", "", false
+	}
+	req := map[string]any{
+		"id":     p.seq.Add(1),
+		"src":    "heheswitch-" + d.DeviceID,
+		"method": "Switch.Set",
+		"params": map[string]any{"id": channel, "on": cmd == RelayOn},
+	}
+	b, _ := json.Marshal(req)
+	return d.DeviceID + "/rpc", string(b), true
+}
+
+func (p *shellyGen2Profile) Topics(d Device, channel int) []string {
+	return []string{
+		d.DeviceID + "/status/switch:" + strconv.Itoa(channel),
+		d.DeviceID + "/events/rpc",
+		d.DeviceID + "/online",
+	}
+}
+
+// Namespaces includes the src topic the device answers our RPC requests on.
+func (p *shellyGen2Profile) Namespaces(d Device) []string {
+	return []string{d.DeviceID + "/#", "heheswitch-" + d.DeviceID + "/#"}
+}
+
+// gen2Switch is the switch status object of Shelly Gen2 devices.
+type gen2Switch struct {
+	Output  *bool    `json:"output"`
+	APower  *float64 `json:"apower"`
+	Voltage float64  `json:"voltage"`
+	Current float64  `json:"current"`
+	AEnergy struct {
+		Total float64 `json:"total"` // Wh
+	} `json:"aenergy"`
+}
+
+func (s gen2Switch) message() ProfileMessage {
+	var msg ProfileMessage
+	if s.Output != nil {
+		msg.Relay = relayValue(*s.Output)
+	}
+	if s.APower != nil {
+		msg.Power = &PowerReading{Watts: *s.APower, Voltage: s.Voltage, Current: s.Current, EnergyKWh: s.AEnergy.Total / 1000}
+	}
+	return msg
+}
+
+func (p *shellyGen2Profile) Parse(d Device, channel int, topic string, payload []byte) ProfileMessage {
+	key := "switch:" + strconv.Itoa(channel)
+	switch {
+	case strings.HasSuffix(topic, "/status/"+key):
+		var s gen2Switch
+		if json.Unmarshal(payload, &s) == nil {
+			return s.message()
+		}
+	case strings.HasSuffix(topic, "/events/rpc"):
+		// params mixes component objects with a numeric "ts", so only the
+		// switch of this channel is decoded
+		var ev struct {
+			Method string                     `json:"method"`
+			Params map[string]json.RawMessage `json:"params"`
+		}
+		if json.Unmarshal(payload, &ev) == nil && ev.Method == "NotifyStatus" {
+			var s gen2Switch
+			if raw, ok := ev.Params[key]; ok && json.Unmarshal(raw, &s) == nil {
+				return s.message()
+			}
+		}
+	case strings.HasSuffix(topic, "/online"):
+		return ProfileMessage{Online: boolPtr(ParseAvailability(string(payload)))}
+	}
+	return ProfileMessage{}
+}
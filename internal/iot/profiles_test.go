@@ -0,0 +1,159 @@
+package iot
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func profileDevice(opts string) Device {
+	return Device{ConsoleID: 1, DeviceID: "plug1", Transport: TransportMQTT, Options: json.RawMessage(opts)}
+}
+
+func TestDeviceProfile(t *testing.T) {
+	_, _, ok, err := Device{DeviceID: "x"}.Profile()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	p, o, ok, err := profileDevice(`{"profile":"tasmota","channel":1}`).Profile()
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1, o.Channel)
+	assert.IsType(t, tasmotaProfile{}, p)
+
+	_, _, _, err = profileDevice(`{"profile":"sonoff"}`).Profile()
+	assert.Error(t, err)
+	_, _, _, err = profileDevice(`{"profile":"tasmota","channel":-1}`).Profile()
+	assert.Error(t, err)
+}
+
+func TestTasmotaProfile(t *testing.T) {
+	d := profileDevice(`{"profile":"tasmota"}`)
+	p := tasmotaProfile{}
+
+	topic, payload, ok := p.Command(d, 0, "ON")
+	assert.True(t, ok)
+	assert.Equal(t, "cmnd/plug1/POWER", topic)
+	assert.Equal(t, "ON", payload)
+	topic, _, _ = p.Command(d, 1, "OFF")
+	assert.Equal(t, "cmnd/plug1/POWER2", topic)
+	_, _, ok = p.Command(d, 0, "WARN5")
+	assert.False(t, ok)
+
+	assert.Equal(t, RelayOn, p.Parse(d, 0, "stat/plug1/POWER", []byte("ON")).Relay)
+	assert.Equal(t, RelayOff, p.Parse(d, 0, "stat/plug1/RESULT", []byte(`{"POWER":"OFF"}`)).Relay)
+	assert.Equal(t, RelayOn, p.Parse(d, 1, "tele/plug1/STATE", []byte(`{"POWER1":"OFF","POWER2":"ON"}`)).Relay)
+	assert.Empty(t, p.Parse(d, 0, "stat/plug1/RESULT", []byte(`{"Dimmer":10}`)).Relay)
+
+	pm := p.Parse(d, 0, "tele/plug1/SENSOR", []byte(`{"ENERGY":{"Power":85,"Voltage":220,"Total":1.5}}`))
+	require.NotNil(t, pm.Power)
+	assert.Equal(t, 85.0, pm.Power.Watts)
+
+	pm = p.Parse(d, 0, "tele/plug1/LWT", []byte("Offline"))
+	require.NotNil(t, pm.Online)
+	assert.False(t, *pm.Online)
+}
+
+func TestShellyGen1Profile(t *testing.T) {
+	d := profileDevice(`{"profile":"shelly_gen1"}`)
+	p := shellyGen1Profile{}
+
+	topic, payload, ok := p.Command(d, 0, "ON")
+	assert.True(t, ok)
+	assert.Equal(t, "shellies/plug1/relay/0/command", topic)
+	assert.Equal(t, "on", payload)
+
+	assert.Equal(t, RelayOn, p.Parse(d, 0, "shellies/plug1/relay/0", []byte("on")).Relay)
+	assert.Equal(t, RelayOff, p.Parse(d, 0, "shellies/plug1/relay/0", []byte("overpower")).Relay)
+	pm := p.Parse(d, 0, "shellies/plug1/relay/0/power", []byte("42.5"))
+	require.NotNil(t, pm.Power)
+	assert.Equal(t, 42.5, pm.Power.Watts)
+	pm = p.Parse(d, 0, "shellies/plug1/online", []byte("false"))
+	require.NotNil(t, pm.Online)
+	assert.False(t, *pm.Online)
+}
+
+func TestShellyGen2Profile(t *testing.T) {
+	d := profileDevice(`{"profile":"shelly_gen2"}`)
+	p := &shellyGen2Profile{}
+
+	topic, payload, ok := p.Command(d, 0, "OFF")
+	assert.True(t, ok)
+	assert.Equal(t, "plug1/rpc", topic)
+	var req struct {
+		Method string `json:"method"`
+		Params struct {
+			ID int  `json:"id"`
+			On bool `json:"on"`
+		} `json:"params"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(payload), &req))
+	assert.Equal(t, "Switch.Set", req.Method)
+	assert.False(t, req.Params.On)
+
+	pm := p.Parse(d, 0, "plug1/status/switch:0", []byte(`{"id":0,"output":true,"apower":120.5,"voltage":229,"aenergy":{"total":2500}}`))
+	assert.Equal(t, RelayOn, pm.Relay)
+	require.NotNil(t, pm.Power)
+	assert.Equal(t, 120.5, pm.Power.Watts)
+	assert.Equal(t, 2.5, pm.Power.EnergyKWh)
+
+	pm = p.Parse(d, 0, "plug1/events/rpc", []byte(`{"method":"NotifyStatus","params":{"ts":1700000000.12,"switch:0":{"output":false}}}`))
+	assert.Equal(t, RelayOff, pm.Relay)
+	assert.Nil(t, pm.Power)
+	pm = p.Parse(d, 1, "plug1/events/rpc", []byte(`{"method":"NotifyStatus","params":{"ts":1700000000.12,"switch:0":{"output":false}}}`))
+	assert.Empty(t, pm.Relay)
+}
+
+func TestMQTTSender_TasmotaRoundTrip(t *testing.T) {
+	b := newTestBroker(t)
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{profileDevice(`{"profile":"tasmota"}`)})
+
+	status := make(chan string, 1)
+	user, pass := b.Credentials()
+	sender, err := NewMQTTSender(b.URL(), MQTTSenderOptions{
+		Prefix: "ps", QOS: 1, Username: user, Password: pass, CleanSession: true, Registry: reg,
+		StatusCallback: func(id int64, payload string) {
+			if id == 1 {
+				status <- payload
+			}
+		},
+	})
+	require.NoError(t, err)
+	defer sender.Close()
+
+	// subscriptions are made by the asynchronous on-connect handler
+	require.Eventually(t, func() bool {
+		sender.subMu.Lock()
+		defer sender.subMu.Unlock()
+		return sender.subs["stat/plug1/POWER"]
+	}, 5*time.Second, 20*time.Millisecond)
+
+	device, err := connectDevice(t, b, "dev", "secret")
+	require.NoError(t, err)
+	cmds := make(chan string, 1)
+	tok := device.Subscribe("cmnd/plug1/POWER", 1, func(_ mqtt.Client, m mqtt.Message) { cmds <- string(m.Payload()) })
+	tok.Wait()
+	require.NoError(t, tok.Error())
+
+	require.NoError(t, sender.Send(1, "ON"))
+	assert.ErrorIs(t, sender.Send(1, "WARN5"), ErrUnsupportedCommand, "no Tasmota equivalent")
+	select {
+	case got := <-cmds:
+		assert.Equal(t, "ON", got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("command not received")
+	}
+
+	device.Publish("stat/plug1/POWER", 1, false, "ON").Wait()
+	select {
+	case got := <-status:
+		assert.Equal(t, RelayOn, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("status not received")
+	}
+}
@@ -0,0 +1,204 @@
+package iot
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProtocolVersion is the newest JSON command protocol the server speaks.
+// Devices that never completed the capability handshake get the legacy
+// plain-text payloads rendered from their payload template.
+const ProtocolVersion = 1
+
+// CommandHello answers a device hello; its args carry the negotiated
+// protocol version.
+const CommandHello = "HELLO"
+
+// CommandTTL is how long a command envelope stays valid; devices should
+// drop commands received after their expiry (e.g. replayed late).
+const CommandTTL = 30 * time.Second
+
+// CommandEnvelope is a versioned JSON command sent to devices that speak
+// protocol 1:
+//
+//	{"v":1,"id":"a1b2c3","command":"WARN","args":{"remaining_sec":300},
+//	 "issued_at":"2024-01-01T10:00:00Z","expiry":"2024-01-01T10:00:30Z"}
+type CommandEnvelope struct {
+	V        int            `json:"v"`
+	ID       string         `json:"id,omitempty"`
+	Command  string         `json:"command"`
+	Args     map[string]any `json:"args,omitempty"`
+	IssuedAt time.Time      `json:"issued_at"`
+	Expiry   time.Time      `json:"expiry"`
+}
+
+// StatusEnvelope is the versioned JSON a device publishes on its status
+// channel. Type is "status" (relay report or command ack, ID echoing the
+// command) or "hello" (capability announcement sent after connecting).
+// Heartbeats may use it too ("heartbeat") to report Wi-Fi signal, uptime in
+// seconds and the last error the device ran into.
+//
+//	{"v":1,"type":"hello","firmware":"1.4.0","protocols":[1],"commands":["ON","OFF","WARN"]}
+//	{"v":1,"type":"status","id":"a1b2c3","relay":"ON","ok":true}
+//	{"v":1,"type":"heartbeat","rssi":-67,"uptime":86400,"error":"brownout"}
+type StatusEnvelope struct {
+	V         int      `json:"v"`
+	Type      string   `json:"type"`
+	ID        string   `json:"id,omitempty"`
+	Relay     string   `json:"relay,omitempty"`
+	OK        *bool    `json:"ok,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Firmware  string   `json:"firmware,omitempty"`
+	Protocols []int    `json:"protocols,omitempty"`
+	Commands  []string `json:"commands,omitempty"`
+	RSSI      *int     `json:"rssi,omitempty"`
+	Uptime    int64    `json:"uptime,omitempty"`
+}
+
+// Status envelope types.
+const (
+	StatusTypeStatus    = "status"
+	StatusTypeHello     = "hello"
+	StatusTypeHeartbeat = "heartbeat"
+)
+
+// ParseStatusEnvelope decodes a versioned status payload; ok is false for
+// legacy (plain or unversioned JSON) payloads.
+func ParseStatusEnvelope(payload string) (StatusEnvelope, bool) {
+	p := strings.TrimSpace(payload)
+	if !strings.HasPrefix(p, "{") {
+		return StatusEnvelope{}, false
+	}
+	var env StatusEnvelope
+	if err := json.Unmarshal([]byte(p), &env); err != nil || env.V < 1 {
+		return StatusEnvelope{}, false
+	}
+	if env.Type == "" {
+		env.Type = StatusTypeStatus
+	}
+	return env, true
+}
+
+// Capabilities is what a device announced in its hello.
+type Capabilities struct {
+	Protocol int       `json:"protocol"` // negotiated version, 0 = legacy
+	Firmware string    `json:"firmware,omitempty"`
+	Commands []string  `json:"commands,omitempty"` // empty = all commands
+	SeenAt   time.Time `json:"seen_at"`
+}
+
+// NegotiateHello picks the protocol for a hello: the highest version both
+// sides speak, 0 (legacy) if there is none. A hello without a protocols
+// list is taken as version 1.
+func NegotiateHello(env StatusEnvelope) Capabilities {
+	caps := Capabilities{Firmware: env.Firmware, Commands: env.Commands, SeenAt: time.Now()}
+	versions := env.Protocols
+	if len(versions) == 0 {
+		versions = []int{env.V}
+	}
+	for _, v := range versions {
+		if v <= ProtocolVersion && v > caps.Protocol {
+			caps.Protocol = v
+		}
+	}
+	return caps
+}
+
+// Supports reports whether the device accepts cmd. Warnings match a
+// "WARN" capability as well as their own name.
+func (c Capabilities) Supports(cmd string) bool {
+	if len(c.Commands) == 0 || cmd == CommandHello {
+		return true
+	}
+	name, _ := commandArgs(cmd)
+	return slices.Contains(c.Commands, cmd) || slices.Contains(c.Commands, name)
+}
+
+var warnCommand = regexp.MustCompile(`^WARN(\d+)(S?)$`)
+
+// commandArgs splits legacy command strings into name and arguments,
+// e.g. WARN5 -> WARN {"remaining_sec":300}, ON:1 -> ON {"channel":1},
+// IR:NEC:32:0x20DF10EF -> IR {"protocol":"NEC","bits":32,"data":"0x20DF10EF"}.
+func commandArgs(cmd string) (string, map[string]any) {
+	if action, ch := SplitOutput(cmd); ch >= 0 {
+		return action, map[string]any{"channel": ch}
+	}
+	if code, ok := ParseIRCommand(cmd); ok {
+		return "IR", map[string]any{"protocol": code.Protocol, "bits": code.Bits, "data": code.Data}
+	}
+	if m := warnCommand.FindStringSubmatch(cmd); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		if m[2] == "" {
+			n *= 60
+		}
+		return "WARN", map[string]any{"remaining_sec": n}
+	}
+	if cmd == CommandHello {
+		return cmd, map[string]any{"protocol": ProtocolVersion}
+	}
+	return cmd, nil
+}
+
+// warningRemaining returns the time left announced by a warning command
+// (WARN5 -> 5m, WARN30S -> 30s); ok is false for other commands.
+func warningRemaining(cmd string) (time.Duration, bool) {
+	name, args := commandArgs(cmd)
+	if name != "WARN" {
+		return 0, false
+	}
+	return time.Duration(args["remaining_sec"].(int)) * time.Second, true
+}
+
+// NewCommandEnvelope builds the protocol 1 envelope of a command.
+func NewCommandEnvelope(cmd, id string) CommandEnvelope {
+	name, args := commandArgs(cmd)
+	now := time.Now().UTC()
+	return CommandEnvelope{V: ProtocolVersion, ID: id, Command: name, Args: args, IssuedAt: now, Expiry: now.Add(CommandTTL)}
+}
+
+// SetCapabilities records the outcome of a device's handshake.
+func (r *Registry) SetCapabilities(deviceID string, caps Capabilities) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.caps == nil {
+		r.caps = make(map[string]Capabilities)
+	}
+	r.caps[deviceID] = caps
+}
+
+// Capabilities returns the handshake outcome of a device.
+func (r *Registry) Capabilities(deviceID string) (Capabilities, bool) {
+	if r == nil {
+		return Capabilities{}, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.caps[deviceID]
+	return c, ok
+}
+
+// ErrUnsupportedCommand is returned by senders for commands the device has
+// no way to receive (not announced in its handshake, or without an
+// equivalent in its vendor profile). Retrying cannot help, so such commands
+// are not queued; the router tries the next transport of the chain.
+var ErrUnsupportedCommand = errors.New("command not supported by device")
+
+// Encode renders cmd for a device: a JSON envelope when the device
+// negotiated protocol 1, the legacy payload template otherwise. ok is false
+// when the device announced it does not support cmd.
+func (r *Registry) Encode(dev Device, prefix, cmd, id string) (payload string, ok bool) {
+	caps, found := r.Capabilities(dev.DeviceID)
+	if !found || caps.Protocol < 1 {
+		return dev.PayloadFor(prefix, cmd, id), true
+	}
+	if !caps.Supports(cmd) {
+		return "", false
+	}
+	b, _ := json.Marshal(NewCommandEnvelope(cmd, id))
+	return string(b), true
+}
@@ -0,0 +1,123 @@
+package iot
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCommandEnvelope(t *testing.T) {
+	env := NewCommandEnvelope("WARN5", "c1")
+	assert.Equal(t, ProtocolVersion, env.V)
+	assert.Equal(t, "c1", env.ID)
+	assert.Equal(t, "WARN", env.Command)
+	assert.Equal(t, map[string]any{"remaining_sec": 300}, env.Args)
+	assert.Equal(t, CommandTTL, env.Expiry.Sub(env.IssuedAt))
+
+	assert.Equal(t, map[string]any{"remaining_sec": 30}, NewCommandEnvelope("WARN30S", "").Args)
+	on := NewCommandEnvelope("ON", "")
+	assert.Equal(t, "ON", on.Command)
+	assert.Nil(t, on.Args)
+}
+
+func TestWarningRemaining(t *testing.T) {
+	d, ok := warningRemaining("WARN5")
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Minute, d)
+	d, ok = warningRemaining("WARN30S")
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+	_, ok = warningRemaining("ON")
+	assert.False(t, ok)
+}
+
+func TestParseStatusEnvelope(t *testing.T) {
+	env, ok := ParseStatusEnvelope(`{"v":1,"type":"hello","firmware":"1.4.0","protocols":[1,2],"commands":["ON","OFF"]}`)
+	require.True(t, ok)
+	assert.Equal(t, StatusTypeHello, env.Type)
+	assert.Equal(t, "1.4.0", env.Firmware)
+
+	env, ok = ParseStatusEnvelope(`{"v":1,"id":"c1","relay":"ON","ok":true}`)
+	require.True(t, ok)
+	assert.Equal(t, StatusTypeStatus, env.Type)
+	assert.Equal(t, RelayOn, ParseStatus(`{"v":1,"id":"c1","relay":"ON","ok":true}`).Relay)
+
+	env, ok = ParseStatusEnvelope(`{"v":1,"type":"heartbeat","rssi":-67,"uptime":86400,"error":"brownout"}`)
+	require.True(t, ok)
+	assert.Equal(t, StatusTypeHeartbeat, env.Type)
+	require.NotNil(t, env.RSSI)
+	assert.Equal(t, -67, *env.RSSI)
+	assert.Equal(t, int64(86400), env.Uptime)
+	assert.Equal(t, "brownout", env.Error)
+
+	for _, legacy := range []string{"ON", `{"relay":"ON"}`, "{broken"} {
+		_, ok := ParseStatusEnvelope(legacy)
+		assert.False(t, ok, legacy)
+	}
+}
+
+func TestNegotiateHello(t *testing.T) {
+	caps := NegotiateHello(StatusEnvelope{V: 1, Protocols: []int{1, 2}, Commands: []string{"ON", "OFF", "WARN"}})
+	assert.Equal(t, 1, caps.Protocol)
+	assert.True(t, caps.Supports("WARN5"))
+	assert.True(t, caps.Supports(CommandHello))
+	assert.False(t, caps.Supports("BEEP"))
+
+	assert.Equal(t, 0, NegotiateHello(StatusEnvelope{V: 2, Protocols: []int{2}}).Protocol)
+	assert.Equal(t, 1, NegotiateHello(StatusEnvelope{V: 1}).Protocol)
+	assert.True(t, Capabilities{Protocol: 1}.Supports("BEEP"))
+}
+
+func TestRegistry_EncodePerDevice(t *testing.T) {
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{{ConsoleID: 1, DeviceID: "legacy"}, {ConsoleID: 2, DeviceID: "modern"}})
+	reg.SetCapabilities("modern", Capabilities{Protocol: 1, Commands: []string{"ON", "OFF"}})
+
+	p, ok := reg.Encode(reg.Resolve(1), "ps", "ON", "c1")
+	assert.True(t, ok)
+	assert.Equal(t, "ON", p)
+
+	p, ok = reg.Encode(reg.Resolve(2), "ps", "ON", "c1")
+	require.True(t, ok)
+	var env CommandEnvelope
+	require.NoError(t, json.Unmarshal([]byte(p), &env))
+	assert.Equal(t, "ON", env.Command)
+	assert.Equal(t, "c1", env.ID)
+	assert.WithinDuration(t, time.Now(), env.IssuedAt, time.Second)
+
+	_, ok = reg.Encode(reg.Resolve(2), "ps", "WARN5", "")
+	assert.False(t, ok, "unsupported commands are skipped")
+
+	// capabilities survive a reload of the device table
+	reg.Replace([]Device{{ConsoleID: 2, DeviceID: "modern"}})
+	_, ok = reg.Capabilities("modern")
+	assert.True(t, ok)
+
+	var nilReg *Registry
+	p, ok = nilReg.Encode(nilReg.Resolve(3), "ps", "OFF", "")
+	assert.True(t, ok)
+	assert.Equal(t, "OFF", p)
+}
+
+func TestDeviceHub_SendsEnvelopeAfterHandshake(t *testing.T) {
+	reg := wsRegistry()
+	h := NewDeviceHub(DeviceHubOptions{Registry: reg})
+	conn := newFakeConn()
+	go h.Serve(4, conn)
+	defer conn.Close()
+	require.Eventually(t, func() bool { return h.Connected(4) }, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, h.SendWithID(4, "ON", "c1"))
+	reg.SetCapabilities("board-4", Capabilities{Protocol: 1})
+	require.NoError(t, h.SendWithID(4, "OFF", "c2"))
+
+	out := conn.written()
+	require.Len(t, out, 2)
+	assert.Equal(t, "ON", out[0])
+	var env CommandEnvelope
+	require.NoError(t, json.Unmarshal([]byte(out[1]), &env))
+	assert.Equal(t, CommandEnvelope{V: 1, ID: "c2", Command: "OFF", IssuedAt: env.IssuedAt, Expiry: env.Expiry}, env)
+}
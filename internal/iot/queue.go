@@ -0,0 +1,114 @@
+package iot
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// QueuedCommand is a command waiting in a CommandQueue.
+type QueuedCommand struct {
+	ID        int64
+	ConsoleID int64
+	Command   string
+	QueuedAt  time.Time
+}
+
+// CommandQueue persists undeliverable commands. Enqueue is expected to
+// collapse stale entries so only the latest desired state of a console is
+// replayed; Pending lists the queue in delivery order.
+type CommandQueue interface {
+	Enqueue(consoleID int64, cmd string, cause error) error
+	Pending() ([]QueuedCommand, error)
+	Done(id int64) error
+	Failed(id int64, cause error) error
+	Clear(consoleID int64) error
+	Len() (int, error)
+}
+
+// QueuedSender is a CommandSender that queues commands its inner sender
+// failed to deliver and replays them once the transport is back. Send still
+// returns the delivery error so callers can report it.
+type QueuedSender struct {
+	inner    CommandSender
+	queue    CommandQueue
+	replayMu sync.Mutex // one replay at a time
+}
+
+// NewQueuedSender wraps inner with the durable queue q.
+func NewQueuedSender(inner CommandSender, q CommandQueue) *QueuedSender {
+	return &QueuedSender{inner: inner, queue: q}
+}
+
+// Send delivers cmd; on failure the command is queued for Replay, except IR
+// codes which are only useful right away and commands the device does not
+// support. A relay
+// command that gets through supersedes whatever was queued for the console.
+func (s *QueuedSender) Send(consoleID int64, cmd string) error {
+	err := s.inner.Send(consoleID, cmd)
+	if err != nil {
+		if isIRCommand(cmd) || errors.Is(err, ErrUnsupportedCommand) {
+			return err
+		}
+		if qerr := s.queue.Enqueue(consoleID, cmd, err); qerr != nil {
+			log.Printf("queue %s for console %d: %v", cmd, consoleID, qerr)
+		}
+		return err
+	}
+	if isRelayCommand(cmd) {
+		if qerr := s.queue.Clear(consoleID); qerr != nil {
+			log.Printf("clear command queue of console %d: %v", consoleID, qerr)
+		}
+	}
+	return nil
+}
+
+// Replay tries to deliver the queued commands in order and returns how many
+// got through. Once a command of a console fails, the console's later
+// commands wait for the next replay so their order is kept. Warnings whose
+// countdown ran out while queued are dropped: the session they announced
+// has ended (or was extended, which re-arms the warning).
+func (s *QueuedSender) Replay() (int, error) {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+	pending, err := s.queue.Pending()
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	blocked := make(map[int64]bool)
+	for _, c := range pending {
+		if blocked[c.ConsoleID] {
+			continue
+		}
+		if left, ok := warningRemaining(c.Command); ok && !c.QueuedAt.IsZero() && time.Since(c.QueuedAt) >= left {
+			log.Printf("drop expired %s queued for console %d", c.Command, c.ConsoleID)
+			if err := s.queue.Done(c.ID); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if err := s.inner.Send(c.ConsoleID, c.Command); err != nil {
+			blocked[c.ConsoleID] = true
+			if qerr := s.queue.Failed(c.ID, err); qerr != nil {
+				return sent, qerr
+			}
+			continue
+		}
+		sent++
+		if err := s.queue.Done(c.ID); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// Depth returns the number of queued commands (0 if the queue is unreadable).
+func (s *QueuedSender) Depth() int {
+	n, err := s.queue.Len()
+	if err != nil {
+		return 0
+	}
+	return n
+}
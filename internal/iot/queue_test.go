@@ -0,0 +1,182 @@
+package iot
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memQueue is an in-memory CommandQueue with the collapsing rules of the
+// command_queue table.
+type memQueue struct {
+	next  int64
+	items []QueuedCommand
+}
+
+func (q *memQueue) Enqueue(consoleID int64, cmd string, _ error) error {
+	kept := q.items[:0]
+	for _, c := range q.items {
+		if c.ConsoleID == consoleID && (isRelayCommand(cmd) || !isRelayCommand(c.Command)) {
+			continue
+		}
+		kept = append(kept, c)
+	}
+	q.next++
+	q.items = append(kept, QueuedCommand{ID: q.next, ConsoleID: consoleID, Command: cmd})
+	return nil
+}
+
+func (q *memQueue) Pending() ([]QueuedCommand, error) {
+	return append([]QueuedCommand(nil), q.items...), nil
+}
+
+func (q *memQueue) Done(id int64) error {
+	for i, c := range q.items {
+		if c.ID == id {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (q *memQueue) Failed(int64, error) error { return nil }
+
+func (q *memQueue) Clear(consoleID int64) error {
+	kept := q.items[:0]
+	for _, c := range q.items {
+		if c.ConsoleID != consoleID {
+			kept = append(kept, c)
+		}
+	}
+	q.items = kept
+	return nil
+}
+
+func (q *memQueue) Len() (int, error) { return len(q.items), nil }
+
+// flakySender fails while down (for all consoles or the listed ones) and
+// records delivered commands.
+type flakySender struct {
+	mu   sync.Mutex
+	down map[int64]bool
+	all  bool
+	sent []string
+}
+
+func (f *flakySender) Send(consoleID int64, cmd string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.all || f.down[consoleID] {
+		return errors.New("mqtt not connected")
+	}
+	f.sent = append(f.sent, cmd)
+	return nil
+}
+
+func TestQueuedSender_CollapsesAndReplays(t *testing.T) {
+	inner := &flakySender{all: true}
+	q := &memQueue{}
+	s := NewQueuedSender(inner, q)
+
+	assert.Error(t, s.Send(1, "OFF"))
+	assert.Error(t, s.Send(1, "WARN5"))
+	assert.Error(t, s.Send(1, "ON")) // supersedes OFF and the warning
+	assert.Error(t, s.Send(2, "OFF"))
+	assert.Equal(t, 2, s.Depth())
+
+	n, err := s.Replay()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Equal(t, 2, s.Depth())
+
+	inner.all = false
+	n, err = s.Replay()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"ON", "OFF"}, inner.sent)
+	assert.Zero(t, s.Depth())
+}
+
+func TestQueuedSender_DirectSendClearsQueue(t *testing.T) {
+	inner := &flakySender{all: true}
+	q := &memQueue{}
+	s := NewQueuedSender(inner, q)
+
+	assert.Error(t, s.Send(1, "OFF"))
+	inner.all = false
+	require.NoError(t, s.Send(1, "ON"))
+	assert.Zero(t, s.Depth(), "stale OFF must not be replayed after ON got through")
+}
+
+func TestQueuedSender_ReplayKeepsOrderPerConsole(t *testing.T) {
+	inner := &flakySender{all: true}
+	q := &memQueue{}
+	s := NewQueuedSender(inner, q)
+
+	assert.Error(t, s.Send(1, "ON"))
+	assert.Error(t, s.Send(1, "WARN1"))
+	assert.Error(t, s.Send(2, "OFF"))
+
+	inner.all = false
+	inner.down = map[int64]bool{1: true}
+	n, err := s.Replay()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"OFF"}, inner.sent)
+	pending, _ := q.Pending()
+	require.Len(t, pending, 2)
+	assert.Equal(t, "ON", pending[0].Command)
+}
+
+func TestQueuedSender_DropsExpiredWarnings(t *testing.T) {
+	q := &memQueue{items: []QueuedCommand{
+		{ID: 1, ConsoleID: 1, Command: "WARN5", QueuedAt: time.Now().Add(-10 * time.Minute)},
+		{ID: 2, ConsoleID: 2, Command: "WARN5", QueuedAt: time.Now().Add(-time.Minute)},
+	}, next: 2}
+	inner := &flakySender{}
+	s := NewQueuedSender(inner, q)
+
+	n, err := s.Replay()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"WARN5"}, inner.sent, "only the warning of the running session")
+	assert.Zero(t, s.Depth())
+}
+
+func TestIdempotentSender_ReplayedOffDoesNotSuppressNextOn(t *testing.T) {
+	inner := &flakySender{}
+	q := &memQueue{}
+	s := NewIdempotentSender(NewQueuedSender(inner, q))
+
+	require.NoError(t, s.Send(1, "ON"))
+	inner.all = true
+	assert.Error(t, s.Send(1, "OFF"))
+	inner.all = false
+	n, err := NewQueuedSender(inner, q).Replay()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	require.NoError(t, s.Send(1, "ON"), "next session")
+	assert.Equal(t, []string{"ON", "OFF", "ON"}, inner.sent)
+}
+
+// unsupportedSender rejects every command like a device without a
+// warning capability.
+type unsupportedSender struct{}
+
+func (unsupportedSender) Send(_ int64, cmd string) error {
+	return fmt.Errorf("%w: %s", ErrUnsupportedCommand, cmd)
+}
+
+func TestQueuedSender_DoesNotQueueUnsupported(t *testing.T) {
+	s := NewQueuedSender(unsupportedSender{}, &memQueue{})
+
+	assert.ErrorIs(t, s.Send(1, "WARN5"), ErrUnsupportedCommand)
+	assert.Zero(t, s.Depth(), "retrying cannot help")
+}
@@ -0,0 +1,339 @@
+package iot
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Transports name the ways of reaching a device.
+const (
+	TransportMQTT   = "mqtt"
+	TransportHTTP   = "http"
+	TransportWS     = "ws"     // boards connected to /device/ws
+	TransportGPIO   = "gpio"   // relays on the host's own GPIO header
+	TransportModbus = "modbus" // Modbus TCP/RTU relay boards
+	TransportSerial = "serial" // USB serial relay boards
+)
+
+// Default templates reproduce the legacy <prefix>/<id>/cmd convention.
+const (
+	DefaultCommandTopic = "{prefix}/{device}/cmd"
+	DefaultStatusTopic  = "{prefix}/{device}/status"
+	DefaultPayload      = "{cmd}"
+)
+
+// Device maps a console to the hardware endpoint that switches it.
+// Topic and payload fields are templates; supported placeholders are
+// {prefix}, {device}, {console}, {cmd}, {cmd_lower}, {id} (command
+// correlation ID) and, for output channel commands such as ON:1, {action}
+// (ON) and {channel} (1, empty for the console relay). Empty templates fall
+// back to the defaults above.
+// Options holds transport specific settings as JSON (see HTTPOptions).
+// Fallback lists further transports reaching the same device, tried in
+// order when Transport fails; their settings share Options or are keyed by
+// transport (see OptionsFor).
+type Device struct {
+	ConsoleID    int64           `json:"console_id"`
+	DeviceID     string          `json:"device_id"`
+	Transport    string          `json:"transport"`
+	CommandTopic string          `json:"command_topic"`
+	StatusTopic  string          `json:"status_topic"`
+	Payload      string          `json:"payload"`
+	Options      json.RawMessage `json:"options,omitempty"`
+	Fallback     []string        `json:"fallback,omitempty"`
+}
+
+// IsTransport reports whether t names a transport of this package.
+func IsTransport(t string) bool {
+	switch t {
+	case TransportMQTT, TransportHTTP, TransportWS, TransportGPIO, TransportModbus, TransportSerial:
+		return true
+	}
+	return false
+}
+
+// OptionsFor returns the settings of transport t. Options are either
+// shared by the whole chain or keyed by transport, e.g.
+// {"modbus":{"address":"10.0.0.50:502"},"serial":{"port":"/dev/ttyUSB0"}}
+// for a board reachable both ways.
+func (d Device) OptionsFor(t string) json.RawMessage {
+	if per, ok := d.transportOptions(); ok {
+		return per[t]
+	}
+	return d.Options
+}
+
+// SharedOptions reports whether Options is shared by the whole chain
+// rather than keyed by transport.
+func (d Device) SharedOptions() bool {
+	_, keyed := d.transportOptions()
+	return !keyed
+}
+
+// transportOptions decodes Options keyed by transport; ok is false when
+// Options is not such an object.
+func (d Device) transportOptions() (map[string]json.RawMessage, bool) {
+	var m map[string]json.RawMessage
+	if json.Unmarshal(d.Options, &m) != nil || len(m) == 0 {
+		return nil, false
+	}
+	for k, v := range m {
+		if !IsTransport(k) || !strings.HasPrefix(strings.TrimSpace(string(v)), "{") {
+			return nil, false
+		}
+	}
+	return m, true
+}
+
+// Chain returns the transports to try in order: Transport, then Fallback.
+func (d Device) Chain() []string {
+	chain := []string{d.Transport}
+	for _, t := range d.Fallback {
+		if !slices.Contains(chain, t) {
+			chain = append(chain, t)
+		}
+	}
+	return chain
+}
+
+// Uses reports whether t is the device's transport or one of its fallbacks.
+func (d Device) Uses(t string) bool {
+	return d.Transport == t || slices.Contains(d.Fallback, t)
+}
+
+// expand fills the template placeholders for this device.
+func (d Device) expand(tmpl, prefix, cmd, id string) string {
+	action, ch := SplitOutput(cmd)
+	channel := ""
+	if ch >= 0 {
+		channel = strconv.Itoa(ch)
+	}
+	return strings.NewReplacer(
+		"{prefix}", prefix,
+		"{device}", d.DeviceID,
+		"{console}", strconv.FormatInt(d.ConsoleID, 10),
+		"{cmd}", cmd,
+		"{cmd_lower}", strings.ToLower(cmd),
+		"{id}", id,
+		"{action}", action,
+		"{channel}", channel,
+	).Replace(tmpl)
+}
+
+// CommandTopicFor returns the expanded command topic.
+func (d Device) CommandTopicFor(prefix string) string {
+	return d.expand(orDefault(d.CommandTopic, DefaultCommandTopic), prefix, "", "")
+}
+
+// StatusTopicFor returns the expanded status topic.
+func (d Device) StatusTopicFor(prefix string) string {
+	return d.expand(orDefault(d.StatusTopic, DefaultStatusTopic), prefix, "", "")
+}
+
+// TopicFilters lists the topics and subscription filters the device itself
+// may use on the embedded broker: its command and status topics plus its
+// heartbeat, availability and power topics, or the vendor namespaces of a
+// device with a profile. Per-command placeholders become + wildcards.
+func (d Device) TopicFilters(prefix string) []string {
+	if p, _, ok, err := d.Profile(); err != nil {
+		return nil
+	} else if ok {
+		return p.Namespaces(d)
+	}
+	wildcards := strings.NewReplacer("{cmd}", "+", "{cmd_lower}", "+", "{id}", "+", "{action}", "+", "{channel}", "+")
+	own := prefix + "/" + d.DeviceID + "/"
+	return []string{
+		d.expand(wildcards.Replace(orDefault(d.CommandTopic, DefaultCommandTopic)), prefix, "", ""),
+		d.expand(wildcards.Replace(orDefault(d.StatusTopic, DefaultStatusTopic)), prefix, "", ""),
+		own + "heartbeat",
+		own + "availability",
+		own + "power",
+	}
+}
+
+// PayloadFor renders a command with the payload template; id is the
+// correlation ID (may be empty).
+func (d Device) PayloadFor(prefix, cmd, id string) string {
+	return d.expand(orDefault(d.Payload, DefaultPayload), prefix, cmd, id)
+}
+
+func orDefault(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// DeviceSource loads the persisted console-to-device mappings.
+type DeviceSource func() ([]Device, error)
+
+// Registry is a thread-safe, in-memory view of the device table used by the
+// transports to resolve consoles to devices and back. Consoles without an
+// entry resolve to a legacy device whose ID is the console ID.
+type Registry struct {
+	mu        sync.RWMutex
+	source    DeviceSource
+	byConsole map[int64]Device
+	byDevice  map[string]Device
+	listeners []registryListener
+	nextID    int
+	caps      map[string]Capabilities // protocol handshakes by device ID
+}
+
+type registryListener struct {
+	id int
+	fn func()
+}
+
+// NewRegistry creates an empty registry backed by src (may be nil).
+func NewRegistry(src DeviceSource) *Registry {
+	return &Registry{source: src, byConsole: make(map[int64]Device), byDevice: make(map[string]Device)}
+}
+
+// Reload refreshes the registry from its source and notifies listeners.
+func (r *Registry) Reload() error {
+	if r.source == nil {
+		return nil
+	}
+	devs, err := r.source()
+	if err != nil {
+		return err
+	}
+	r.Replace(devs)
+	return nil
+}
+
+// Replace swaps the registry contents and notifies listeners.
+func (r *Registry) Replace(devs []Device) {
+	byConsole := make(map[int64]Device, len(devs))
+	byDevice := make(map[string]Device, len(devs))
+	for _, d := range devs {
+		if d.Transport == "" {
+			d.Transport = TransportMQTT
+		}
+		byConsole[d.ConsoleID] = d
+		byDevice[d.DeviceID] = d
+	}
+	r.mu.Lock()
+	r.byConsole, r.byDevice = byConsole, byDevice
+	listeners := append([]registryListener{}, r.listeners...)
+	r.mu.Unlock()
+	for _, l := range listeners {
+		l.fn()
+	}
+}
+
+// OnChange registers fn to be called after every Replace/Reload and returns
+// a function that unregisters it.
+func (r *Registry) OnChange(fn func()) (remove func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	id := r.nextID
+	r.listeners = append(r.listeners, registryListener{id: id, fn: fn})
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for i, l := range r.listeners {
+			if l.id == id {
+				r.listeners = append(r.listeners[:i], r.listeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Lookup returns the registered device of a console.
+func (r *Registry) Lookup(consoleID int64) (Device, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, ok := r.byConsole[consoleID]
+	return d, ok
+}
+
+// LookupDevice returns a registered device by its device identifier.
+func (r *Registry) LookupDevice(deviceID string) (Device, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, ok := r.byDevice[deviceID]
+	return d, ok
+}
+
+// Resolve returns the registered device of a console or the legacy default.
+// A nil registry always resolves to the legacy default.
+func (r *Registry) Resolve(consoleID int64) Device {
+	if r != nil {
+		if d, ok := r.Lookup(consoleID); ok {
+			return d
+		}
+	}
+	return Device{ConsoleID: consoleID, DeviceID: strconv.FormatInt(consoleID, 10), Transport: TransportMQTT}
+}
+
+// ConsoleFor maps a device identifier back to its console. Unregistered
+// numeric identifiers are treated as legacy console IDs unless that console
+// is mapped to a different device.
+func (r *Registry) ConsoleFor(deviceID string) (int64, bool) {
+	if r != nil {
+		r.mu.RLock()
+		d, ok := r.byDevice[deviceID]
+		r.mu.RUnlock()
+		if ok {
+			return d.ConsoleID, true
+		}
+	}
+	id, err := strconv.ParseInt(deviceID, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if r != nil {
+		if _, taken := r.Lookup(id); taken {
+			return 0, false
+		}
+	}
+	return id, true
+}
+
+// Supports reports whether the device of a console announced cmd in its
+// protocol handshake. Devices without a handshake report false, since
+// nothing is known about what their firmware understands.
+func (r *Registry) Supports(consoleID int64, cmd string) bool {
+	caps, ok := r.Capabilities(r.Resolve(consoleID).DeviceID)
+	return ok && caps.Protocol >= 1 && caps.Supports(cmd)
+}
+
+// Accepts reports whether cmd can be delivered to the device of a console:
+// devices that negotiated the JSON protocol take the commands they
+// announced, vendor profiles the commands they have an equivalent for, and
+// legacy devices anything their payload template renders. Callers sending
+// optional commands (warnings) check it to skip devices instead of getting
+// ErrUnsupportedCommand.
+func (r *Registry) Accepts(consoleID int64, cmd string) bool {
+	dev := r.Resolve(consoleID)
+	if caps, ok := r.Capabilities(dev.DeviceID); ok && caps.Protocol >= 1 && !caps.Supports(cmd) {
+		return false
+	}
+	if p, o, ok, err := dev.Profile(); err == nil && ok {
+		channel := o.Channel
+		if action, ch := SplitOutput(cmd); ch >= 0 {
+			cmd, channel = action, ch
+		}
+		_, _, ok = p.Command(dev, channel, cmd)
+		return ok
+	}
+	return true
+}
+
+// All returns a snapshot of the registered devices.
+func (r *Registry) All() []Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make([]Device, 0, len(r.byConsole))
+	for _, d := range r.byConsole {
+		res = append(res, d)
+	}
+	return res
+}
@@ -0,0 +1,156 @@
+package iot
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_ResolveDefaults(t *testing.T) {
+	var reg *Registry
+
+	dev := reg.Resolve(3)
+	assert.Equal(t, "3", dev.DeviceID)
+	assert.Equal(t, "ps/3/cmd", dev.CommandTopicFor("ps"))
+	assert.Equal(t, "ps/3/status", dev.StatusTopicFor("ps"))
+	assert.Equal(t, "ON", dev.PayloadFor("ps", "ON", "abc"))
+}
+
+func TestRegistry_ResolveRegistered(t *testing.T) {
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{{
+		ConsoleID:    1,
+		DeviceID:     "relay-a",
+		CommandTopic: "shop/{device}/relay/set",
+		Payload:      "{\"state\":\"{cmd}\",\"console\":{console},\"id\":\"{id}\"}",
+	}})
+
+	dev := reg.Resolve(1)
+	assert.Equal(t, TransportMQTT, dev.Transport)
+	assert.Equal(t, "shop/relay-a/relay/set", dev.CommandTopicFor("ps"))
+	assert.Equal(t, "ps/relay-a/status", dev.StatusTopicFor("ps"))
+	assert.Equal(t, `{"state":"OFF","console":1,"id":"c1"}`, dev.PayloadFor("ps", "OFF", "c1"))
+}
+
+func TestRegistry_ConsoleFor(t *testing.T) {
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{{ConsoleID: 2, DeviceID: "relay-b"}})
+
+	id, ok := reg.ConsoleFor("relay-b")
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), id)
+
+	// legacy numeric id of an unregistered console
+	id, ok = reg.ConsoleFor("4")
+	assert.True(t, ok)
+	assert.Equal(t, int64(4), id)
+
+	// console 2 is wired to relay-b, so a device calling itself "2" is unknown
+	_, ok = reg.ConsoleFor("2")
+	assert.False(t, ok)
+
+	_, ok = reg.ConsoleFor("unknown")
+	assert.False(t, ok)
+}
+
+func TestRegistry_Accepts(t *testing.T) {
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{
+		{ConsoleID: 2, DeviceID: "modern"},
+		profileDevice(`{"profile":"tasmota"}`),
+	})
+	reg.SetCapabilities("modern", Capabilities{Protocol: 1, Commands: []string{"ON", "OFF"}})
+
+	assert.True(t, reg.Accepts(3, "WARN5"), "legacy devices get every command")
+	assert.True(t, reg.Accepts(2, "ON:1"))
+	assert.False(t, reg.Accepts(2, "WARN5"), "not announced")
+	assert.True(t, reg.Accepts(1, "OFF"))
+	assert.False(t, reg.Accepts(1, "WARN5"), "no vendor equivalent")
+}
+
+func TestDevice_OptionsFor(t *testing.T) {
+	shared := Device{Transport: TransportMQTT, Fallback: []string{TransportHTTP}, Options: json.RawMessage(`{"profile":"tasmota","url":"http://10.0.0.32/cm"}`)}
+	assert.True(t, shared.SharedOptions())
+	assert.Equal(t, shared.Options, shared.OptionsFor(TransportHTTP))
+
+	d := Device{Transport: TransportModbus, Fallback: []string{TransportSerial},
+		Options: json.RawMessage(`{"modbus":{"address":"10.0.0.50:502","channels":[4]},"serial":{"port":"/dev/ttyUSB0","channels":[3]}}`)}
+	assert.False(t, d.SharedOptions())
+	mb, err := d.Modbus()
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.50:502", mb.Address)
+	assert.Equal(t, []int{4}, mb.Channels)
+	sr, err := d.SerialRelay()
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/ttyUSB0", sr.Port)
+	assert.Equal(t, []int{3}, sr.Channels)
+	assert.Nil(t, d.OptionsFor(TransportHTTP))
+}
+
+func TestRegistry_OnChange(t *testing.T) {
+	calls := 0
+	reg := NewRegistry(func() ([]Device, error) {
+		return []Device{{ConsoleID: 1, DeviceID: "a"}}, nil
+	})
+	remove := reg.OnChange(func() { calls++ })
+
+	assert.NoError(t, reg.Reload())
+	assert.Equal(t, 1, calls)
+	assert.Len(t, reg.All(), 1)
+
+	remove()
+	assert.NoError(t, reg.Reload())
+	assert.Equal(t, 1, calls)
+}
+
+func TestMQTTSender_ConsoleForStatus(t *testing.T) {
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{
+		{ConsoleID: 1, DeviceID: "relay-a"},
+		{ConsoleID: 2, DeviceID: "relay-b", StatusTopic: "shop/relay-b/state"},
+	})
+	m := &MQTTSender{prefix: "ps", registry: reg}
+
+	tests := []struct {
+		topic string
+		id    int64
+		ok    bool
+	}{
+		{"ps/relay-a/status", 1, true},
+		{"shop/relay-b/state", 2, true},
+		{"ps/5/status", 5, true},
+		{"ps/1/status", 0, false},
+		{"ps/relay-a/cmd", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			id, ok := m.consoleForStatus(tt.topic)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.id, id)
+		})
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	assert.True(t, topicMatches("ps/+/status", "ps/1/status"))
+	assert.False(t, topicMatches("ps/+/status", "ps/1/state"))
+	assert.False(t, topicMatches("ps/+/status", "ps/a/b/status"))
+	assert.True(t, topicMatches("ps/#", "ps/a/b/status"))
+}
+
+func TestMQTTSender_ConsoleForHeartbeat(t *testing.T) {
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{{ConsoleID: 1, DeviceID: "relay-a"}})
+	m := &MQTTSender{prefix: "ps", registry: reg}
+
+	id, ok := m.consoleForTopic("ps/relay-a/heartbeat", "heartbeat")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), id)
+	id, ok = m.consoleForTopic("ps/3/availability", "availability")
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), id)
+	_, ok = m.consoleForTopic("ps/relay-a/status", "heartbeat")
+	assert.False(t, ok)
+}
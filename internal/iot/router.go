@@ -0,0 +1,150 @@
+package iot
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TransportAlert may end a device's fallback chain: when every transport
+// before it failed, the router raises an alert (see SetAlert) instead of
+// dropping the command quietly.
+const TransportAlert = "alert"
+
+// TransportMock is reported as the delivering transport when a command only
+// reached the in-memory MockSender.
+const TransportMock = "mock"
+
+// DeliveryAttempt is one transport tried for a command.
+type DeliveryAttempt struct {
+	Transport string `json:"transport"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Delivery reports how a command was routed: the transports tried in
+// order and the one that accepted it (empty when none did).
+type Delivery struct {
+	Command   string            `json:"command"`
+	Transport string            `json:"transport,omitempty"`
+	Attempts  []DeliveryAttempt `json:"attempts"`
+	Alerted   bool              `json:"alerted,omitempty"`
+	At        time.Time         `json:"at"`
+}
+
+// Fallback reports whether the command was delivered by a transport other
+// than the first one tried.
+func (d Delivery) Fallback() bool {
+	return d.Transport != "" && len(d.Attempts) > 1
+}
+
+// TransportRouter is a CommandSender that delivers each command through the
+// sender registered for the transport of the console's device, so consoles
+// can be switched by MQTT, HTTP, ... side by side. When that transport
+// fails, the device's fallback transports are tried in order.
+type TransportRouter struct {
+	registry   *Registry
+	mu         sync.RWMutex
+	routes     map[string]CommandSender
+	deliveries map[int64]Delivery
+	onDelivery func(consoleID int64, d Delivery)
+	alert      func(consoleID int64, cmd string, cause error)
+}
+
+// NewTransportRouter creates a router resolving devices through reg.
+func NewTransportRouter(reg *Registry) *TransportRouter {
+	return &TransportRouter{registry: reg, routes: make(map[string]CommandSender), deliveries: make(map[int64]Delivery)}
+}
+
+// Set registers the sender of a transport; nil removes it. Senders can be
+// replaced at runtime, e.g. after reconnecting MQTT.
+func (r *TransportRouter) Set(transport string, s CommandSender) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s == nil {
+		delete(r.routes, transport)
+		return
+	}
+	r.routes[transport] = s
+}
+
+// Get returns the sender of a transport.
+func (r *TransportRouter) Get(transport string) CommandSender {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.routes[transport]
+}
+
+// OnDelivery sets a callback receiving the delivery report of every command.
+func (r *TransportRouter) OnDelivery(fn func(consoleID int64, d Delivery)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onDelivery = fn
+}
+
+// SetAlert sets the function called when a chain reaches TransportAlert;
+// cause holds the errors of the transports tried.
+func (r *TransportRouter) SetAlert(fn func(consoleID int64, cmd string, cause error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.alert = fn
+}
+
+// LastDelivery returns the delivery report of the last command routed to a
+// console.
+func (r *TransportRouter) LastDelivery(consoleID int64) (Delivery, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, ok := r.deliveries[consoleID]
+	return d, ok
+}
+
+// Send routes the command by the console's device transport, falling back
+// along the device's chain until a transport accepts it.
+func (r *TransportRouter) Send(consoleID int64, cmd string) error {
+	dev := r.registry.Resolve(consoleID)
+	d := Delivery{Command: cmd, At: time.Now()}
+	var errs []error
+	for _, t := range dev.Chain() {
+		if t == TransportAlert {
+			r.mu.RLock()
+			alert := r.alert
+			r.mu.RUnlock()
+			if alert != nil {
+				alert(consoleID, cmd, errors.Join(errs...))
+				d.Alerted = true
+			}
+			break
+		}
+		s := r.Get(t)
+		var err error
+		if s == nil {
+			err = fmt.Errorf("no sender for transport %q", t)
+		} else {
+			err = s.Send(consoleID, cmd)
+		}
+		attempt := DeliveryAttempt{Transport: t}
+		if err != nil {
+			attempt.Error = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", t, err))
+		} else if _, mock := s.(*MockSender); mock {
+			attempt.Transport = TransportMock
+		}
+		d.Attempts = append(d.Attempts, attempt)
+		if err == nil {
+			d.Transport = attempt.Transport
+			break
+		}
+	}
+	r.mu.Lock()
+	r.deliveries[consoleID] = d
+	notify := r.onDelivery
+	r.mu.Unlock()
+	if notify != nil {
+		notify(consoleID, d)
+	}
+	if d.Transport == "" {
+		return fmt.Errorf("console %d: %w", consoleID, errors.Join(errs...))
+	}
+	return nil
+}
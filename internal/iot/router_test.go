@@ -0,0 +1,82 @@
+package iot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportRouter_Fallback(t *testing.T) {
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{{ConsoleID: 1, DeviceID: "plug-1", Transport: TransportMQTT, Fallback: []string{TransportHTTP, TransportAlert}}})
+	mqttSide := &flakySender{all: true}
+	httpSide := &flakySender{}
+	r := NewTransportRouter(reg)
+	r.Set(TransportMQTT, mqttSide)
+	r.Set(TransportHTTP, httpSide)
+	var reports []Delivery
+	r.OnDelivery(func(id int64, d Delivery) { reports = append(reports, d) })
+	var alerts []string
+	r.SetAlert(func(id int64, cmd string, cause error) { alerts = append(alerts, cmd+": "+cause.Error()) })
+
+	require.NoError(t, r.Send(1, "ON"))
+	assert.Equal(t, []string{"ON"}, httpSide.sent)
+	d, ok := r.LastDelivery(1)
+	require.True(t, ok)
+	assert.Equal(t, TransportHTTP, d.Transport)
+	assert.True(t, d.Fallback())
+	assert.Equal(t, []DeliveryAttempt{{Transport: TransportMQTT, Error: "mqtt not connected"}, {Transport: TransportHTTP}}, d.Attempts)
+	assert.Empty(t, alerts)
+
+	// both transports down: the chain ends in an alert and the error names each
+	httpSide.all = true
+	err := r.Send(1, "OFF")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "http: mqtt not connected")
+	require.Len(t, alerts, 1)
+	assert.Contains(t, alerts[0], "OFF: mqtt: mqtt not connected")
+	d, _ = r.LastDelivery(1)
+	assert.Empty(t, d.Transport)
+	assert.True(t, d.Alerted)
+	assert.Len(t, reports, 2)
+}
+
+func TestTransportRouter_UnsupportedFallsBack(t *testing.T) {
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{{ConsoleID: 1, DeviceID: "plug-1", Transport: TransportMQTT, Fallback: []string{TransportHTTP}}})
+	httpSide := &flakySender{}
+	r := NewTransportRouter(reg)
+	r.Set(TransportMQTT, unsupportedSender{})
+	r.Set(TransportHTTP, httpSide)
+
+	require.NoError(t, r.Send(1, "WARN5"))
+	assert.Equal(t, []string{"WARN5"}, httpSide.sent)
+
+	r.Set(TransportHTTP, unsupportedSender{})
+	assert.ErrorIs(t, r.Send(1, "WARN5"), ErrUnsupportedCommand)
+}
+
+func TestTransportRouter_MissingRouteIsNotMocked(t *testing.T) {
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{{ConsoleID: 1, DeviceID: "plug-1", Transport: TransportMQTT, Fallback: []string{TransportHTTP}}})
+	httpSide := NewMockSender()
+	r := NewTransportRouter(reg)
+	r.Set(TransportHTTP, httpSide)
+
+	// no MQTT route registered: the HTTP fallback delivers
+	require.NoError(t, r.Send(1, "ON"))
+	d, _ := r.LastDelivery(1)
+	assert.Contains(t, d.Attempts[0].Error, `no sender for transport "mqtt"`)
+	// the mock is reported as such, never as a real transport
+	assert.Equal(t, TransportMock, d.Transport)
+
+	assert.Error(t, r.Send(2, "ON"), "legacy console without MQTT")
+}
+
+func TestDeviceChain(t *testing.T) {
+	d := Device{Transport: TransportMQTT, Fallback: []string{TransportHTTP, TransportMQTT, TransportAlert}}
+	assert.Equal(t, []string{TransportMQTT, TransportHTTP, TransportAlert}, d.Chain())
+	assert.True(t, d.Uses(TransportHTTP))
+	assert.False(t, d.Uses(TransportWS))
+}
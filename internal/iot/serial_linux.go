@@ -0,0 +1,65 @@
+//go:build linux
+
+package iot
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var serialBauds = map[int]uint32{
+	1200: unix.B1200, 2400: unix.B2400, 4800: unix.B4800, 9600: unix.B9600,
+	19200: unix.B19200, 38400: unix.B38400, 57600: unix.B57600,
+	115200: unix.B115200, 230400: unix.B230400,
+}
+
+// openSerial opens a serial port in raw mode, 8 data bits and one stop bit.
+// Parity is "N", "E" or "O". The file stays non-blocking so read deadlines
+// work.
+func openSerial(path string, baud int, parity string) (*os.File, error) {
+	speed, ok := serialBauds[baud]
+	if !ok {
+		return nil, fmt.Errorf("serial: unsupported baud rate %d", baud)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var terr error
+	err = rc.Control(func(fd uintptr) {
+		t, err := unix.IoctlGetTermios(int(fd), unix.TCGETS)
+		if err != nil {
+			terr = err
+			return
+		}
+		t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF | unix.IXANY
+		t.Oflag &^= unix.OPOST
+		t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		t.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+		t.Cflag |= unix.CS8 | unix.CREAD | unix.CLOCAL | speed
+		switch parity {
+		case "E":
+			t.Cflag |= unix.PARENB
+		case "O":
+			t.Cflag |= unix.PARENB | unix.PARODD
+		}
+		t.Ispeed, t.Ospeed = speed, speed
+		t.Cc[unix.VMIN], t.Cc[unix.VTIME] = 1, 0
+		terr = unix.IoctlSetTermios(int(fd), unix.TCSETS, t)
+	})
+	if err == nil {
+		err = terr
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("serial %s: %w", path, err)
+	}
+	return f, nil
+}
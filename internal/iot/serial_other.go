@@ -0,0 +1,13 @@
+//go:build !linux
+
+package iot
+
+import (
+	"errors"
+	"os"
+)
+
+// openSerial is only implemented on Linux.
+func openSerial(path string, baud int, parity string) (*os.File, error) {
+	return nil, errors.New("serial: not supported on this platform")
+}
@@ -0,0 +1,480 @@
+package iot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SerialRelayOptions configures a console on a USB serial relay board,
+// stored in Device.Options. Prefer the stable /dev/serial/by-id/... path:
+// /dev/ttyUSBn may change when the board re-enumerates.
+type SerialRelayOptions struct {
+	Port      string `json:"port"`
+	Baud      int    `json:"baud"`     // default 9600
+	Protocol  string `json:"protocol"` // see SerialProtocolNames, default lctech
+	Relay     int    `json:"relay"`    // relay of the console, 1-based as printed on the board
+	Channels  []int  `json:"channels,omitempty"`
+	TimeoutMS int    `json:"timeout_ms"` // default 1000
+}
+
+// SerialRelay decodes and validates the serial options of a device.
+func (d Device) SerialRelay() (SerialRelayOptions, error) {
+	var o SerialRelayOptions
+	if raw := d.OptionsFor(TransportSerial); len(raw) > 0 {
+		if err := json.Unmarshal(raw, &o); err != nil {
+			return o, fmt.Errorf("invalid serial options: %w", err)
+		}
+	}
+	if o.Port == "" {
+		return o, errors.New("serial options: port required")
+	}
+	if o.Baud == 0 {
+		o.Baud = 9600
+	}
+	if o.Protocol == "" {
+		o.Protocol = SerialLCTech
+	}
+	if _, ok := LookupSerialProtocol(o.Protocol); !ok {
+		return o, fmt.Errorf("unknown serial protocol %q (supported: %s)", o.Protocol, strings.Join(SerialProtocolNames(), ", "))
+	}
+	if o.Relay == 0 {
+		o.Relay = 1
+	}
+	for _, r := range append([]int{o.Relay}, o.Channels...) {
+		if r < 1 || r > 32 {
+			return o, fmt.Errorf("serial options: invalid relay %d", r)
+		}
+	}
+	if o.TimeoutMS <= 0 {
+		o.TimeoutMS = 1000
+	}
+	return o, nil
+}
+
+// relay returns the relay of a channel (-1 is the console relay).
+func (o SerialRelayOptions) relay(channel int) (int, error) {
+	if channel < 0 {
+		return o.Relay, nil
+	}
+	if channel >= len(o.Channels) {
+		return 0, fmt.Errorf("serial: no relay for channel %d", channel)
+	}
+	return o.Channels[channel], nil
+}
+
+// ErrNoReadBack is returned by SerialProtocol.Get for boards that cannot
+// report their relay state.
+var ErrNoReadBack = errors.New("board cannot report relay state")
+
+// SerialProtocol speaks the command format of a family of serial relay
+// boards. Relays are 1-based.
+type SerialProtocol interface {
+	// Set switches a relay and consumes the board's reply, if any.
+	Set(port io.ReadWriter, relay int, on bool) error
+	// Get reads the state of a relay, or returns ErrNoReadBack.
+	Get(port io.ReadWriter, relay int) (bool, error)
+}
+
+// Built-in serial protocols.
+const (
+	SerialLCTech = "lctech" // CH340 boards taking A0 <relay> <state> <sum>
+	SerialAT     = "at"     // AT firmware: AT+CH<n>=<0|1>
+	SerialNumato = "numato" // Numato Lab: relay on <n>
+)
+
+var serialProtocols = map[string]SerialProtocol{
+	SerialLCTech: lctechProtocol{},
+	SerialAT:     atProtocol{},
+	SerialNumato: numatoProtocol{},
+}
+
+// LookupSerialProtocol returns a serial protocol by name.
+func LookupSerialProtocol(name string) (SerialProtocol, bool) {
+	p, ok := serialProtocols[name]
+	return p, ok
+}
+
+// SerialProtocolNames lists the serial protocols.
+func SerialProtocolNames() []string {
+	names := make([]string, 0, len(serialProtocols))
+	for n := range serialProtocols {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readUntil reads from r one byte at a time until done reports the reply
+// complete. Serial replies are short, and reading byte-wise never consumes
+// bytes of the next reply.
+func readUntil(r io.Reader, done func([]byte) bool) ([]byte, error) {
+	var buf []byte
+	b := make([]byte, 1)
+	for len(buf) < 1024 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return buf, err
+		}
+		buf = append(buf, b[0])
+		if done(buf) {
+			return buf, nil
+		}
+	}
+	return buf, errors.New("reply too long")
+}
+
+// ---- LC Technology ----
+
+// lctechProtocol is the 4 byte hex protocol of the common CH340 "LCUS"
+// boards: A0, relay, state, checksum. The board does not answer.
+type lctechProtocol struct{}
+
+func (lctechProtocol) Set(port io.ReadWriter, relay int, on bool) error {
+	var state byte
+	if on {
+		state = 1
+	}
+	_, err := port.Write([]byte{0xA0, byte(relay), state, 0xA0 + byte(relay) + state})
+	return err
+}
+
+func (lctechProtocol) Get(io.ReadWriter, int) (bool, error) { return false, ErrNoReadBack }
+
+// ---- AT ----
+
+// atProtocol speaks AT firmware: AT+CH<n>=<0|1> answered with OK, and
+// AT+CH<n>? answered with +CH<n>:<0|1> and OK.
+type atProtocol struct{}
+
+var atStateRe = regexp.MustCompile(`\+CH(\d+)[:=]\s*(\d)`)
+
+func (atProtocol) reply(port io.Reader) (string, error) {
+	buf, err := readUntil(port, func(b []byte) bool {
+		return bytes.HasSuffix(b, []byte("OK\r\n")) || bytes.HasSuffix(b, []byte("ERROR\r\n"))
+	})
+	if err != nil {
+		return "", err
+	}
+	if bytes.HasSuffix(buf, []byte("ERROR\r\n")) {
+		return "", errors.New("board replied ERROR")
+	}
+	return string(buf), nil
+}
+
+func (p atProtocol) Set(port io.ReadWriter, relay int, on bool) error {
+	state := 0
+	if on {
+		state = 1
+	}
+	if _, err := fmt.Fprintf(port, "AT+CH%d=%d\r\n", relay, state); err != nil {
+		return err
+	}
+	_, err := p.reply(port)
+	return err
+}
+
+func (p atProtocol) Get(port io.ReadWriter, relay int) (bool, error) {
+	if _, err := fmt.Fprintf(port, "AT+CH%d?\r\n", relay); err != nil {
+		return false, err
+	}
+	reply, err := p.reply(port)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range atStateRe.FindAllStringSubmatch(reply, -1) {
+		if m[1] == strconv.Itoa(relay) {
+			return m[2] == "1", nil
+		}
+	}
+	return false, fmt.Errorf("no state for relay %d in reply %q", relay, reply)
+}
+
+// ---- Numato ----
+
+// numatoProtocol speaks the Numato Lab USB relay console: "relay on 0\r",
+// "relay read 0\r" (0-based, 0-9 then A-V), each reply ending with the ">"
+// prompt.
+type numatoProtocol struct{}
+
+func (numatoProtocol) index(relay int) string {
+	return strings.ToUpper(strconv.FormatInt(int64(relay-1), 32))
+}
+
+func (numatoProtocol) reply(port io.Reader) (string, error) {
+	buf, err := readUntil(port, func(b []byte) bool { return b[len(b)-1] == '>' })
+	return string(buf), err
+}
+
+func (p numatoProtocol) Set(port io.ReadWriter, relay int, on bool) error {
+	action := "off"
+	if on {
+		action = "on"
+	}
+	if _, err := fmt.Fprintf(port, "relay %s %s\r", action, p.index(relay)); err != nil {
+		return err
+	}
+	_, err := p.reply(port)
+	return err
+}
+
+func (p numatoProtocol) Get(port io.ReadWriter, relay int) (bool, error) {
+	if _, err := fmt.Fprintf(port, "relay read %s\r", p.index(relay)); err != nil {
+		return false, err
+	}
+	reply, err := p.reply(port)
+	if err != nil {
+		return false, err
+	}
+	// the reply echoes the command, then the state on its own line
+	for _, line := range strings.FieldsFunc(reply, func(r rune) bool { return r == '\r' || r == '\n' }) {
+		switch strings.TrimSpace(line) {
+		case "on":
+			return true, nil
+		case "off":
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("no state in reply %q", reply)
+}
+
+// SerialRelaySenderOptions configures the serial relay transport.
+type SerialRelaySenderOptions struct {
+	Registry *Registry
+	// Open opens a serial port; default 8N1 at the given baud rate.
+	Open func(path string, baud int) (io.ReadWriteCloser, error)
+	// CheckInterval is how often ports are checked for re-enumeration
+	// (default 2s).
+	CheckInterval time.Duration
+	// StatusCallback receives the relay state after each switch: read back
+	// where the protocol allows it, otherwise the state written.
+	StatusCallback func(id int64, payload string)
+	// AvailabilityCallback receives whether the console's port is open
+	// after each check.
+	AvailabilityCallback func(id int64, online bool, payload string)
+}
+
+// SerialRelaySender implements CommandSender for devices with the serial
+// transport. Ports are opened on demand and watched: when the USB board
+// re-enumerates (the port path disappears or refers to a new device) the
+// port is reopened and the relay states last commanded are restored, since
+// the board lost power on the way.
+type SerialRelaySender struct {
+	opt      SerialRelaySenderOptions
+	mu       sync.Mutex
+	ports    map[string]*serialRelayPort
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// serialRelayPort is one open board; commands to it are serialized.
+type serialRelayPort struct {
+	path    string
+	baud    int
+	timeout time.Duration
+
+	mu     sync.Mutex
+	conn   io.ReadWriteCloser
+	info   os.FileInfo // of path when opened
+	proto  SerialProtocol
+	states map[int]bool // last state commanded per relay, replayed on reopen
+}
+
+// NewSerialRelaySender creates a serial relay transport; call Start to
+// watch the ports.
+func NewSerialRelaySender(opt SerialRelaySenderOptions) *SerialRelaySender {
+	if opt.Open == nil {
+		opt.Open = func(path string, baud int) (io.ReadWriteCloser, error) { return openSerial(path, baud, "N") }
+	}
+	if opt.CheckInterval <= 0 {
+		opt.CheckInterval = 2 * time.Second
+	}
+	return &SerialRelaySender{opt: opt, ports: make(map[string]*serialRelayPort), stop: make(chan struct{})}
+}
+
+// Start opens the ports of the registered serial devices and watches them
+// until Close.
+func (s *SerialRelaySender) Start() {
+	s.check()
+	go func() {
+		t := time.NewTicker(s.opt.CheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-t.C:
+				s.check()
+			}
+		}
+	}()
+}
+
+// check reopens ports that went away and reports availability.
+func (s *SerialRelaySender) check() {
+	for _, dev := range s.opt.Registry.All() {
+		if !dev.Uses(TransportSerial) {
+			continue
+		}
+		o, err := dev.SerialRelay()
+		if err != nil {
+			continue
+		}
+		p := s.port(o)
+		p.mu.Lock()
+		err = p.ensure(s.opt.Open)
+		p.mu.Unlock()
+		if s.opt.AvailabilityCallback == nil {
+			continue
+		}
+		if err != nil {
+			s.opt.AvailabilityCallback(dev.ConsoleID, false, err.Error())
+		} else {
+			s.opt.AvailabilityCallback(dev.ConsoleID, true, o.Port)
+		}
+	}
+}
+
+func (s *SerialRelaySender) port(o SerialRelayOptions) *serialRelayPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.ports[o.Port]
+	if !ok {
+		p = &serialRelayPort{path: o.Port, baud: o.Baud, timeout: time.Duration(o.TimeoutMS) * time.Millisecond, states: make(map[int]bool)}
+		s.ports[o.Port] = p
+	}
+	return p
+}
+
+// ensure keeps the port open on the device currently at its path,
+// restoring the relay states after a reopen. Called with p.mu held.
+func (p *serialRelayPort) ensure(open func(string, int) (io.ReadWriteCloser, error)) error {
+	fi, err := os.Stat(p.path)
+	if p.conn != nil && (err != nil || !os.SameFile(fi, p.info)) {
+		log.Printf("serial %s re-enumerated, reopening", p.path)
+		p.closeConn()
+	}
+	if err != nil {
+		return err
+	}
+	if p.conn != nil {
+		return nil
+	}
+	conn, err := open(p.path, p.baud)
+	if err != nil {
+		return err
+	}
+	p.conn, p.info = conn, fi
+	if p.proto != nil {
+		p.deadline()
+		for relay, on := range p.states {
+			if err := p.proto.Set(conn, relay, on); err != nil {
+				p.closeConn()
+				return fmt.Errorf("restore relay %d: %w", relay, err)
+			}
+		}
+	}
+	return nil
+}
+
+// deadline bounds the next exchange with the board.
+func (p *serialRelayPort) deadline() {
+	if d, ok := p.conn.(interface{ SetDeadline(time.Time) error }); ok {
+		_ = d.SetDeadline(time.Now().Add(p.timeout))
+	}
+}
+
+func (p *serialRelayPort) closeConn() {
+	if p.conn != nil {
+		_ = p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// Send switches the console's relay (ON/OFF) or one of its output channels
+// (ON:1). A failed write reopens the port and retries once. Other commands
+// are ignored.
+func (s *SerialRelaySender) Send(consoleID int64, cmd string) error {
+	action, channel := SplitOutput(cmd)
+	if !isRelayCommand(action) {
+		return nil
+	}
+	dev, ok := s.opt.Registry.Lookup(consoleID)
+	if !ok || !dev.Uses(TransportSerial) {
+		return fmt.Errorf("console %d has no serial device", consoleID)
+	}
+	o, err := dev.SerialRelay()
+	if err != nil {
+		return err
+	}
+	relay, err := o.relay(channel)
+	if err != nil {
+		return err
+	}
+	proto, _ := LookupSerialProtocol(o.Protocol)
+	on := action == RelayOn
+
+	p := s.port(o)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.proto = proto
+	got, err := p.switchRelay(s.opt.Open, relay, on)
+	if err != nil {
+		p.closeConn()
+		got, err = p.switchRelay(s.opt.Open, relay, on)
+	}
+	if err != nil {
+		p.closeConn()
+		return fmt.Errorf("serial %s relay %d: %w", o.Port, relay, err)
+	}
+	if got != on {
+		return fmt.Errorf("serial %s relay %d: read back %s", o.Port, relay, relayName(got))
+	}
+	if channel < 0 && s.opt.StatusCallback != nil {
+		s.opt.StatusCallback(consoleID, relayName(got))
+	}
+	return nil
+}
+
+// switchRelay writes a relay and reads it back when the protocol can. The
+// state is recorded first, so a board that comes back after a failed write
+// is restored to the latest command rather than the one before it.
+// Called with p.mu held.
+func (p *serialRelayPort) switchRelay(open func(string, int) (io.ReadWriteCloser, error), relay int, on bool) (bool, error) {
+	p.states[relay] = on
+	if err := p.ensure(open); err != nil {
+		return false, err
+	}
+	p.deadline()
+	if err := p.proto.Set(p.conn, relay, on); err != nil {
+		return false, err
+	}
+	got, err := p.proto.Get(p.conn, relay)
+	if errors.Is(err, ErrNoReadBack) {
+		return on, nil
+	}
+	return got, err
+}
+
+// Close stops the watcher and closes every port.
+func (s *SerialRelaySender) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for path, p := range s.ports {
+		p.mu.Lock()
+		p.closeConn()
+		p.mu.Unlock()
+		delete(s.ports, path)
+	}
+	return nil
+}
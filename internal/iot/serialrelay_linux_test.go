@@ -0,0 +1,165 @@
+//go:build linux
+
+package iot
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// openPTY returns the master of a new pseudo-terminal and the path of its
+// slave, which stands in for the board's /dev/ttyUSB.
+func openPTY(t *testing.T) (*os.File, string) {
+	t.Helper()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("no pty support: %v", err)
+	}
+	rc, err := master.SyscallConn()
+	require.NoError(t, err)
+	var n uint32
+	var ierr error
+	require.NoError(t, rc.Control(func(fd uintptr) {
+		if ierr = unix.IoctlSetPointerInt(int(fd), unix.TIOCSPTLCK, 0); ierr == nil {
+			n, ierr = unix.IoctlGetUint32(int(fd), unix.TIOCGPTN)
+		}
+	}))
+	require.NoError(t, ierr)
+	t.Cleanup(func() { master.Close() })
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+// atBoard emulates an AT firmware relay board on a pty master.
+type atBoard struct {
+	mu     sync.Mutex
+	relays map[int]bool
+}
+
+func (b *atBoard) relay(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.relays[n]
+}
+
+func (b *atBoard) serve(master *os.File) {
+	r := bufio.NewReader(master)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		var n, v int
+		reply := "ERROR\r\n"
+		b.mu.Lock()
+		if _, err := fmt.Sscanf(line, "AT+CH%d=%d", &n, &v); err == nil {
+			b.relays[n] = v == 1
+			reply = "OK\r\n"
+		} else if _, err := fmt.Sscanf(line, "AT+CH%d?", &n); err == nil {
+			state := 0
+			if b.relays[n] {
+				state = 1
+			}
+			reply = fmt.Sprintf("+CH%d:%d\r\nOK\r\n", n, state)
+		}
+		b.mu.Unlock()
+		if _, err := master.WriteString(reply); err != nil {
+			return
+		}
+	}
+}
+
+func serialDevice(t *testing.T, opts SerialRelayOptions) *Registry {
+	t.Helper()
+	raw, err := json.Marshal(opts)
+	require.NoError(t, err)
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{{ConsoleID: 1, DeviceID: "usb-relay", Transport: TransportSerial, Options: raw}})
+	return reg
+}
+
+func TestSerialRelaySender_PTY(t *testing.T) {
+	master, slave := openPTY(t)
+	board := &atBoard{relays: make(map[int]bool)}
+	go board.serve(master)
+
+	reg := serialDevice(t, SerialRelayOptions{Port: slave, Protocol: SerialAT, Relay: 2, Channels: []int{3}})
+	var mu sync.Mutex
+	var status []string
+	s := NewSerialRelaySender(SerialRelaySenderOptions{Registry: reg, StatusCallback: func(id int64, p string) {
+		mu.Lock()
+		status = append(status, p)
+		mu.Unlock()
+	}})
+	defer s.Close()
+
+	require.NoError(t, s.Send(1, "ON"))
+	assert.True(t, board.relay(2))
+	require.NoError(t, s.Send(1, "ON:0"))
+	assert.True(t, board.relay(3))
+	require.NoError(t, s.Send(1, "OFF"))
+	assert.False(t, board.relay(2))
+	require.NoError(t, s.Send(1, "WARN5"))
+	mu.Lock()
+	assert.Equal(t, []string{"ON", "OFF"}, status)
+	mu.Unlock()
+}
+
+func TestSerialRelaySender_LCTech(t *testing.T) {
+	master, slave := openPTY(t)
+	reg := serialDevice(t, SerialRelayOptions{Port: slave, Relay: 1})
+	s := NewSerialRelaySender(SerialRelaySenderOptions{Registry: reg})
+	defer s.Close()
+
+	require.NoError(t, s.Send(1, "ON"))
+	got := make([]byte, 4)
+	_, err := master.Read(got)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xA0, 0x01, 0x01, 0xA2}, got)
+}
+
+func TestSerialRelaySender_Reenumeration(t *testing.T) {
+	master, slave := openPTY(t)
+	first := &atBoard{relays: make(map[int]bool)}
+	go first.serve(master)
+	link := filepath.Join(t.TempDir(), "usb-relay")
+	require.NoError(t, os.Symlink(slave, link))
+
+	reg := serialDevice(t, SerialRelayOptions{Port: link, Protocol: SerialAT, Relay: 1})
+	var mu sync.Mutex
+	online := map[bool]int{}
+	s := NewSerialRelaySender(SerialRelaySenderOptions{Registry: reg, CheckInterval: 20 * time.Millisecond,
+		AvailabilityCallback: func(id int64, up bool, _ string) {
+			mu.Lock()
+			online[up]++
+			mu.Unlock()
+		}})
+	s.Start()
+	defer s.Close()
+	require.NoError(t, s.Send(1, "ON"))
+	assert.True(t, first.relay(1))
+
+	// the board resets and comes back as a new tty with every relay off
+	require.NoError(t, os.Remove(link))
+	master.Close()
+	master2, slave2 := openPTY(t)
+	second := &atBoard{relays: make(map[int]bool)}
+	go second.serve(master2)
+	require.NoError(t, os.Symlink(slave2, link))
+
+	require.Eventually(t, func() bool { return second.relay(1) }, 2*time.Second, 10*time.Millisecond, "state restored")
+	mu.Lock()
+	assert.Positive(t, online[true])
+	mu.Unlock()
+}
@@ -0,0 +1,103 @@
+package iot
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scripted is a port that records writes and replays a canned reply.
+type scripted struct {
+	bytes.Buffer // reply
+	written      bytes.Buffer
+}
+
+func (s *scripted) Write(p []byte) (int, error) { return s.written.Write(p) }
+
+func TestSerialProtocols(t *testing.T) {
+	lc, _ := LookupSerialProtocol(SerialLCTech)
+	port := &scripted{}
+	require.NoError(t, lc.Set(port, 2, true))
+	assert.Equal(t, []byte{0xA0, 0x02, 0x01, 0xA3}, port.written.Bytes())
+	_, err := lc.Get(port, 2)
+	assert.ErrorIs(t, err, ErrNoReadBack)
+
+	at, _ := LookupSerialProtocol(SerialAT)
+	port = &scripted{}
+	port.WriteString("OK\r\n+CH3:1\r\nOK\r\n")
+	require.NoError(t, at.Set(port, 3, true))
+	on, err := at.Get(port, 3)
+	require.NoError(t, err)
+	assert.True(t, on)
+	assert.Equal(t, "AT+CH3=1\r\nAT+CH3?\r\n", port.written.String())
+	port = &scripted{}
+	port.WriteString("ERROR\r\n")
+	assert.Error(t, at.Set(port, 3, false))
+
+	numato, _ := LookupSerialProtocol(SerialNumato)
+	port = &scripted{}
+	port.WriteString("relay on A\n\r>relay read A\n\ron\n\r>")
+	require.NoError(t, numato.Set(port, 11, true))
+	on, err = numato.Get(port, 11)
+	require.NoError(t, err)
+	assert.True(t, on)
+	assert.Equal(t, "relay on A\rrelay read A\r", port.written.String())
+}
+
+func TestDeviceSerialRelay(t *testing.T) {
+	o, err := Device{Options: json.RawMessage(`{"port":"/dev/ttyUSB0"}`)}.SerialRelay()
+	require.NoError(t, err)
+	assert.Equal(t, SerialLCTech, o.Protocol)
+	assert.Equal(t, 1, o.Relay)
+	assert.Equal(t, 9600, o.Baud)
+	_, err = Device{Options: json.RawMessage(`{"port":"/dev/ttyUSB0","protocol":"hid"}`)}.SerialRelay()
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "at, lctech, numato"))
+	_, err = Device{Options: json.RawMessage(`{"port":"/dev/ttyUSB0","relay":0,"channels":[0]}`)}.SerialRelay()
+	assert.Error(t, err)
+}
+
+// boardPort is an open LCTech board that records what was written to it.
+type boardPort struct {
+	written bytes.Buffer
+}
+
+func (b *boardPort) Read([]byte) (int, error)    { return 0, io.EOF }
+func (b *boardPort) Write(p []byte) (int, error) { return b.written.Write(p) }
+func (b *boardPort) Close() error                { return nil }
+
+func TestSerialRelaySender_RestoresLatestCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ttyUSB0")
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	reg := NewRegistry(nil)
+	reg.Replace([]Device{{ConsoleID: 1, DeviceID: "usb", Transport: TransportSerial, Options: json.RawMessage(`{"port":"` + path + `"}`)}})
+	var boards []*boardPort
+	s := NewSerialRelaySender(SerialRelaySenderOptions{
+		Registry: reg,
+		Open: func(string, int) (io.ReadWriteCloser, error) {
+			b := &boardPort{}
+			boards = append(boards, b)
+			return b, nil
+		},
+	})
+	t.Cleanup(func() { _ = s.Close() })
+
+	require.NoError(t, s.Send(1, RelayOn))
+
+	// the board is unplugged, so OFF cannot be written
+	require.NoError(t, os.Remove(path))
+	assert.Error(t, s.Send(1, RelayOff))
+
+	// once it re-enumerates, the watcher restores OFF, not the earlier ON
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	s.check()
+	require.Len(t, boards, 2)
+	assert.Equal(t, []byte{0xA0, 0x01, 0x00, 0xA1}, boards[1].written.Bytes())
+}
@@ -0,0 +1,70 @@
+package iot
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Relay states reported by devices.
+const (
+	RelayOn  = "ON"
+	RelayOff = "OFF"
+)
+
+// DeviceStatus is the normalized content of a device status message.
+type DeviceStatus struct {
+	Relay string // ON, OFF or empty when the payload carries no relay state
+}
+
+// ParseStatus understands the plain payloads used by the reference firmware
+// (ON, OFF, relay_on, relay_off, 1, 0) and JSON objects with a relay, state
+// or power field. Unknown payloads yield an empty DeviceStatus.
+func ParseStatus(payload string) DeviceStatus {
+	p := strings.TrimSpace(payload)
+	if strings.HasPrefix(p, "{") {
+		var obj map[string]any
+		if err := json.Unmarshal([]byte(p), &obj); err == nil {
+			for _, k := range []string{"relay", "state", "power"} {
+				if v, ok := obj[k]; ok {
+					return DeviceStatus{Relay: relayValue(v)}
+				}
+			}
+		}
+		return DeviceStatus{}
+	}
+	return DeviceStatus{Relay: relayValue(p)}
+}
+
+// relayValue maps a scalar to ON/OFF.
+func relayValue(v any) string {
+	switch x := v.(type) {
+	case bool:
+		if x {
+			return RelayOn
+		}
+		return RelayOff
+	case float64:
+		if x != 0 {
+			return RelayOn
+		}
+		return RelayOff
+	case string:
+		switch strings.ToLower(strings.TrimSpace(x)) {
+		case "on", "relay_on", "1", "true":
+			return RelayOn
+		case "off", "relay_off", "0", "false":
+			return RelayOff
+		}
+	}
+	return ""
+}
+
+// ParseAvailability interprets an availability / Last Will payload; anything
+// other than an explicit offline marker counts as online.
+func ParseAvailability(payload string) bool {
+	switch strings.ToLower(strings.TrimSpace(payload)) {
+	case "offline", "0", "false", "lost", "disconnected":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,351 @@
+package iot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT connection states reported by MQTTSupervisor.
+const (
+	MQTTDisconnected = "DISCONNECTED" // no broker configured, or closed
+	MQTTConnecting   = "CONNECTING"
+	MQTTConnected    = "CONNECTED"
+	MQTTBackoff      = "BACKOFF" // every broker failed, waiting for NextRetry
+)
+
+// MQTTEndpoint is one broker of the failover list.
+type MQTTEndpoint struct {
+	URL      string
+	Prefix   string
+	Username string
+	Password string
+	TLS      TLSOptions
+}
+
+// MQTTState describes the supervised connection.
+type MQTTState struct {
+	State     string    `json:"state"`
+	Broker    string    `json:"broker"`
+	Prefix    string    `json:"prefix"`
+	Attempt   int       `json:"attempt"` // failed rounds since the last connect
+	LastError string    `json:"last_error"`
+	NextRetry time.Time `json:"next_retry"`
+	Since     time.Time `json:"since"`
+}
+
+// SupervisorOptions configures MQTTSupervisor.
+type SupervisorOptions struct {
+	MinBackoff time.Duration // first wait after all brokers failed (default 1s)
+	MaxBackoff time.Duration // cap of the doubling wait (default 1m)
+}
+
+var errMQTTNotConnected = errors.New("mqtt not connected")
+
+// MQTTSupervisor owns the MQTT connection: it connects in the background to
+// the first reachable broker of an ordered failover list, starts over from
+// the primary when the connection drops and waits with exponential backoff
+// when every broker failed. It is a CommandSender delegating to the current
+// MQTTSender; commands fail fast while disconnected.
+type MQTTSupervisor struct {
+	base      MQTTSenderOptions
+	opt       SupervisorOptions
+	mu        sync.Mutex
+	endpoints []MQTTEndpoint
+	cur       *MQTTSender
+	state     MQTTState
+	listeners []func(MQTTState)
+	restart   chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewMQTTSupervisor starts supervising connections to endpoints with the
+// base sender options; it returns immediately.
+func NewMQTTSupervisor(base MQTTSenderOptions, endpoints []MQTTEndpoint, opt SupervisorOptions) *MQTTSupervisor {
+	if opt.MinBackoff <= 0 {
+		opt.MinBackoff = time.Second
+	}
+	if opt.MaxBackoff < opt.MinBackoff {
+		opt.MaxBackoff = max(time.Minute, opt.MinBackoff)
+	}
+	s := &MQTTSupervisor{
+		base:      base,
+		opt:       opt,
+		endpoints: endpoints,
+		state:     MQTTState{State: MQTTDisconnected, Since: time.Now()},
+		restart:   make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// SetEndpoints replaces the failover list and reconnects using it.
+func (s *MQTTSupervisor) SetEndpoints(endpoints []MQTTEndpoint) {
+	s.mu.Lock()
+	s.endpoints = endpoints
+	s.mu.Unlock()
+	select {
+	case s.restart <- struct{}{}:
+	default:
+	}
+}
+
+// Endpoints returns the failover list.
+func (s *MQTTSupervisor) Endpoints() []MQTTEndpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]MQTTEndpoint(nil), s.endpoints...)
+}
+
+// OnChange registers fn to be called on every state change.
+func (s *MQTTSupervisor) OnChange(fn func(MQTTState)) {
+	s.mu.Lock()
+	s.listeners = append(s.listeners, fn)
+	s.mu.Unlock()
+}
+
+// State returns the current connection state.
+func (s *MQTTSupervisor) State() MQTTState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+func (s *MQTTSupervisor) setState(st MQTTState) {
+	st.Since = time.Now()
+	s.mu.Lock()
+	s.state = st
+	listeners := append([]func(MQTTState){}, s.listeners...)
+	s.mu.Unlock()
+	for _, fn := range listeners {
+		fn(st)
+	}
+}
+
+// Current returns the connected sender, nil while disconnected.
+func (s *MQTTSupervisor) Current() *MQTTSender {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cur
+}
+
+func (s *MQTTSupervisor) setCurrent(ms *MQTTSender) {
+	s.mu.Lock()
+	s.cur = ms
+	s.mu.Unlock()
+}
+
+// Send implements CommandSender.
+func (s *MQTTSupervisor) Send(consoleID int64, cmd string) error {
+	return s.SendWithID(consoleID, cmd, "")
+}
+
+// SendWithID implements CorrelatedSender.
+func (s *MQTTSupervisor) SendWithID(consoleID int64, cmd, id string) error {
+	ms := s.Current()
+	if ms == nil {
+		return errMQTTNotConnected
+	}
+	return ms.SendWithID(consoleID, cmd, id)
+}
+
+// IsConnected reports whether a broker connection is up.
+func (s *MQTTSupervisor) IsConnected() bool {
+	ms := s.Current()
+	return ms != nil && ms.IsConnected()
+}
+
+// Prefix returns the topic prefix of the current (or last tried) broker.
+func (s *MQTTSupervisor) Prefix() string {
+	return s.State().Prefix
+}
+
+// PublishHomeAssistant forwards to the connected sender.
+func (s *MQTTSupervisor) PublishHomeAssistant(consoles []HAConsole) error {
+	ms := s.Current()
+	if ms == nil {
+		return nil
+	}
+	return ms.PublishHomeAssistant(consoles)
+}
+
+// Close stops supervising and disconnects.
+func (s *MQTTSupervisor) Close() {
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	<-s.done
+}
+
+// run is the connection loop.
+func (s *MQTTSupervisor) run() {
+	defer close(s.done)
+	defer s.setState(MQTTState{State: MQTTDisconnected})
+	backoff := s.opt.MinBackoff
+	attempt := 0
+	var lastErr error
+	for {
+		endpoints := s.Endpoints()
+		if len(endpoints) == 0 {
+			s.setState(MQTTState{State: MQTTDisconnected})
+			attempt, backoff = 0, s.opt.MinBackoff
+			if !s.wait(0) {
+				return
+			}
+			continue
+		}
+		connected, stopped := false, false
+		for _, ep := range endpoints {
+			s.setState(MQTTState{State: MQTTConnecting, Broker: ep.URL, Prefix: ep.Prefix, Attempt: attempt, LastError: errString(lastErr)})
+			if connected, stopped, lastErr = s.session(ep); connected || stopped {
+				break
+			}
+			log.Printf("mqtt connect %s: %v", ep.URL, lastErr)
+		}
+		if stopped {
+			return
+		}
+		if connected {
+			// connection dropped or endpoints changed: start over from the primary
+			attempt, backoff = 0, s.opt.MinBackoff
+			continue
+		}
+		attempt++
+		s.setState(MQTTState{State: MQTTBackoff, Prefix: endpoints[0].Prefix, Attempt: attempt, LastError: errString(lastErr), NextRetry: time.Now().Add(backoff)})
+		if !s.wait(backoff) {
+			return
+		}
+		backoff = min(backoff*2, s.opt.MaxBackoff)
+	}
+}
+
+// session connects to one broker and blocks while the connection is up.
+// connected tells whether the connection was established; stopped is set
+// when Close was called.
+func (s *MQTTSupervisor) session(ep MQTTEndpoint) (connected, stopped bool, err error) {
+	lost := make(chan error, 1)
+	opt := s.base
+	opt.Prefix, opt.Username, opt.Password = ep.Prefix, ep.Username, ep.Password
+	if !ep.TLS.IsZero() {
+		if opt.TLS, err = ep.TLS.Config(); err != nil {
+			return false, false, err
+		}
+	}
+	opt.ConnectionLostCallback = func(err error) {
+		select {
+		case lost <- err:
+		default:
+		}
+	}
+	ms, err := NewMQTTSender(ep.URL, opt)
+	if err != nil {
+		return false, false, err
+	}
+	s.setCurrent(ms)
+	s.setState(MQTTState{State: MQTTConnected, Broker: ep.URL, Prefix: ms.Prefix()})
+	defer func() {
+		s.setCurrent(nil)
+		ms.Close()
+	}()
+	select {
+	case err = <-lost:
+		log.Printf("mqtt connection to %s lost: %v", ep.URL, err)
+		return true, false, fmt.Errorf("connection lost: %w", err)
+	case <-s.restart:
+		return true, false, nil
+	case <-s.stop:
+		return true, true, nil
+	}
+}
+
+// wait sleeps for d (forever if d is 0) and reports false once stopped.
+// SetEndpoints cuts the wait short.
+func (s *MQTTSupervisor) wait(d time.Duration) bool {
+	var timer <-chan time.Time
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timer = t.C
+	}
+	select {
+	case <-s.stop:
+		return false
+	case <-s.restart:
+	case <-timer:
+	}
+	return true
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// EndpointTest is the outcome of TestEndpoint for one broker.
+type EndpointTest struct {
+	Broker    string   `json:"broker"`
+	OK        bool     `json:"ok"`
+	Error     string   `json:"error,omitempty"`
+	LatencyMS int64    `json:"latency_ms"`
+	TLS       *TLSInfo `json:"tls,omitempty"` // ssl:// and wss:// brokers
+}
+
+// TestEndpoint connects to a broker with the endpoint's credentials and TLS
+// settings and disconnects right away. It runs on its own client, so the
+// supervised connection is not touched and nothing is subscribed or
+// published.
+func TestEndpoint(ep MQTTEndpoint, timeout time.Duration) EndpointTest {
+	res := EndpointTest{Broker: ep.URL}
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	secure, err := ValidateBrokerURL(ep.URL)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	opts := mqtt.NewClientOptions().AddBroker(ep.URL).SetClientID(fmt.Sprintf("heheswitch-test-%d", time.Now().UnixNano())).
+		SetCleanSession(true).SetAutoReconnect(false).SetConnectTimeout(timeout).
+		SetUsername(ep.Username).SetPassword(ep.Password)
+	if secure {
+		info, err := CheckTLS(ep.URL, ep.TLS, timeout)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.TLS = &info
+		cfg, err := ep.TLS.Config()
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		opts.SetTLSConfig(cfg)
+	}
+	start := time.Now()
+	c := mqtt.NewClient(opts)
+	tok := c.Connect()
+	if !tok.WaitTimeout(timeout) {
+		c.Disconnect(0)
+		res.Error = "mqtt connect timeout"
+		return res
+	}
+	if err := tok.Error(); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.LatencyMS = time.Since(start).Milliseconds()
+	c.Disconnect(100)
+	res.OK = true
+	return res
+}
@@ -0,0 +1,104 @@
+package iot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unreachableBroker refuses connections.
+const unreachableBroker = "tcp://127.0.0.1:1"
+
+func endpointFor(b *Broker) MQTTEndpoint {
+	user, pass := b.Credentials()
+	return MQTTEndpoint{URL: b.URL(), Prefix: "ps", Username: user, Password: pass}
+}
+
+func newTestSupervisor(t *testing.T, endpoints ...MQTTEndpoint) *MQTTSupervisor {
+	t.Helper()
+	s := NewMQTTSupervisor(MQTTSenderOptions{QOS: 1, CleanSession: true, ConnectTimeout: 2 * time.Second}, endpoints,
+		SupervisorOptions{MinBackoff: 20 * time.Millisecond, MaxBackoff: 100 * time.Millisecond})
+	t.Cleanup(s.Close)
+	return s
+}
+
+func waitState(t *testing.T, s *MQTTSupervisor, state, broker string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		st := s.State()
+		return st.State == state && (broker == "" || st.Broker == broker)
+	}, 5*time.Second, 10*time.Millisecond, "want %s %s, have %+v", state, broker, s.State())
+}
+
+func TestMQTTSupervisor_FailsOverInOrder(t *testing.T) {
+	b := newTestBroker(t)
+	s := newTestSupervisor(t, MQTTEndpoint{URL: unreachableBroker, Prefix: "ps"}, endpointFor(b))
+
+	waitState(t, s, MQTTConnected, b.URL())
+	assert.True(t, s.IsConnected())
+	assert.Equal(t, "ps", s.Prefix())
+	assert.NoError(t, s.Send(1, "ON"))
+}
+
+func TestMQTTSupervisor_ReconnectsToBackup(t *testing.T) {
+	primary, backup := newTestBroker(t), newTestBroker(t)
+	s := newTestSupervisor(t, endpointFor(primary), endpointFor(backup))
+	waitState(t, s, MQTTConnected, primary.URL())
+
+	require.NoError(t, primary.Close())
+	waitState(t, s, MQTTConnected, backup.URL())
+	assert.NoError(t, s.Send(1, "OFF"))
+}
+
+func TestMQTTSupervisor_BackoffAndEndpointChange(t *testing.T) {
+	s := newTestSupervisor(t)
+	waitState(t, s, MQTTDisconnected, "")
+	assert.Error(t, s.Send(1, "ON"))
+
+	changes := make(chan MQTTState, 64)
+	s.OnChange(func(st MQTTState) {
+		select {
+		case changes <- st:
+		default:
+		}
+	})
+	s.SetEndpoints([]MQTTEndpoint{{URL: unreachableBroker, Prefix: "ps"}})
+	require.Eventually(t, func() bool { return s.State().Attempt >= 2 }, 5*time.Second, 10*time.Millisecond)
+	st := s.State()
+	assert.NotEmpty(t, st.LastError)
+	assert.False(t, s.IsConnected())
+
+	b := newTestBroker(t)
+	s.SetEndpoints([]MQTTEndpoint{endpointFor(b)})
+	waitState(t, s, MQTTConnected, b.URL())
+	assert.Zero(t, s.State().Attempt)
+
+	seen := map[string]bool{}
+	for len(changes) > 0 {
+		seen[(<-changes).State] = true
+	}
+	assert.True(t, seen[MQTTBackoff])
+	assert.True(t, seen[MQTTConnecting])
+	assert.True(t, seen[MQTTConnected])
+}
+
+func TestTestEndpoint(t *testing.T) {
+	b := newTestBroker(t)
+	r := TestEndpoint(endpointFor(b), 2*time.Second)
+	assert.True(t, r.OK, r.Error)
+	assert.Equal(t, b.URL(), r.Broker)
+	assert.Nil(t, r.TLS)
+
+	r = TestEndpoint(MQTTEndpoint{URL: b.URL(), Username: "dev", Password: "wrong"}, 2*time.Second)
+	assert.False(t, r.OK)
+	assert.NotEmpty(t, r.Error)
+
+	r = TestEndpoint(MQTTEndpoint{URL: unreachableBroker}, 2*time.Second)
+	assert.False(t, r.OK)
+	assert.NotEmpty(t, r.Error)
+
+	r = TestEndpoint(MQTTEndpoint{URL: "ftp://example"}, 2*time.Second)
+	assert.False(t, r.OK)
+}
@@ -0,0 +1,136 @@
+package iot
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TLSOptions configures TLS towards an ssl:// or wss:// broker. Certificates
+// and the key are PEM encoded. An empty CACert trusts the system roots.
+type TLSOptions struct {
+	CACert     string
+	ClientCert string
+	ClientKey  string
+	ServerName string // overrides the host name verified in the certificate
+}
+
+// IsZero reports whether no TLS option is set.
+func (o TLSOptions) IsZero() bool {
+	return o == TLSOptions{}
+}
+
+// Config builds the tls.Config; the CA bundle replaces (pins) the system roots.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: o.ServerName, MinVersion: tls.VersionTLS12}
+	if strings.TrimSpace(o.CACert) != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(o.CACert)) {
+			return nil, errors.New("ca_cert: no PEM certificate found")
+		}
+		cfg.RootCAs = pool
+	}
+	if (o.ClientCert == "") != (o.ClientKey == "") {
+		return nil, errors.New("client_cert and client_key must be set together")
+	}
+	if o.ClientCert != "" {
+		cert, err := tls.X509KeyPair([]byte(o.ClientCert), []byte(o.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// brokerSchemes are the broker URL schemes supported by the MQTT client;
+// the value tells whether the scheme uses TLS.
+var brokerSchemes = map[string]bool{
+	"tcp": false, "mqtt": false, "ws": false,
+	"ssl": true, "tls": true, "mqtts": true, "wss": true,
+}
+
+// ValidateBrokerURL checks a broker URL and reports whether it uses TLS.
+func ValidateBrokerURL(raw string) (secure bool, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid broker url %q: %w", raw, err)
+	}
+	secure, ok := brokerSchemes[strings.ToLower(u.Scheme)]
+	if !ok {
+		return false, fmt.Errorf("unsupported broker scheme %q in %q (use tcp, ssl, ws or wss)", u.Scheme, raw)
+	}
+	if u.Hostname() == "" {
+		return false, fmt.Errorf("broker url %q has no host", raw)
+	}
+	return secure, nil
+}
+
+// TLSInfo describes a successful handshake.
+type TLSInfo struct {
+	Version    string    `json:"version"`
+	Subject    string    `json:"subject"`
+	Issuer     string    `json:"issuer"`
+	NotAfter   time.Time `json:"not_after"`
+	ClientCert bool      `json:"client_cert"` // a client certificate was offered
+}
+
+// CheckTLS performs a TLS handshake with the broker at raw (ssl:// or wss://)
+// without speaking MQTT, to validate CA, client certificate and server name.
+func CheckTLS(raw string, o TLSOptions, timeout time.Duration) (TLSInfo, error) {
+	secure, err := ValidateBrokerURL(raw)
+	if err != nil {
+		return TLSInfo{}, err
+	}
+	if !secure {
+		return TLSInfo{}, fmt.Errorf("%s does not use TLS", raw)
+	}
+	cfg, err := o.Config()
+	if err != nil {
+		return TLSInfo{}, err
+	}
+	u, _ := url.Parse(raw)
+	port := u.Port()
+	if port == "" {
+		port = "8883"
+		if strings.EqualFold(u.Scheme, "wss") {
+			port = "443"
+		}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	d := tls.Dialer{NetDialer: &net.Dialer{}, Config: cfg}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return TLSInfo{}, err
+	}
+	defer conn.Close()
+	// with TLS 1.3 a rejected client certificate only shows up as an alert
+	// after the handshake; a broker that accepted us waits for CONNECT
+	_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			return TLSInfo{}, fmt.Errorf("broker closed the TLS connection: %w", err)
+		}
+	}
+	st := conn.(*tls.Conn).ConnectionState()
+	info := TLSInfo{Version: tls.VersionName(st.Version), ClientCert: len(cfg.Certificates) > 0}
+	if len(st.PeerCertificates) > 0 {
+		leaf := st.PeerCertificates[0]
+		info.Subject, info.Issuer, info.NotAfter = leaf.Subject.String(), leaf.Issuer.String(), leaf.NotAfter
+	}
+	return info, nil
+}
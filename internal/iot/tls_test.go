@@ -0,0 +1,146 @@
+package iot
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPKI is a throwaway CA with a server certificate for "broker.test"
+// and a client certificate.
+type testPKI struct {
+	caPEM                 string
+	server                tls.Certificate
+	clientCert, clientKey string
+	pool                  *x509.CertPool
+}
+
+func newTestPKI(t *testing.T) testPKI {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test ca"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	issue := func(serial int64, cn string, usage x509.ExtKeyUsage) (certPEM, keyPEM string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial), Subject: pkix.Name{CommonName: cn}, DNSNames: []string{cn},
+			NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+			KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		require.NoError(t, err)
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		require.NoError(t, err)
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+			string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	}
+	p := testPKI{caPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})), pool: x509.NewCertPool()}
+	p.pool.AddCert(ca)
+	srvCert, srvKey := issue(2, "broker.test", x509.ExtKeyUsageServerAuth)
+	p.server, err = tls.X509KeyPair([]byte(srvCert), []byte(srvKey))
+	require.NoError(t, err)
+	p.clientCert, p.clientKey = issue(3, "device", x509.ExtKeyUsageClientAuth)
+	return p
+}
+
+// serverTLS requires client certificates signed by the test CA.
+func (p testPKI) serverTLS() *tls.Config {
+	return &tls.Config{Certificates: []tls.Certificate{p.server}, ClientCAs: p.pool, ClientAuth: tls.RequireAndVerifyClientCert}
+}
+
+func TestValidateBrokerURL(t *testing.T) {
+	for raw, secure := range map[string]bool{"tcp://h:1883": false, "ws://h/mqtt": false, "ssl://h:8883": true, "wss://h/mqtt": true, "mqtts://h": true} {
+		got, err := ValidateBrokerURL(raw)
+		assert.NoError(t, err, raw)
+		assert.Equal(t, secure, got, raw)
+	}
+	for _, raw := range []string{"http://h", "h:1883", "ssl://"} {
+		_, err := ValidateBrokerURL(raw)
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestTLSOptions_Config(t *testing.T) {
+	p := newTestPKI(t)
+	cfg, err := TLSOptions{CACert: p.caPEM, ClientCert: p.clientCert, ClientKey: p.clientKey, ServerName: "broker.test"}.Config()
+	require.NoError(t, err)
+	assert.Len(t, cfg.Certificates, 1)
+	assert.Equal(t, "broker.test", cfg.ServerName)
+
+	_, err = TLSOptions{CACert: "not a pem"}.Config()
+	assert.Error(t, err)
+	_, err = TLSOptions{ClientCert: p.clientCert}.Config()
+	assert.Error(t, err)
+}
+
+func TestCheckTLS(t *testing.T) {
+	p := newTestPKI(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", p.serverTLS())
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				_ = c.(*tls.Conn).Handshake()
+				time.Sleep(time.Second) // wait for CONNECT like a broker
+			}(c)
+		}
+	}()
+	url := "ssl://" + ln.Addr().String()
+
+	info, err := CheckTLS(url, TLSOptions{CACert: p.caPEM, ClientCert: p.clientCert, ClientKey: p.clientKey, ServerName: "broker.test"}, 5*time.Second)
+	require.NoError(t, err)
+	assert.Contains(t, info.Subject, "broker.test")
+	assert.True(t, info.ClientCert)
+
+	// wrong server name, unknown CA, missing client certificate
+	_, err = CheckTLS(url, TLSOptions{CACert: p.caPEM, ClientCert: p.clientCert, ClientKey: p.clientKey}, 5*time.Second)
+	assert.Error(t, err)
+	_, err = CheckTLS(url, TLSOptions{ServerName: "broker.test"}, 5*time.Second)
+	assert.Error(t, err)
+	_, err = CheckTLS(url, TLSOptions{CACert: p.caPEM, ServerName: "broker.test"}, 5*time.Second)
+	assert.Error(t, err)
+
+	_, err = CheckTLS("tcp://"+ln.Addr().String(), TLSOptions{}, time.Second)
+	assert.Error(t, err)
+}
+
+func TestMQTTSupervisor_TLSBroker(t *testing.T) {
+	p := newTestPKI(t)
+	b, err := NewBroker(BrokerOptions{Addr: "127.0.0.1:0", TLS: p.serverTLS()})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = b.Close() })
+	assert.Contains(t, b.URL(), "ssl://")
+
+	ep := endpointFor(b)
+	ep.TLS = TLSOptions{CACert: p.caPEM, ClientCert: p.clientCert, ClientKey: p.clientKey, ServerName: "broker.test"}
+	s := newTestSupervisor(t, ep)
+	waitState(t, s, MQTTConnected, b.URL())
+	assert.NoError(t, s.Send(1, "ON"))
+}
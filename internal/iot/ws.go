@@ -1,6 +1,7 @@
 package iot
 
 import (
+	"encoding/json"
 	"sync"
 
 	"github.com/gofiber/websocket/v2"
@@ -32,6 +33,15 @@ func (h *Hub) Broadcast(msg []byte) {
 	}
 }
 
+// BroadcastJSON marshals v and sends it to all clients; marshal errors are dropped.
+func (h *Hub) BroadcastJSON(v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	h.Broadcast(b)
+}
+
 // Size returns current connected client count.
 func (h *Hub) Size() int {
 	h.mu.RLock()
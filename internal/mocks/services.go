@@ -47,6 +47,11 @@ func (m *MockConsoleService) CheckExpiredRentals() ([]entities.Console, error) {
 	return args.Get(0).([]entities.Console), args.Error(1)
 }
 
+func (m *MockConsoleService) ProcessExpiredRentals(grace time.Duration) ([]entities.Console, []entities.Console, error) {
+	args := m.Called(grace)
+	return args.Get(0).([]entities.Console), args.Get(1).([]entities.Console), args.Error(2)
+}
+
 // MockUserService is a mock implementation of UserService
 type MockUserService struct {
 	mock.Mock
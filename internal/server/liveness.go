@@ -0,0 +1,59 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"switchiot/internal/db"
+)
+
+// livenessWatcher notices devices whose heartbeat timed out. The
+// availability handler only runs when a message arrives, so a board that
+// dies silently would otherwise never produce an offline event. Last Will
+// messages are left to the handler, which already reported them.
+type livenessWatcher struct {
+	timeout time.Duration
+
+	mu       sync.Mutex
+	reported map[int64]time.Time // last heartbeat already reported as timed out
+}
+
+func newLivenessWatcher(timeout time.Duration) *livenessWatcher {
+	return &livenessWatcher{timeout: timeout, reported: make(map[int64]time.Time)}
+}
+
+// expired returns the devices that went offline by heartbeat timeout since
+// the previous call.
+func (l *livenessWatcher) expired(states map[int64]db.DeviceState) []db.DeviceState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var res []db.DeviceState
+	for id, st := range states {
+		if !st.Online || st.Connectivity(l.timeout) != db.DeviceOffline {
+			continue
+		}
+		if l.reported[id].Equal(st.LastHeartbeat) {
+			continue
+		}
+		l.reported[id] = st.LastHeartbeat
+		res = append(res, st)
+	}
+	return res
+}
+
+// run performs one check and pushes an offline event per timed out device.
+func (l *livenessWatcher) run(s *Server) {
+	if l.timeout <= 0 {
+		return
+	}
+	states, err := db.GetDeviceStates(s.app.Database)
+	if err != nil {
+		log.Printf("heartbeat check: %v", err)
+		return
+	}
+	for _, st := range l.expired(states) {
+		log.Printf("device of console %d is %s (no heartbeat since %s)", st.ConsoleID, db.DeviceOffline, st.LastHeartbeat.Format(time.RFC3339))
+		s.app.Hub.BroadcastJSON(map[string]any{"type": "device", "console_id": st.ConsoleID, "device_status": db.DeviceOffline, "last_seen": st.LastSeen})
+	}
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"switchiot/internal/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLivenessWatcher_Expired(t *testing.T) {
+	l := newLivenessWatcher(90 * time.Second)
+	now := time.Now()
+	stale := now.Add(-2 * time.Minute)
+	states := map[int64]db.DeviceState{
+		1: {ConsoleID: 1, Online: true, LastHeartbeat: stale},          // timed out
+		2: {ConsoleID: 2, Online: true, LastHeartbeat: now},            // alive
+		3: {ConsoleID: 3, Online: false, LastHeartbeat: stale},         // Last Will, reported by the handler
+		4: {ConsoleID: 4, Online: true, LastSeen: now.Add(-time.Hour)}, // never sent a heartbeat
+	}
+	got := l.expired(states)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, int64(1), got[0].ConsoleID)
+	}
+	assert.Empty(t, l.expired(states), "reported once")
+
+	// a heartbeat brings it back; timing out again is reported again
+	states[1] = db.DeviceState{ConsoleID: 1, Online: true, LastHeartbeat: now}
+	assert.Empty(t, l.expired(states))
+	states[1] = db.DeviceState{ConsoleID: 1, Online: true, LastHeartbeat: now.Add(-100 * time.Second)}
+	assert.Len(t, l.expired(states), 1)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"switchiot/internal/app"
+	"switchiot/internal/db"
+	"switchiot/internal/iot"
+)
+
+// reconcileCooldown is the minimum time between two corrections of the same console.
+const reconcileCooldown = 30 * time.Second
+
+// reconciler compares the relay state reported by each device with the
+// state its console should be in and re-sends the command on mismatch.
+type reconciler struct {
+	mu   sync.Mutex
+	last map[int64]time.Time // last correction per console
+}
+
+func newReconciler() *reconciler {
+	return &reconciler{last: make(map[int64]time.Time)}
+}
+
+// run performs one reconciliation pass.
+func (r *reconciler) run(s *Server) {
+	consoles, err := db.GetConsoles(s.app.Database)
+	if err != nil {
+		log.Printf("reconcile: %v", err)
+		return
+	}
+	states, err := db.GetDeviceStates(s.app.Database)
+	if err != nil {
+		log.Printf("reconcile: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, cs := range consoles {
+		st, ok := states[cs.ID]
+		if !ok || st.Relay == "" {
+			continue // device never reported its relay
+		}
+		desired := app.DesiredRelay(cs.Status)
+		if st.Relay == desired {
+			continue
+		}
+		if s.app.Sequences.Running(cs.ID) {
+			continue // the relay step of the power sequence may still be due
+		}
+		if s.app.Acks.SelfTesting(cs.ID) {
+			continue // the self-test pulse switches the relay on purpose
+		}
+		if cmd, ok := s.app.Acks.State(cs.ID); ok {
+			// a command is still being retried, or the report predates it
+			if cmd.State == iot.CommandPending || st.LastSeen.Before(cmd.IssuedAt) {
+				continue
+			}
+		}
+		r.mu.Lock()
+		if now.Sub(r.last[cs.ID]) < reconcileCooldown {
+			r.mu.Unlock()
+			continue
+		}
+		r.last[cs.ID] = now
+		r.mu.Unlock()
+
+		ev := db.ReconcileEvent{ConsoleID: cs.ID, Desired: desired, Reported: st.Relay}
+		if err := s.app.Sequences.ResendRelay(cs.ID, desired); err != nil {
+			ev.Error = err.Error()
+		}
+		log.Printf("reconcile %s: reported %s, desired %s (err=%q)", cs.Name, st.Relay, desired, ev.Error)
+		if err := db.InsertReconcileEvent(s.app.Database, ev); err != nil {
+			log.Printf("reconcile event: %v", err)
+		}
+	}
+}
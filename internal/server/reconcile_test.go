@@ -0,0 +1,70 @@
+package server
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"switchiot/internal/db"
+	"switchiot/internal/iot"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ackingDevice switches instantly: it stores the new relay state as its
+// report and acks the command.
+type ackingDevice struct {
+	db   *sql.DB
+	acks *iot.AckTracker
+}
+
+func (d ackingDevice) Send(consoleID int64, cmd string) error {
+	if err := db.SaveDeviceReport(d.db, consoleID, cmd, "relay_"+cmd); err != nil {
+		return err
+	}
+	d.acks.Observe(consoleID, cmd)
+	return nil
+}
+
+func TestReconcileAndTamper_SkipSelfTest(t *testing.T) {
+	corrections := &fakeSender{}
+	s := newTestServer(t, corrections)
+	s.app.Acks = iot.NewAckTracker(iot.AckOptions{Timeout: time.Second})
+	s.app.Sequences = iot.NewSequenceSender(corrections, nil)
+	require.NoError(t, db.SaveDeviceHeartbeat(s.app.Database, 1, true))
+	device := s.app.Acks.Wrap(ackingDevice{db: s.app.Database, acks: s.app.Acks})
+
+	r := newReconciler()
+	tamper := newTamperDetector(0, 20, time.Minute)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		end, ok := s.app.Acks.BeginSelfTest(1)
+		if !assert.True(t, ok) {
+			return
+		}
+		defer end()
+		steps := iot.PulseRelay(device, s.app.Acks, 1, iot.PulseOptions{Hold: 100 * time.Millisecond})
+		for _, st := range steps {
+			assert.True(t, st.OK, "%s: %s", st.Command, st.Error)
+		}
+	}()
+	for ticking := true; ticking; {
+		select {
+		case <-done:
+			ticking = false
+		case <-time.After(10 * time.Millisecond):
+			r.run(s)
+			tamper.run(s)
+		}
+	}
+
+	assert.Empty(t, corrections.commands(), "reconciler switched the relay during the pulse")
+	events, err := db.ListReconcileEvents(s.app.Database, 10)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+	alerts, err := db.ListAlerts(s.app.Database, "", 10)
+	require.NoError(t, err)
+	assert.Empty(t, alerts)
+}
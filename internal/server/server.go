@@ -3,8 +3,11 @@ package server
 import (
 	"io/fs"
 	"log"
+	"strings"
 	"switchiot/internal/api"
 	"switchiot/internal/app"
+	"switchiot/internal/db"
+	"switchiot/internal/iot"
 	"time"
 
 	switchiot "switchiot"
@@ -18,6 +21,13 @@ import (
 type Server struct {
 	app     *app.Application
 	fiberApp *fiber.App
+	// api is the single API layer shared by the routes, the dashboard
+	// websocket and the background loop
+	api      *api.API
+	warnings *warningTracker
+	reconcile *reconciler
+	tamper    *tamperDetector
+	liveness  *livenessWatcher
 }
 
 // NewServer creates a new HTTP server
@@ -28,11 +38,18 @@ func NewServer(application *app.Application) *Server {
 	server := &Server{
 		app:      application,
 		fiberApp: fiberApp,
+		warnings: newWarningTracker(application.Config.Session.WarningThresholds),
+		reconcile: newReconciler(),
+		tamper: newTamperDetector(application.Config.Alerts.Debounce, application.Config.Alerts.PowerWatts,
+			application.Config.Device.HeartbeatTimeout),
+		liveness: newLivenessWatcher(application.Config.Device.HeartbeatTimeout),
 	}
+	server.api = server.newAPI()
 
 	server.setupRoutes()
 	server.setupStaticFiles()
 	server.setupWebSocket()
+	server.setupDeviceWebSocket()
 
 	return server
 }
@@ -41,10 +58,28 @@ func NewServer(application *app.Application) *Server {
 func (s *Server) setupRoutes() {
 	// For now, we'll use the existing API layer to maintain compatibility
 	// In a future iteration, we can fully replace it with our new controllers
-	apiLayer := api.New(s.app.Database, s.app.IoTSender, s.app.Hub)
+	apiLayer := s.api
+	// push MQTT connection changes (reconnects, failover) to dashboards
+	s.app.MQTT.OnChange(func(iot.MQTTState) { apiLayer.BroadcastMQTT() })
 	apiLayer.Register(s.fiberApp)
 }
 
+// newAPI creates an API layer wired to the shared application components
+func (s *Server) newAPI() *api.API {
+	a := api.New(s.app.Database, s.app.IoTSender, s.app.Hub)
+	a.Devices = s.app.Devices
+	a.Acks = s.app.Acks
+	a.HeartbeatTimeout = s.app.Config.Device.HeartbeatTimeout
+	a.StandbyWatts = s.app.Config.Device.StandbyWatts
+	a.ReloadMQTT = s.app.ReloadMQTT
+	a.Broker = s.app.Broker
+	a.Router = s.app.Router
+	a.Queue = s.app.Queue
+	a.Mqtt = s.app.MQTT
+	a.Sequences = s.app.Sequences
+	return a
+}
+
 // setupStaticFiles configures static file serving
 func (s *Server) setupStaticFiles() {
 	// static admin page (embedded)
@@ -87,7 +122,7 @@ func (s *Server) setupStaticFiles() {
 
 // setupWebSocket configures the WebSocket endpoint
 func (s *Server) setupWebSocket() {
-	apiLayer := api.New(s.app.Database, s.app.IoTSender, s.app.Hub)
+	apiLayer := s.api
 
 	s.fiberApp.Get("/ws", websocket.New(func(c *websocket.Conn) {
 		defer c.Close()
@@ -112,6 +147,37 @@ func (s *Server) setupWebSocket() {
 	}))
 }
 
+// setupDeviceWebSocket configures the endpoint relay boards keep connected
+// to receive commands and push status. Boards authenticate with their
+// device ID and the token from the device registry:
+//
+//	/device/ws?device=<device_id> with "Authorization: Bearer <token>"
+//	(or ?token=<token> for firmware that cannot set headers)
+func (s *Server) setupDeviceWebSocket() {
+	s.fiberApp.Use("/device/ws", func(c *fiber.Ctx) error {
+		if !websocket.IsWebSocketUpgrade(c) {
+			return fiber.ErrUpgradeRequired
+		}
+		token := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = c.Query("token")
+		}
+		id, err := s.app.DeviceWS.Authenticate(c.Query("device"), token)
+		if err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+		}
+		c.Locals("console_id", id)
+		return c.Next()
+	})
+
+	s.fiberApp.Get("/device/ws", websocket.New(func(c *websocket.Conn) {
+		id, _ := c.Locals("console_id").(int64)
+		log.Printf("device of console %d connected via websocket", id)
+		s.app.DeviceWS.Serve(id, c)
+		log.Printf("device of console %d disconnected", id)
+	}))
+}
+
 // Start starts the HTTP server
 func (s *Server) Start() error {
 	port := s.app.Config.Server.Port
@@ -122,6 +188,7 @@ func (s *Server) Start() error {
 // StartBackgroundTasks starts background tasks like auto-stop watcher
 func (s *Server) StartBackgroundTasks() {
 	go s.runBackgroundLoop()
+	go s.runShutdowns()
 }
 
 // runBackgroundLoop runs the adaptive background loop
@@ -129,8 +196,9 @@ func (s *Server) runBackgroundLoop() {
 	fast := 2 * time.Second
 	slow := 10 * time.Second
 	lastTick := time.Now()
+	var lastDownsample time.Time
 	
-	apiLayer := api.New(s.app.Database, s.app.IoTSender, s.app.Hub)
+	apiLayer := s.api
 
 	for {
 		interval := slow
@@ -140,34 +208,71 @@ func (s *Server) runBackgroundLoop() {
 		time.Sleep(time.Until(lastTick.Add(interval)))
 		lastTick = time.Now()
 
-		// Check for expired rentals
-		expiredConsoles, err := s.app.ConsoleService.CheckExpiredRentals()
+		// Move expired rentals into overtime (grace period) or stop them
+		overtimeConsoles, expiredConsoles, err := s.app.ConsoleService.ProcessExpiredRentals(s.app.Config.Session.GracePeriod)
 		if err != nil {
 			log.Printf("Error checking expired rentals: %v", err)
 			continue
 		}
 
-		// Stop expired consoles and send IoT commands
-		for _, console := range expiredConsoles {
-			log.Printf("auto-stop %s (expired)\n", console.Name)
-			_ = s.app.IoTSender.Send(console.ID, "OFF")
+		for _, console := range overtimeConsoles {
+			log.Printf("overtime %s (grace %s)\n", console.Name, s.app.Config.Session.GracePeriod)
+			s.app.Hub.BroadcastJSON(map[string]any{"type": "overtime", "console_id": console.ID, "name": console.Name, "grace_sec": int(s.app.Config.Session.GracePeriod.Seconds())})
 		}
 
-		// Check for consoles due soon
-		dueConsoles, err := s.app.ConsoleService.GetDueSoon(time.Minute)
-		if err != nil {
-			log.Printf("Error checking due soon consoles: %v", err)
-			continue
-		}
+		// Stop expired consoles and send IoT commands
+		s.stopExpired(expiredConsoles)
 
-		// Log warnings for consoles due soon
-		for _, console := range dueConsoles {
-			if s.app.Hub.Size() > 0 {
+		// Send pre-expiry warnings to the device and dashboards
+		if maxWarn := s.warnings.maxThreshold(); maxWarn > 0 {
+			dueConsoles, err := s.app.ConsoleService.GetDueSoon(maxWarn)
+			if err != nil {
+				log.Printf("Error checking due soon consoles: %v", err)
+				continue
+			}
+			for _, console := range dueConsoles {
 				remaining := console.TimeRemaining()
+				threshold, ok := s.warnings.due(console.ID, console.EndTime, remaining)
+				if !ok {
+					continue
+				}
 				log.Printf("warning: %s akan habis dalam %d detik", console.Name, int(remaining.Seconds()))
+				if cmd := warningCommand(threshold); s.app.Devices.Accepts(console.ID, cmd) {
+					if err := s.app.IoTSender.Send(console.ID, cmd); err != nil {
+						log.Printf("warning command %s: %v", console.Name, err)
+					}
+				}
+				s.app.Hub.BroadcastJSON(map[string]any{"type": "warning", "console_id": console.ID, "name": console.Name, "remaining_sec": int(remaining.Seconds()), "threshold_sec": int(threshold.Seconds())})
+			}
+		}
+
+		// Retry commands queued while their transport was down
+		if s.app.Queue.Depth() > 0 {
+			s.app.ReplayQueue()
+		}
+
+		// Correct relays whose reported state differs from the desired state
+		s.reconcile.run(s)
+
+		// Raise alerts for devices contradicting their console (bypass / tamper)
+		s.tamper.run(s)
+
+		// Report devices whose heartbeat timed out
+		s.liveness.run(s)
+
+		// Fold old raw power readings into hourly aggregates
+		if time.Since(lastDownsample) >= time.Hour {
+			lastDownsample = time.Now()
+			if n, err := db.DownsamplePower(s.app.Database, lastDownsample.Add(-s.app.Config.Device.PowerRetention)); err != nil {
+				log.Printf("downsample power readings: %v", err)
+			} else if n > 0 {
+				log.Printf("downsampled %d power readings", n)
 			}
 		}
 
+		// Mirror consoles to Home Assistant (no-op unless HA_DISCOVERY is set)
+		apiLayer.PublishHomeAssistant()
+
 		// Broadcast status updates if there are clients connected
 		if s.app.Hub.Size() > 0 {
 			apiLayer.BroadcastStatus()
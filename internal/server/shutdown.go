@@ -0,0 +1,125 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"switchiot/internal/db"
+	"switchiot/internal/domain/entities"
+)
+
+// shutdownTick is how often running power-downs are advanced; they run on
+// their own ticker so phase delays do not depend on the adaptive loop.
+const shutdownTick = time.Second
+
+// powerDown ends the power of a console whose session just stopped: a
+// console with a shutdown profile enters STOPPING and is handled by
+// runShutdowns, any other console is switched OFF right away.
+func (s *Server) powerDown(consoleID int64) error {
+	started, err := db.BeginShutdown(s.app.Database, consoleID)
+	if err != nil {
+		log.Printf("begin shutdown of console %d: %v", consoleID, err)
+	}
+	if started {
+		s.api.BroadcastShutdown(consoleID, db.ShutdownWarn, time.Now())
+		return nil
+	}
+	return s.app.IoTSender.Send(consoleID, "OFF")
+}
+
+// stopExpired powers down the consoles whose session just expired, all at
+// once so their relay commands share a Modbus batch.
+func (s *Server) stopExpired(consoles []entities.Console) {
+	inParallel(len(consoles), func(i int) {
+		console := consoles[i]
+		log.Printf("auto-stop %s (expired)\n", console.Name)
+		s.warnings.forget(console.ID)
+		if err := s.powerDown(console.ID); err != nil {
+			log.Printf("auto-stop %s: send OFF: %v", console.Name, err)
+		}
+	})
+}
+
+// inParallel runs fn for the indexes 0..n-1 concurrently and waits for
+// all of them.
+func inParallel(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// runShutdowns advances the power-downs in progress every shutdownTick.
+// Phases are stored in the shutdowns table, so a restart resumes them.
+func (s *Server) runShutdowns() {
+	for {
+		s.advanceShutdowns()
+		time.Sleep(shutdownTick)
+	}
+}
+
+// advanceShutdowns runs the phases that are due: the warning, the soft
+// shutdown command (only if the device announced it) and finally the
+// relay OFF, which makes the console IDLE. Due consoles are handled in
+// parallel so their commands share a Modbus batch.
+func (s *Server) advanceShutdowns() {
+	list, err := db.ListShutdowns(s.app.Database)
+	if err != nil {
+		log.Printf("shutdowns: %v", err)
+		return
+	}
+	now := time.Now()
+	var due []db.Shutdown
+	for _, sd := range list {
+		if !sd.DueAt.After(now) {
+			due = append(due, sd)
+		}
+	}
+	inParallel(len(due), func(i int) { s.advanceShutdown(due[i], now) })
+}
+
+// advanceShutdown runs the due phase of one power-down.
+func (s *Server) advanceShutdown(sd db.Shutdown, now time.Time) {
+	switch sd.Phase {
+	case db.ShutdownWarn:
+		if cmd := warningCommand(time.Duration(sd.WarnSec) * time.Second); s.app.Devices.Accepts(sd.ConsoleID, cmd) {
+			if err := s.app.IoTSender.Send(sd.ConsoleID, cmd); err != nil {
+				log.Printf("shutdown console %d: warning: %v", sd.ConsoleID, err)
+			}
+		}
+		s.nextShutdownPhase(sd.ConsoleID, db.ShutdownSoft, now.Add(time.Duration(sd.WarnSec)*time.Second))
+	case db.ShutdownSoft:
+		delay := time.Duration(sd.DelaySec) * time.Second
+		if sd.SoftCommand != "" && s.app.Devices.Supports(sd.ConsoleID, sd.SoftCommand) {
+			if err := s.app.IoTSender.Send(sd.ConsoleID, sd.SoftCommand); err != nil {
+				log.Printf("shutdown console %d: %s: %v", sd.ConsoleID, sd.SoftCommand, err)
+			}
+		}
+		s.nextShutdownPhase(sd.ConsoleID, db.ShutdownOff, now.Add(delay))
+	default:
+		if err := s.app.IoTSender.Send(sd.ConsoleID, "OFF"); err != nil {
+			// the queue and the reconciler keep retrying the relay
+			log.Printf("shutdown console %d: send OFF: %v", sd.ConsoleID, err)
+		}
+		if err := db.FinishShutdown(s.app.Database, sd.ConsoleID); err != nil {
+			log.Printf("finish shutdown of console %d: %v", sd.ConsoleID, err)
+			return
+		}
+		log.Printf("shutdown console %d: relay off after %s", sd.ConsoleID, now.Sub(sd.StartedAt).Round(time.Second))
+		s.api.BroadcastShutdown(sd.ConsoleID, "DONE", now)
+	}
+}
+
+func (s *Server) nextShutdownPhase(consoleID int64, phase string, due time.Time) {
+	if err := db.AdvanceShutdown(s.app.Database, consoleID, phase, due); err != nil {
+		log.Printf("shutdown console %d: %v", consoleID, err)
+		return
+	}
+	s.api.BroadcastShutdown(consoleID, phase, due)
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	"switchiot/internal/api"
+	"switchiot/internal/app"
+	"switchiot/internal/db"
+	"switchiot/internal/domain/entities"
+	"switchiot/internal/iot"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+// fakeSender records the commands sent to devices.
+type fakeSender struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (f *fakeSender) Send(consoleID int64, cmd string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, cmd)
+	return nil
+}
+
+func (f *fakeSender) commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.sent...)
+}
+
+// rendezvousSender holds every Send until n of them are in flight (or a
+// second passed), like a Modbus batch waiting for its window.
+type rendezvousSender struct {
+	fakeSender
+	n        int
+	mu       sync.Mutex
+	inFlight int
+	met      chan struct{}
+}
+
+func newRendezvousSender(n int) *rendezvousSender {
+	return &rendezvousSender{n: n, met: make(chan struct{})}
+}
+
+func (r *rendezvousSender) Send(consoleID int64, cmd string) error {
+	r.mu.Lock()
+	if r.inFlight++; r.inFlight == r.n {
+		close(r.met)
+	}
+	r.mu.Unlock()
+	select {
+	case <-r.met:
+	case <-time.After(time.Second):
+	}
+	return r.fakeSender.Send(consoleID, cmd)
+}
+
+// together reports whether n sends were in flight at the same time.
+func (r *rendezvousSender) together() bool {
+	select {
+	case <-r.met:
+		return true
+	default:
+		return false
+	}
+}
+
+// newTestServer returns a server on an in-memory database with four
+// consoles, sending device commands to sender.
+func newTestServer(t *testing.T, sender iot.CommandSender) *Server {
+	t.Helper()
+	dbx, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	dbx.SetMaxOpenConns(1)
+	t.Cleanup(func() { dbx.Close() })
+	require.NoError(t, db.Init(dbx, 4, 10000))
+	a := &app.Application{Database: dbx, IoTSender: sender, Hub: iot.NewHub(), Devices: iot.NewRegistry(nil)}
+	return &Server{app: a, api: api.New(dbx, sender, a.Hub)}
+}
+
+func TestAdvanceShutdowns(t *testing.T) {
+	sender := &fakeSender{}
+	s := newTestServer(t, sender)
+	dbx := s.app.Database
+	require.NoError(t, db.SaveShutdownProfile(dbx, db.ShutdownProfile{ConsoleType: "PS5", WarnSec: 60, SoftCommand: "CEC_STANDBY", DelaySec: 30}))
+	require.NoError(t, db.SetConsoleType(dbx, 1, "PS5"))
+	s.app.Devices.Replace([]iot.Device{{ConsoleID: 1, DeviceID: "board-1"}})
+	s.app.Devices.SetCapabilities("board-1", iot.Capabilities{Protocol: 1, Commands: []string{"ON", "OFF", "WARN", "CEC_STANDBY"}})
+	phase := func() db.Shutdown {
+		list, err := db.ListShutdowns(dbx)
+		require.NoError(t, err)
+		require.Len(t, list, 1)
+		return list[0]
+	}
+	due := func() { require.NoError(t, db.AdvanceShutdown(dbx, 1, phase().Phase, time.Now().Add(-time.Second))) }
+
+	require.NoError(t, s.powerDown(1))
+	s.advanceShutdowns()
+	assert.Equal(t, []string{"WARN1"}, sender.commands())
+	sd := phase()
+	assert.Equal(t, db.ShutdownSoft, sd.Phase)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), sd.DueAt, time.Second)
+
+	// nothing happens before the phase is due
+	s.advanceShutdowns()
+	assert.Len(t, sender.commands(), 1)
+
+	due()
+	s.advanceShutdowns()
+	assert.Equal(t, []string{"WARN1", "CEC_STANDBY"}, sender.commands())
+	assert.Equal(t, db.ShutdownOff, phase().Phase)
+
+	due()
+	s.advanceShutdowns()
+	assert.Equal(t, []string{"WARN1", "CEC_STANDBY", "OFF"}, sender.commands())
+	list, err := db.ListShutdowns(dbx)
+	require.NoError(t, err)
+	assert.Empty(t, list)
+	consoles, err := db.GetConsoles(dbx)
+	require.NoError(t, err)
+	assert.Equal(t, "IDLE", consoles[0].Status)
+}
+
+func TestAdvanceShutdowns_SkipsUnannouncedSoftCommand(t *testing.T) {
+	sender := &fakeSender{}
+	s := newTestServer(t, sender)
+	dbx := s.app.Database
+	require.NoError(t, db.SaveShutdownProfile(dbx, db.ShutdownProfile{ConsoleType: "PS4", SoftCommand: "CEC_STANDBY"}))
+	require.NoError(t, db.SetConsoleType(dbx, 2, "PS4"))
+
+	// a board without handshake never gets the soft command
+	require.NoError(t, s.powerDown(2))
+	s.advanceShutdowns()
+	s.advanceShutdowns()
+	assert.Equal(t, []string{"OFF"}, sender.commands())
+
+	// consoles without a profile are switched off right away
+	require.NoError(t, s.powerDown(3))
+	assert.Equal(t, []string{"OFF", "OFF"}, sender.commands())
+}
+
+func TestAdvanceShutdowns_SendsDueConsolesTogether(t *testing.T) {
+	sender := newRendezvousSender(3)
+	s := newTestServer(t, sender)
+	dbx := s.app.Database
+	require.NoError(t, db.SaveShutdownProfile(dbx, db.ShutdownProfile{ConsoleType: "PS4", DelaySec: 1}))
+	for id := int64(1); id <= 3; id++ {
+		require.NoError(t, db.SetConsoleType(dbx, id, "PS4"))
+		require.NoError(t, s.powerDown(id))
+		require.NoError(t, db.AdvanceShutdown(dbx, id, db.ShutdownOff, time.Now().Add(-time.Second)))
+	}
+
+	s.advanceShutdowns()
+	assert.True(t, sender.together(), "OFF commands of due consoles are sent in parallel")
+	assert.Equal(t, []string{"OFF", "OFF", "OFF"}, sender.commands())
+}
+
+func TestStopExpired_SendsTogether(t *testing.T) {
+	sender := newRendezvousSender(2)
+	s := newTestServer(t, sender)
+	s.warnings = newWarningTracker(nil)
+
+	s.stopExpired([]entities.Console{{ID: 1, Name: "PS1"}, {ID: 2, Name: "PS2"}})
+	assert.True(t, sender.together(), "expired consoles are switched off in parallel")
+	assert.Len(t, sender.commands(), 2)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"switchiot/internal/app"
+	"switchiot/internal/db"
+	"switchiot/internal/domain/entities"
+	"switchiot/internal/iot"
+)
+
+// tamperDetector raises alerts when a device contradicts its console: power
+// draw or relay ON while the console is idle (plugged around the relay), or
+// relay OFF while the console needs power (running, overtime or stopping).
+// A condition must hold for the debounce period before an alert is stored,
+// so short glitches do not alarm.
+type tamperDetector struct {
+	debounce time.Duration
+	watts    float64       // minimum draw treated as a console in use
+	timeout  time.Duration // heartbeat timeout; also the maximum age of power readings
+
+	mu    sync.Mutex
+	since map[tamperKey]time.Time // when each condition was first seen
+}
+
+type tamperKey struct {
+	console int64
+	kind    string
+}
+
+func newTamperDetector(debounce time.Duration, watts float64, timeout time.Duration) *tamperDetector {
+	return &tamperDetector{debounce: debounce, watts: watts, timeout: timeout, since: make(map[tamperKey]time.Time)}
+}
+
+// conditions returns the alert kinds (with messages) the device state
+// currently violates for a console in the given status. Relay reports of
+// offline devices and stale power readings are not trusted.
+func (d *tamperDetector) conditions(status string, st db.DeviceState, now time.Time) map[string]string {
+	res := make(map[string]string)
+	active := entities.PowerRequired(status)
+	reachable := st.Connectivity(d.timeout) != db.DeviceOffline
+	want := app.DesiredRelay(status)
+	if reachable && want == iot.RelayOff && st.Relay == iot.RelayOn {
+		res[db.AlertRelayOnIdle] = "relay reported ON while console is " + status
+	}
+	if reachable && want == iot.RelayOn && st.Relay == iot.RelayOff {
+		res[db.AlertRelayOffRunning] = "relay reported OFF while console is " + status
+	}
+	if !active && !st.PowerAt.IsZero() && (d.timeout <= 0 || now.Sub(st.PowerAt) <= d.timeout) && st.Watts >= d.watts {
+		res[db.AlertPowerWhileIdle] = fmt.Sprintf("console draws %.0f W while %s", st.Watts, status)
+	}
+	return res
+}
+
+// held records a condition seen at now and reports whether it has held
+// for the debounce period. Callers hold d.mu.
+func (d *tamperDetector) held(k tamperKey, now time.Time) bool {
+	first, ok := d.since[k]
+	if !ok {
+		d.since[k] = now
+		return false
+	}
+	return now.Sub(first) >= d.debounce
+}
+
+// run performs one detection pass.
+func (d *tamperDetector) run(s *Server) {
+	consoles, err := db.GetConsoles(s.app.Database)
+	if err != nil {
+		log.Printf("tamper check: %v", err)
+		return
+	}
+	states, err := db.GetDeviceStates(s.app.Database)
+	if err != nil {
+		log.Printf("tamper check: %v", err)
+		return
+	}
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	seen := make(map[tamperKey]bool)
+	for _, cs := range consoles {
+		st, ok := states[cs.ID]
+		if !ok {
+			continue
+		}
+		if s.app.Acks.SelfTesting(cs.ID) {
+			continue // the self-test pulse switches the relay on purpose
+		}
+		if cmd, ok := s.app.Acks.State(cs.ID); ok {
+			// a command is in flight, or the report predates it
+			if cmd.State == iot.CommandPending || st.LastSeen.Before(cmd.IssuedAt) {
+				continue
+			}
+		}
+		for kind, msg := range d.conditions(cs.Status, st, now) {
+			k := tamperKey{cs.ID, kind}
+			seen[k] = true
+			if !d.held(k, now) {
+				continue
+			}
+			alert, created, err := db.RaiseAlert(s.app.Database, cs.ID, kind, cs.Name+": "+msg)
+			if err != nil {
+				log.Printf("raise alert: %v", err)
+				continue
+			}
+			if created {
+				log.Printf("ALERT %s %s", kind, alert.Message)
+				s.app.Hub.BroadcastJSON(map[string]any{"type": "alert", "alert": alert})
+			}
+		}
+	}
+	for k := range d.since {
+		if !seen[k] {
+			delete(d.since, k)
+		}
+	}
+}
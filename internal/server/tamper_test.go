@@ -0,0 +1,62 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"switchiot/internal/db"
+	"switchiot/internal/iot"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTamperDetector_Conditions(t *testing.T) {
+	d := newTamperDetector(time.Minute, 20, 90*time.Second)
+	now := time.Now()
+	online := db.DeviceState{Online: true, LastHeartbeat: now}
+	with := func(f func(*db.DeviceState)) db.DeviceState {
+		st := online
+		f(&st)
+		return st
+	}
+	tests := []struct {
+		name   string
+		status string
+		state  db.DeviceState
+		want   []string
+	}{
+		{"idle relay off", "IDLE", with(func(s *db.DeviceState) { s.Relay = iot.RelayOff }), nil},
+		{"idle relay on", "IDLE", with(func(s *db.DeviceState) { s.Relay = iot.RelayOn }), []string{db.AlertRelayOnIdle}},
+		{"running relay off", "RUNNING", with(func(s *db.DeviceState) { s.Relay = iot.RelayOff }), []string{db.AlertRelayOffRunning}},
+		{"overtime relay on", "OVERTIME", with(func(s *db.DeviceState) { s.Relay = iot.RelayOn }), nil},
+		{"overtime relay off", "OVERTIME", with(func(s *db.DeviceState) { s.Relay = iot.RelayOff }), []string{db.AlertRelayOffRunning}},
+		{"stopping relay off", db.StatusStopping, with(func(s *db.DeviceState) { s.Relay = iot.RelayOff }), []string{db.AlertRelayOffRunning}},
+		{"stopping relay on", db.StatusStopping, with(func(s *db.DeviceState) { s.Relay = iot.RelayOn }), nil},
+		{"offline relay report ignored", "IDLE", db.DeviceState{Relay: iot.RelayOn, Online: false, LastHeartbeat: now}, nil},
+		{"idle drawing power", "IDLE", with(func(s *db.DeviceState) { s.Watts, s.PowerAt = 80, now }), []string{db.AlertPowerWhileIdle}},
+		{"idle standby draw", "IDLE", with(func(s *db.DeviceState) { s.Watts, s.PowerAt = 5, now }), nil},
+		{"stale power reading", "IDLE", with(func(s *db.DeviceState) { s.Watts, s.PowerAt = 80, now.Add(-time.Hour) }), nil},
+		{"running drawing power", "RUNNING", with(func(s *db.DeviceState) { s.Watts, s.PowerAt = 80, now }), nil},
+		{"bypassed relay", "IDLE", with(func(s *db.DeviceState) { s.Relay, s.Watts, s.PowerAt = iot.RelayOn, 80, now }),
+			[]string{db.AlertRelayOnIdle, db.AlertPowerWhileIdle}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var kinds []string
+			for k := range d.conditions(tt.status, tt.state, now) {
+				kinds = append(kinds, k)
+			}
+			assert.ElementsMatch(t, tt.want, kinds)
+		})
+	}
+}
+
+func TestTamperDetector_Debounce(t *testing.T) {
+	d := newTamperDetector(time.Minute, 20, 0)
+	k := tamperKey{1, db.AlertRelayOnIdle}
+	now := time.Now()
+	assert.False(t, d.held(k, now), "first sighting")
+	assert.False(t, d.held(k, now.Add(30*time.Second)))
+	assert.True(t, d.held(k, now.Add(time.Minute)))
+	assert.False(t, d.held(tamperKey{2, db.AlertRelayOnIdle}, now.Add(time.Minute)), "per console")
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// warningTracker remembers which pre-expiry warnings were already sent for
+// the current session of each console. A session is identified by its end
+// time, so extending a rental re-arms the warnings.
+type warningTracker struct {
+	mu         sync.Mutex
+	thresholds []time.Duration // largest first
+	sent       map[int64]warningState
+}
+
+type warningState struct {
+	endTime time.Time
+	sent    map[time.Duration]bool
+}
+
+func newWarningTracker(thresholds []time.Duration) *warningTracker {
+	return &warningTracker{thresholds: thresholds, sent: make(map[int64]warningState)}
+}
+
+// maxThreshold returns the largest configured threshold (0 if none).
+func (w *warningTracker) maxThreshold() time.Duration {
+	if len(w.thresholds) == 0 {
+		return 0
+	}
+	return w.thresholds[0]
+}
+
+// due returns the threshold whose warning should be sent now, if any. When
+// several thresholds were crossed at once (e.g. after a restart) only the
+// smallest is reported and the larger ones are marked as sent.
+func (w *warningTracker) due(consoleID int64, endTime time.Time, remaining time.Duration) (time.Duration, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st, ok := w.sent[consoleID]
+	if !ok || !st.endTime.Equal(endTime) {
+		st = warningState{endTime: endTime, sent: make(map[time.Duration]bool)}
+		w.sent[consoleID] = st
+	}
+	var hit time.Duration
+	for _, t := range w.thresholds {
+		if remaining <= t && !st.sent[t] {
+			st.sent[t] = true
+			hit = t
+		}
+	}
+	return hit, hit > 0
+}
+
+// forget drops the state of a console whose session ended.
+func (w *warningTracker) forget(consoleID int64) {
+	w.mu.Lock()
+	delete(w.sent, consoleID)
+	w.mu.Unlock()
+}
+
+// warningCommand returns the device command for a threshold: WARN5 for five
+// minutes, WARN30S for sub-minute thresholds.
+func warningCommand(t time.Duration) string {
+	if t%time.Minute == 0 {
+		return fmt.Sprintf("WARN%d", int(t/time.Minute))
+	}
+	return fmt.Sprintf("WARN%dS", int(t/time.Second))
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarningTracker_Due(t *testing.T) {
+	w := newWarningTracker([]time.Duration{5 * time.Minute, time.Minute})
+	end := time.Now().Add(10 * time.Minute)
+
+	_, ok := w.due(1, end, 6*time.Minute)
+	assert.False(t, ok)
+
+	th, ok := w.due(1, end, 5*time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, 5*time.Minute, th)
+	_, ok = w.due(1, end, 4*time.Minute)
+	assert.False(t, ok, "sent once per session")
+
+	th, ok = w.due(1, end, 30*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, th)
+
+	// other consoles are tracked separately
+	_, ok = w.due(2, end, 4*time.Minute)
+	assert.True(t, ok)
+}
+
+func TestWarningTracker_CrossedAtOnce(t *testing.T) {
+	w := newWarningTracker([]time.Duration{5 * time.Minute, time.Minute})
+	end := time.Now().Add(30 * time.Second)
+
+	// after a restart only the smallest threshold is sent
+	th, ok := w.due(1, end, 30*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, th)
+	_, ok = w.due(1, end, 20*time.Second)
+	assert.False(t, ok)
+}
+
+func TestWarningTracker_ExtendAndForget(t *testing.T) {
+	w := newWarningTracker([]time.Duration{5 * time.Minute})
+	end := time.Now().Add(5 * time.Minute)
+	_, ok := w.due(1, end, 5*time.Minute)
+	assert.True(t, ok)
+
+	// extending the rental changes the end time and re-arms the warning
+	_, ok = w.due(1, end.Add(30*time.Minute), 5*time.Minute)
+	assert.True(t, ok)
+
+	w.forget(1)
+	_, ok = w.due(1, end.Add(30*time.Minute), 5*time.Minute)
+	assert.True(t, ok)
+
+	assert.Equal(t, 5*time.Minute, w.maxThreshold())
+	assert.Zero(t, newWarningTracker(nil).maxThreshold())
+}
+
+func TestWarningCommand(t *testing.T) {
+	assert.Equal(t, "WARN5", warningCommand(5*time.Minute))
+	assert.Equal(t, "WARN1", warningCommand(time.Minute))
+	assert.Equal(t, "WARN30S", warningCommand(30*time.Second))
+}
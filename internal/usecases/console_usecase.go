@@ -46,7 +46,7 @@ func (c *ConsoleUseCase) StartRental(consoleID int64, durationMinutes int) error
 		return errors.NewInternalError(err)
 	}
 
-	if console.IsRunning() {
+	if console.IsActive() || console.IsStopping() {
 		return errors.NewConsoleAlreadyRunning(console.Name)
 	}
 
@@ -81,7 +81,7 @@ func (c *ConsoleUseCase) ExtendRental(consoleID int64, additionalMinutes int) er
 		return errors.NewInternalError(err)
 	}
 
-	if !console.IsRunning() {
+	if !console.IsActive() {
 		return errors.NewConsoleNotRunning(console.Name)
 	}
 
@@ -119,7 +119,7 @@ func (c *ConsoleUseCase) StopRental(consoleID int64) error {
 		return errors.NewInternalError(err)
 	}
 
-	if !console.IsRunning() {
+	if !console.IsActive() {
 		return errors.NewConsoleNotRunning(console.Name)
 	}
 
@@ -175,4 +175,34 @@ func (c *ConsoleUseCase) CheckExpiredRentals() ([]entities.Console, error) {
 	}
 
 	return expiredConsoles, nil
-}
\ No newline at end of file
+}
+
+// ProcessExpiredRentals moves expired sessions into OVERTIME while the grace
+// period lasts and stops those whose grace period has run out. Overtime
+// minutes are billed by the repository when the session is stopped.
+func (c *ConsoleUseCase) ProcessExpiredRentals(grace time.Duration) ([]entities.Console, []entities.Console, error) {
+	consoles, err := c.consoleRepo.GetAll()
+	if err != nil {
+		return nil, nil, errors.NewInternalError(err)
+	}
+
+	var overtime, stopped []entities.Console
+	for _, console := range consoles {
+		switch {
+		case console.IsExpired() && grace > 0:
+			console.MarkOvertime()
+			if err := c.consoleRepo.Update(&console); err != nil {
+				return nil, nil, errors.NewInternalError(err)
+			}
+			overtime = append(overtime, console)
+		case console.IsExpired() || console.GraceExpired(grace):
+			console.StopRental()
+			if err := c.consoleRepo.Update(&console); err != nil {
+				return nil, nil, errors.NewInternalError(err)
+			}
+			stopped = append(stopped, console)
+		}
+	}
+
+	return overtime, stopped, nil
+}
@@ -132,6 +132,27 @@ func TestConsoleUseCase_StartRental_ConsoleAlreadyRunning(t *testing.T) {
 	consoleRepo.AssertExpectations(t)
 }
 
+func TestConsoleUseCase_StartRental_ConsoleStopping(t *testing.T) {
+	consoleRepo := &mocks.MockConsoleRepository{}
+	transactionRepo := &mocks.MockTransactionRepository{}
+	useCase := NewConsoleUseCase(consoleRepo, transactionRepo)
+
+	console := &entities.Console{
+		ID:     1,
+		Name:   "PS1",
+		Status: entities.StatusStopping,
+	}
+
+	consoleRepo.On("GetByID", int64(1)).Return(console, nil)
+
+	err := useCase.StartRental(1, 30)
+
+	assert.Error(t, err)
+	domainErr := err.(*domainErrors.DomainError)
+	assert.Equal(t, domainErrors.CodeConsoleAlreadyRunning, domainErr.Code)
+	consoleRepo.AssertExpectations(t)
+}
+
 func TestConsoleUseCase_ExtendRental_Success(t *testing.T) {
 	consoleRepo := &mocks.MockConsoleRepository{}
 	transactionRepo := &mocks.MockTransactionRepository{}
@@ -271,4 +292,75 @@ func TestConsoleUseCase_CheckExpiredRentals_Success(t *testing.T) {
 	assert.Equal(t, int64(1), expiredConsoles[0].ID)
 	assert.Equal(t, entities.StatusIdle, expiredConsoles[0].Status)
 	consoleRepo.AssertExpectations(t)
-}
\ No newline at end of file
+}
+func TestConsoleUseCase_ProcessExpiredRentals_Grace(t *testing.T) {
+	consoleRepo := &mocks.MockConsoleRepository{}
+	transactionRepo := &mocks.MockTransactionRepository{}
+	useCase := NewConsoleUseCase(consoleRepo, transactionRepo)
+
+	now := time.Now()
+	consoles := []entities.Console{
+		{
+			ID:      1,
+			Name:    "PS1",
+			Status:  entities.StatusRunning,
+			EndTime: now.Add(-time.Minute), // Just expired
+		},
+		{
+			ID:      2,
+			Name:    "PS2",
+			Status:  entities.StatusOvertime,
+			EndTime: now.Add(-20 * time.Minute), // Grace period over
+		},
+		{
+			ID:      3,
+			Name:    "PS3",
+			Status:  entities.StatusOvertime,
+			EndTime: now.Add(-5 * time.Minute), // Still within grace
+		},
+	}
+
+	consoleRepo.On("GetAll").Return(consoles, nil)
+	consoleRepo.On("Update", mock.MatchedBy(func(c *entities.Console) bool {
+		return c.ID == 1 && c.Status == entities.StatusOvertime
+	})).Return(nil)
+	consoleRepo.On("Update", mock.MatchedBy(func(c *entities.Console) bool {
+		return c.ID == 2 && c.Status == entities.StatusIdle
+	})).Return(nil)
+
+	overtime, stopped, err := useCase.ProcessExpiredRentals(10 * time.Minute)
+
+	assert.NoError(t, err)
+	assert.Len(t, overtime, 1)
+	assert.Equal(t, int64(1), overtime[0].ID)
+	assert.Len(t, stopped, 1)
+	assert.Equal(t, int64(2), stopped[0].ID)
+	consoleRepo.AssertExpectations(t)
+}
+
+func TestConsoleUseCase_ProcessExpiredRentals_NoGrace(t *testing.T) {
+	consoleRepo := &mocks.MockConsoleRepository{}
+	transactionRepo := &mocks.MockTransactionRepository{}
+	useCase := NewConsoleUseCase(consoleRepo, transactionRepo)
+
+	consoles := []entities.Console{
+		{
+			ID:      1,
+			Name:    "PS1",
+			Status:  entities.StatusRunning,
+			EndTime: time.Now().Add(-time.Minute),
+		},
+	}
+
+	consoleRepo.On("GetAll").Return(consoles, nil)
+	consoleRepo.On("Update", mock.MatchedBy(func(c *entities.Console) bool {
+		return c.ID == 1 && c.Status == entities.StatusIdle
+	})).Return(nil)
+
+	overtime, stopped, err := useCase.ProcessExpiredRentals(0)
+
+	assert.NoError(t, err)
+	assert.Empty(t, overtime)
+	assert.Len(t, stopped, 1)
+	consoleRepo.AssertExpectations(t)
+}